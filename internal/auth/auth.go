@@ -1,30 +1,25 @@
 package auth
 
 import (
+	"errors"
 	"log"
+	"math"
 	"net/http"
-	"os"
 	"secmail/internal/crypto"
+	"secmail/internal/email"
 	"secmail/internal/models"
+	"secmail/internal/notify"
+	"secmail/internal/transparency"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/golang-jwt/jwt"
 	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
 )
 
-var jwtSecret = getJWTSecret()
-
-func getJWTSecret() []byte {
-	secret := os.Getenv("JWT_SECRET")
-	if secret == "" {
-		log.Fatal("JWT_SECRET environment variable not set")
-	}
-	return []byte(secret)
-}
-
 // RegisterRequest represents the request body for user registration
 type RegisterRequest struct {
 	Email    string `json:"email" binding:"required,email,max=254"`
@@ -37,8 +32,9 @@ type LoginRequest struct {
 	Password string `json:"password" binding:"required,min=1,max=128"`
 }
 
-// Register handles user registration
-func Register(c *gin.Context, db *gorm.DB) {
+// Register handles user registration. New accounts stay pending until the
+// address is confirmed through the emailed verification link.
+func Register(c *gin.Context, db *gorm.DB, notifier notify.Notifier) {
 	var req RegisterRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
@@ -49,6 +45,15 @@ func Register(c *gin.Context, db *gorm.DB) {
 	req.Email = strings.TrimSpace(req.Email)
 	req.Password = strings.TrimSpace(req.Password)
 
+	// Mailing list addresses cannot be taken over by an account
+	if _, err := email.LookupList(req.Email, db); err == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Address is already in use"})
+		return
+	} else if !errors.Is(err, email.ErrListNotFound) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create user"})
+		return
+	}
+
 	// Hash password
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
 	if err != nil {
@@ -63,19 +68,49 @@ func Register(c *gin.Context, db *gorm.DB) {
 		return
 	}
 
+	// Wrap private key with the user's password
+	wrappedKey, err := crypto.WrapPrivateKey(privateKey, req.Password)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to protect keys"})
+		return
+	}
+
+	// Wrap private key with a recovery phrase shown only once
+	recoveryPhrase, recoveryKey, err := newRecoveryKey(privateKey)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate recovery key"})
+		return
+	}
+
 	// Create user
 	user := models.User{
 		Email:        req.Email,
 		PasswordHash: string(hashedPassword),
 		PublicKey:    publicKey,
-		PrivateKey:   privateKey,
+		PrivateKey:   wrappedKey,
+		RecoveryKey:  recoveryKey,
 	}
-	if err := db.Create(&user).Error; err != nil {
+	// Publish the key in the transparency log along with the account
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&user).Error; err != nil {
+			return err
+		}
+		return transparency.Append(tx, user.ID, user.Email, 1, user.PublicKey)
+	})
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create user"})
 		return
 	}
 
-	c.JSON(http.StatusCreated, gin.H{"message": "User registered successfully"})
+	if err := SendVerification(user, notifier); err != nil {
+		log.Println("Failed to deliver verification notification:", err)
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message":      "User registered successfully. Check your email to verify your address.",
+		"recovery_key": recoveryPhrase,
+		"warning":      recoveryKeyWarning,
+	})
 }
 
 // Login handles user login
@@ -90,63 +125,173 @@ func Login(c *gin.Context, db *gorm.DB) {
 	req.Email = strings.TrimSpace(req.Email)
 	req.Password = strings.TrimSpace(req.Password)
 
-	// Find user
-	var user models.User
-	if err := db.Where("email = ?", req.Email).First(&user).Error; err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
-		return
-	}
-
-	// Check password
-	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.Password)); err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+	user, privateKey, err := Authenticate(db, req.Email, req.Password, c.ClientIP())
+	if err != nil {
+		authenticationError(c, err)
 		return
 	}
 
 	// Generate JWT token
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"user_id": user.ID,
-		"exp":     time.Now().Add(time.Hour * 24).Unix(),
-	})
-	tokenString, err := token.SignedString(jwtSecret)
+	tokenString, tokenID, err := IssueToken(user.ID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
 		return
 	}
+	sessionKeys.put(tokenID, user.ID, privateKey, time.Now().Add(tokenLifetime))
 
 	c.JSON(http.StatusOK, gin.H{"token": tokenString})
 }
 
-// JWTMiddleware validates JWT token and sets user_id in context
-func JWTMiddleware() gin.HandlerFunc {
-	return func(c *gin.Context) {
-		tokenString := c.GetHeader("Authorization")
-		if tokenString == "" {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Missing token"})
-			c.Abort()
-			return
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// ThrottledError is returned by Authenticate while failed attempts for the
+// account or client IP are being backed off.
+type ThrottledError struct {
+	Wait   time.Duration
+	Locked bool
+}
+
+func (e *ThrottledError) Error() string {
+	if e.Locked {
+		return "too many failed login attempts, account locked"
+	}
+	return "too many failed login attempts"
+}
+
+// Authenticate checks an email and password, applying the login throttling
+// and audit logging, and returns the user with their unwrapped private key.
+// It is shared by every protocol that accepts secmail credentials.
+func Authenticate(db *gorm.DB, address, password, clientIP string) (*models.User, []byte, error) {
+	// Throttle repeated failures per account and per client IP
+	accountKey := strings.ToLower(address)
+	if wait, locked := loginWait(accountKey, clientIP); wait > 0 {
+		reason := "throttled"
+		if locked {
+			reason = "locked"
 		}
+		recordLoginFailure(db, address, clientIP, reason)
+		return nil, nil, &ThrottledError{Wait: wait, Locked: locked}
+	}
+
+	// Find user; unknown emails still run bcrypt so both failures take the same time
+	var user models.User
+	passwordHash := dummyPasswordHash()
+	userErr := db.Where("email = ?", address).First(&user).Error
+	if userErr == nil && user.Shared {
+		// Shared mailboxes are opened through their delegates' accounts
+		userErr = gorm.ErrRecordNotFound
+	}
+	if userErr == nil {
+		passwordHash = []byte(user.PasswordHash)
+	}
+
+	// Check password
+	passwordErr := bcrypt.CompareHashAndPassword(passwordHash, []byte(password))
+	if userErr != nil || passwordErr != nil {
+		accountThrottle.fail(accountKey)
+		ipThrottle.fail(clientIP)
+		recordLoginFailure(db, address, clientIP, "invalid_credentials")
+		return nil, nil, ErrInvalidCredentials
+	}
+	accountThrottle.reset(accountKey)
+	ipThrottle.release(clientIP)
+
+	// Unlock private key for this session
+	privateKey, err := crypto.UnwrapPrivateKey(user.PrivateKey, password)
+	if err != nil {
+		return nil, nil, err
+	}
 
-		// Remove "Bearer " prefix if present
-		if len(tokenString) > 7 && tokenString[:7] == "Bearer " {
-			tokenString = tokenString[7:]
+	// Wrap keys stored before password wrapping was introduced
+	if !crypto.IsWrappedPrivateKey(user.PrivateKey) {
+		wrappedKey, err := crypto.WrapPrivateKey(privateKey, password)
+		if err != nil {
+			return nil, nil, err
 		}
+		if err := db.Model(&user).Update("private_key", wrappedKey).Error; err != nil {
+			return nil, nil, err
+		}
+	}
 
-		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-			return jwtSecret, nil
-		})
-		if err != nil || !token.Valid {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
-			c.Abort()
-			return
+	// Prekeys can only be signed while the key is unlocked
+	if err := email.MaintainPrekey(user.ID, privateKey, db); err != nil {
+		log.Println("Failed to rotate prekey:", err)
+	}
+	return &user, privateKey, nil
+}
+
+var (
+	dummyHashOnce sync.Once
+	dummyHash     []byte
+)
+
+// dummyPasswordHash returns a bcrypt hash compared against when the email is
+// unknown, so response timing does not reveal which accounts exist.
+func dummyPasswordHash() []byte {
+	dummyHashOnce.Do(func() {
+		hash, err := bcrypt.GenerateFromPassword([]byte("secmail-dummy-password"), bcrypt.DefaultCost)
+		if err != nil {
+			log.Fatal("Failed to generate dummy password hash:", err)
 		}
+		dummyHash = hash
+	})
+	return dummyHash
+}
+
+// reauthenticate checks the password of a logged-in user before a sensitive
+// change, through the same throttling and audit logging as a login, and
+// returns their unwrapped private key.
+func reauthenticate(db *gorm.DB, userID uint, password, clientIP string) (*models.User, []byte, error) {
+	var user models.User
+	if err := db.Select("email").Where("id = ?", userID).First(&user).Error; err != nil {
+		return nil, nil, err
+	}
+	return Authenticate(db, user.Email, password, clientIP)
+}
 
-		if claims, ok := token.Claims.(jwt.MapClaims); ok {
-			if userIDFloat, ok := claims["user_id"].(float64); ok {
-				c.Set("user_id", uint(userIDFloat))
-			}
+// authenticationError maps Authenticate errors to HTTP responses.
+func authenticationError(c *gin.Context, err error) {
+	var throttled *ThrottledError
+	switch {
+	case errors.As(err, &throttled):
+		code := "login_throttled"
+		if throttled.Locked {
+			code = "account_locked"
 		}
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(throttled.Wait.Seconds()))))
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many failed login attempts, try again later", "code": code})
+	case errors.Is(err, ErrInvalidCredentials):
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to unlock keys"})
+	}
+}
+
+// loginWait returns how long the client must wait before trying to log in to
+// the account again, and whether the account or IP is locked out. When no
+// wait is needed, the attempt is reserved with both throttles until its
+// outcome is recorded.
+func loginWait(accountKey, clientIP string) (time.Duration, bool) {
+	accountWait, accountLocked := accountThrottle.reserve(accountKey)
+	if accountWait > 0 {
+		if ipWait, ipLocked := ipThrottle.check(clientIP); ipWait > accountWait {
+			return ipWait, ipLocked
+		}
+		return accountWait, accountLocked
+	}
+	ipWait, ipLocked := ipThrottle.reserve(clientIP)
+	if ipWait > 0 {
+		accountThrottle.release(accountKey)
+		return ipWait, ipLocked
+	}
+	return 0, false
+}
 
-		c.Next()
+// recordLoginFailure writes an audit record for a failed login attempt.
+func recordLoginFailure(db *gorm.DB, email, clientIP, reason string) {
+	attempt := models.LoginAttempt{Email: email, IPAddress: clientIP, Reason: reason}
+	if err := db.Create(&attempt).Error; err != nil {
+		log.Println("Failed to record login attempt:", err)
 	}
+	log.Printf("Failed login email=%s ip=%s reason=%s", email, clientIP, reason)
 }
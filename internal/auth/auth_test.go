@@ -1,11 +1,23 @@
 package auth
 
 import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"secmail/internal/crypto"
+	"secmail/internal/email"
+	"secmail/internal/models"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt"
 	"golang.org/x/crypto/bcrypt"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
 )
 
 func TestPasswordHashing(t *testing.T) {
@@ -76,3 +88,460 @@ func TestJWTGenerationAndParsing(t *testing.T) {
 		t.Error("Claims are not MapClaims")
 	}
 }
+
+func setTestJWTConfig() {
+	jwtConfig = JWTConfig{
+		Secret:    []byte("test-jwt-secret-for-testing"),
+		Issuer:    "secmail-test",
+		Audience:  "secmail-test-api",
+		ClockSkew: 30 * time.Second,
+	}
+}
+
+func TestIssueAndParseToken(t *testing.T) {
+	setTestJWTConfig()
+
+	tokenString, tokenID, err := IssueToken(42)
+	if err != nil {
+		t.Fatalf("Failed to issue token: %v", err)
+	}
+
+	claims, err := ParseToken(tokenString)
+	if err != nil {
+		t.Fatalf("Failed to parse token: %v", err)
+	}
+	userID, err := claims.UserID()
+	if err != nil || userID != 42 {
+		t.Errorf("Parsed user ID does not match: got %d, want 42", userID)
+	}
+	if claims.Id != tokenID {
+		t.Errorf("Token ID does not match: got %s, want %s", claims.Id, tokenID)
+	}
+}
+
+func TestJWTMiddlewareRejections(t *testing.T) {
+	setTestJWTConfig()
+	gin.SetMode(gin.TestMode)
+
+	now := time.Now()
+	valid := jwt.StandardClaims{
+		Issuer:    jwtConfig.Issuer,
+		Audience:  jwtConfig.Audience,
+		Subject:   "7",
+		ExpiresAt: now.Add(time.Hour).Unix(),
+		IssuedAt:  now.Unix(),
+		Id:        "test-jti",
+	}
+	sign := func(method jwt.SigningMethod, key interface{}, mutate func(*jwt.StandardClaims)) string {
+		claims := valid
+		if mutate != nil {
+			mutate(&claims)
+		}
+		s, err := jwt.NewWithClaims(method, Claims{StandardClaims: claims}).SignedString(key)
+		if err != nil {
+			t.Fatalf("Failed to sign token: %v", err)
+		}
+		return s
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		code  string
+	}{
+		{"missing", "", ErrCodeTokenMissing},
+		{"malformed", "not-a-token", ErrCodeTokenMalformed},
+		{"none algorithm", sign(jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, nil), ErrCodeTokenAlgorithm},
+		{"HS512 algorithm", sign(jwt.SigningMethodHS512, jwtConfig.Secret, nil), ErrCodeTokenAlgorithm},
+		{"bad signature", sign(jwt.SigningMethodHS256, []byte("other-secret"), nil), ErrCodeTokenSignature},
+		{"expired", sign(jwt.SigningMethodHS256, jwtConfig.Secret, func(c *jwt.StandardClaims) { c.ExpiresAt = now.Add(-time.Minute).Unix() }), ErrCodeTokenExpired},
+		{"issued in future", sign(jwt.SigningMethodHS256, jwtConfig.Secret, func(c *jwt.StandardClaims) { c.IssuedAt = now.Add(time.Hour).Unix() }), ErrCodeTokenNotYetValid},
+		{"wrong issuer", sign(jwt.SigningMethodHS256, jwtConfig.Secret, func(c *jwt.StandardClaims) { c.Issuer = "evil" }), ErrCodeTokenIssuer},
+		{"wrong audience", sign(jwt.SigningMethodHS256, jwtConfig.Secret, func(c *jwt.StandardClaims) { c.Audience = "evil" }), ErrCodeTokenAudience},
+		{"missing subject", sign(jwt.SigningMethodHS256, jwtConfig.Secret, func(c *jwt.StandardClaims) { c.Subject = "" }), ErrCodeTokenClaims},
+		{"missing jti", sign(jwt.SigningMethodHS256, jwtConfig.Secret, func(c *jwt.StandardClaims) { c.Id = "" }), ErrCodeTokenClaims},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.token != "" {
+				c.Request.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+
+			JWTMiddleware()(c)
+
+			if w.Code != http.StatusUnauthorized {
+				t.Fatalf("Expected status 401, got %d", w.Code)
+			}
+			var body map[string]string
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+			if body["code"] != tt.code {
+				t.Errorf("Error code does not match: got %s, want %s", body["code"], tt.code)
+			}
+			if _, exists := c.Get("user_id"); exists {
+				t.Error("user_id should not be set for rejected token")
+			}
+		})
+	}
+}
+
+func TestSessionKeyCache(t *testing.T) {
+	cache := &keyCache{entries: make(map[string]sessionKey)}
+	cache.put("token-a", 1, []byte("key-a"), time.Now().Add(time.Hour))
+	cache.put("token-b", 1, []byte("key-b"), time.Now().Add(time.Hour))
+	cache.put("token-c", 2, []byte("key-c"), time.Now().Add(-time.Second))
+
+	if key, ok := cache.get("token-a", 1); !ok || string(key) != "key-a" {
+		t.Error("Expected cached key for token-a")
+	}
+	if _, ok := cache.get("token-a", 2); ok {
+		t.Error("Key should not be returned for a different user")
+	}
+	if _, ok := cache.get("token-c", 2); ok {
+		t.Error("Expired key should not be returned")
+	}
+
+	cache.dropUser(1)
+	if _, ok := cache.get("token-b", 1); ok {
+		t.Error("Keys should be removed after dropUser")
+	}
+}
+
+func TestThrottleBackoffAndLockout(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	th := newThrottle(ThrottlePolicy{
+		FreeAttempts:     2,
+		BaseDelay:        time.Second,
+		MaxDelay:         4 * time.Second,
+		LockoutThreshold: 6,
+		LockoutDuration:  time.Minute,
+		ResetAfter:       time.Hour,
+	})
+	th.now = func() time.Time { return now }
+
+	// Free attempts do not delay
+	th.fail("alice")
+	th.fail("alice")
+	if wait, _ := th.check("alice"); wait != 0 {
+		t.Errorf("Expected no wait within free attempts, got %v", wait)
+	}
+
+	// Backoff doubles per failure and is capped
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second}
+	for _, want := range expected {
+		th.fail("alice")
+		if wait, locked := th.check("alice"); wait != want || locked {
+			t.Errorf("Expected wait %v without lockout, got %v (locked=%v)", want, wait, locked)
+		}
+	}
+
+	// Reaching the threshold locks the key out
+	th.fail("alice")
+	wait, locked := th.check("alice")
+	if !locked || wait != time.Minute {
+		t.Errorf("Expected lockout for %v, got %v (locked=%v)", time.Minute, wait, locked)
+	}
+
+	// Other keys are unaffected
+	if wait, _ := th.check("bob"); wait != 0 {
+		t.Errorf("Expected no wait for unrelated key, got %v", wait)
+	}
+
+	// Lockout expires
+	now = now.Add(time.Minute + time.Second)
+	if wait, locked := th.check("alice"); wait != 0 || locked {
+		t.Errorf("Expected lockout to expire, got %v (locked=%v)", wait, locked)
+	}
+
+	// Reset clears failures
+	th.fail("carol")
+	th.fail("carol")
+	th.fail("carol")
+	th.reset("carol")
+	if wait, _ := th.check("carol"); wait != 0 {
+		t.Errorf("Expected no wait after reset, got %v", wait)
+	}
+}
+
+func TestThrottleReservesAttempts(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	th := newThrottle(ThrottlePolicy{
+		FreeAttempts:     2,
+		BaseDelay:        time.Second,
+		MaxDelay:         4 * time.Second,
+		LockoutThreshold: 6,
+		LockoutDuration:  time.Minute,
+		ResetAfter:       time.Hour,
+	})
+	th.now = func() time.Time { return now }
+
+	// Attempts in flight count as failures, so parallel guesses get as many
+	// tries as sequential ones
+	for i := 0; i < 3; i++ {
+		if wait, _ := th.reserve("alice"); wait != 0 {
+			t.Fatalf("Attempt %d: expected no wait, got %v", i+1, wait)
+		}
+	}
+	if wait, locked := th.reserve("alice"); wait != time.Second || locked {
+		t.Errorf("Expected wait %v for an attempt beyond the free ones, got %v (locked=%v)", time.Second, wait, locked)
+	}
+
+	// A success forgets the failures but not the other attempts in flight
+	th.reset("alice")
+	if wait, _ := th.reserve("alice"); wait != 0 {
+		t.Errorf("Expected no wait after a success, got %v", wait)
+	}
+	th.fail("alice")
+	th.fail("alice")
+	th.fail("alice")
+	if wait, _ := th.check("alice"); wait != time.Second {
+		t.Errorf("Expected wait %v after the attempts failed, got %v", time.Second, wait)
+	}
+
+	// Released attempts leave nothing behind
+	th.reserve("bob")
+	th.release("bob")
+	if _, ok := th.records["bob"]; ok {
+		t.Error("Expected the released attempt to be forgotten")
+	}
+}
+
+func TestVerificationToken(t *testing.T) {
+	setTestJWTConfig()
+
+	token, err := IssueVerificationToken(5, "alice@example.com")
+	if err != nil {
+		t.Fatalf("Failed to issue verification token: %v", err)
+	}
+	claims, err := ParseVerificationToken(token)
+	if err != nil {
+		t.Fatalf("Failed to parse verification token: %v", err)
+	}
+	if claims.Subject != "5" || claims.Email != "alice@example.com" {
+		t.Errorf("Unexpected verification claims: %+v", claims)
+	}
+
+	// Access tokens are not accepted as verification tokens and vice versa
+	accessToken, _, err := IssueToken(5)
+	if err != nil {
+		t.Fatalf("Failed to issue token: %v", err)
+	}
+	if _, err := ParseVerificationToken(accessToken); err == nil {
+		t.Error("Access token should not be accepted as verification token")
+	}
+	if _, err := ParseToken(token); err == nil {
+		t.Error("Verification token should not be accepted as access token")
+	}
+}
+
+func TestReauthenticationIsThrottled(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name    string
+		handler func(c *gin.Context, db *gorm.DB)
+		body    func(password string) string
+	}{
+		{"regenerate recovery key", RegenerateRecoveryKey, func(password string) string {
+			return `{"password":"` + password + `"}`
+		}},
+		{"change password", ChangePassword, func(password string) string {
+			return `{"current_password":"` + password + `","new_password":"battery staple"}`
+		}},
+		{"rotate key", RotateKey, func(password string) string {
+			return `{"password":"` + password + `"}`
+		}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			accountThrottle = newThrottle(accountThrottlePolicy)
+			ipThrottle = newThrottle(ipThrottlePolicy)
+
+			db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "secmail.db")), &gorm.Config{Logger: logger.Discard})
+			if err != nil {
+				t.Fatalf("Failed to open database: %v", err)
+			}
+			if err := db.AutoMigrate(&models.User{}, &models.LoginAttempt{}, &models.Prekey{}); err != nil {
+				t.Fatalf("Failed to migrate database: %v", err)
+			}
+			publicKey, privateKey, err := crypto.GenerateRSAKeyPair()
+			if err != nil {
+				t.Fatalf("Failed to generate key pair: %v", err)
+			}
+			wrappedKey, err := crypto.WrapPrivateKey(privateKey, "correct horse")
+			if err != nil {
+				t.Fatalf("Failed to wrap key: %v", err)
+			}
+			hash, err := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.MinCost)
+			if err != nil {
+				t.Fatalf("Failed to hash password: %v", err)
+			}
+			user := models.User{Email: "alice@secmail.test", PasswordHash: string(hash), PublicKey: publicKey, PrivateKey: wrappedKey}
+			if err := db.Create(&user).Error; err != nil {
+				t.Fatalf("Failed to create user: %v", err)
+			}
+
+			r := gin.New()
+			r.POST("/", func(c *gin.Context) {
+				c.Set("user_id", user.ID)
+				tc.handler(c, db)
+			})
+			request := func(password string) int {
+				w := httptest.NewRecorder()
+				req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tc.body(password)))
+				req.Header.Set("Content-Type", "application/json")
+				r.ServeHTTP(w, req)
+				return w.Code
+			}
+
+			// Wrong passwords count against the account like failed logins
+			for i := 0; i <= accountThrottlePolicy.FreeAttempts; i++ {
+				if code := request("wrong"); code != http.StatusUnauthorized {
+					t.Fatalf("Attempt %d: expected %d, got %d", i+1, http.StatusUnauthorized, code)
+				}
+			}
+			if code := request("correct horse"); code != http.StatusTooManyRequests {
+				t.Errorf("Expected the correct password to be throttled, got %d", code)
+			}
+			var attempts int64
+			if err := db.Model(&models.LoginAttempt{}).Where("email = ?", user.Email).Count(&attempts).Error; err != nil {
+				t.Fatalf("Failed to count login attempts: %v", err)
+			}
+			if want := int64(accountThrottlePolicy.FreeAttempts + 2); attempts != want {
+				t.Errorf("Expected %d login attempts recorded, got %d", want, attempts)
+			}
+		})
+	}
+}
+
+// openResetTestDB opens an empty database with the tables a key reset
+// touches.
+func openResetTestDB(t *testing.T) *gorm.DB {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "secmail.db")), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	err = db.AutoMigrate(&models.User{}, &models.PasswordResetToken{}, &email.Message{}, &models.MessageChange{},
+		&models.UserKey{}, &models.KeyLogEntry{}, &models.Prekey{}, &models.SendingChain{}, &models.Group{},
+		&models.GroupMember{}, &models.GroupEpochKey{}, &models.MailboxDelegate{}, &models.MailboxAuditEvent{},
+		&models.MailingList{}, &models.PGPKey{}, &models.Contact{})
+	if err != nil {
+		t.Fatalf("Failed to migrate database: %v", err)
+	}
+	return db
+}
+
+// createResetTestUser creates a verified user whose private key is wrapped
+// with password and returns it with the unwrapped key.
+func createResetTestUser(t *testing.T, db *gorm.DB, address, password string) (models.User, []byte) {
+	publicKey, privateKey, err := crypto.GenerateRSAKeyPair()
+	if err != nil {
+		t.Fatalf("Failed to generate key pair: %v", err)
+	}
+	wrappedKey, err := crypto.WrapPrivateKey(privateKey, password)
+	if err != nil {
+		t.Fatalf("Failed to wrap key: %v", err)
+	}
+	now := time.Now()
+	user := models.User{Email: address, PasswordHash: "x", PublicKey: publicKey, PrivateKey: wrappedKey, EmailVerifiedAt: &now}
+	if err := db.Create(&user).Error; err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	return user, privateKey
+}
+
+// resetKeys completes a reset_keys password reset for user and returns the
+// response status.
+func resetKeys(t *testing.T, db *gorm.DB, user models.User, password string) int {
+	token := "reset-" + user.Email
+	resetToken := models.PasswordResetToken{UserID: user.ID, TokenHash: hashResetToken(token), ExpiresAt: time.Now().Add(time.Hour)}
+	if err := db.Create(&resetToken).Error; err != nil {
+		t.Fatalf("Failed to create reset token: %v", err)
+	}
+	r := gin.New()
+	r.POST("/", func(c *gin.Context) { ResetPassword(c, db) })
+	w := httptest.NewRecorder()
+	body := `{"token":"` + token + `","new_password":"` + password + `","mode":"reset_keys","acknowledge_mail_loss":true}`
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	r.ServeHTTP(w, req)
+	return w.Code
+}
+
+func TestResetKeysKeepsInboxReadable(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	db := openResetTestDB(t)
+	alice, _ := createResetTestUser(t, db, "alice@secmail.test", "correct horse")
+	bob, bobKey := createResetTestUser(t, db, "bob@secmail.test", "bob password")
+
+	before, err := email.SendMessage(bob.ID, []uint{alice.ID}, nil, nil, "Before", "Old mail", email.Lifetime{}, bobKey, db)
+	if err != nil {
+		t.Fatalf("Failed to send message: %v", err)
+	}
+	if code := resetKeys(t, db, alice, "battery staple"); code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, code)
+	}
+	after, err := email.SendMessage(bob.ID, []uint{alice.ID}, nil, nil, "After", "New mail", email.Lifetime{}, bobKey, db)
+	if err != nil {
+		t.Fatalf("Failed to send message: %v", err)
+	}
+
+	if err := db.Where("id = ?", alice.ID).First(&alice).Error; err != nil {
+		t.Fatalf("Failed to load user: %v", err)
+	}
+	privateKey, err := crypto.UnwrapPrivateKey(alice.PrivateKey, "battery staple")
+	if err != nil {
+		t.Fatalf("Failed to unwrap new key: %v", err)
+	}
+	inbox, err := email.GetInbox(alice.ID, privateKey, db)
+	if err != nil {
+		t.Fatalf("Failed to read inbox: %v", err)
+	}
+	if len(inbox) != 2 {
+		t.Fatalf("Expected 2 messages, got %d", len(inbox))
+	}
+	for _, msg := range inbox {
+		switch msg.ID {
+		case before.ID:
+			if !msg.Unreadable || msg.Subject != "Before" || msg.Body == "Old mail" {
+				t.Errorf("Expected mail sent before the reset to be unreadable, got %+v", msg)
+			}
+		case after.ID:
+			if msg.Unreadable || msg.Body != "New mail" {
+				t.Errorf("Expected mail sent after the reset to be readable, got %+v", msg)
+			}
+		}
+	}
+}
+
+func TestResetKeysKeepsSharedMailboxKey(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	db := openResetTestDB(t)
+	alice, _ := createResetTestUser(t, db, "alice@secmail.test", "correct horse")
+	email.SetAdmins([]string{alice.Email})
+	email.SetLocalDomains([]string{"secmail.test"})
+	t.Cleanup(func() {
+		email.SetAdmins(nil)
+		email.SetLocalDomains(nil)
+	})
+	if _, err := email.CreateSharedMailbox(alice.ID, "support@secmail.test", db); err != nil {
+		t.Fatalf("Failed to create shared mailbox: %v", err)
+	}
+
+	// Discarding the only delegate's key would lose the mailbox's key
+	if code := resetKeys(t, db, alice, "battery staple"); code != http.StatusConflict {
+		t.Fatalf("Expected status %d, got %d", http.StatusConflict, code)
+	}
+	var user models.User
+	if err := db.Where("id = ?", alice.ID).First(&user).Error; err != nil {
+		t.Fatalf("Failed to load user: %v", err)
+	}
+	if string(user.PublicKey) != string(alice.PublicKey) {
+		t.Error("Expected the keys to be kept")
+	}
+}
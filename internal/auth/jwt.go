@@ -0,0 +1,273 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt"
+)
+
+// Defaults used when the corresponding environment variables are not set.
+const (
+	defaultJWTIssuer   = "secmail"
+	defaultJWTAudience = "secmail-api"
+	defaultClockSkew   = 30 * time.Second
+	tokenLifetime      = 24 * time.Hour
+)
+
+// Error codes returned in the "code" field of 401 responses from JWTMiddleware.
+const (
+	ErrCodeTokenMissing     = "token_missing"
+	ErrCodeTokenMalformed   = "token_malformed"
+	ErrCodeTokenAlgorithm   = "token_algorithm"
+	ErrCodeTokenSignature   = "token_signature"
+	ErrCodeTokenExpired     = "token_expired"
+	ErrCodeTokenNotYetValid = "token_not_yet_valid"
+	ErrCodeTokenIssuer      = "token_issuer"
+	ErrCodeTokenAudience    = "token_audience"
+	ErrCodeTokenClaims      = "token_claims"
+)
+
+// allowedSigningMethods lists the only JWT algorithms accepted by JWTMiddleware.
+var allowedSigningMethods = map[string]bool{
+	jwt.SigningMethodHS256.Alg(): true,
+}
+
+var errUnexpectedAlgorithm = errors.New("unexpected signing algorithm")
+
+// JWTConfig holds the settings used to issue and validate tokens.
+type JWTConfig struct {
+	Secret    []byte
+	Issuer    string
+	Audience  string
+	ClockSkew time.Duration
+}
+
+var jwtConfig JWTConfig
+
+// LoadConfig reads the JWT settings from the environment. It must be called
+// before any token is issued or validated.
+func LoadConfig() error {
+	secret := os.Getenv("JWT_SECRET")
+	if secret == "" {
+		return errors.New("JWT_SECRET environment variable not set")
+	}
+
+	cfg := JWTConfig{
+		Secret:    []byte(secret),
+		Issuer:    defaultJWTIssuer,
+		Audience:  defaultJWTAudience,
+		ClockSkew: defaultClockSkew,
+	}
+	if issuer := os.Getenv("JWT_ISSUER"); issuer != "" {
+		cfg.Issuer = issuer
+	}
+	if audience := os.Getenv("JWT_AUDIENCE"); audience != "" {
+		cfg.Audience = audience
+	}
+	if skew := os.Getenv("JWT_CLOCK_SKEW"); skew != "" {
+		d, err := time.ParseDuration(skew)
+		if err != nil || d < 0 {
+			return errors.New("JWT_CLOCK_SKEW must be a non-negative duration")
+		}
+		cfg.ClockSkew = d
+	}
+
+	jwtConfig = cfg
+	return nil
+}
+
+// Claims is the typed claim set carried by secmail access tokens. The user ID
+// is stored in the standard "sub" claim.
+type Claims struct {
+	jwt.StandardClaims
+}
+
+// tokenError describes why a token was rejected.
+type tokenError struct {
+	code    string
+	message string
+}
+
+func (e *tokenError) Error() string {
+	return e.message
+}
+
+// IssueToken creates a signed access token for the given user and returns it
+// together with its token ID.
+func IssueToken(userID uint) (tokenString, tokenID string, err error) {
+	tokenID, err = newTokenID()
+	if err != nil {
+		return "", "", err
+	}
+
+	now := time.Now()
+	claims := Claims{
+		StandardClaims: jwt.StandardClaims{
+			Issuer:    jwtConfig.Issuer,
+			Audience:  jwtConfig.Audience,
+			Subject:   strconv.FormatUint(uint64(userID), 10),
+			ExpiresAt: now.Add(tokenLifetime).Unix(),
+			IssuedAt:  now.Unix(),
+			Id:        tokenID,
+		},
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	tokenString, err = token.SignedString(jwtConfig.Secret)
+	if err != nil {
+		return "", "", err
+	}
+	return tokenString, tokenID, nil
+}
+
+// newTokenID returns a random identifier for the "jti" claim.
+func newTokenID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// ParseToken verifies the signature of tokenString and validates its claims.
+func ParseToken(tokenString string) (*Claims, error) {
+	claims := &Claims{}
+	parser := jwt.Parser{SkipClaimsValidation: true}
+	_, err := parser.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		if !allowedSigningMethods[token.Method.Alg()] {
+			return nil, errUnexpectedAlgorithm
+		}
+		return jwtConfig.Secret, nil
+	})
+	if err != nil {
+		return nil, classifyParseError(err)
+	}
+
+	if err := validateClaims(claims, time.Now()); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// classifyParseError maps errors from the jwt library onto tokenErrors.
+func classifyParseError(err error) error {
+	var ve *jwt.ValidationError
+	if !errors.As(err, &ve) {
+		return &tokenError{code: ErrCodeTokenMalformed, message: "Malformed token"}
+	}
+	switch {
+	case ve.Inner == errUnexpectedAlgorithm:
+		return &tokenError{code: ErrCodeTokenAlgorithm, message: "Token signing algorithm not allowed"}
+	case ve.Errors&jwt.ValidationErrorMalformed != 0:
+		return &tokenError{code: ErrCodeTokenMalformed, message: "Malformed token"}
+	default:
+		return &tokenError{code: ErrCodeTokenSignature, message: "Invalid token signature"}
+	}
+}
+
+// validateClaims checks that every required claim is present and valid at
+// time now, allowing for the configured clock skew.
+func validateClaims(claims *Claims, now time.Time) error {
+	missing := []string{}
+	if claims.Issuer == "" {
+		missing = append(missing, "iss")
+	}
+	if claims.Audience == "" {
+		missing = append(missing, "aud")
+	}
+	if claims.Subject == "" {
+		missing = append(missing, "sub")
+	}
+	if claims.ExpiresAt == 0 {
+		missing = append(missing, "exp")
+	}
+	if claims.IssuedAt == 0 {
+		missing = append(missing, "iat")
+	}
+	if claims.Id == "" {
+		missing = append(missing, "jti")
+	}
+	if len(missing) > 0 {
+		return &tokenError{code: ErrCodeTokenClaims, message: "Missing required claims: " + strings.Join(missing, ", ")}
+	}
+
+	if claims.Issuer != jwtConfig.Issuer {
+		return &tokenError{code: ErrCodeTokenIssuer, message: "Invalid token issuer"}
+	}
+	if claims.Audience != jwtConfig.Audience {
+		return &tokenError{code: ErrCodeTokenAudience, message: "Invalid token audience"}
+	}
+	if _, err := claims.UserID(); err != nil {
+		return &tokenError{code: ErrCodeTokenClaims, message: "Invalid subject claim"}
+	}
+
+	skew := int64(jwtConfig.ClockSkew / time.Second)
+	unixNow := now.Unix()
+	if unixNow > claims.ExpiresAt+skew {
+		return &tokenError{code: ErrCodeTokenExpired, message: "Token has expired"}
+	}
+	if claims.IssuedAt > unixNow+skew {
+		return &tokenError{code: ErrCodeTokenNotYetValid, message: "Token issued in the future"}
+	}
+	if claims.NotBefore != 0 && claims.NotBefore > unixNow+skew {
+		return &tokenError{code: ErrCodeTokenNotYetValid, message: "Token not valid yet"}
+	}
+
+	return nil
+}
+
+// UserID returns the user ID stored in the subject claim.
+func (c *Claims) UserID() (uint, error) {
+	id, err := strconv.ParseUint(c.Subject, 10, 64)
+	if err != nil || id == 0 {
+		return 0, errors.New("invalid subject")
+	}
+	return uint(id), nil
+}
+
+// JWTMiddleware validates JWT token and sets user_id and token_id in context
+func JWTMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		tokenString := c.GetHeader("Authorization")
+		if tokenString == "" {
+			abortUnauthorized(c, ErrCodeTokenMissing, "Missing token")
+			return
+		}
+
+		// Remove "Bearer " prefix if present
+		if len(tokenString) > 7 && tokenString[:7] == "Bearer " {
+			tokenString = tokenString[7:]
+		}
+
+		claims, err := ParseToken(tokenString)
+		if err != nil {
+			var te *tokenError
+			if errors.As(err, &te) {
+				abortUnauthorized(c, te.code, te.message)
+			} else {
+				abortUnauthorized(c, ErrCodeTokenMalformed, "Invalid token")
+			}
+			return
+		}
+
+		userID, _ := claims.UserID()
+		c.Set("user_id", userID)
+		c.Set("token_id", claims.Id)
+
+		c.Next()
+	}
+}
+
+// abortUnauthorized stops the request with a 401 and a machine-readable code.
+func abortUnauthorized(c *gin.Context, code, message string) {
+	c.JSON(http.StatusUnauthorized, gin.H{"error": message, "code": code})
+	c.Abort()
+}
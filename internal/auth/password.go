@@ -0,0 +1,341 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"secmail/internal/crypto"
+	"secmail/internal/email"
+	"secmail/internal/models"
+	"secmail/internal/notify"
+	"secmail/internal/transparency"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+const resetTokenLifetime = time.Hour
+
+// Password reset modes accepted by ResetPassword.
+const (
+	ResetModeRecoveryKey = "recovery_key"
+	ResetModeResetKeys   = "reset_keys"
+)
+
+// mailLossWarning is returned when a key reset is requested without
+// acknowledging that existing mail becomes unreadable.
+const mailLossWarning = "Resetting your keys generates a new key pair. Messages encrypted to your old key can no longer be decrypted and will be permanently unreadable. Resend with acknowledge_mail_loss set to true to continue."
+
+// ChangePasswordRequest represents the request body for changing a password
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password" binding:"required,min=1,max=128"`
+	NewPassword     string `json:"new_password" binding:"required,min=6,max=128"`
+}
+
+// ForgotPasswordRequest represents the request body for requesting a reset token
+type ForgotPasswordRequest struct {
+	Email string `json:"email" binding:"required,email,max=254"`
+}
+
+// ResetPasswordRequest represents the request body for completing a reset
+type ResetPasswordRequest struct {
+	Token               string `json:"token" binding:"required,max=128"`
+	NewPassword         string `json:"new_password" binding:"required,min=6,max=128"`
+	Mode                string `json:"mode" binding:"required,oneof=recovery_key reset_keys"`
+	RecoveryKey         string `json:"recovery_key" binding:"max=128"`
+	AcknowledgeMailLoss bool   `json:"acknowledge_mail_loss"`
+}
+
+// ChangePassword handles changing the authenticated user's password. The
+// private key is re-wrapped with the new password so existing mail stays readable.
+func ChangePassword(c *gin.Context, db *gorm.DB) {
+	userIDVal, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	userID := userIDVal.(uint)
+
+	var req ChangePasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Sanitize inputs
+	req.CurrentPassword = strings.TrimSpace(req.CurrentPassword)
+	req.NewPassword = strings.TrimSpace(req.NewPassword)
+
+	// Check current password, throttled like a login
+	user, privateKey, err := reauthenticate(db, userID, req.CurrentPassword, c.ClientIP())
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	if err != nil {
+		authenticationError(c, err)
+		return
+	}
+
+	// Re-wrap private key with the new password
+	wrappedKey, err := crypto.WrapPrivateKey(privateKey, req.NewPassword)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to protect keys"})
+		return
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
+		return
+	}
+
+	if err := db.Model(user).Updates(map[string]interface{}{
+		"password_hash": string(hashedPassword),
+		"private_key":   wrappedKey,
+	}).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update password"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Password changed successfully"})
+}
+
+// RequestPasswordReset handles issuing a password reset token. The response is
+// the same whether or not the email is registered.
+func RequestPasswordReset(c *gin.Context, db *gorm.DB, notifier notify.Notifier) {
+	var req ForgotPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Sanitize inputs
+	req.Email = strings.TrimSpace(req.Email)
+
+	response := gin.H{
+		"message": "If the account exists, a reset token has been sent",
+		"options": gin.H{
+			ResetModeRecoveryKey: "Restore access with the recovery key shown at registration. Existing mail stays readable.",
+			ResetModeResetKeys:   "Generate new keys. Existing mail becomes permanently unreadable.",
+		},
+	}
+
+	var user models.User
+	// Shared mailboxes have no password to reset
+	if err := db.Where("email = ? AND NOT shared", req.Email).First(&user).Error; err != nil {
+		c.JSON(http.StatusAccepted, response)
+		return
+	}
+
+	token, err := newResetToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate reset token"})
+		return
+	}
+	resetToken := models.PasswordResetToken{
+		UserID:    user.ID,
+		TokenHash: hashResetToken(token),
+		ExpiresAt: time.Now().Add(resetTokenLifetime),
+	}
+	if err := db.Create(&resetToken).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate reset token"})
+		return
+	}
+
+	body := "A password reset was requested for your secmail account.\n\n" +
+		"Reset token: " + token + "\n\n" +
+		"The token expires in one hour. Submit it to POST /auth/password/reset.\n" +
+		"If you have your recovery key, use mode \"recovery_key\" to keep access to\n" +
+		"existing mail. Otherwise mode \"reset_keys\" generates new keys, makes\n" +
+		"all existing mail permanently unreadable and deletes your address book.\n"
+	if err := notifier.Notify(user.Email, "secmail password reset", body); err != nil {
+		log.Println("Failed to deliver password reset notification:", err)
+	}
+
+	c.JSON(http.StatusAccepted, response)
+}
+
+// ResetPassword handles completing a password reset with an emailed token.
+func ResetPassword(c *gin.Context, db *gorm.DB) {
+	var req ResetPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Sanitize inputs
+	req.Token = strings.TrimSpace(req.Token)
+	req.NewPassword = strings.TrimSpace(req.NewPassword)
+
+	var resetToken models.PasswordResetToken
+	err := db.Where("token_hash = ? AND used_at IS NULL AND expires_at > ?", hashResetToken(req.Token), time.Now()).
+		First(&resetToken).Error
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired reset token"})
+		return
+	}
+
+	if req.Mode == ResetModeResetKeys && !req.AcknowledgeMailLoss {
+		c.JSON(http.StatusConflict, gin.H{
+			"error":   "Key reset requires acknowledging mail loss",
+			"code":    "mail_loss_not_acknowledged",
+			"warning": mailLossWarning,
+		})
+		return
+	}
+
+	var user models.User
+	if err := db.Where("id = ?", resetToken.UserID).First(&user).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired reset token"})
+		return
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
+		return
+	}
+
+	updates := map[string]interface{}{"password_hash": string(hashedPassword)}
+	message := "Password reset successfully"
+	var newPublicKey []byte
+	newVersion := 0
+
+	switch req.Mode {
+	case ResetModeRecoveryKey:
+		if len(user.RecoveryKey) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "No recovery key configured for this account"})
+			return
+		}
+
+		// Unwrap the private key with the recovery phrase and re-wrap it
+		privateKey, err := crypto.UnwrapPrivateKey(user.RecoveryKey, crypto.NormalizeRecoveryPhrase(req.RecoveryKey))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid recovery key"})
+			return
+		}
+		wrappedKey, err := crypto.WrapPrivateKey(privateKey, req.NewPassword)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to protect keys"})
+			return
+		}
+		updates["private_key"] = wrappedKey
+
+	case ResetModeResetKeys:
+		// Generate a fresh key pair; the old private key cannot be recovered
+		publicKey, privateKey, err := crypto.GenerateRSAKeyPair()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate keys"})
+			return
+		}
+		wrappedKey, err := crypto.WrapPrivateKey(privateKey, req.NewPassword)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to protect keys"})
+			return
+		}
+		updates["public_key"] = publicKey
+		updates["private_key"] = wrappedKey
+		// The old recovery key unwraps the discarded private key
+		updates["recovery_key"] = nil
+		// The certificate certifies the discarded public key
+		updates["certificate"] = nil
+		// Mail encrypted to earlier versions is unreadable either way
+		version := user.KeyVersion
+		if version < 1 {
+			version = 1
+		}
+		newPublicKey, newVersion = publicKey, version+1
+		updates["key_version"] = newVersion
+		message = "Password reset and keys regenerated. Previous mail is no longer readable. Generate a new recovery key after logging in."
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := consumeResetTokens(tx, user.ID); err != nil {
+			return err
+		}
+		if req.Mode == ResetModeResetKeys {
+			// The OpenPGP secret key, retired keys, prekeys, sending chains,
+			// group epoch secrets, shared mailbox keys and the address book
+			// are encrypted to the discarded key
+			if err := tx.Where("user_id = ?", user.ID).Delete(&models.PGPKey{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Where("user_id = ?", user.ID).Delete(&models.UserKey{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Where("user_id = ?", user.ID).Delete(&models.Prekey{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Where("sender_id = ?", user.ID).Delete(&models.SendingChain{}).Error; err != nil {
+				return err
+			}
+			if err := email.ForgetGroupEpochs(tx, user.ID); err != nil {
+				return err
+			}
+			if err := email.RevokeDelegations(tx, user.ID); err != nil {
+				return err
+			}
+			if err := email.ForgetContacts(tx, user.ID); err != nil {
+				return err
+			}
+		}
+		if err := tx.Model(&user).Updates(updates).Error; err != nil {
+			return err
+		}
+		if req.Mode == ResetModeResetKeys {
+			return transparency.Append(tx, user.ID, user.Email, newVersion, newPublicKey)
+		}
+		return nil
+	})
+	if errors.Is(err, email.ErrLastMailboxManager) {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "You are the only delegate of a shared mailbox, whose key would be lost with yours. Reset with your recovery key, or add another delegate to the mailbox first.",
+			"code":  "last_mailbox_delegate",
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reset password"})
+		return
+	}
+
+	sessionKeys.dropUser(user.ID)
+	c.JSON(http.StatusOK, gin.H{"message": message})
+}
+
+// consumeResetTokens marks every outstanding reset token of the user as used.
+func consumeResetTokens(tx *gorm.DB, userID uint) error {
+	result := tx.Model(&models.PasswordResetToken{}).
+		Where("user_id = ? AND used_at IS NULL", userID).
+		Update("used_at", time.Now())
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errors.New("reset token already used")
+	}
+	return nil
+}
+
+// newResetToken returns a random URL-safe reset token.
+func newResetToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashResetToken returns the hex-encoded SHA-256 of a reset token.
+func hashResetToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
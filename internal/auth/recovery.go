@@ -0,0 +1,80 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"secmail/internal/crypto"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// recoveryKeyWarning accompanies every response that reveals a recovery key.
+const recoveryKeyWarning = "Store this recovery key somewhere safe. It is shown only once and is the only way to keep access to your mail if you forget your password."
+
+// RegenerateRecoveryKeyRequest represents the request body for regenerating a recovery key
+type RegenerateRecoveryKeyRequest struct {
+	Password string `json:"password" binding:"required,min=1,max=128"`
+}
+
+// RegenerateRecoveryKey handles replacing the authenticated user's recovery
+// key. The password is required again so a stolen token alone is not enough.
+func RegenerateRecoveryKey(c *gin.Context, db *gorm.DB) {
+	userIDVal, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	userID := userIDVal.(uint)
+
+	var req RegenerateRecoveryKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Sanitize inputs
+	req.Password = strings.TrimSpace(req.Password)
+
+	// Re-authenticate, throttled like a login so the password cannot be
+	// guessed here instead
+	user, privateKey, err := reauthenticate(db, userID, req.Password, c.ClientIP())
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	if err != nil {
+		authenticationError(c, err)
+		return
+	}
+
+	recoveryPhrase, recoveryKey, err := newRecoveryKey(privateKey)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate recovery key"})
+		return
+	}
+	if err := db.Model(user).Update("recovery_key", recoveryKey).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update recovery key"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":      "Recovery key regenerated. The previous recovery key no longer works.",
+		"recovery_key": recoveryPhrase,
+		"warning":      recoveryKeyWarning,
+	})
+}
+
+// newRecoveryKey generates a recovery phrase and wraps privateKey with it.
+func newRecoveryKey(privateKey []byte) (phrase string, wrapped []byte, err error) {
+	phrase, err = crypto.GenerateRecoveryPhrase()
+	if err != nil {
+		return "", nil, err
+	}
+	wrapped, err = crypto.WrapPrivateKey(privateKey, crypto.NormalizeRecoveryPhrase(phrase))
+	if err != nil {
+		return "", nil, err
+	}
+	return phrase, wrapped, nil
+}
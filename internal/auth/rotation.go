@@ -0,0 +1,109 @@
+package auth
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"secmail/internal/crypto"
+	"secmail/internal/email"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// RotateKeyRequest represents the request body for rotating the key pair
+type RotateKeyRequest struct {
+	Password string `json:"password" binding:"required,min=1,max=128"`
+}
+
+// RotateKey handles replacing the authenticated user's key pair. New mail
+// is encrypted to the new key; the old private key is retained so existing
+// mail stays readable. The recovery key unwraps the old private key, so a
+// new one is issued.
+func RotateKey(c *gin.Context, db *gorm.DB) {
+	userIDVal, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	userID := userIDVal.(uint)
+
+	var req RotateKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Sanitize inputs
+	req.Password = strings.TrimSpace(req.Password)
+
+	// Re-authenticate, throttled like a login
+	_, privateKey, err := reauthenticate(db, userID, req.Password, c.ClientIP())
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	if err != nil {
+		authenticationError(c, err)
+		return
+	}
+
+	publicKey, newPrivateKey, err := crypto.GenerateRSAKeyPair()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate keys"})
+		return
+	}
+	wrappedKey, err := crypto.WrapPrivateKey(newPrivateKey, req.Password)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to protect keys"})
+		return
+	}
+	recoveryPhrase, recoveryKey, err := newRecoveryKey(newPrivateKey)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate recovery key"})
+		return
+	}
+
+	version, err := email.RotateKey(userID, privateKey, publicKey, wrappedKey, recoveryKey, db)
+	if errors.Is(err, email.ErrKeyOutdated) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Keys were rotated concurrently, try again"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to rotate keys"})
+		return
+	}
+
+	// Other sessions hold the retired key; this one moves to the new key
+	sessionKeys.replaceUser(c.GetString("token_id"), userID, newPrivateKey)
+	// A prekey signed by the retired key is replaced right away
+	if err := email.MaintainPrekey(userID, newPrivateKey, db); err != nil {
+		log.Println("Failed to rotate prekey:", err)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":      "Keys rotated. New mail is encrypted to the new key and existing mail stays readable. The previous recovery key no longer works.",
+		"key_version":  version,
+		"recovery_key": recoveryPhrase,
+		"warning":      recoveryKeyWarning,
+	})
+}
+
+// ListKeys handles listing every version of the authenticated user's key.
+func ListKeys(c *gin.Context, db *gorm.DB) {
+	userIDVal, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	userID := userIDVal.(uint)
+
+	versions, err := email.ListKeyVersions(userID, db)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list keys"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"keys": versions})
+}
@@ -0,0 +1,104 @@
+package auth
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// sessionKey is an unwrapped private key held in memory for one access token.
+type sessionKey struct {
+	userID     uint
+	privateKey []byte
+	expiresAt  time.Time
+}
+
+// keyCache holds unwrapped private keys keyed by token ID. Private keys are
+// stored wrapped with the user's password, so the only time the server can
+// unwrap them is at login; the result lives here until the token expires.
+type keyCache struct {
+	mu      sync.Mutex
+	entries map[string]sessionKey
+}
+
+var sessionKeys = &keyCache{entries: make(map[string]sessionKey)}
+
+// put stores the private key for a token.
+func (k *keyCache) put(tokenID string, userID uint, privateKey []byte, expiresAt time.Time) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.evictExpired(time.Now())
+	k.entries[tokenID] = sessionKey{userID: userID, privateKey: privateKey, expiresAt: expiresAt}
+}
+
+// get returns the private key for a token if it is present and not expired.
+func (k *keyCache) get(tokenID string, userID uint) ([]byte, bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	entry, ok := k.entries[tokenID]
+	if !ok || entry.userID != userID {
+		return nil, false
+	}
+	if time.Now().After(entry.expiresAt) {
+		delete(k.entries, tokenID)
+		return nil, false
+	}
+	return entry.privateKey, true
+}
+
+// dropUser removes every cached key belonging to the user.
+func (k *keyCache) dropUser(userID uint) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	for tokenID, entry := range k.entries {
+		if entry.userID == userID {
+			delete(k.entries, tokenID)
+		}
+	}
+}
+
+// replaceUser stores a new private key for a token and removes every other
+// cached key belonging to the user.
+func (k *keyCache) replaceUser(tokenID string, userID uint, privateKey []byte) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	for id, entry := range k.entries {
+		if entry.userID != userID {
+			continue
+		}
+		if id == tokenID {
+			entry.privateKey = privateKey
+			k.entries[id] = entry
+			continue
+		}
+		delete(k.entries, id)
+	}
+}
+
+// evictExpired removes expired entries. The caller must hold k.mu.
+func (k *keyCache) evictExpired(now time.Time) {
+	for tokenID, entry := range k.entries {
+		if now.After(entry.expiresAt) {
+			delete(k.entries, tokenID)
+		}
+	}
+}
+
+// SessionPrivateKey returns the unwrapped private key for the authenticated
+// request. It is only available for tokens issued by Login on this server.
+func SessionPrivateKey(c *gin.Context) ([]byte, bool) {
+	userIDVal, exists := c.Get("user_id")
+	if !exists {
+		return nil, false
+	}
+	tokenID := c.GetString("token_id")
+	if tokenID == "" {
+		return nil, false
+	}
+	return sessionKeys.get(tokenID, userIDVal.(uint))
+}
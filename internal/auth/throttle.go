@@ -0,0 +1,202 @@
+package auth
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// ThrottlePolicy controls how failed logins for one key (an account or a
+// client IP) are slowed down and eventually locked out.
+type ThrottlePolicy struct {
+	// FreeAttempts is the number of failures allowed before backoff starts.
+	FreeAttempts int
+	// BaseDelay is the backoff after the first throttled failure; it doubles
+	// with every further failure up to MaxDelay.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// LockoutThreshold is the number of failures that triggers a lockout.
+	LockoutThreshold int
+	LockoutDuration  time.Duration
+	// ResetAfter forgets failures when no new failure happened for this long.
+	ResetAfter time.Duration
+}
+
+// Default throttling policies for login attempts.
+var (
+	accountThrottlePolicy = ThrottlePolicy{
+		FreeAttempts:     3,
+		BaseDelay:        time.Second,
+		MaxDelay:         5 * time.Minute,
+		LockoutThreshold: 10,
+		LockoutDuration:  15 * time.Minute,
+		ResetAfter:       time.Hour,
+	}
+	ipThrottlePolicy = ThrottlePolicy{
+		FreeAttempts:     10,
+		BaseDelay:        time.Second,
+		MaxDelay:         5 * time.Minute,
+		LockoutThreshold: 50,
+		LockoutDuration:  time.Hour,
+		ResetAfter:       time.Hour,
+	}
+)
+
+// failureRecord tracks consecutive failures for one key.
+type failureRecord struct {
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+	pending     int // Attempts reserved and not yet completed
+}
+
+// throttle is an in-memory failure tracker enforcing a ThrottlePolicy.
+type throttle struct {
+	policy  ThrottlePolicy
+	now     func() time.Time
+	mu      sync.Mutex
+	records map[string]*failureRecord
+}
+
+func newThrottle(policy ThrottlePolicy) *throttle {
+	return &throttle{policy: policy, now: time.Now, records: make(map[string]*failureRecord)}
+}
+
+// check returns how long the caller must wait before another attempt for key
+// is allowed, and whether the key is locked out rather than merely backed off.
+func (t *throttle) check(key string) (wait time.Duration, locked bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	rec := t.record(key, now)
+	if rec == nil {
+		return 0, false
+	}
+	if now.Before(rec.lockedUntil) {
+		return rec.lockedUntil.Sub(now), true
+	}
+
+	allowedAt := rec.lastFailure.Add(t.backoff(rec.failures))
+	if now.Before(allowedAt) {
+		return allowedAt.Sub(now), false
+	}
+	return 0, false
+}
+
+// reserve checks key like check and, when an attempt is allowed, reserves
+// it until it is completed with fail, reset or release. Reserved attempts
+// count as failures made now, so parallel attempts cannot all pass the check
+// while the first ones are still being verified.
+func (t *throttle) reserve(key string) (wait time.Duration, locked bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	rec := t.record(key, now)
+	if rec == nil {
+		rec = &failureRecord{}
+		t.records[key] = rec
+	}
+	if now.Before(rec.lockedUntil) {
+		return rec.lockedUntil.Sub(now), true
+	}
+
+	allowedAt := rec.lastFailure.Add(t.backoff(rec.failures))
+	if rec.pending > 0 {
+		if inFlight := now.Add(t.backoff(rec.failures + rec.pending)); inFlight.After(allowedAt) {
+			allowedAt = inFlight
+		}
+	}
+	if now.Before(allowedAt) {
+		return allowedAt.Sub(now), false
+	}
+	rec.pending++
+	return 0, false
+}
+
+// release gives back an attempt reserved for key without recording an
+// outcome.
+func (t *throttle) release(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	rec, ok := t.records[key]
+	if !ok {
+		return
+	}
+	if rec.pending > 0 {
+		rec.pending--
+	}
+	if rec.pending == 0 && rec.failures == 0 && rec.lockedUntil.IsZero() {
+		delete(t.records, key)
+	}
+}
+
+// fail records a failed attempt for key, completing a reserved one.
+func (t *throttle) fail(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	rec := t.record(key, now)
+	if rec == nil {
+		rec = &failureRecord{}
+		t.records[key] = rec
+	}
+	if rec.pending > 0 {
+		rec.pending--
+	}
+	rec.failures++
+	rec.lastFailure = now
+	if rec.failures >= t.policy.LockoutThreshold {
+		rec.lockedUntil = now.Add(t.policy.LockoutDuration)
+		rec.failures = 0
+	}
+}
+
+// reset forgets all failures for key, completing a reserved attempt. Other
+// attempts still in flight stay reserved.
+func (t *throttle) reset(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	rec, ok := t.records[key]
+	if !ok || rec.pending <= 1 {
+		delete(t.records, key)
+		return
+	}
+	t.records[key] = &failureRecord{pending: rec.pending - 1}
+}
+
+// record returns the live record for key, discarding it if it went stale.
+// The caller must hold t.mu.
+func (t *throttle) record(key string, now time.Time) *failureRecord {
+	rec, ok := t.records[key]
+	if !ok {
+		return nil
+	}
+	if rec.pending == 0 && now.After(rec.lockedUntil) && now.Sub(rec.lastFailure) > t.policy.ResetAfter {
+		delete(t.records, key)
+		return nil
+	}
+	return rec
+}
+
+// backoff returns the delay required after the given number of failures.
+func (t *throttle) backoff(failures int) time.Duration {
+	excess := failures - t.policy.FreeAttempts
+	if excess <= 0 {
+		return 0
+	}
+	delay := float64(t.policy.BaseDelay) * math.Pow(2, float64(excess-1))
+	if delay > float64(t.policy.MaxDelay) {
+		return t.policy.MaxDelay
+	}
+	return time.Duration(delay)
+}
+
+var (
+	accountThrottle = newThrottle(accountThrottlePolicy)
+	ipThrottle      = newThrottle(ipThrottlePolicy)
+)
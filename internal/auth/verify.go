@@ -0,0 +1,147 @@
+package auth
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"secmail/internal/models"
+	"secmail/internal/notify"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt"
+	"gorm.io/gorm"
+)
+
+// verificationAudience separates verification tokens from access tokens so
+// one can never be used in place of the other.
+const verificationAudience = "secmail-email-verification"
+
+const verificationTokenLifetime = 48 * time.Hour
+
+// VerificationClaims is the claim set of an email verification token.
+type VerificationClaims struct {
+	jwt.StandardClaims
+	Email string `json:"email"`
+}
+
+// ResendVerificationRequest represents the request body for resending a verification email
+type ResendVerificationRequest struct {
+	Email string `json:"email" binding:"required,email,max=254"`
+}
+
+// IssueVerificationToken creates a signed token proving control of email.
+func IssueVerificationToken(userID uint, email string) (string, error) {
+	now := time.Now()
+	claims := VerificationClaims{
+		StandardClaims: jwt.StandardClaims{
+			Issuer:    jwtConfig.Issuer,
+			Audience:  verificationAudience,
+			Subject:   strconv.FormatUint(uint64(userID), 10),
+			ExpiresAt: now.Add(verificationTokenLifetime).Unix(),
+			IssuedAt:  now.Unix(),
+		},
+		Email: email,
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(jwtConfig.Secret)
+}
+
+// ParseVerificationToken validates a verification token and returns its claims.
+func ParseVerificationToken(tokenString string) (*VerificationClaims, error) {
+	claims := &VerificationClaims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		if !allowedSigningMethods[token.Method.Alg()] {
+			return nil, errUnexpectedAlgorithm
+		}
+		return jwtConfig.Secret, nil
+	})
+	if err != nil || !token.Valid {
+		return nil, errors.New("invalid verification token")
+	}
+	if claims.Issuer != jwtConfig.Issuer || claims.Audience != verificationAudience || claims.Email == "" {
+		return nil, errors.New("invalid verification token")
+	}
+	return claims, nil
+}
+
+// SendVerification emails a verification link to the address of a user or
+// shared mailbox.
+func SendVerification(user models.User, notifier notify.Notifier) error {
+	token, err := IssueVerificationToken(user.ID, user.Email)
+	if err != nil {
+		return err
+	}
+
+	link := PublicBaseURL() + "/auth/verify?token=" + token
+	body := "Confirm your secmail address by opening the link below:\n\n" +
+		link + "\n\n" +
+		"The link expires in 48 hours. Until the address is verified you cannot\n" +
+		"send or receive mail.\n"
+	return notifier.Notify(user.Email, "Verify your secmail address", body)
+}
+
+// PublicBaseURL returns the base URL clients reach the API at, used in
+// emailed links and advertised URLs.
+func PublicBaseURL() string {
+	if base := os.Getenv("PUBLIC_BASE_URL"); base != "" {
+		return strings.TrimRight(base, "/")
+	}
+	return "http://localhost:8080"
+}
+
+// VerifyEmail handles the link sent to a newly registered address.
+func VerifyEmail(c *gin.Context, db *gorm.DB) {
+	claims, err := ParseVerificationToken(c.Query("token"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired verification token"})
+		return
+	}
+
+	// The email claim must still match so a token cannot verify a changed address
+	result := db.Model(&models.User{}).
+		Where("id = ? AND email = ?", claims.Subject, claims.Email).
+		Where("email_verified_at IS NULL").
+		Update("email_verified_at", time.Now())
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify email"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		var count int64
+		db.Model(&models.User{}).Where("id = ? AND email = ?", claims.Subject, claims.Email).Count(&count)
+		if count == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired verification token"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Email already verified"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Email verified successfully"})
+}
+
+// ResendVerification handles sending a new verification email. The response
+// is the same whether or not the email is registered.
+func ResendVerification(c *gin.Context, db *gorm.DB, notifier notify.Notifier) {
+	var req ResendVerificationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Sanitize inputs
+	req.Email = strings.TrimSpace(req.Email)
+
+	var user models.User
+	err := db.Where("email = ? AND email_verified_at IS NULL", req.Email).First(&user).Error
+	if err == nil {
+		if err := SendVerification(user, notifier); err != nil {
+			log.Println("Failed to deliver verification notification:", err)
+		}
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"message": "If the account exists and is unverified, a verification email has been sent"})
+}
@@ -0,0 +1,241 @@
+// Package backup exports a user's account into a passphrase-encrypted
+// archive and restores such archives into fresh accounts.
+//
+// An archive is a gzipped tar file encrypted with age using a scrypt
+// recipient. It holds a manifest, the user's key material, the keys and
+// certificates of their correspondents, their address book as a vCard file,
+// and their messages in Maildir layout: the inbox in Maildir/ and sent mail
+// in Maildir/.Sent/.
+package backup
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"secmail/internal/crypto"
+	"secmail/internal/email"
+	"secmail/internal/models"
+	"secmail/internal/relay"
+	"sort"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// formatVersion is the version of the archive layout.
+const formatVersion = 1
+
+// Paths of the archive entries.
+const (
+	manifestPath     = "manifest.json"
+	privateKeyPath   = "keys/secmail-private.pem"
+	publicKeyPath    = "keys/secmail-public.pem"
+	certificatePath  = "keys/smime-certificate.pem"
+	pgpSecretKeyPath = "keys/pgp-secret.asc"
+	pgpContactsDir   = "contacts/pgp/"
+	smimeContactsDir = "contacts/smime/"
+	addressBookPath  = "contacts/addressbook.vcf"
+	inboxMaildir     = "Maildir/"
+	sentMaildir      = "Maildir/.Sent/"
+	// maxKeyEntryBytes bounds the entries other than messages.
+	maxKeyEntryBytes = 1 << 20
+)
+
+var (
+	ErrInvalidArchive  = errors.New("not a secmail backup archive")
+	ErrAccountNotEmpty = errors.New("account already has messages")
+)
+
+// Manifest describes an archive.
+type Manifest struct {
+	Version    int       `json:"version"`
+	Email      string    `json:"email"`
+	ExportedAt time.Time `json:"exported_at"`
+}
+
+// Maildir info flags (the letters after ":2,") of the stored IMAP flags.
+var maildirFlags = map[string]byte{
+	`\Draft`:    'D',
+	`\Flagged`:  'F',
+	`\Answered`: 'R',
+	`\Seen`:     'S',
+	`\Deleted`:  'T',
+}
+
+// Export writes an archive of the user's account to w, encrypted with
+// passphrase. privateKey is the user's unwrapped key; messages it cannot
+// decrypt are left out. queue names the Message-ID of messages sent within
+// secmail.
+func Export(w io.Writer, userID uint, privateKey []byte, passphrase string, queue *relay.Queue, db *gorm.DB) error {
+	var user models.User
+	if err := db.Where("id = ?", userID).First(&user).Error; err != nil {
+		return err
+	}
+
+	encrypted, err := crypto.EncryptWithPassphrase(w, passphrase)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(encrypted)
+	tw := tar.NewWriter(gz)
+
+	if err := writeArchive(tw, user, privateKey, queue, db); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	return encrypted.Close()
+}
+
+func writeArchive(tw *tar.Writer, user models.User, privateKey []byte, queue *relay.Queue, db *gorm.DB) error {
+	now := time.Now()
+	manifest, err := json.MarshalIndent(Manifest{Version: formatVersion, Email: user.Email, ExportedAt: now.UTC()}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeEntry(tw, manifestPath, manifest, now); err != nil {
+		return err
+	}
+
+	// Key material
+	if err := writeEntry(tw, privateKeyPath, privateKey, now); err != nil {
+		return err
+	}
+	if err := writeEntry(tw, publicKeyPath, user.PublicKey, now); err != nil {
+		return err
+	}
+	if len(user.Certificate) > 0 {
+		if err := writeEntry(tw, certificatePath, user.Certificate, now); err != nil {
+			return err
+		}
+	}
+	keys, err := email.LoadReadKeys(user.ID, privateKey, db)
+	if err != nil {
+		return err
+	}
+	if keys.PGPSecretKey != nil {
+		armored, err := crypto.ArmorPGPSecretKey(keys.PGPSecretKey)
+		if err != nil {
+			return err
+		}
+		if err := writeEntry(tw, pgpSecretKeyPath, armored, now); err != nil {
+			return err
+		}
+	}
+
+	// Correspondents
+	var pgpContacts []models.PGPContactKey
+	if err := db.Where("user_id = ?", user.ID).Order("email").Find(&pgpContacts).Error; err != nil {
+		return err
+	}
+	for _, contact := range pgpContacts {
+		if err := writeEntry(tw, pgpContactsDir+url.PathEscape(contact.Email)+".asc", contact.PublicKey, contact.UpdatedAt); err != nil {
+			return err
+		}
+	}
+	var smimeContacts []models.SMIMEContactCert
+	if err := db.Where("user_id = ?", user.ID).Order("email").Find(&smimeContacts).Error; err != nil {
+		return err
+	}
+	for _, contact := range smimeContacts {
+		if err := writeEntry(tw, smimeContactsDir+url.PathEscape(contact.Email)+".pem", contact.Certificate, contact.UpdatedAt); err != nil {
+			return err
+		}
+	}
+
+	addressBook, err := email.ExportContacts(user.ID, privateKey, db)
+	if err != nil {
+		return err
+	}
+	if len(addressBook) > 0 {
+		if err := writeEntry(tw, addressBookPath, addressBook, now); err != nil {
+			return err
+		}
+	}
+
+	// Messages
+	for _, dir := range []struct{ mailbox, path string }{
+		{email.MailboxInbox, inboxMaildir},
+		{email.MailboxSent, sentMaildir},
+	} {
+		for _, sub := range []string{"cur/", "new/", "tmp/"} {
+			if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: dir.path + sub, Mode: 0700, ModTime: now}); err != nil {
+				return err
+			}
+		}
+		messages, err := email.ListMailbox(user.ID, dir.mailbox, db)
+		if err != nil {
+			return err
+		}
+		for _, msg := range messages {
+			// Expiring and burn-after-reading messages must not outlive
+			// their lifetime in an archive, and exporting would burn them
+			if msg.Ephemeral {
+				continue
+			}
+			raw, err := email.RenderMessage(user.ID, msg.ID, privateKey, queue.MessageID(&email.Message{ID: msg.ID}), db)
+			if errors.Is(err, email.ErrSessionKeyNotFound) {
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("failed to render message %d: %w", msg.ID, err)
+			}
+			if err := writeEntry(tw, dir.path+"cur/"+maildirName(msg), raw, msg.SentAt); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func writeEntry(tw *tar.Writer, name string, data []byte, modTime time.Time) error {
+	if err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0600,
+		Size:     int64(len(data)),
+		ModTime:  modTime,
+	}); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+// maildirName returns the Maildir file name of a message, encoding its
+// flags in the info part.
+func maildirName(msg email.MailboxMessage) string {
+	var info []byte
+	for _, flag := range msg.Flags {
+		if letter, ok := maildirFlags[flag]; ok {
+			info = append(info, letter)
+		}
+	}
+	sort.Slice(info, func(i, j int) bool { return info[i] < info[j] })
+	return fmt.Sprintf("%d.%d.secmail:2,%s", msg.SentAt.Unix(), msg.ID, info)
+}
+
+// parseMaildirFlags returns the IMAP flags encoded in a Maildir file name.
+func parseMaildirFlags(name string) []string {
+	_, info, ok := strings.Cut(name, ":2,")
+	if !ok {
+		return nil
+	}
+	var flags []string
+	for flag, letter := range maildirFlags {
+		if strings.IndexByte(info, letter) >= 0 {
+			flags = append(flags, flag)
+		}
+	}
+	sort.Strings(flags)
+	return flags
+}
@@ -0,0 +1,48 @@
+package backup
+
+import (
+	"reflect"
+	"secmail/internal/email"
+	"testing"
+	"time"
+)
+
+func TestMaildirFlags(t *testing.T) {
+	msg := email.MailboxMessage{
+		ID:     42,
+		SentAt: time.Unix(1700000000, 0),
+		Flags:  []string{`\Seen`, `\Flagged`, `$Forwarded`, `\Answered`},
+	}
+	name := maildirName(msg)
+	if name != "1700000000.42.secmail:2,FRS" {
+		t.Fatalf("Unexpected Maildir name: %s", name)
+	}
+	want := []string{`\Answered`, `\Flagged`, `\Seen`}
+	if flags := parseMaildirFlags(name); !reflect.DeepEqual(flags, want) {
+		t.Errorf("Expected flags %v, got %v", want, flags)
+	}
+	if flags := parseMaildirFlags("1700000000.42.host"); flags != nil {
+		t.Errorf("Name without info should have no flags, got %v", flags)
+	}
+}
+
+func TestArchivePaths(t *testing.T) {
+	if mailbox, ok := messageMailbox("Maildir/cur/1.1.secmail:2,S"); !ok || mailbox != email.MailboxInbox {
+		t.Errorf("Expected inbox message, got %q, %v", mailbox, ok)
+	}
+	if mailbox, ok := messageMailbox("Maildir/.Sent/new/1.2.secmail"); !ok || mailbox != email.MailboxSent {
+		t.Errorf("Expected sent message, got %q, %v", mailbox, ok)
+	}
+	if _, ok := messageMailbox("Maildir/tmp/1.3.secmail"); ok {
+		t.Error("Messages in tmp should not be restored")
+	}
+
+	if address, ok := contactAddress("contacts/pgp/bob%2Btag@example.org.asc", pgpContactsDir, ".asc"); !ok || address != "bob+tag@example.org" {
+		t.Errorf("Unexpected contact address %q, %v", address, ok)
+	}
+	for _, name := range []string{"contacts/pgp/.asc", "contacts/pgp/bob@example.org.pem", "contacts/pgp/x/bob@example.org.asc"} {
+		if _, ok := contactAddress(name, pgpContactsDir, ".asc"); ok {
+			t.Errorf("Expected %s to be rejected", name)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package backup
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/url"
+	"path"
+	"secmail/internal/crypto"
+	"secmail/internal/email"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// RestoreResult summarizes what Restore brought into the account.
+type RestoreResult struct {
+	Messages      int  `json:"messages"`
+	PGPKey        bool `json:"pgp_key"`
+	PGPContacts   int  `json:"pgp_contacts"`
+	SMIMEContacts int  `json:"smime_contacts"`
+	Contacts      int  `json:"contacts"` // Address book entries
+	Certificate   bool `json:"certificate"`
+	// Skipped lists the entries that were not restored, with the reason.
+	Skipped []string `json:"skipped"`
+}
+
+// Restore imports an archive written by Export into the user's account,
+// which must not have any messages yet. Messages are encrypted to the
+// account's own key; the archived secmail key pair is not adopted, so an
+// archived S/MIME certificate is only restored if it was issued for the
+// account's key. Everything is restored in one transaction.
+func Restore(r io.Reader, userID uint, passphrase string, db *gorm.DB) (*RestoreResult, error) {
+	count, err := email.CountMessages(userID, db)
+	if err != nil {
+		return nil, err
+	}
+	if count > 0 {
+		return nil, ErrAccountNotEmpty
+	}
+
+	plaintext, err := crypto.DecryptWithPassphrase(r, passphrase)
+	if errors.Is(err, crypto.ErrWrongPassphrase) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, ErrInvalidArchive
+	}
+	gz, err := gzip.NewReader(plaintext)
+	if err != nil {
+		return nil, ErrInvalidArchive
+	}
+	defer gz.Close()
+
+	result := &RestoreResult{Skipped: []string{}}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		return restoreEntries(tar.NewReader(gz), userID, tx, result)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func restoreEntries(tr *tar.Reader, userID uint, db *gorm.DB, result *RestoreResult) error {
+	sawManifest := false
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return ErrInvalidArchive
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		name := path.Clean(hdr.Name)
+
+		if !sawManifest {
+			if name != manifestPath {
+				return ErrInvalidArchive
+			}
+			if err := checkManifest(tr); err != nil {
+				return err
+			}
+			sawManifest = true
+			continue
+		}
+
+		mailbox, isMessage := messageMailbox(name)
+		limit := int64(maxKeyEntryBytes)
+		if isMessage {
+			limit = email.MaxImportMessageBytes
+		}
+		if hdr.Size > limit {
+			result.Skipped = append(result.Skipped, name+": too large")
+			continue
+		}
+		data, err := io.ReadAll(io.LimitReader(tr, limit))
+		if err != nil {
+			return ErrInvalidArchive
+		}
+
+		if isMessage {
+			msg, err := email.ImportMessage(userID, data, mailbox, db)
+			if errors.Is(err, email.ErrInvalidMessage) {
+				result.Skipped = append(result.Skipped, name+": "+err.Error())
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if flags := parseMaildirFlags(path.Base(name)); len(flags) > 0 {
+				if err := email.SetMessageFlags(userID, msg.ID, flags, db); err != nil {
+					return err
+				}
+			}
+			result.Messages++
+			continue
+		}
+
+		if err := restoreKeyEntry(name, data, userID, db, result); err != nil {
+			return err
+		}
+	}
+	if !sawManifest {
+		return ErrInvalidArchive
+	}
+	return nil
+}
+
+func checkManifest(r io.Reader) error {
+	var manifest Manifest
+	if err := json.NewDecoder(io.LimitReader(r, maxKeyEntryBytes)).Decode(&manifest); err != nil {
+		return ErrInvalidArchive
+	}
+	if manifest.Version != formatVersion {
+		return ErrInvalidArchive
+	}
+	return nil
+}
+
+// messageMailbox returns the mailbox of a Maildir message entry.
+func messageMailbox(name string) (string, bool) {
+	dir := path.Dir(name)
+	switch {
+	case dir == path.Clean(sentMaildir+"cur") || dir == path.Clean(sentMaildir+"new"):
+		return email.MailboxSent, true
+	case dir == path.Clean(inboxMaildir+"cur") || dir == path.Clean(inboxMaildir+"new"):
+		return email.MailboxInbox, true
+	}
+	return "", false
+}
+
+// restoreKeyEntry restores key material, correspondents' keys and the
+// address book. Entries that cannot be used are recorded as skipped rather
+// than failing the restore.
+func restoreKeyEntry(name string, data []byte, userID uint, db *gorm.DB, result *RestoreResult) error {
+	skip := func(reason string) {
+		result.Skipped = append(result.Skipped, name+": "+reason)
+	}
+
+	switch {
+	case name == privateKeyPath, name == publicKeyPath:
+		// The account keeps its own key pair
+	case name == certificatePath:
+		_, err := email.SetCertificate(userID, data, db)
+		if errors.Is(err, email.ErrCertificateMismatch) {
+			skip("certificate was issued for the archived key, not this account's")
+			return nil
+		}
+		if err != nil {
+			skip(err.Error())
+			return nil
+		}
+		result.Certificate = true
+	case name == pgpSecretKeyPath:
+		if _, _, err := email.ImportPGPKey(userID, data, "", db); err != nil {
+			skip(err.Error())
+			return nil
+		}
+		result.PGPKey = true
+	case strings.HasPrefix(name, pgpContactsDir):
+		address, ok := contactAddress(name, pgpContactsDir, ".asc")
+		if !ok {
+			skip("unexpected file name")
+			return nil
+		}
+		if _, err := email.ImportPGPContactKey(userID, data, []string{address}, db); err != nil {
+			skip(err.Error())
+			return nil
+		}
+		result.PGPContacts++
+	case strings.HasPrefix(name, smimeContactsDir):
+		address, ok := contactAddress(name, smimeContactsDir, ".pem")
+		if !ok {
+			skip("unexpected file name")
+			return nil
+		}
+		if _, err := email.ImportSMIMEContactCert(userID, data, []string{address}, db); err != nil {
+			skip(err.Error())
+			return nil
+		}
+		result.SMIMEContacts++
+	case name == addressBookPath:
+		cards, err := email.ParseVCards(data)
+		if err != nil {
+			skip(err.Error())
+			return nil
+		}
+		imported, err := email.ImportContacts(userID, cards, db)
+		if errors.Is(err, email.ErrInvalidContact) || errors.Is(err, email.ErrEmptyContact) || errors.Is(err, email.ErrInvalidFingerprint) {
+			skip(err.Error())
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		result.Contacts = imported
+	default:
+		skip("unknown entry")
+	}
+	return nil
+}
+
+// contactAddress returns the address a correspondent's key file is named
+// after.
+func contactAddress(name, dir, ext string) (string, bool) {
+	base := strings.TrimSuffix(strings.TrimPrefix(name, dir), ext)
+	if base == "" || strings.Contains(base, "/") || len(base)+len(dir)+len(ext) != len(name) {
+		return "", false
+	}
+	address, err := url.PathUnescape(base)
+	if err != nil || !strings.Contains(address, "@") {
+		return "", false
+	}
+	return address, true
+}
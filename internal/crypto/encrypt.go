@@ -5,10 +5,7 @@ import (
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
-	"crypto/x509"
 	"encoding/base64"
-	"encoding/pem"
-	"errors"
 	"io"
 
 	"filippo.io/age"
@@ -67,19 +64,10 @@ func DecryptBody(ciphertext []byte, passphrase string) (plaintext []byte, err er
 
 // EncryptPassphrase encrypts the passphrase using RSA OAEP with the recipient's public key.
 func EncryptPassphrase(passphrase string, publicKeyPEM []byte) ([]byte, error) {
-	// Parse public key
-	block, _ := pem.Decode(publicKeyPEM)
-	if block == nil || block.Type != "PUBLIC KEY" {
-		return nil, errors.New("not an RSA public key")
-	}
-	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	rsaPub, err := parseRSAPublicKey(publicKeyPEM)
 	if err != nil {
 		return nil, err
 	}
-	rsaPub, ok := pub.(*rsa.PublicKey)
-	if !ok {
-		return nil, errors.New("not an RSA public key")
-	}
 
 	// Encrypt
 	encrypted, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, rsaPub, []byte(passphrase), nil)
@@ -88,19 +76,10 @@ func EncryptPassphrase(passphrase string, publicKeyPEM []byte) ([]byte, error) {
 
 // DecryptPassphrase decrypts the passphrase using RSA OAEP with the recipient's private key.
 func DecryptPassphrase(encrypted []byte, privateKeyPEM []byte) (string, error) {
-	// Parse private key
-	block, _ := pem.Decode(privateKeyPEM)
-	if block == nil || block.Type != "PRIVATE KEY" {
-		return "", errors.New("not an RSA private key")
-	}
-	priv, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	rsaPriv, err := parseRSAPrivateKey(privateKeyPEM)
 	if err != nil {
 		return "", err
 	}
-	rsaPriv, ok := priv.(*rsa.PrivateKey)
-	if !ok {
-		return "", errors.New("not an RSA private key")
-	}
 
 	// Decrypt
 	decrypted, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, rsaPriv, encrypted, nil)
@@ -0,0 +1,111 @@
+package crypto
+
+import (
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"slices"
+)
+
+// Group keys are modelled on MLS (RFC 9420) but are not an implementation of
+// it. Only the key schedule is borrowed (section 8, with HKDF-SHA256): every
+// epoch secret is derived from the previous epoch's init secret and a fresh
+// commit secret, and message keys are derived from the epoch's encryption
+// secret. There is no TreeKEM ratchet tree and there are no Commit or Welcome
+// messages: the member starting an epoch encrypts its secret to every
+// member's RSA key, so an epoch change costs one RSA encryption per member.
+// Only sending a message is constant in the number of members.
+
+// EpochSecretSize is the size of group epoch secrets (Nh for SHA-256).
+const EpochSecretSize = sha256.Size
+
+// labelPrefix is the label prefix of the MLS key schedule, kept so that keys
+// derived for stored group messages do not change.
+const labelPrefix = "MLS 1.0 "
+
+// ExpandWithLabel is the ExpandWithLabel function of the MLS key schedule
+// (RFC 9420 section 8).
+func ExpandWithLabel(secret []byte, label string, context []byte, length int) []byte {
+	info := binary.BigEndian.AppendUint16(nil, uint16(length))
+	info = appendOpaque(info, []byte(labelPrefix+label))
+	info = appendOpaque(info, context)
+	key, err := hkdf.Expand(sha256.New, secret, string(info), length)
+	if err != nil {
+		// Only possible for lengths above 255*Nh, which are never requested
+		panic(err)
+	}
+	return key
+}
+
+// DeriveSecret is the DeriveSecret function of the MLS key schedule.
+func DeriveSecret(secret []byte, label string) []byte {
+	return ExpandWithLabel(secret, label, nil, EpochSecretSize)
+}
+
+// appendOpaque appends data as an MLS opaque<V>, prefixed with its length
+// as a variable-length integer (RFC 9420 section 2.1.2).
+func appendOpaque(buf, data []byte) []byte {
+	n := len(data)
+	switch {
+	case n < 1<<6:
+		buf = append(buf, byte(n))
+	case n < 1<<14:
+		buf = binary.BigEndian.AppendUint16(buf, uint16(n)|0x4000)
+	default:
+		buf = binary.BigEndian.AppendUint32(buf, uint32(n)|0x80000000)
+	}
+	return append(buf, data...)
+}
+
+// GroupContext summarizes the state a group's epoch secret is bound to: the
+// group, the epoch and its members.
+func GroupContext(groupID uint, epoch uint64, members []uint) []byte {
+	sorted := slices.Clone(members)
+	slices.Sort(sorted)
+	var memberList []byte
+	for _, id := range sorted {
+		memberList = binary.BigEndian.AppendUint64(memberList, uint64(id))
+	}
+	membersHash := sha256.Sum256(memberList)
+
+	buf := appendOpaque(nil, binary.BigEndian.AppendUint64(nil, uint64(groupID)))
+	buf = binary.BigEndian.AppendUint64(buf, epoch)
+	return appendOpaque(buf, membersHash[:])
+}
+
+// NewEpochSecret derives the secret of the epoch described by groupContext
+// from the previous epoch's secret. previousEpochSecret is nil for a new
+// group. A fresh commit secret makes the new epoch unknown to anyone who
+// only held earlier epochs.
+func NewEpochSecret(previousEpochSecret, groupContext []byte) ([]byte, error) {
+	initSecret := make([]byte, EpochSecretSize)
+	if previousEpochSecret != nil {
+		initSecret = DeriveSecret(previousEpochSecret, "init")
+	} else if _, err := rand.Read(initSecret); err != nil {
+		return nil, err
+	}
+	commitSecret := make([]byte, EpochSecretSize)
+	if _, err := rand.Read(commitSecret); err != nil {
+		return nil, err
+	}
+
+	joinerSecret := ExpandWithLabel(extract(initSecret, commitSecret), "joiner", groupContext, EpochSecretSize)
+	// No pre-shared keys are used
+	pskSecret := make([]byte, EpochSecretSize)
+	return ExpandWithLabel(extract(joinerSecret, pskSecret), "epoch", groupContext, EpochSecretSize), nil
+}
+
+func extract(salt, secret []byte) []byte {
+	prk, err := hkdf.Extract(sha256.New, secret, salt)
+	if err != nil {
+		panic(err)
+	}
+	return prk
+}
+
+// GroupMessageKey returns the key of one group message, derived from the
+// epoch's encryption secret and the message's random nonce.
+func GroupMessageKey(epochSecret, nonce []byte) []byte {
+	return ExpandWithLabel(DeriveSecret(epochSecret, "encryption"), "message key", nonce, ChainKeySize)
+}
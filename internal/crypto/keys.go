@@ -1,12 +1,25 @@
 package crypto
 
 import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
+	"encoding/hex"
 	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
 )
 
+// PublicKeyInfo describes a secmail public key.
+type PublicKeyInfo struct {
+	Fingerprint string // SHA-256 of the DER SubjectPublicKeyInfo
+	Algorithm   string
+}
+
 // GenerateRSAKeyPair generates a new RSA key pair (2048 bits) and returns PEM-encoded public and private keys.
 func GenerateRSAKeyPair() (publicKeyPEM, privateKeyPEM []byte, err error) {
 	// Generate RSA key pair
@@ -39,3 +52,83 @@ func GenerateRSAKeyPair() (publicKeyPEM, privateKeyPEM []byte, err error) {
 
 	return publicKeyPEM, privateKeyPEM, nil
 }
+
+// DescribePublicKey returns the fingerprint and algorithm of a PEM public key
+// from GenerateRSAKeyPair.
+func DescribePublicKey(publicKeyPEM []byte) (PublicKeyInfo, error) {
+	block, _ := pem.Decode(publicKeyPEM)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return PublicKeyInfo{}, errors.New("not a PEM public key")
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return PublicKeyInfo{}, err
+	}
+	sum := sha256.Sum256(block.Bytes)
+	return PublicKeyInfo{
+		Fingerprint: strings.ToUpper(hex.EncodeToString(sum[:])),
+		Algorithm:   keyAlgorithm(pub),
+	}, nil
+}
+
+// PrivateKeyMatches reports whether privateKeyPEM is the private half of
+// publicKeyPEM.
+func PrivateKeyMatches(privateKeyPEM, publicKeyPEM []byte) bool {
+	priv, err := parseRSAPrivateKey(privateKeyPEM)
+	if err != nil {
+		return false
+	}
+	pub, err := parseRSAPublicKey(publicKeyPEM)
+	if err != nil {
+		return false
+	}
+	return priv.PublicKey.Equal(pub)
+}
+
+// keyAlgorithm names the algorithm and size of a public key, such as
+// "RSA-2048".
+func keyAlgorithm(pub any) string {
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		return fmt.Sprintf("RSA-%d", pub.N.BitLen())
+	case *ecdsa.PublicKey:
+		return "ECDSA-" + pub.Curve.Params().Name
+	case ed25519.PublicKey:
+		return "Ed25519"
+	}
+	return "unknown"
+}
+
+// parseRSAPublicKey parses a PKIX "PUBLIC KEY" PEM block.
+func parseRSAPublicKey(publicKeyPEM []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(publicKeyPEM)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, errors.New("not an RSA public key")
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaPub, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("not an RSA public key")
+	}
+	return rsaPub, nil
+}
+
+// parseRSAPrivateKey parses a PKCS#8 "PRIVATE KEY" PEM block.
+func parseRSAPrivateKey(privateKeyPEM []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(privateKeyPEM)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, errors.New("not an RSA private key")
+	}
+	priv, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaPriv, ok := priv.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("not an RSA private key")
+	}
+	return rsaPriv, nil
+}
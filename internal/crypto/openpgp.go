@@ -0,0 +1,372 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	pgperrors "github.com/ProtonMail/go-crypto/openpgp/errors"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	openpgp "github.com/ProtonMail/go-crypto/openpgp/v2"
+)
+
+// Results of verifying an OpenPGP signature.
+const (
+	PGPSignatureNone       = "none"
+	PGPSignatureValid      = "valid"
+	PGPSignatureInvalid    = "invalid"
+	PGPSignatureUnknownKey = "unknown_key"
+)
+
+// ErrPGPKeyLocked is returned when a protected OpenPGP secret key is imported
+// without the correct passphrase.
+var ErrPGPKeyLocked = errors.New("OpenPGP secret key is locked; wrong or missing passphrase")
+
+// PGPKeyInfo describes an OpenPGP key.
+type PGPKeyInfo struct {
+	Fingerprint string
+	KeyID       string
+	Algorithm   string // Of the primary key
+	Emails      []string
+}
+
+// GeneratePGPKey creates a new OpenPGP key for name and email and returns the
+// armored, unprotected secret key.
+func GeneratePGPKey(name, email string) ([]byte, error) {
+	entity, err := openpgp.NewEntity(name, "", email, nil)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	w, err := armor.Encode(&buf, "PGP PRIVATE KEY BLOCK", nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := entity.SerializePrivate(w, nil); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// ImportPGPSecretKey parses an armored OpenPGP secret key, unlocking it with
+// passphrase when it is protected. It returns the unprotected binary secret
+// key (to be stored encrypted) and the armored public key.
+func ImportPGPSecretKey(armored []byte, passphrase string) (secretKey, publicKey []byte, info PGPKeyInfo, err error) {
+	entity, err := readSingleEntity(armored)
+	if err != nil {
+		return nil, nil, PGPKeyInfo{}, err
+	}
+	if entity.PrivateKey == nil {
+		return nil, nil, PGPKeyInfo{}, errors.New("not an OpenPGP secret key")
+	}
+	if err := entity.DecryptPrivateKeys([]byte(passphrase)); err != nil {
+		return nil, nil, PGPKeyInfo{}, ErrPGPKeyLocked
+	}
+
+	var secret bytes.Buffer
+	if err := entity.SerializePrivateWithoutSigning(&secret, nil); err != nil {
+		return nil, nil, PGPKeyInfo{}, err
+	}
+	publicKey, err = armorPublicKey(entity)
+	if err != nil {
+		return nil, nil, PGPKeyInfo{}, err
+	}
+	return secret.Bytes(), publicKey, pgpKeyInfo(entity), nil
+}
+
+// ArmorPGPSecretKey encodes an unprotected binary secret key, as returned by
+// ImportPGPSecretKey, in ASCII armor so it can be imported again.
+func ArmorPGPSecretKey(secretKey []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := armor.Encode(&buf, "PGP PRIVATE KEY BLOCK", nil)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(secretKey); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// ImportPGPPublicKey parses an armored OpenPGP public key and returns it
+// re-armored without any secret material.
+func ImportPGPPublicKey(armored []byte) (publicKey []byte, info PGPKeyInfo, err error) {
+	entity, err := readSingleEntity(armored)
+	if err != nil {
+		return nil, PGPKeyInfo{}, err
+	}
+	if _, ok := entity.EncryptionKey(time.Now(), nil); !ok {
+		return nil, PGPKeyInfo{}, errors.New("OpenPGP key has no usable encryption key")
+	}
+	publicKey, err = armorPublicKey(entity)
+	if err != nil {
+		return nil, PGPKeyInfo{}, err
+	}
+	return publicKey, pgpKeyInfo(entity), nil
+}
+
+// DescribePGPPublicKey summarizes an armored OpenPGP public key.
+func DescribePGPPublicKey(armored []byte) (PGPKeyInfo, error) {
+	entity, err := readSingleEntity(armored)
+	if err != nil {
+		return PGPKeyInfo{}, err
+	}
+	return pgpKeyInfo(entity), nil
+}
+
+// EncryptPGP encrypts plaintext to the armored public keys and returns an
+// armored OpenPGP message. It is signed when signerKey (a binary secret key
+// from ImportPGPSecretKey) is given.
+func EncryptPGP(plaintext []byte, publicKeys [][]byte, signerKey []byte) ([]byte, error) {
+	to, err := readKeyRing(publicKeys)
+	if err != nil {
+		return nil, err
+	}
+	if len(to) == 0 {
+		return nil, errors.New("no OpenPGP recipients")
+	}
+	var signers openpgp.EntityList
+	if signerKey != nil {
+		if signers, err = openpgp.ReadKeyRing(bytes.NewReader(signerKey)); err != nil {
+			return nil, err
+		}
+	}
+
+	var buf bytes.Buffer
+	aw, err := armor.Encode(&buf, "PGP MESSAGE", nil)
+	if err != nil {
+		return nil, err
+	}
+	w, err := openpgp.Encrypt(aw, to, nil, signers, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(plaintext); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	if err := aw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// DecryptPGP decrypts an armored OpenPGP message with a binary secret key and
+// checks any embedded signature against verifyKeys.
+func DecryptPGP(ciphertext []byte, secretKey []byte, verifyKeys [][]byte) (plaintext []byte, signature string, err error) {
+	keyring, err := openpgp.ReadKeyRing(bytes.NewReader(secretKey))
+	if err != nil {
+		return nil, "", err
+	}
+	contacts, err := readKeyRing(verifyKeys)
+	if err != nil {
+		return nil, "", err
+	}
+	keyring = append(keyring, contacts...)
+
+	block, err := armor.Decode(bytes.NewReader(ciphertext))
+	if err != nil {
+		return nil, "", err
+	}
+	md, err := openpgp.ReadMessage(block.Body, keyring, nil, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	plaintext, err = io.ReadAll(md.UnverifiedBody)
+	if err != nil {
+		return nil, "", err
+	}
+	return plaintext, signatureStatus(md.IsSigned, md.SignedBy != nil, md.SignatureError), nil
+}
+
+// SignPGPDetached returns an armored detached signature over data and the
+// RFC 3156 micalg name of the hash it used (e.g. "pgp-sha256").
+func SignPGPDetached(data []byte, secretKey []byte) (signature []byte, micalg string, err error) {
+	signers, err := openpgp.ReadKeyRing(bytes.NewReader(secretKey))
+	if err != nil {
+		return nil, "", err
+	}
+	var buf bytes.Buffer
+	if err := openpgp.DetachSign(&buf, signers, bytes.NewReader(data), nil); err != nil {
+		return nil, "", err
+	}
+	p, err := packet.Read(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		return nil, "", err
+	}
+	sig, ok := p.(*packet.Signature)
+	if !ok {
+		return nil, "", errors.New("unexpected OpenPGP packet in signature")
+	}
+	micalg = "pgp-" + strings.ToLower(strings.ReplaceAll(sig.Hash.String(), "-", ""))
+
+	var armored bytes.Buffer
+	w, err := armor.Encode(&armored, "PGP SIGNATURE", nil)
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		return nil, "", err
+	}
+	if err := w.Close(); err != nil {
+		return nil, "", err
+	}
+	return armored.Bytes(), micalg, nil
+}
+
+// VerifyPGPDetached checks an armored detached signature over data against
+// the armored public keys.
+func VerifyPGPDetached(data, signature []byte, publicKeys [][]byte) string {
+	keyring, err := readKeyRing(publicKeys)
+	if err != nil {
+		return PGPSignatureInvalid
+	}
+	_, signer, err := openpgp.VerifyArmoredDetachedSignature(keyring, bytes.NewReader(data), bytes.NewReader(signature), nil)
+	return signatureStatus(true, signer != nil, err)
+}
+
+// signatureStatus maps the outcome of signature verification to one of the
+// PGPSignature* values.
+func signatureStatus(signed, knownSigner bool, err error) string {
+	switch {
+	case !signed:
+		return PGPSignatureNone
+	case err == nil:
+		return PGPSignatureValid
+	case !knownSigner && errors.Is(err, pgperrors.ErrUnknownIssuer):
+		return PGPSignatureUnknownKey
+	default:
+		return PGPSignatureInvalid
+	}
+}
+
+// readSingleEntity parses armored data that must contain exactly one key.
+func readSingleEntity(armored []byte) (*openpgp.Entity, error) {
+	entities, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(armored))
+	if err != nil {
+		return nil, err
+	}
+	if len(entities) != 1 {
+		return nil, errors.New("expected exactly one OpenPGP key")
+	}
+	return entities[0], nil
+}
+
+// readKeyRing parses a list of armored public keys into one key ring.
+func readKeyRing(armored [][]byte) (openpgp.EntityList, error) {
+	var keyring openpgp.EntityList
+	for _, key := range armored {
+		entities, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(key))
+		if err != nil {
+			return nil, err
+		}
+		keyring = append(keyring, entities...)
+	}
+	return keyring, nil
+}
+
+// armorPublicKey serializes the public part of entity in ASCII armor.
+func armorPublicKey(entity *openpgp.Entity) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := armor.Encode(&buf, "PGP PUBLIC KEY BLOCK", nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := entity.Serialize(w); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// pgpKeyInfo summarizes entity.
+func pgpKeyInfo(entity *openpgp.Entity) PGPKeyInfo {
+	info := PGPKeyInfo{
+		Fingerprint: strings.ToUpper(hex.EncodeToString(entity.PrimaryKey.Fingerprint)),
+		KeyID:       entity.PrimaryKey.KeyIdString(),
+		Algorithm:   pgpKeyAlgorithm(entity.PrimaryKey),
+	}
+	for _, identity := range entity.Identities {
+		if identity.UserId != nil && identity.UserId.Email != "" {
+			info.Emails = append(info.Emails, strings.ToLower(identity.UserId.Email))
+		}
+	}
+	sort.Strings(info.Emails)
+	return info
+}
+
+// pgpKeyAlgorithm names the algorithm and size of an OpenPGP key in the
+// style of keyAlgorithm.
+func pgpKeyAlgorithm(key *packet.PublicKey) string {
+	switch key.PubKeyAlgo {
+	case packet.PubKeyAlgoRSA, packet.PubKeyAlgoRSASignOnly, packet.PubKeyAlgoRSAEncryptOnly:
+		bits, err := key.BitLength()
+		if err != nil {
+			return "RSA"
+		}
+		return fmt.Sprintf("RSA-%d", bits)
+	case packet.PubKeyAlgoEdDSA, packet.PubKeyAlgoEd25519:
+		return "Ed25519"
+	case packet.PubKeyAlgoEd448:
+		return "Ed448"
+	case packet.PubKeyAlgoECDSA:
+		curve, err := key.Curve()
+		if err != nil {
+			return "ECDSA"
+		}
+		return "ECDSA-" + string(curve)
+	case packet.PubKeyAlgoDSA:
+		return "DSA"
+	}
+	return fmt.Sprintf("OpenPGP-%d", key.PubKeyAlgo)
+}
+
+// DearmorPGPPublicKey returns the binary encoding of an armored public key,
+// as served by a Web Key Directory.
+func DearmorPGPPublicKey(armored []byte) ([]byte, error) {
+	block, err := armor.Decode(bytes.NewReader(armored))
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(block.Body)
+}
+
+// zbase32Alphabet is the human-oriented base-32 alphabet used by WKD.
+const zbase32Alphabet = "ybndrfg8ejkmcpqxot1uwisza345h769"
+
+// WKDHash returns the Web Key Directory hash of the local part of an
+// address: the z-base-32 encoded SHA-1 of the lowercased local part.
+func WKDHash(localPart string) string {
+	sum := sha1.Sum([]byte(strings.ToLower(localPart)))
+	var out strings.Builder
+	var buffer, bits uint
+	for _, b := range sum {
+		buffer = buffer<<8 | uint(b)
+		bits += 8
+		for bits >= 5 {
+			bits -= 5
+			out.WriteByte(zbase32Alphabet[(buffer>>bits)&31])
+		}
+	}
+	if bits > 0 {
+		out.WriteByte(zbase32Alphabet[(buffer<<(5-bits))&31])
+	}
+	return out.String()
+}
@@ -0,0 +1,194 @@
+package crypto
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+)
+
+// Forward secret messages wrap their session passphrase with a message key
+// from a symmetric ratchet: the KDF chain of the Signal double ratchet,
+// without its Diffie-Hellman ratchet. Each chain starts from an X25519
+// agreement between a sender's ephemeral key and a recipient's signed
+// prekey, and is only restarted with a new ephemeral key when the recipient
+// rotates their prekey. Senders keep just the next chain key, but recipients
+// recompute message keys from the prekey, since stored mail stays readable:
+// received messages are only protected once the prekey is erased, and
+// nothing restores secrecy after a chain key leaks until then.
+
+// ChainKeySize is the size of ratchet chain and message keys.
+const ChainKeySize = 32
+
+// ratchetInfo binds chain keys to their purpose.
+const ratchetInfo = "secmail ratchet v1"
+
+// ErrInvalidPrekeySignature is returned when a prekey was not signed by the
+// owner's secmail key.
+var ErrInvalidPrekeySignature = errors.New("invalid prekey signature")
+
+// GeneratePrekey returns a new X25519 key pair.
+func GeneratePrekey() (publicKey, privateKey []byte, err error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key.PublicKey().Bytes(), key.Bytes(), nil
+}
+
+// SignPrekey signs an X25519 public prekey with a secmail private key
+// (RSA-PSS over its SHA-256), so senders can tell it belongs to the owner.
+func SignPrekey(prekey, privateKeyPEM []byte) ([]byte, error) {
+	key, err := parseRSAPrivateKey(privateKeyPEM)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256(prekey)
+	return rsa.SignPSS(rand.Reader, key, crypto.SHA256, digest[:], nil)
+}
+
+// VerifyPrekey checks a prekey signature made by SignPrekey.
+func VerifyPrekey(prekey, signature, publicKeyPEM []byte) error {
+	key, err := parseRSAPublicKey(publicKeyPEM)
+	if err != nil {
+		return err
+	}
+	digest := sha256.Sum256(prekey)
+	if err := rsa.VerifyPSS(key, crypto.SHA256, digest[:], signature, nil); err != nil {
+		return ErrInvalidPrekeySignature
+	}
+	return nil
+}
+
+// StartChain begins a sending chain to a recipient's prekey. It returns the
+// ephemeral public key to send along with the messages and the first chain
+// key; the ephemeral private key is discarded. context identifies the
+// conversation and parties, and must be the same on both sides.
+func StartChain(recipientPrekey, context []byte) (ephemeralPublicKey, chainKey []byte, err error) {
+	peer, err := ecdh.X25519().NewPublicKey(recipientPrekey)
+	if err != nil {
+		return nil, nil, err
+	}
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	chainKey, err = rootChainKey(ephemeral, peer, context)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ephemeral.PublicKey().Bytes(), chainKey, nil
+}
+
+// ReceiveChain recomputes the first chain key of a chain started by
+// StartChain, from the recipient's prekey private key.
+func ReceiveChain(prekeyPrivateKey, ephemeralPublicKey, context []byte) ([]byte, error) {
+	key, err := ecdh.X25519().NewPrivateKey(prekeyPrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	peer, err := ecdh.X25519().NewPublicKey(ephemeralPublicKey)
+	if err != nil {
+		return nil, err
+	}
+	return rootChainKey(key, peer, context)
+}
+
+func rootChainKey(key *ecdh.PrivateKey, peer *ecdh.PublicKey, context []byte) ([]byte, error) {
+	shared, err := key.ECDH(peer)
+	if err != nil {
+		return nil, err
+	}
+	return hkdf.Key(sha256.New, shared, nil, ratchetInfo+string(context), ChainKeySize)
+}
+
+// ChainStep advances a chain key, returning the message key for the current
+// position and the chain key for the next one.
+func ChainStep(chainKey []byte) (messageKey, nextChainKey []byte) {
+	mac := hmac.New(sha256.New, chainKey)
+	mac.Write([]byte{1})
+	messageKey = mac.Sum(nil)
+	mac.Reset()
+	mac.Write([]byte{2})
+	return messageKey, mac.Sum(nil)
+}
+
+// MessageKeyAt returns the message key at position counter of the chain
+// starting with chainKey. It takes counter+1 steps; callers reading a chain
+// in order should keep the chain key and step it with ChainStep instead.
+func MessageKeyAt(chainKey []byte, counter uint32) []byte {
+	var messageKey []byte
+	for i := uint32(0); i <= counter; i++ {
+		messageKey, chainKey = ChainStep(chainKey)
+	}
+	return messageKey
+}
+
+// RatchetContext returns the context binding a chain to a conversation, its
+// sender and its recipient.
+func RatchetContext(conversationID, senderID, recipientID uint) []byte {
+	buf := make([]byte, 0, 24)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(conversationID))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(senderID))
+	return binary.BigEndian.AppendUint64(buf, uint64(recipientID))
+}
+
+// SealWithKey encrypts plaintext with a 32-byte key using AES-256-GCM.
+func SealWithKey(key, plaintext []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// OpenWithKey decrypts data produced by SealWithKey.
+func OpenWithKey(key, ciphertext []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, sealed := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+	return aead.Open(nil, nonce, sealed, nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// EncryptRatchetKey encrypts a prekey private key or chain key to a secmail
+// public key with RSA-OAEP.
+func EncryptRatchetKey(key, publicKeyPEM []byte) ([]byte, error) {
+	rsaPub, err := parseRSAPublicKey(publicKeyPEM)
+	if err != nil {
+		return nil, err
+	}
+	return rsa.EncryptOAEP(sha256.New(), rand.Reader, rsaPub, key, nil)
+}
+
+// DecryptRatchetKey decrypts a key encrypted by EncryptRatchetKey.
+func DecryptRatchetKey(encrypted, privateKeyPEM []byte) ([]byte, error) {
+	rsaPriv, err := parseRSAPrivateKey(privateKeyPEM)
+	if err != nil {
+		return nil, err
+	}
+	return rsa.DecryptOAEP(sha256.New(), rand.Reader, rsaPriv, encrypted, nil)
+}
@@ -0,0 +1,49 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"strings"
+)
+
+// recoveryPhraseBytes is the entropy of a recovery phrase (160 bits).
+const recoveryPhraseBytes = 20
+
+// oneTimePassphraseBytes is the entropy of a one-time passphrase (80 bits),
+// short enough to be read out over the phone.
+const oneTimePassphraseBytes = 10
+
+// GenerateRecoveryPhrase returns a random recovery phrase formatted as groups
+// of four base32 characters, e.g. "ABCD-EFGH-...".
+func GenerateRecoveryPhrase() (string, error) {
+	return groupedBase32(recoveryPhraseBytes)
+}
+
+// GenerateOneTimePassphrase returns a random passphrase for a single use,
+// such as opening a secure message link, formatted like a recovery phrase.
+func GenerateOneTimePassphrase() (string, error) {
+	return groupedBase32(oneTimePassphraseBytes)
+}
+
+func groupedBase32(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	encoded := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b)
+
+	groups := make([]string, 0, len(encoded)/4+1)
+	for i := 0; i < len(encoded); i += 4 {
+		groups = append(groups, encoded[i:min(i+4, len(encoded))])
+	}
+	return strings.Join(groups, "-"), nil
+}
+
+// NormalizeRecoveryPhrase canonicalizes user input so that case, spaces and
+// dashes do not matter when unwrapping with a recovery phrase or one-time
+// passphrase.
+func NormalizeRecoveryPhrase(phrase string) string {
+	phrase = strings.ToUpper(phrase)
+	phrase = strings.NewReplacer("-", "", " ", "", "\t", "", "\n", "").Replace(phrase)
+	return phrase
+}
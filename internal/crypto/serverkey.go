@@ -0,0 +1,55 @@
+package crypto
+
+import (
+	"bytes"
+	"io"
+
+	"filippo.io/age"
+)
+
+// GenerateServerKey returns a new age X25519 secret key ("AGE-SECRET-KEY-1...")
+// used to seal data the server itself must be able to read later, such as
+// queued outbound mail.
+func GenerateServerKey() (string, error) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		return "", err
+	}
+	return identity.String(), nil
+}
+
+// SealWithServerKey encrypts plaintext to the public half of an age X25519
+// secret key.
+func SealWithServerKey(plaintext []byte, secretKey string) ([]byte, error) {
+	identity, err := age.ParseX25519Identity(secretKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	w, err := age.Encrypt(&buf, identity.Recipient())
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(plaintext); err != nil {
+		return nil, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// OpenWithServerKey decrypts data produced by SealWithServerKey.
+func OpenWithServerKey(ciphertext []byte, secretKey string) ([]byte, error) {
+	identity, err := age.ParseX25519Identity(secretKey)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := age.Decrypt(bytes.NewReader(ciphertext), identity)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
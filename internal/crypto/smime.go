@@ -0,0 +1,222 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/smallstep/pkcs7"
+)
+
+// Results of verifying an S/MIME signature.
+const (
+	SMIMESignatureValid     = "valid"
+	SMIMESignatureInvalid   = "invalid"
+	SMIMESignatureUntrusted = "untrusted"
+)
+
+// SMIMEMicalg is the multipart/signed micalg matching SignSMIME's digest.
+const SMIMEMicalg = "sha-256"
+
+func init() {
+	// The package default is DES-CBC; AES-256-CBC is what mail clients expect
+	pkcs7.ContentEncryptionAlgorithm = pkcs7.EncryptionAlgorithmAES256CBC
+}
+
+// CertificateInfo describes an X.509 certificate.
+type CertificateInfo struct {
+	Fingerprint string // SHA-256 of the DER encoding
+	Algorithm   string // Of the certified key
+	Subject     string
+	Emails      []string
+	NotBefore   time.Time
+	NotAfter    time.Time
+}
+
+// CreateSelfSignedCertificate issues a self-signed S/MIME certificate for
+// email over an existing key pair from GenerateRSAKeyPair.
+func CreateSelfSignedCertificate(publicKeyPEM, privateKeyPEM []byte, email string, validFor time.Duration) ([]byte, error) {
+	pub, err := parseRSAPublicKey(publicKeyPEM)
+	if err != nil {
+		return nil, err
+	}
+	priv, err := parseRSAPrivateKey(privateKeyPEM)
+	if err != nil {
+		return nil, err
+	}
+	if !priv.PublicKey.Equal(pub) {
+		return nil, errors.New("private key does not match public key")
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:   serial,
+		Subject:        pkix.Name{CommonName: email},
+		EmailAddresses: []string{email},
+		NotBefore:      now.Add(-time.Hour),
+		NotAfter:       now.Add(validFor),
+		KeyUsage:       x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageEmailProtection},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, pub, priv)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), nil
+}
+
+// ParseCertificate parses a PEM X.509 certificate and summarizes it.
+func ParseCertificate(certPEM []byte) (*x509.Certificate, CertificateInfo, error) {
+	block, _ := pem.Decode(certPEM)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, CertificateInfo{}, errors.New("not a PEM certificate")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, CertificateInfo{}, err
+	}
+
+	sum := sha256.Sum256(cert.Raw)
+	info := CertificateInfo{
+		Fingerprint: strings.ToUpper(hex.EncodeToString(sum[:])),
+		Algorithm:   keyAlgorithm(cert.PublicKey),
+		Subject:     cert.Subject.String(),
+		NotBefore:   cert.NotBefore,
+		NotAfter:    cert.NotAfter,
+	}
+	for _, addr := range cert.EmailAddresses {
+		info.Emails = append(info.Emails, strings.ToLower(addr))
+	}
+	return cert, info, nil
+}
+
+// CertificateMatchesKey reports whether the certificate certifies the RSA
+// public key in publicKeyPEM.
+func CertificateMatchesKey(certPEM, publicKeyPEM []byte) bool {
+	cert, _, err := ParseCertificate(certPEM)
+	if err != nil {
+		return false
+	}
+	pub, err := parseRSAPublicKey(publicKeyPEM)
+	if err != nil {
+		return false
+	}
+	certPub, ok := cert.PublicKey.(*rsa.PublicKey)
+	return ok && certPub.Equal(pub)
+}
+
+// LoadTrustStore reads a PEM bundle of CA certificates used to verify
+// S/MIME signatures.
+func LoadTrustStore(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.New("no certificates found in " + path)
+	}
+	return pool, nil
+}
+
+// EncryptSMIME returns a DER CMS EnvelopedData of content for the PEM
+// certificates.
+func EncryptSMIME(content []byte, certsPEM [][]byte) ([]byte, error) {
+	var certs []*x509.Certificate
+	for _, certPEM := range certsPEM {
+		cert, _, err := ParseCertificate(certPEM)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no S/MIME recipients")
+	}
+	return pkcs7.Encrypt(content, certs)
+}
+
+// DecryptSMIME opens a DER CMS EnvelopedData with the recipient's certificate
+// and RSA private key.
+func DecryptSMIME(der, certPEM, privateKeyPEM []byte) ([]byte, error) {
+	cert, _, err := ParseCertificate(certPEM)
+	if err != nil {
+		return nil, err
+	}
+	priv, err := parseRSAPrivateKey(privateKeyPEM)
+	if err != nil {
+		return nil, err
+	}
+	p7, err := pkcs7.Parse(der)
+	if err != nil {
+		return nil, err
+	}
+	return p7.Decrypt(cert, priv)
+}
+
+// SignSMIME returns a DER CMS SignedData over content, signed with SHA-256.
+// A detached signature does not embed content.
+func SignSMIME(content, certPEM, privateKeyPEM []byte, detached bool) ([]byte, error) {
+	cert, _, err := ParseCertificate(certPEM)
+	if err != nil {
+		return nil, err
+	}
+	priv, err := parseRSAPrivateKey(privateKeyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	sd, err := pkcs7.NewSignedData(content)
+	if err != nil {
+		return nil, err
+	}
+	sd.SetDigestAlgorithm(pkcs7.OIDDigestAlgorithmSHA256)
+	if err := sd.AddSigner(cert, priv, pkcs7.SignerInfoConfig{}); err != nil {
+		return nil, err
+	}
+	if detached {
+		sd.Detach()
+	}
+	return sd.Finish()
+}
+
+// VerifySMIME checks a DER CMS SignedData. content is the signed data for a
+// detached signature and nil for an embedded one. It returns the signed
+// content, one of the SMIMESignature* values and the signer's address. A
+// correct signature whose certificate does not chain to roots is untrusted.
+func VerifySMIME(der, content []byte, roots *x509.CertPool) (signed []byte, status, signer string) {
+	p7, err := pkcs7.Parse(der)
+	if err != nil {
+		return nil, SMIMESignatureInvalid, ""
+	}
+	if content != nil {
+		p7.Content = content
+	}
+	if cert := p7.GetOnlySigner(); cert != nil && len(cert.EmailAddresses) > 0 {
+		signer = strings.ToLower(cert.EmailAddresses[0])
+	}
+
+	if err := p7.Verify(); err != nil {
+		return p7.Content, SMIMESignatureInvalid, signer
+	}
+	if roots == nil {
+		roots = x509.NewCertPool()
+	}
+	if err := p7.VerifyWithChain(roots); err != nil {
+		return p7.Content, SMIMESignatureUntrusted, signer
+	}
+	return p7.Content, SMIMESignatureValid, signer
+}
@@ -0,0 +1,395 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math/bits"
+	"strings"
+	"time"
+)
+
+// The key transparency log is a Merkle tree as defined by RFC 9162 (Certificate
+// Transparency 2.0) section 2.1 over key publication records. The functions
+// here are used both by the server to build proofs and by clients to audit
+// them.
+
+var (
+	// ErrInvalidProof is returned when an inclusion or consistency proof
+	// does not match the tree heads it is checked against.
+	ErrInvalidProof = errors.New("invalid Merkle proof")
+	// ErrInvalidTreeHead is returned when a tree head signature does not
+	// verify.
+	ErrInvalidTreeHead = errors.New("invalid tree head signature")
+	// ErrKeyLogMismatch is returned when a log entry does not publish the
+	// expected key for an address.
+	ErrKeyLogMismatch = errors.New("log entry does not match the key")
+)
+
+// treeHeadContext prefixes the signed data of tree heads so the signature
+// cannot be mistaken for one over anything else.
+const treeHeadContext = "secmail key transparency tree head v1\n"
+
+// KeyLogLeaf is one entry of the key transparency log: the publication of a
+// version of a user's public key. The address is only logged as a hash.
+type KeyLogLeaf struct {
+	AddressHash string `json:"address_hash"` // KeyLogAddressHash of the user's address
+	KeyVersion  int    `json:"key_version"`
+	PublicKey   string `json:"public_key"` // PEM-encoded secmail public key
+	Timestamp   int64  `json:"timestamp"`  // Unix seconds
+}
+
+// NewKeyLogLeaf returns the encoded log entry publishing publicKey as version
+// keyVersion of the key of address.
+func NewKeyLogLeaf(address string, keyVersion int, publicKeyPEM []byte, publishedAt time.Time) ([]byte, error) {
+	return json.Marshal(KeyLogLeaf{
+		AddressHash: KeyLogAddressHash(address),
+		KeyVersion:  keyVersion,
+		PublicKey:   string(publicKeyPEM),
+		Timestamp:   publishedAt.Unix(),
+	})
+}
+
+// ParseKeyLogLeaf decodes a log entry.
+func ParseKeyLogLeaf(leaf []byte) (*KeyLogLeaf, error) {
+	var parsed KeyLogLeaf
+	if err := json.Unmarshal(leaf, &parsed); err != nil {
+		return nil, err
+	}
+	return &parsed, nil
+}
+
+// KeyLogAddressHash returns the hex-encoded SHA-256 of the lowercased address,
+// which identifies a user in the log.
+func KeyLogAddressHash(address string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(address))))
+	return hex.EncodeToString(sum[:])
+}
+
+// LeafHash returns the Merkle tree hash of a log entry.
+func LeafHash(leaf []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{0})
+	h.Write(leaf)
+	return h.Sum(nil)
+}
+
+// nodeHash returns the Merkle tree hash of an interior node.
+func nodeHash(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{1})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// splitPoint returns the largest power of two smaller than n, for n > 1.
+func splitPoint(n int) int {
+	k := 1
+	for k<<1 < n {
+		k <<= 1
+	}
+	return k
+}
+
+// MerkleTree is a growing log's Merkle tree. It keeps the hash of every
+// complete subtree, so the root and proofs of any tree size up to Size are
+// computed from O(log n) stored hashes instead of rehashing every leaf.
+type MerkleTree struct {
+	// levels[h][i] is the hash of the complete subtree of 2^h leaves
+	// starting at leaf i<<h
+	levels [][][]byte
+}
+
+// NewMerkleTree returns the tree with the given leaf hashes.
+func NewMerkleTree(leafHashes [][]byte) *MerkleTree {
+	t := &MerkleTree{}
+	for _, leafHash := range leafHashes {
+		t.Append(leafHash)
+	}
+	return t
+}
+
+// Size returns the number of leaves in the tree.
+func (t *MerkleTree) Size() int {
+	if len(t.levels) == 0 {
+		return 0
+	}
+	return len(t.levels[0])
+}
+
+// Append adds a leaf hash to the tree along with the subtrees it completes.
+func (t *MerkleTree) Append(leafHash []byte) {
+	if len(t.levels) == 0 {
+		t.levels = [][][]byte{nil}
+	}
+	t.levels[0] = append(t.levels[0], leafHash)
+	for h := 0; len(t.levels[h])%2 == 0; h++ {
+		if h+1 == len(t.levels) {
+			t.levels = append(t.levels, nil)
+		}
+		n := len(t.levels[h])
+		t.levels[h+1] = append(t.levels[h+1], nodeHash(t.levels[h][n-2], t.levels[h][n-1]))
+	}
+}
+
+// Root returns the root hash of the tree of the first size leaves.
+func (t *MerkleTree) Root(size int) []byte {
+	return t.hash(0, size)
+}
+
+// InclusionProof returns the audit path of leaf index in the tree of the
+// first size leaves.
+func (t *MerkleTree) InclusionProof(index, size int) [][]byte {
+	return t.inclusion(0, size, index)
+}
+
+// ConsistencyProof returns the proof that the tree of the first first leaves
+// is a prefix of the tree of the first second leaves.
+func (t *MerkleTree) ConsistencyProof(first, second int) [][]byte {
+	if first <= 0 || first >= second {
+		return [][]byte{}
+	}
+	return t.subProof(0, second, first, true)
+}
+
+// hash returns the root hash of the subtree of leaves start to end. Every
+// subtree of the RFC 9162 tree starts at a multiple of its size rounded up
+// to a power of two, so complete subtrees are found in levels.
+func (t *MerkleTree) hash(start, end int) []byte {
+	n := end - start
+	if n == 0 {
+		sum := sha256.Sum256(nil)
+		return sum[:]
+	}
+	if n&(n-1) == 0 {
+		h := bits.TrailingZeros(uint(n))
+		return t.levels[h][start>>h]
+	}
+	k := splitPoint(n)
+	return nodeHash(t.hash(start, start+k), t.hash(start+k, end))
+}
+
+func (t *MerkleTree) inclusion(start, end, index int) [][]byte {
+	n := end - start
+	if n <= 1 {
+		return [][]byte{}
+	}
+	k := splitPoint(n)
+	if index < k {
+		return append(t.inclusion(start, start+k, index), t.hash(start+k, end))
+	}
+	return append(t.inclusion(start+k, end, index-k), t.hash(start, start+k))
+}
+
+func (t *MerkleTree) subProof(start, end, m int, complete bool) [][]byte {
+	n := end - start
+	if m == n {
+		if complete {
+			return [][]byte{}
+		}
+		return [][]byte{t.hash(start, end)}
+	}
+	k := splitPoint(n)
+	if m <= k {
+		return append(t.subProof(start, start+k, m, complete), t.hash(start+k, end))
+	}
+	return append(t.subProof(start+k, end, m-k, false), t.hash(start, start+k))
+}
+
+// MerkleRoot returns the root hash of the tree with the given leaf hashes.
+func MerkleRoot(leafHashes [][]byte) []byte {
+	return NewMerkleTree(leafHashes).Root(len(leafHashes))
+}
+
+// InclusionProof returns the audit path of leaf index in the tree with the
+// given leaf hashes.
+func InclusionProof(leafHashes [][]byte, index int) [][]byte {
+	return NewMerkleTree(leafHashes).InclusionProof(index, len(leafHashes))
+}
+
+// ConsistencyProof returns the proof that the tree of the first size leaves
+// is a prefix of the tree with the given leaf hashes.
+func ConsistencyProof(leafHashes [][]byte, size int) [][]byte {
+	return NewMerkleTree(leafHashes).ConsistencyProof(size, len(leafHashes))
+}
+
+// VerifyInclusion checks that leafHash is leaf index of the tree of the given
+// size with root hash root (RFC 9162 section 2.1.3.2).
+func VerifyInclusion(leafHash []byte, index, size uint64, proof [][]byte, root []byte) error {
+	if index >= size {
+		return ErrInvalidProof
+	}
+	fn, sn := index, size-1
+	r := leafHash
+	for _, p := range proof {
+		if sn == 0 {
+			return ErrInvalidProof
+		}
+		if fn&1 == 1 || fn == sn {
+			r = nodeHash(p, r)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			r = nodeHash(r, p)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	if sn != 0 || !bytes.Equal(r, root) {
+		return ErrInvalidProof
+	}
+	return nil
+}
+
+// VerifyConsistency checks that the tree of size first with root hash
+// firstRoot is a prefix of the tree of size second with root hash secondRoot
+// (RFC 9162 section 2.1.4.2).
+func VerifyConsistency(first, second uint64, firstRoot, secondRoot []byte, proof [][]byte) error {
+	switch {
+	case first > second:
+		return ErrInvalidProof
+	case first == second:
+		if len(proof) != 0 || !bytes.Equal(firstRoot, secondRoot) {
+			return ErrInvalidProof
+		}
+		return nil
+	case first == 0:
+		// The empty tree is a prefix of every tree
+		if len(proof) != 0 {
+			return ErrInvalidProof
+		}
+		return nil
+	}
+	if first&(first-1) == 0 {
+		proof = append([][]byte{firstRoot}, proof...)
+	}
+	if len(proof) == 0 {
+		return ErrInvalidProof
+	}
+
+	fn, sn := first-1, second-1
+	for fn&1 == 1 {
+		fn >>= 1
+		sn >>= 1
+	}
+	fr, sr := proof[0], proof[0]
+	for _, c := range proof[1:] {
+		if sn == 0 {
+			return ErrInvalidProof
+		}
+		if fn&1 == 1 || fn == sn {
+			fr = nodeHash(c, fr)
+			sr = nodeHash(c, sr)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			sr = nodeHash(sr, c)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	if sn != 0 || !bytes.Equal(fr, firstRoot) || !bytes.Equal(sr, secondRoot) {
+		return ErrInvalidProof
+	}
+	return nil
+}
+
+// TreeHead is a signed statement of the size and root hash of the log at a
+// point in time.
+type TreeHead struct {
+	TreeSize  uint64 `json:"tree_size"`
+	Timestamp int64  `json:"timestamp"` // Unix milliseconds
+	RootHash  []byte `json:"root_hash"`
+	Signature []byte `json:"signature"`
+}
+
+// signedData returns the bytes covered by the tree head signature.
+func (h *TreeHead) signedData() []byte {
+	buf := make([]byte, 0, len(treeHeadContext)+16+len(h.RootHash))
+	buf = append(buf, treeHeadContext...)
+	buf = binary.BigEndian.AppendUint64(buf, h.TreeSize)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(h.Timestamp))
+	return append(buf, h.RootHash...)
+}
+
+// SignTreeHead signs head with the log's private key.
+func SignTreeHead(head *TreeHead, logKey ed25519.PrivateKey) {
+	head.Signature = ed25519.Sign(logKey, head.signedData())
+}
+
+// VerifyTreeHead checks the signature of head against the log's public key.
+func VerifyTreeHead(head *TreeHead, logPublicKey ed25519.PublicKey) error {
+	if len(logPublicKey) != ed25519.PublicKeySize || !ed25519.Verify(logPublicKey, head.signedData(), head.Signature) {
+		return ErrInvalidTreeHead
+	}
+	return nil
+}
+
+// AuditKey checks that the log, as of the signed tree head, publishes
+// publicKeyPEM for address in the entry leaf at index, proven by the
+// inclusion proof. It returns the parsed entry. Clients call it before
+// encrypting to a key the server handed them; combined with consistency
+// proofs between the tree heads they have seen, a key swapped by the
+// server becomes visible in the log.
+func AuditKey(logPublicKey ed25519.PublicKey, head *TreeHead, leaf []byte, index uint64, proof [][]byte, address string, publicKeyPEM []byte) (*KeyLogLeaf, error) {
+	if err := VerifyTreeHead(head, logPublicKey); err != nil {
+		return nil, err
+	}
+	if err := VerifyInclusion(LeafHash(leaf), index, head.TreeSize, proof, head.RootHash); err != nil {
+		return nil, err
+	}
+	entry, err := ParseKeyLogLeaf(leaf)
+	if err != nil {
+		return nil, err
+	}
+	if entry.AddressHash != KeyLogAddressHash(address) || !samePublicKey([]byte(entry.PublicKey), publicKeyPEM) {
+		return nil, ErrKeyLogMismatch
+	}
+	return entry, nil
+}
+
+// samePublicKey reports whether two PEM public keys are the same key.
+func samePublicKey(a, b []byte) bool {
+	infoA, err := DescribePublicKey(a)
+	if err != nil {
+		return false
+	}
+	infoB, err := DescribePublicKey(b)
+	if err != nil {
+		return false
+	}
+	return infoA.Fingerprint == infoB.Fingerprint
+}
+
+// GenerateLogKey returns a new base64-encoded Ed25519 seed for signing tree
+// heads.
+func GenerateLogKey() (string, error) {
+	seed := make([]byte, ed25519.SeedSize)
+	if _, err := rand.Read(seed); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(seed), nil
+}
+
+// ParseLogKey decodes a key produced by GenerateLogKey.
+func ParseLogKey(encoded string) (ed25519.PrivateKey, error) {
+	seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, err
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, errors.New("log key must be a base64-encoded 32-byte Ed25519 seed")
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
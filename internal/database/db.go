@@ -3,6 +3,7 @@ package database
 import (
 	"secmail/internal/email"
 	"secmail/internal/models"
+	"secmail/internal/relay"
 
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
@@ -15,11 +16,30 @@ func InitDB(dsn string) (*gorm.DB, error) {
 		return nil, err
 	}
 
-	// Auto-migrate the schema
-	err = db.AutoMigrate(&models.User{}, &email.Message{})
-	if err != nil {
+	if err := migrate(db); err != nil {
 		return nil, err
 	}
 
 	return db, nil
 }
+
+// migrate auto-migrates the schema in one transaction, so that data
+// migrations depending on the schema it started from run exactly once.
+func migrate(db *gorm.DB) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		// Accounts created before email verification was required are
+		// treated as verified; only new accounts must confirm their address
+		backfillVerified := tx.Migrator().HasTable(&models.User{}) && !tx.Migrator().HasColumn(&models.User{}, "EmailVerifiedAt")
+
+		// Auto-migrate the schema
+		err := tx.AutoMigrate(&models.User{}, &models.PasswordResetToken{}, &models.LoginAttempt{}, &email.Message{}, &relay.OutboundMessage{}, &models.PGPKey{}, &models.PGPContactKey{}, &models.SMIMEContactCert{}, &models.MessageFlags{}, &models.MessageChange{}, &models.UserKey{}, &models.KeyLogEntry{}, &models.Prekey{}, &models.SendingChain{}, &models.Group{}, &models.GroupMember{}, &models.GroupEpochKey{}, &models.MailingList{}, &models.MailingListMember{}, &models.MailingListPost{}, &models.MailboxDelegate{}, &models.MailboxAuditEvent{}, &models.Contact{}, &models.SecureLink{})
+		if err != nil {
+			return err
+		}
+
+		if backfillVerified {
+			return tx.Exec("UPDATE users SET email_verified_at = created_at WHERE email_verified_at IS NULL").Error
+		}
+		return nil
+	})
+}
@@ -0,0 +1,52 @@
+package database
+
+import (
+	"path/filepath"
+	"secmail/internal/models"
+	"testing"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func TestMigrateBackfillsVerification(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "secmail.db")), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+
+	// A users table from before email verification
+	if err := db.Exec("CREATE TABLE users (id integer PRIMARY KEY, email text NOT NULL UNIQUE, password_hash text NOT NULL, public_key blob NOT NULL, private_key blob NOT NULL, recovery_key blob, created_at datetime, updated_at datetime, deleted_at datetime)").Error; err != nil {
+		t.Fatalf("Failed to create legacy table: %v", err)
+	}
+	if err := db.Exec("INSERT INTO users (email, password_hash, public_key, private_key, created_at) VALUES ('alice@secmail.test', 'x', 'pub', 'priv', CURRENT_TIMESTAMP)").Error; err != nil {
+		t.Fatalf("Failed to create legacy user: %v", err)
+	}
+
+	if err := migrate(db); err != nil {
+		t.Fatalf("Failed to migrate: %v", err)
+	}
+	var existing models.User
+	if err := db.Where("email = ?", "alice@secmail.test").First(&existing).Error; err != nil {
+		t.Fatalf("Failed to load user: %v", err)
+	}
+	if !existing.IsVerified() {
+		t.Error("Existing user should be verified by the migration")
+	}
+
+	// Later migrations leave new, unverified accounts alone
+	pending := models.User{Email: "bob@secmail.test", PasswordHash: "x", PublicKey: []byte("pub"), PrivateKey: []byte("priv")}
+	if err := db.Create(&pending).Error; err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	if err := migrate(db); err != nil {
+		t.Fatalf("Failed to migrate again: %v", err)
+	}
+	if err := db.Where("id = ?", pending.ID).First(&pending).Error; err != nil {
+		t.Fatalf("Failed to load user: %v", err)
+	}
+	if pending.IsVerified() {
+		t.Error("New user should stay pending after a later migration")
+	}
+}
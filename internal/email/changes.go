@@ -0,0 +1,53 @@
+package email
+
+import (
+	"secmail/internal/models"
+
+	"gorm.io/gorm"
+)
+
+// Kinds of MessageChange.
+const (
+	ChangeCreated   = "created"
+	ChangeUpdated   = "updated"
+	ChangeDestroyed = "destroyed"
+)
+
+// LatestChange returns the ID of the user's latest message change, or 0 when
+// nothing has changed yet.
+func LatestChange(userID uint, db *gorm.DB) (uint, error) {
+	var latest uint
+	err := db.Model(&models.MessageChange{}).Where("user_id = ?", userID).
+		Select("COALESCE(MAX(id), 0)").Scan(&latest).Error
+	return latest, err
+}
+
+// ChangesSince returns up to limit of the user's message changes after the
+// change with ID since, oldest first. A limit of 0 returns all of them.
+func ChangesSince(userID, since uint, limit int, db *gorm.DB) ([]models.MessageChange, error) {
+	query := db.Where("user_id = ? AND id > ?", userID, since).Order("id")
+	if limit > 0 {
+		query = query.Limit(limit)
+	}
+	var changes []models.MessageChange
+	if err := query.Find(&changes).Error; err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+// recordChange logs a change to a message for each user who can see it.
+func recordChange(db *gorm.DB, userIDs []uint, messageID uint, kind string) error {
+	seen := make(map[uint]bool, len(userIDs))
+	for _, userID := range userIDs {
+		if seen[userID] {
+			continue
+		}
+		seen[userID] = true
+		change := models.MessageChange{UserID: userID, MessageID: messageID, Kind: kind}
+		if err := db.Create(&change).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,414 @@
+package email
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/mail"
+	"secmail/internal/crypto"
+	"secmail/internal/models"
+	"slices"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Limits on address book entries. They are checked here rather than only
+// in request binding because vCard imports bypass it.
+const (
+	maxContactName   = 100
+	maxContactEmails = 20
+	maxContactNotes  = 2000
+)
+
+var (
+	ErrContactNotFound    = errors.New("contact not found")
+	ErrInvalidContact     = errors.New("invalid contact")
+	ErrEmptyContact       = errors.New("a contact needs a name or an email address")
+	ErrInvalidFingerprint = errors.New("a key fingerprint is 64 hexadecimal digits")
+	ErrNoPublishedKey     = errors.New("none of the contact's addresses has a published key")
+)
+
+// ContactData is the encrypted content of an address book entry.
+// PinnedFingerprint is the fingerprint of the secmail key the user expects
+// the contact to have (see crypto.PublicKeyInfo).
+type ContactData struct {
+	Name              string   `json:"name"`
+	Emails            []string `json:"emails"`
+	Notes             string   `json:"notes"`
+	PinnedFingerprint string   `json:"pinned_fingerprint"`
+}
+
+// ContactInfo is a decrypted address book entry with the keys its local
+// addresses publish. KeyChanged warns that one of them differs from the
+// pinned fingerprint.
+type ContactInfo struct {
+	ID uint
+	ContactData
+	Keys       []ContactKey
+	KeyChanged bool
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+}
+
+// ContactKey is the key a local user publishes under one of a contact's
+// addresses.
+type ContactKey struct {
+	Email       string
+	UserID      uint
+	Fingerprint string
+	Pinned      bool
+}
+
+// ContactSuggestion is an autocompletion of a recipient from the address
+// book. UserID is set when the address belongs to a local user.
+type ContactSuggestion struct {
+	ContactID uint
+	Name      string
+	Email     string
+	UserID    uint
+}
+
+// CreateContact adds an entry to the user's address book, encrypted to
+// their current key.
+func CreateContact(userID uint, data ContactData, db *gorm.DB) (*ContactInfo, error) {
+	data, err := normalizeContact(data)
+	if err != nil {
+		return nil, err
+	}
+	var user models.User
+	if err := db.Where("id = ?", userID).First(&user).Error; err != nil {
+		return nil, err
+	}
+	contact, err := sealContact(user, data)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Create(contact).Error; err != nil {
+		return nil, err
+	}
+	return contactInfo(*contact, data, db)
+}
+
+// ImportContacts adds every contact to the user's address book, or none of
+// them if one is invalid. It returns the number of contacts imported.
+func ImportContacts(userID uint, contacts []ContactData, db *gorm.DB) (int, error) {
+	var user models.User
+	if err := db.Where("id = ?", userID).First(&user).Error; err != nil {
+		return 0, err
+	}
+	rows := make([]models.Contact, 0, len(contacts))
+	for i, data := range contacts {
+		data, err := normalizeContact(data)
+		if err != nil {
+			return 0, fmt.Errorf("contact %d: %w", i+1, err)
+		}
+		contact, err := sealContact(user, data)
+		if err != nil {
+			return 0, err
+		}
+		rows = append(rows, *contact)
+	}
+	if len(rows) == 0 {
+		return 0, nil
+	}
+	if err := db.Create(&rows).Error; err != nil {
+		return 0, err
+	}
+	return len(rows), nil
+}
+
+// ListContacts decrypts the user's address book, sorted by creation.
+// privateKey is the user's unwrapped current key.
+func ListContacts(userID uint, privateKey []byte, db *gorm.DB) ([]ContactInfo, error) {
+	contacts, data, err := openContacts(userID, privateKey, db)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]ContactInfo, 0, len(contacts))
+	for i, contact := range contacts {
+		info, err := contactInfo(contact, data[i], db)
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, *info)
+	}
+	return infos, nil
+}
+
+// GetContact decrypts one entry of the user's address book.
+func GetContact(userID, contactID uint, privateKey []byte, db *gorm.DB) (*ContactInfo, error) {
+	contact, data, err := openContact(userID, contactID, privateKey, db)
+	if err != nil {
+		return nil, err
+	}
+	return contactInfo(*contact, *data, db)
+}
+
+// UpdateContact replaces the content of an entry of the user's address book
+// and encrypts it to their current key.
+func UpdateContact(userID, contactID uint, data ContactData, db *gorm.DB) (*ContactInfo, error) {
+	data, err := normalizeContact(data)
+	if err != nil {
+		return nil, err
+	}
+	contact, err := loadContact(db, userID, contactID)
+	if err != nil {
+		return nil, err
+	}
+	var user models.User
+	if err := db.Where("id = ?", userID).First(&user).Error; err != nil {
+		return nil, err
+	}
+	sealed, err := sealContact(user, data)
+	if err != nil {
+		return nil, err
+	}
+	contact.KeyVersion = sealed.KeyVersion
+	contact.EncryptedData = sealed.EncryptedData
+	contact.EncryptedPassphrase = sealed.EncryptedPassphrase
+	if err := db.Save(contact).Error; err != nil {
+		return nil, err
+	}
+	return contactInfo(*contact, data, db)
+}
+
+// DeleteContact removes an entry from the user's address book.
+func DeleteContact(userID, contactID uint, db *gorm.DB) error {
+	result := db.Where("id = ? AND user_id = ?", contactID, userID).Delete(&models.Contact{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrContactNotFound
+	}
+	return nil
+}
+
+// PinContactKey pins the key currently published under the contact's first
+// local address, trusting it from now on.
+func PinContactKey(userID, contactID uint, privateKey []byte, db *gorm.DB) (*ContactInfo, error) {
+	contact, data, err := openContact(userID, contactID, privateKey, db)
+	if err != nil {
+		return nil, err
+	}
+	info, err := contactInfo(*contact, *data, db)
+	if err != nil {
+		return nil, err
+	}
+	if len(info.Keys) == 0 {
+		return nil, ErrNoPublishedKey
+	}
+	data.PinnedFingerprint = info.Keys[0].Fingerprint
+	return UpdateContact(userID, contactID, *data, db)
+}
+
+// AutocompleteContacts returns up to limit addresses from the user's
+// address book whose address, or the name of whose contact, starts with
+// query, ignoring case. Names match at the start of any word.
+func AutocompleteContacts(userID uint, query string, limit int, privateKey []byte, db *gorm.DB) ([]ContactSuggestion, error) {
+	contacts, data, err := openContacts(userID, privateKey, db)
+	if err != nil {
+		return nil, err
+	}
+	query = strings.ToLower(strings.TrimSpace(query))
+	suggestions := []ContactSuggestion{}
+	for i, contact := range contacts {
+		nameMatches := matchesName(data[i].Name, query)
+		for _, address := range data[i].Emails {
+			if len(suggestions) == limit {
+				return suggestions, nil
+			}
+			if !nameMatches && !strings.HasPrefix(address, query) {
+				continue
+			}
+			suggestion := ContactSuggestion{ContactID: contact.ID, Name: data[i].Name, Email: address}
+			localID, err := LookupLocalRecipient(address, db)
+			switch {
+			case err == nil:
+				suggestion.UserID = localID
+			case !errors.Is(err, ErrUnknownRecipient) && !errors.Is(err, ErrRecipientUnverified):
+				return nil, err
+			}
+			suggestions = append(suggestions, suggestion)
+		}
+	}
+	return suggestions, nil
+}
+
+// ExportContacts renders the user's address book as vCards.
+func ExportContacts(userID uint, privateKey []byte, db *gorm.DB) ([]byte, error) {
+	_, data, err := openContacts(userID, privateKey, db)
+	if err != nil {
+		return nil, err
+	}
+	return FormatVCards(data), nil
+}
+
+// ForgetContacts deletes the user's address book, for when their key is
+// discarded and the contacts encrypted to it can no longer be read.
+func ForgetContacts(tx *gorm.DB, userID uint) error {
+	return tx.Where("user_id = ?", userID).Delete(&models.Contact{}).Error
+}
+
+// normalizeContact trims a contact, lowercases and deduplicates its
+// addresses and checks it against the limits. A contact without a name is
+// named after its first address.
+func normalizeContact(data ContactData) (ContactData, error) {
+	normalized := ContactData{
+		Name:  strings.TrimSpace(data.Name),
+		Notes: strings.TrimSpace(data.Notes),
+	}
+	for _, address := range data.Emails {
+		address = strings.ToLower(strings.TrimSpace(address))
+		if address == "" {
+			continue
+		}
+		if parsed, err := mail.ParseAddress(address); err != nil || parsed.Address != address {
+			return ContactData{}, fmt.Errorf("%w: malformed email address %q", ErrInvalidContact, address)
+		}
+		if !slices.Contains(normalized.Emails, address) {
+			normalized.Emails = append(normalized.Emails, address)
+		}
+	}
+	if normalized.Name == "" && len(normalized.Emails) > 0 {
+		normalized.Name = normalized.Emails[0]
+	}
+	if normalized.Name == "" {
+		return ContactData{}, ErrEmptyContact
+	}
+	if len([]rune(normalized.Name)) > maxContactName || len(normalized.Emails) > maxContactEmails || len([]rune(normalized.Notes)) > maxContactNotes {
+		return ContactData{}, fmt.Errorf("%w: a contact has at most %d characters of name, %d addresses and %d characters of notes", ErrInvalidContact, maxContactName, maxContactEmails, maxContactNotes)
+	}
+	if data.PinnedFingerprint != "" {
+		normalized.PinnedFingerprint = normalizeFingerprint(data.PinnedFingerprint)
+		if decoded, err := hex.DecodeString(normalized.PinnedFingerprint); err != nil || len(decoded) != 32 {
+			return ContactData{}, ErrInvalidFingerprint
+		}
+	}
+	return normalized, nil
+}
+
+// normalizeFingerprint uppercases a fingerprint and removes the separators
+// it is often written with.
+func normalizeFingerprint(fingerprint string) string {
+	fingerprint = strings.NewReplacer(" ", "", ":", "", "-", "").Replace(strings.TrimSpace(fingerprint))
+	return strings.ToUpper(fingerprint)
+}
+
+func matchesName(name, query string) bool {
+	for _, word := range strings.Fields(strings.ToLower(name)) {
+		if strings.HasPrefix(word, query) {
+			return true
+		}
+	}
+	return strings.HasPrefix(strings.ToLower(name), query)
+}
+
+// sealContact encrypts a contact to the user's current key.
+func sealContact(user models.User, data ContactData) (*models.Contact, error) {
+	plaintext, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	encryptedData, encryptedPassphrase, err := sealUserKey(plaintext, user.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	return &models.Contact{
+		UserID:              user.ID,
+		KeyVersion:          currentVersion(user),
+		EncryptedData:       encryptedData,
+		EncryptedPassphrase: encryptedPassphrase,
+	}, nil
+}
+
+// openContacts loads and decrypts the user's address book.
+func openContacts(userID uint, privateKey []byte, db *gorm.DB) ([]models.Contact, []ContactData, error) {
+	var contacts []models.Contact
+	if err := db.Where("user_id = ?", userID).Order("id").Find(&contacts).Error; err != nil {
+		return nil, nil, err
+	}
+	keys := newKeyring(userID, privateKey, db)
+	data := make([]ContactData, len(contacts))
+	for i, contact := range contacts {
+		if err := decryptContact(keys, contact, &data[i]); err != nil {
+			return nil, nil, err
+		}
+	}
+	return contacts, data, nil
+}
+
+func openContact(userID, contactID uint, privateKey []byte, db *gorm.DB) (*models.Contact, *ContactData, error) {
+	contact, err := loadContact(db, userID, contactID)
+	if err != nil {
+		return nil, nil, err
+	}
+	var data ContactData
+	if err := decryptContact(newKeyring(userID, privateKey, db), *contact, &data); err != nil {
+		return nil, nil, err
+	}
+	return contact, &data, nil
+}
+
+func decryptContact(keys *keyring, contact models.Contact, data *ContactData) error {
+	key, err := keys.key(contact.KeyVersion)
+	if err != nil {
+		return err
+	}
+	plaintext, err := openSealedKey(contact.EncryptedData, contact.EncryptedPassphrase, key)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(plaintext, data)
+}
+
+// loadContact returns an entry of the user's address book, or
+// ErrContactNotFound.
+func loadContact(db *gorm.DB, userID, contactID uint) (*models.Contact, error) {
+	var contact models.Contact
+	err := db.Where("id = ? AND user_id = ?", contactID, userID).First(&contact).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrContactNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &contact, nil
+}
+
+// contactInfo looks up the keys published under the contact's addresses
+// and compares them with the pinned fingerprint. Addresses of unknown or
+// unverified users have no key.
+func contactInfo(contact models.Contact, data ContactData, db *gorm.DB) (*ContactInfo, error) {
+	info := &ContactInfo{ID: contact.ID, ContactData: data, Keys: []ContactKey{}, CreatedAt: contact.CreatedAt, UpdatedAt: contact.UpdatedAt}
+	if info.Emails == nil {
+		info.Emails = []string{}
+	}
+	for _, address := range data.Emails {
+		userID, err := LookupLocalRecipient(address, db)
+		if errors.Is(err, ErrUnknownRecipient) || errors.Is(err, ErrRecipientUnverified) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var user models.User
+		if err := db.Where("id = ?", userID).First(&user).Error; err != nil {
+			return nil, err
+		}
+		published, err := crypto.DescribePublicKey(user.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		key := ContactKey{Email: address, UserID: userID, Fingerprint: published.Fingerprint}
+		if data.PinnedFingerprint != "" {
+			key.Pinned = key.Fingerprint == data.PinnedFingerprint
+			info.KeyChanged = info.KeyChanged || !key.Pinned
+		}
+		info.Keys = append(info.Keys, key)
+	}
+	return info, nil
+}
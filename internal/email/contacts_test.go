@@ -0,0 +1,111 @@
+package email
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseVCards(t *testing.T) {
+	data := "BEGIN:VCARD\r\n" +
+		"VERSION:3.0\r\n" +
+		"N:Doe;Jane;;Dr.;\r\n" +
+		"item1.EMAIL;TYPE=INTERNET,WORK:jane@example.org\r\n" +
+		"EMAIL:mailto:jane.doe@example.com\r\n" +
+		"NOTE:Met at the conference\\, 2024\\nLikes tea\r\n" +
+		"TEL:+1 555 0100\r\n" +
+		"END:VCARD\r\n" +
+		"BEGIN:VCARD\n" +
+		"VERSION:4.0\n" +
+		"FN:Bob \n" +
+		" Builder\n" +
+		"X-SECMAIL-FINGERPRINT:ab:cd\n" +
+		"END:VCARD\n"
+
+	contacts, err := ParseVCards([]byte(data))
+	if err != nil {
+		t.Fatalf("Failed to parse vCards: %v", err)
+	}
+	expected := []ContactData{
+		{Name: "Dr. Jane Doe", Emails: []string{"jane@example.org", "jane.doe@example.com"}, Notes: "Met at the conference, 2024\nLikes tea"},
+		{Name: "Bob Builder", PinnedFingerprint: "ABCD"},
+	}
+	if !reflect.DeepEqual(contacts, expected) {
+		t.Errorf("Unexpected contacts: %+v", contacts)
+	}
+
+	for _, invalid := range []string{"FN:Nobody\r\n", "BEGIN:VCARD\r\nFN:Open\r\n", "BEGIN:VCARD\r\nno colon\r\nEND:VCARD\r\n"} {
+		if _, err := ParseVCards([]byte(invalid)); !errors.Is(err, ErrInvalidVCard) {
+			t.Errorf("Expected ErrInvalidVCard for %q, got %v", invalid, err)
+		}
+	}
+}
+
+func TestFormatVCardsRoundTrip(t *testing.T) {
+	contacts := []ContactData{{
+		Name:              "Zoë; the \"tester\", esq.",
+		Emails:            []string{"zoe@example.org"},
+		Notes:             strings.Repeat("Long note with ünïcode, ", 10) + "\nsecond line",
+		PinnedFingerprint: strings.Repeat("0123456789ABCDEF", 4),
+	}}
+	formatted := FormatVCards(contacts)
+	for _, line := range strings.Split(strings.TrimSuffix(string(formatted), "\r\n"), "\r\n") {
+		if len(line) > vcardLineLength {
+			t.Errorf("Line longer than %d octets: %q", vcardLineLength, line)
+		}
+	}
+
+	parsed, err := ParseVCards(formatted)
+	if err != nil {
+		t.Fatalf("Failed to parse formatted vCards: %v", err)
+	}
+	if !reflect.DeepEqual(parsed, contacts) {
+		t.Errorf("Round trip changed the contacts: %+v", parsed)
+	}
+}
+
+func TestNormalizeContact(t *testing.T) {
+	fingerprint := strings.Repeat("ab", 32)
+	contact, err := normalizeContact(ContactData{
+		Emails:            []string{" Alice@Example.org", "alice@example.org", ""},
+		PinnedFingerprint: fingerprint[:32] + ":" + fingerprint[32:],
+	})
+	if err != nil {
+		t.Fatalf("Failed to normalize contact: %v", err)
+	}
+	if contact.Name != "alice@example.org" || len(contact.Emails) != 1 || contact.PinnedFingerprint != strings.ToUpper(fingerprint) {
+		t.Errorf("Unexpected contact: %+v", contact)
+	}
+
+	for _, tc := range []struct {
+		contact ContactData
+		err     error
+	}{
+		{ContactData{Name: "  "}, ErrEmptyContact},
+		{ContactData{Name: "Bad", Emails: []string{"not an address"}}, ErrInvalidContact},
+		{ContactData{Name: "Bad", Emails: []string{"Bob <bob@example.org>"}}, ErrInvalidContact},
+		{ContactData{Name: strings.Repeat("x", maxContactName+1)}, ErrInvalidContact},
+		{ContactData{Name: "Bad", PinnedFingerprint: "ABCD"}, ErrInvalidFingerprint},
+	} {
+		if _, err := normalizeContact(tc.contact); !errors.Is(err, tc.err) {
+			t.Errorf("Expected %v for %+v, got %v", tc.err, tc.contact, err)
+		}
+	}
+}
+
+func TestMatchesName(t *testing.T) {
+	for _, tc := range []struct {
+		name, query string
+		match       bool
+	}{
+		{"Jane Doe", "ja", true},
+		{"Jane Doe", "do", true},
+		{"Jane Doe", "jane d", true},
+		{"Jane Doe", "oe", false},
+	} {
+		if matchesName(tc.name, tc.query) != tc.match {
+			t.Errorf("matchesName(%q, %q) = %v", tc.name, tc.query, !tc.match)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package email
+
+import (
+	"path/filepath"
+	"secmail/internal/crypto"
+	"secmail/internal/models"
+	"testing"
+	"time"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// openTestDB opens an empty database with the email package's tables.
+func openTestDB(t *testing.T) *gorm.DB {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "secmail.db")), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	err = db.AutoMigrate(&models.User{}, &Message{}, &models.MessageFlags{}, &models.MessageChange{}, &models.UserKey{},
+		&models.KeyLogEntry{}, &models.Prekey{}, &models.Group{}, &models.GroupMember{}, &models.GroupEpochKey{},
+		&models.MailingList{}, &models.MailingListMember{}, &models.MailingListPost{}, &models.MailboxDelegate{},
+		&models.MailboxAuditEvent{}, &models.PGPKey{}, &models.PGPContactKey{}, &models.SMIMEContactCert{})
+	if err != nil {
+		t.Fatalf("Failed to migrate database: %v", err)
+	}
+	return db
+}
+
+// createTestUser creates a verified user and returns it with its unwrapped
+// private key.
+func createTestUser(t *testing.T, db *gorm.DB, address string) (models.User, []byte) {
+	publicKey, privateKey, err := crypto.GenerateRSAKeyPair()
+	if err != nil {
+		t.Fatalf("Failed to generate key pair: %v", err)
+	}
+	now := time.Now()
+	user := models.User{Email: address, PasswordHash: "x", PublicKey: publicKey, PrivateKey: privateKey, EmailVerifiedAt: &now}
+	if err := db.Create(&user).Error; err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	return user, privateKey
+}
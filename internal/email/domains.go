@@ -0,0 +1,88 @@
+package email
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"secmail/internal/models"
+	"slices"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+var (
+	ErrAddressNotLocal = errors.New("address is not in a local domain")
+	ErrNotAdmin        = errors.New("only administrators can create shared addresses")
+)
+
+// localDomains are the domains secmail receives mail for. Shared mailboxes
+// and lists can only take addresses in them.
+var localDomains []string
+
+// admins are the addresses of the users allowed to create shared mailboxes
+// and lists.
+var admins []string
+
+// ParseLocalDomains parses a comma-separated list of domains.
+func ParseLocalDomains(s string) ([]string, error) {
+	var domains []string
+	for _, domain := range strings.Split(s, ",") {
+		domain = strings.ToLower(strings.TrimSpace(domain))
+		if domain == "" {
+			continue
+		}
+		if strings.ContainsAny(domain, "@ \t") {
+			return nil, fmt.Errorf("invalid local domain %q", domain)
+		}
+		domains = append(domains, domain)
+	}
+	return domains, nil
+}
+
+// SetLocalDomains sets the domains shared mailboxes and lists can be created
+// in. With none, they cannot be created.
+func SetLocalDomains(domains []string) {
+	localDomains = domains
+}
+
+// ParseAdmins parses a comma-separated list of administrator addresses.
+func ParseAdmins(s string) ([]string, error) {
+	var addresses []string
+	for _, address := range strings.Split(s, ",") {
+		address = strings.TrimSpace(address)
+		if address == "" {
+			continue
+		}
+		if _, err := mail.ParseAddress(address); err != nil {
+			return nil, fmt.Errorf("invalid administrator address %q", address)
+		}
+		addresses = append(addresses, strings.ToLower(address))
+	}
+	return addresses, nil
+}
+
+// SetAdmins sets the users allowed to create shared mailboxes and lists.
+func SetAdmins(addresses []string) {
+	admins = addresses
+}
+
+// IsLocalAddress reports whether address is in one of the local domains.
+func IsLocalAddress(address string) bool {
+	at := strings.LastIndex(address, "@")
+	return at >= 0 && slices.Contains(localDomains, strings.ToLower(address[at+1:]))
+}
+
+// checkSharedAddress checks that user may create a shared mailbox or list
+// at the lowercased address: they must be a verified administrator, and the
+// address must be free and in a local domain, so that nobody can claim
+// another organization's address or someone's future mailbox.
+func checkSharedAddress(user models.User, address string, db *gorm.DB) error {
+	if !user.IsVerified() || !slices.Contains(admins, strings.ToLower(user.Email)) {
+		return ErrNotAdmin
+	}
+	if !IsLocalAddress(address) {
+		return ErrAddressNotLocal
+	}
+	return checkAddressFree(address, db)
+}
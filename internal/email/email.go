@@ -5,6 +5,16 @@ import "time"
 type EncryptedKey struct {
 	RecipientID         uint   `json:"recipient_id"`
 	EncryptedPassphrase []byte `json:"encrypted_passphrase"`
+	// KeyVersion is the version of the recipient's key the passphrase is
+	// encrypted to; 0 in messages stored before key rotation, meaning 1.
+	KeyVersion int `json:"key_version,omitempty"`
+	// Ratchet is set for forward secret messages, whose passphrase is wrapped
+	// with a ratchet message key instead of the recipient's key.
+	Ratchet *RatchetHeader `json:"ratchet,omitempty"`
+	// Group is set for the key of a group recipient, whose passphrase is
+	// wrapped with a key derived from the group's epoch secret; RecipientID
+	// is 0.
+	Group *GroupHeader `json:"group,omitempty"`
 }
 
 type Message struct {
@@ -17,6 +27,8 @@ type Message struct {
 	EncryptedAttachments []byte
 	Metadata             string `gorm:"type:text"` // JSON string for additional data
 	Status               string
+	ExpiresAt            *time.Time `gorm:"index"` // Purged by the reaper once passed; nil never expires
+	BurnAfterReading     bool       // Recipients' keys are erased once they read it
 	CreatedAt            time.Time
 	UpdatedAt            time.Time
 	SentAt               time.Time
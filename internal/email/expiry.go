@@ -0,0 +1,162 @@
+package email
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"secmail/internal/models"
+	"slices"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrExpiryInPast = errors.New("expires_at must be in the future")
+	ErrBurnGroups   = errors.New("burn after reading cannot be used with groups, whose members share a key")
+)
+
+// burnedBody replaces the body of a burn-after-reading message for a
+// recipient who has already read it.
+const burnedBody = "[This message was erased after it was read.]"
+
+// Lifetime limits how long the recipients of a message can read it.
+type Lifetime struct {
+	// ExpiresAt is when the message, with its ciphertext and every wrapped
+	// session key, is purged. nil keeps it.
+	ExpiresAt *time.Time
+	// BurnAfterReading erases each recipient's wrapped session key once they
+	// have read the message. The sender keeps theirs.
+	BurnAfterReading bool
+}
+
+// check validates the lifetime of a message addressed to groups or not.
+func (l Lifetime) check(groups bool) error {
+	if l.ExpiresAt != nil && !l.ExpiresAt.After(time.Now()) {
+		return ErrExpiryInPast
+	}
+	if l.BurnAfterReading && groups {
+		return ErrBurnGroups
+	}
+	return nil
+}
+
+// Expired reports whether the message has expired, even if it has not been
+// purged yet.
+func (m Message) Expired() bool {
+	return m.ExpiresAt != nil && !m.ExpiresAt.After(time.Now())
+}
+
+// unexpired filters out expired messages the reaper has not purged yet.
+func unexpired(db *gorm.DB) *gorm.DB {
+	return db.Where("expires_at IS NULL OR expires_at > ?", time.Now())
+}
+
+// burnKey erases the user's wrapped session key of a burn-after-reading
+// message they received, once they have read it.
+func burnKey(db *gorm.DB, msg Message, userID uint) error {
+	if !msg.BurnAfterReading || msg.SenderID == userID {
+		return nil
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		var locked Message
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id", "encrypted_session_keys").Where("id = ?", msg.ID).First(&locked).Error
+		if err != nil {
+			return err
+		}
+		var keys []EncryptedKey
+		if err := json.Unmarshal([]byte(locked.EncryptedSessionKeys), &keys); err != nil {
+			return err
+		}
+		kept := slices.DeleteFunc(slices.Clone(keys), func(key EncryptedKey) bool {
+			return key.RecipientID == userID && key.Group == nil
+		})
+		if len(kept) == len(keys) {
+			return nil
+		}
+		keysJSON, err := json.Marshal(kept)
+		if err != nil {
+			return err
+		}
+		if err := tx.Model(&Message{}).Where("id = ?", msg.ID).Update("encrypted_session_keys", string(keysJSON)).Error; err != nil {
+			return err
+		}
+		return recordChange(tx, []uint{userID}, msg.ID, ChangeUpdated)
+	})
+}
+
+// MarkRead records that the user has read the body of a message, erasing
+// their wrapped session key if it is a burn-after-reading message.
+func MarkRead(userID, messageID uint, db *gorm.DB) error {
+	var msg Message
+	err := db.Select("id", "sender_id", "burn_after_reading").Where("id = ?", messageID).First(&msg).Error
+	if err != nil {
+		return err
+	}
+	return burnKey(db, msg, userID)
+}
+
+// PurgeExpiredMessages deletes expired messages, with their flags and
+// moderation state, and records their destruction for the sender and
+// recipients. It returns the number of messages purged.
+func PurgeExpiredMessages(db *gorm.DB) (int64, error) {
+	var purged int64
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var messages []Message
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id", "sender_id", "recipients_json").
+			Where("expires_at IS NOT NULL AND expires_at <= ?", time.Now()).Find(&messages).Error
+		if err != nil || len(messages) == 0 {
+			return err
+		}
+		ids := make([]uint, 0, len(messages))
+		for _, msg := range messages {
+			ids = append(ids, msg.ID)
+		}
+		if err := tx.Where("message_id IN ?", ids).Delete(&models.MessageFlags{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("message_id IN ?", ids).Delete(&models.MailingListPost{}).Error; err != nil {
+			return err
+		}
+		result := tx.Where("id IN ?", ids).Delete(&Message{})
+		if result.Error != nil {
+			return result.Error
+		}
+		purged = result.RowsAffected
+
+		for _, msg := range messages {
+			var recipients []uint
+			if err := json.Unmarshal([]byte(msg.RecipientsJSON), &recipients); err != nil {
+				return err
+			}
+			if err := recordChange(tx, append([]uint{msg.SenderID}, recipients...), msg.ID, ChangeDestroyed); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return purged, err
+}
+
+// RunMessageReaper purges expired messages and secure links every interval
+// until ctx is cancelled.
+func RunMessageReaper(ctx context.Context, db *gorm.DB, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := PurgeExpiredMessages(db); err != nil {
+			log.Println("Expired message purge failed:", err)
+		}
+		if _, err := PurgeSecureLinks(db); err != nil {
+			log.Println("Secure link purge failed:", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package email
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLifetimeCheck(t *testing.T) {
+	past := time.Now().Add(-time.Minute)
+	future := time.Now().Add(time.Hour)
+	for _, tc := range []struct {
+		lifetime Lifetime
+		groups   bool
+		err      error
+	}{
+		{Lifetime{}, true, nil},
+		{Lifetime{ExpiresAt: &future, BurnAfterReading: true}, false, nil},
+		{Lifetime{ExpiresAt: &past}, false, ErrExpiryInPast},
+		{Lifetime{BurnAfterReading: true}, true, ErrBurnGroups},
+	} {
+		if err := tc.lifetime.check(tc.groups); !errors.Is(err, tc.err) {
+			t.Errorf("Expected %v for %+v (groups %v), got %v", tc.err, tc.lifetime, tc.groups, err)
+		}
+	}
+
+	if (Message{ExpiresAt: &future}).Expired() || !(Message{ExpiresAt: &past}).Expired() || (Message{}).Expired() {
+		t.Error("Unexpected expiry of messages")
+	}
+}
+
+func TestDecryptBurnedMessage(t *testing.T) {
+	msg := Message{
+		SenderID:             1,
+		RecipientsJSON:       "[2]",
+		EncryptedSessionKeys: "[]",
+		Metadata:             `{"subject":"Gone"}`,
+		BurnAfterReading:     true,
+	}
+	body, metadata, err := decryptMessage(msg, 2, nil)
+	if err != nil {
+		t.Fatalf("Failed to decrypt burned message: %v", err)
+	}
+	if string(body) != burnedBody || metadata["subject"] != "Gone" {
+		t.Errorf("Unexpected burned message: %q %v", body, metadata)
+	}
+
+	// Only recipients see the placeholder
+	if _, _, err := decryptMessage(msg, 3, nil); !errors.Is(err, ErrSessionKeyNotFound) {
+		t.Errorf("Expected ErrSessionKeyNotFound for a stranger, got %v", err)
+	}
+	msg.BurnAfterReading = false
+	if _, _, err := decryptMessage(msg, 2, nil); !errors.Is(err, ErrSessionKeyNotFound) {
+		t.Errorf("Expected ErrSessionKeyNotFound without burn after reading, got %v", err)
+	}
+}
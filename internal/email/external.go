@@ -0,0 +1,110 @@
+package email
+
+import (
+	"secmail/internal/models"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// ExternalDelivery is one rendered copy of a message and the external
+// addresses it is sent to.
+type ExternalDelivery struct {
+	Recipients []string
+	Raw        []byte
+}
+
+// ComposeExternal renders the copies of msg sent to external recipients.
+// Recipients with an OpenPGP contact key share one PGP/MIME encrypted copy,
+// the remaining recipients with an S/MIME contact certificate share one S/MIME
+// encrypted copy, and all others share a plain copy. Copies are signed with
+// the sender's OpenPGP key or certificate when privateKey (their unwrapped
+// secmail key) is available.
+func ComposeExternal(msg *Message, subject, body, messageID string, recipients []string, privateKey []byte, db *gorm.DB) ([]ExternalDelivery, error) {
+	var sender models.User
+	if err := db.Where("id = ?", msg.SenderID).First(&sender).Error; err != nil {
+		return nil, err
+	}
+
+	var pgpSigner, smimeCert []byte
+	if privateKey != nil {
+		var err error
+		if pgpSigner, err = userPGPSecretKey(sender.ID, privateKey, db); err != nil {
+			return nil, err
+		}
+		smimeCert = sender.Certificate
+	}
+
+	lowered := make([]string, 0, len(recipients))
+	for _, addr := range recipients {
+		lowered = append(lowered, strings.ToLower(addr))
+	}
+	var pgpContacts []models.PGPContactKey
+	if err := db.Where("user_id = ? AND email IN ?", sender.ID, lowered).Find(&pgpContacts).Error; err != nil {
+		return nil, err
+	}
+	var smimeContacts []models.SMIMEContactCert
+	if err := db.Where("user_id = ? AND email IN ?", sender.ID, lowered).Find(&smimeContacts).Error; err != nil {
+		return nil, err
+	}
+	pgpKeys := make(map[string][]byte, len(pgpContacts))
+	for _, contact := range pgpContacts {
+		pgpKeys[contact.Email] = contact.PublicKey
+	}
+	smimeCerts := make(map[string][]byte, len(smimeContacts))
+	for _, contact := range smimeContacts {
+		smimeCerts[contact.Email] = contact.Certificate
+	}
+
+	var pgpTo, smimeTo, plainTo []string
+	var pgpRecipientKeys, smimeRecipientCerts [][]byte
+	for _, addr := range recipients {
+		if key, ok := pgpKeys[strings.ToLower(addr)]; ok {
+			pgpTo = append(pgpTo, addr)
+			pgpRecipientKeys = append(pgpRecipientKeys, key)
+		} else if cert, ok := smimeCerts[strings.ToLower(addr)]; ok {
+			smimeTo = append(smimeTo, addr)
+			smimeRecipientCerts = append(smimeRecipientCerts, cert)
+		} else {
+			plainTo = append(plainTo, addr)
+		}
+	}
+
+	m := OutgoingMessage{
+		From:      sender.Email,
+		To:        recipients,
+		Subject:   subject,
+		Body:      body,
+		Date:      msg.SentAt,
+		MessageID: messageID,
+	}
+	var deliveries []ExternalDelivery
+	if len(pgpTo) > 0 {
+		raw, err := ComposePGPMIME(m, pgpRecipientKeys, pgpSigner)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, ExternalDelivery{Recipients: pgpTo, Raw: raw})
+	}
+	if len(smimeTo) > 0 {
+		raw, err := ComposeSMIME(m, smimeRecipientCerts, smimeCert, privateKey)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, ExternalDelivery{Recipients: smimeTo, Raw: raw})
+	}
+	if len(plainTo) > 0 {
+		var raw []byte
+		var err error
+		if pgpSigner == nil && smimeCert != nil {
+			raw, err = ComposeSMIME(m, nil, smimeCert, privateKey)
+		} else {
+			raw, err = ComposePGPMIME(m, nil, pgpSigner)
+		}
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, ExternalDelivery{Recipients: plainTo, Raw: raw})
+	}
+	return deliveries, nil
+}
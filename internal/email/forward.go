@@ -0,0 +1,304 @@
+package email
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"secmail/internal/crypto"
+	"secmail/internal/models"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	// ErrConversationNotFound is returned when a forward secret message
+	// continues a conversation the sender is not part of.
+	ErrConversationNotFound = errors.New("conversation not found")
+	// ErrMessageKeyErased is returned internally when the prekey a forward
+	// secret message was sent through, or the group epoch secret it was
+	// sent with, has been erased.
+	ErrMessageKeyErased = errors.New("message key erased")
+)
+
+// erasedBody replaces the body of a message whose prekey or group epoch
+// secret has been erased.
+const erasedBody = "[The key of this message has been erased.]"
+
+// RatchetHeader identifies the message key a forward secret message's
+// passphrase is wrapped with: the recipient's prekey, the ephemeral key
+// that started the chain and the position in the chain.
+type RatchetHeader struct {
+	PrekeyID     uint   `json:"prekey_id"`
+	EphemeralKey []byte `json:"ephemeral_key"`
+	Counter      uint32 `json:"counter"`
+}
+
+// SendForwardSecret sends a message to local recipients with its session
+// passphrase wrapped through per-conversation ratchet chains rather than to
+// their long-lived keys, so a later compromise of those keys does not reveal
+// it once its prekeys have been erased. The sender and every recipient must
+// have forward secrecy enabled. A conversationID of 0 starts a new
+// conversation. privateKey is the sender's unwrapped current key, which
+// protects their sending chains. lifetime limits how long the message stays
+// readable.
+func SendForwardSecret(senderID, conversationID uint, recipients []uint, subject, body string, lifetime Lifetime, privateKey []byte, db *gorm.DB) (*Message, error) {
+	if len(recipients) == 0 {
+		return nil, errors.New("no recipients")
+	}
+	if err := lifetime.check(false); err != nil {
+		return nil, err
+	}
+
+	recipients = uniqueIDs(recipients)
+	var users []models.User
+	if err := db.Where("id IN ?", recipients).Find(&users).Error; err != nil {
+		return nil, err
+	}
+	if len(users) != len(recipients) {
+		return nil, ErrUsersNotFound
+	}
+	var sender models.User
+	if err := db.Where("id = ?", senderID).First(&sender).Error; err != nil {
+		return nil, err
+	}
+	if err := checkVerification(sender, users); err != nil {
+		return nil, err
+	}
+	if !crypto.PrivateKeyMatches(privateKey, sender.PublicKey) {
+		return nil, ErrKeyOutdated
+	}
+	if conversationID != 0 {
+		visible, err := conversationVisible(senderID, conversationID, db)
+		if err != nil {
+			return nil, err
+		}
+		if !visible {
+			return nil, ErrConversationNotFound
+		}
+	}
+
+	// Every key holder, the sender included, needs a prekey signed by their
+	// current key
+	keyHolders := users
+	if !containsUser(users, sender.ID) {
+		keyHolders = append(keyHolders, sender)
+	}
+	prekeys := make(map[uint]*models.Prekey, len(keyHolders))
+	for _, user := range keyHolders {
+		prekey, err := CurrentPrekey(user.ID, db)
+		if err == nil && (prekey.KeyVersion != currentVersion(user) || crypto.VerifyPrekey(prekey.PublicKey, prekey.Signature, user.PublicKey) != nil) {
+			err = ErrForwardSecrecyDisabled
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w for %s", err, user.Email)
+		}
+		prekeys[user.ID] = prekey
+	}
+
+	encryptedBody, passphrase, err := crypto.EncryptBody([]byte(body))
+	if err != nil {
+		return nil, err
+	}
+	recipientsJSON, err := json.Marshal(recipients)
+	if err != nil {
+		return nil, err
+	}
+	metadataJSON, err := json.Marshal(map[string]string{"subject": subject, "forward_secrecy": "true"})
+	if err != nil {
+		return nil, err
+	}
+
+	message := Message{
+		ConversationID:       conversationID,
+		SenderID:             senderID,
+		RecipientsJSON:       string(recipientsJSON),
+		EncryptedBody:        encryptedBody,
+		EncryptedSessionKeys: "[]",
+		Metadata:             string(metadataJSON),
+		Status:               StatusSent,
+		ExpiresAt:            lifetime.ExpiresAt,
+		BurnAfterReading:     lifetime.BurnAfterReading,
+		SentAt:               time.Now(),
+	}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&message).Error; err != nil {
+			return err
+		}
+		// A new conversation is named after its first message
+		if message.ConversationID == 0 {
+			message.ConversationID = message.ID
+		}
+
+		var encryptedKeys []EncryptedKey
+		for _, user := range keyHolders {
+			header, messageKey, err := nextMessageKey(tx, message.ConversationID, sender, user.ID, prekeys[user.ID], privateKey)
+			if err != nil {
+				return err
+			}
+			wrapped, err := crypto.SealWithKey(messageKey, []byte(passphrase))
+			if err != nil {
+				return err
+			}
+			encryptedKeys = append(encryptedKeys, EncryptedKey{RecipientID: user.ID, EncryptedPassphrase: wrapped, Ratchet: header})
+		}
+		keysJSON, err := json.Marshal(encryptedKeys)
+		if err != nil {
+			return err
+		}
+		message.EncryptedSessionKeys = string(keysJSON)
+		if err := tx.Model(&message).Updates(map[string]interface{}{
+			"conversation_id":        message.ConversationID,
+			"encrypted_session_keys": message.EncryptedSessionKeys,
+		}).Error; err != nil {
+			return err
+		}
+		return recordChange(tx, append([]uint{senderID}, recipients...), message.ID, ChangeCreated)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &message, nil
+}
+
+// nextMessageKey advances the sender's chain to recipientID in a
+// conversation and returns the message key for the next message. A new
+// chain is started when there is none or the recipient's prekey changed.
+func nextMessageKey(tx *gorm.DB, conversationID uint, sender models.User, recipientID uint, prekey *models.Prekey, privateKey []byte) (*RatchetHeader, []byte, error) {
+	var chain models.SendingChain
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("conversation_id = ? AND sender_id = ? AND recipient_id = ?", conversationID, sender.ID, recipientID).
+		First(&chain).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil, err
+	}
+
+	var chainKey []byte
+	if err == nil && chain.PrekeyID == prekey.ID {
+		// Chain keys are encrypted to the sender's key at the time; after a
+		// key rotation the chain is simply restarted
+		chainKey, err = crypto.DecryptRatchetKey(chain.EncryptedChainKey, privateKey)
+		if err != nil {
+			chainKey = nil
+		}
+	}
+	if chainKey == nil {
+		context := crypto.RatchetContext(conversationID, sender.ID, recipientID)
+		ephemeralKey, startKey, err := crypto.StartChain(prekey.PublicKey, context)
+		if err != nil {
+			return nil, nil, err
+		}
+		chain.ConversationID = conversationID
+		chain.SenderID = sender.ID
+		chain.RecipientID = recipientID
+		chain.PrekeyID = prekey.ID
+		chain.EphemeralPublicKey = ephemeralKey
+		chain.Counter = 0
+		chainKey = startKey
+	}
+
+	messageKey, nextChainKey := crypto.ChainStep(chainKey)
+	header := &RatchetHeader{PrekeyID: chain.PrekeyID, EphemeralKey: chain.EphemeralPublicKey, Counter: chain.Counter}
+	if chain.EncryptedChainKey, err = crypto.EncryptRatchetKey(nextChainKey, sender.PublicKey); err != nil {
+		return nil, nil, err
+	}
+	chain.Counter++
+	if err := tx.Save(&chain).Error; err != nil {
+		return nil, nil, err
+	}
+	return header, messageKey, nil
+}
+
+// conversationVisible reports whether the user sent or received a message
+// of the conversation.
+func conversationVisible(userID, conversationID uint, db *gorm.DB) (bool, error) {
+	var messages []Message
+	err := db.Select("id", "sender_id", "recipients_json").
+		Where("id = ? OR conversation_id = ?", conversationID, conversationID).Find(&messages).Error
+	if err != nil {
+		return false, err
+	}
+	for _, msg := range messages {
+		if len(MessageMailboxes(msg, userID)) > 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ratchetPassphrase recomputes the message key of a forward secret message
+// from the user's prekey and unwraps its passphrase.
+func (k *keyring) ratchetPassphrase(msg Message, key EncryptedKey) (string, error) {
+	prekey, err := k.prekey(key.Ratchet.PrekeyID)
+	if err != nil {
+		return "", err
+	}
+	context := crypto.RatchetContext(msg.ConversationID, msg.SenderID, k.userID)
+	messageKey, err := k.messageKey(prekey, key.Ratchet, context)
+	if err != nil {
+		return "", err
+	}
+	passphrase, err := crypto.OpenWithKey(messageKey, key.EncryptedPassphrase)
+	if err != nil {
+		return "", err
+	}
+	return string(passphrase), nil
+}
+
+// messageKey returns the message key at the header's position of a chain
+// received through prekey. The chain is stepped on from the position reached
+// by earlier messages, and only restarted for an earlier position.
+func (k *keyring) messageKey(prekey []byte, header *RatchetHeader, context []byte) ([]byte, error) {
+	id := fmt.Sprintf("%d:%x:%x", header.PrekeyID, header.EphemeralKey, context)
+	chain, ok := k.chains[id]
+	if !ok {
+		start, err := crypto.ReceiveChain(prekey, header.EphemeralKey, context)
+		if err != nil {
+			return nil, err
+		}
+		chain = &receivingChain{start: start, key: start}
+		if k.chains == nil {
+			k.chains = make(map[string]*receivingChain)
+		}
+		k.chains[id] = chain
+	}
+	if header.Counter < chain.counter {
+		chain.counter, chain.key = 0, chain.start
+	}
+	for chain.counter < header.Counter {
+		_, chain.key = crypto.ChainStep(chain.key)
+		chain.counter++
+	}
+	messageKey, _ := crypto.ChainStep(chain.key)
+	return messageKey, nil
+}
+
+// prekey returns the private key of one of the user's prekeys, or
+// ErrMessageKeyErased when it no longer exists.
+func (k *keyring) prekey(id uint) ([]byte, error) {
+	if key, ok := k.prekeys[id]; ok {
+		return key, nil
+	}
+	var prekey models.Prekey
+	err := k.db.Where("id = ? AND user_id = ?", id, k.userID).First(&prekey).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrMessageKeyErased
+	}
+	if err != nil {
+		return nil, err
+	}
+	privateKey, err := k.key(prekey.KeyVersion)
+	if err != nil {
+		return nil, err
+	}
+	key, err := crypto.DecryptRatchetKey(prekey.EncryptedPrivateKey, privateKey)
+	if err != nil {
+		return nil, err
+	}
+	if k.prekeys == nil {
+		k.prekeys = make(map[uint][]byte)
+	}
+	k.prekeys[id] = key
+	return key, nil
+}
@@ -0,0 +1,465 @@
+package email
+
+import (
+	"crypto/rand"
+	"errors"
+	"secmail/internal/crypto"
+	"secmail/internal/models"
+	"slices"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrGroupNotFound  = errors.New("group not found")
+	ErrNotGroupAdmin  = errors.New("only group admins can change the membership")
+	ErrAlreadyMember  = errors.New("user is already a member of the group")
+	ErrNotGroupMember = errors.New("user is not a member of the group")
+	ErrLastGroupAdmin = errors.New("the last admin cannot leave a group with other members")
+	ErrUsersNotFound  = errors.New("some recipients not found")
+	// ErrGroupEpochUnavailable is returned when a member cannot open the
+	// group's current epoch secret, such as after resetting their keys.
+	ErrGroupEpochUnavailable = errors.New("group secret of the current epoch is not available")
+)
+
+// groupNonceSize is the size of the per-message nonce group message keys
+// are derived with.
+const groupNonceSize = 16
+
+// GroupHeader identifies the key a group message's passphrase is wrapped
+// with: the group's epoch secret and the message's nonce.
+type GroupHeader struct {
+	GroupID uint   `json:"group_id"`
+	Epoch   uint64 `json:"epoch"`
+	Nonce   []byte `json:"nonce"`
+}
+
+// GroupInfo describes a group to one of its members.
+type GroupInfo struct {
+	ID        uint
+	Name      string
+	Epoch     uint64
+	Admin     bool
+	Members   []GroupMemberInfo
+	CreatedAt time.Time
+}
+
+// GroupMemberInfo describes a member of a group.
+type GroupMemberInfo struct {
+	UserID uint
+	Email  string
+	Admin  bool
+}
+
+// CreateGroup creates a group of the creator, who becomes its admin, and
+// memberIDs, and starts its first epoch. privateKey is the creator's
+// unwrapped key.
+func CreateGroup(creatorID uint, name string, memberIDs []uint, privateKey []byte, db *gorm.DB) (*models.Group, error) {
+	var creator models.User
+	if err := db.Where("id = ?", creatorID).First(&creator).Error; err != nil {
+		return nil, err
+	}
+	if !crypto.PrivateKeyMatches(privateKey, creator.PublicKey) {
+		return nil, ErrKeyOutdated
+	}
+	var ids []uint
+	for _, id := range memberIDs {
+		if id != creatorID && !slices.Contains(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+	var users []models.User
+	if len(ids) > 0 {
+		if err := db.Where("id IN ?", ids).Find(&users).Error; err != nil {
+			return nil, err
+		}
+		if len(users) != len(ids) {
+			return nil, ErrUsersNotFound
+		}
+	}
+	if err := checkVerification(creator, users); err != nil {
+		return nil, err
+	}
+
+	group := models.Group{Name: name}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&group).Error; err != nil {
+			return err
+		}
+		members := []models.GroupMember{{GroupID: group.ID, UserID: creatorID, Admin: true}}
+		for _, user := range users {
+			members = append(members, models.GroupMember{GroupID: group.ID, UserID: user.ID})
+		}
+		if err := tx.Create(&members).Error; err != nil {
+			return err
+		}
+		return commitEpoch(tx, &group, nil, append([]models.User{creator}, users...), 0)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &group, nil
+}
+
+// ListGroups returns the groups the user is a member of.
+func ListGroups(userID uint, db *gorm.DB) ([]GroupInfo, error) {
+	var memberships []models.GroupMember
+	if err := db.Where("user_id = ?", userID).Order("group_id").Find(&memberships).Error; err != nil {
+		return nil, err
+	}
+	groups := make([]GroupInfo, 0, len(memberships))
+	for _, membership := range memberships {
+		info, err := GetGroup(userID, membership.GroupID, db)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, *info)
+	}
+	return groups, nil
+}
+
+// GetGroup returns a group the user is a member of.
+func GetGroup(userID, groupID uint, db *gorm.DB) (*GroupInfo, error) {
+	var group models.Group
+	if err := db.Where("id = ?", groupID).First(&group).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrGroupNotFound
+		}
+		return nil, err
+	}
+	var members []models.GroupMember
+	if err := db.Where("group_id = ?", groupID).Order("id").Find(&members).Error; err != nil {
+		return nil, err
+	}
+
+	info := &GroupInfo{ID: group.ID, Name: group.Name, Epoch: group.Epoch, CreatedAt: group.CreatedAt}
+	isMember := false
+	for _, member := range members {
+		var user models.User
+		if err := db.Select("id", "email").Where("id = ?", member.UserID).First(&user).Error; err != nil {
+			return nil, err
+		}
+		info.Members = append(info.Members, GroupMemberInfo{UserID: user.ID, Email: user.Email, Admin: member.Admin})
+		if member.UserID == userID {
+			isMember = true
+			info.Admin = member.Admin
+		}
+	}
+	if !isMember {
+		return nil, ErrGroupNotFound
+	}
+	return info, nil
+}
+
+// AddGroupMember adds a user to a group and starts a new epoch that
+// includes them. The new member can only read messages sent from then on.
+// adminID must be an admin holding the current epoch; privateKey is their
+// unwrapped key.
+func AddGroupMember(adminID, groupID, userID uint, privateKey []byte, db *gorm.DB) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		group, admin, err := lockMembership(tx, groupID, adminID)
+		if err != nil {
+			return err
+		}
+		if !admin.Admin {
+			return ErrNotGroupAdmin
+		}
+		var existing int64
+		if err := tx.Model(&models.GroupMember{}).Where("group_id = ? AND user_id = ?", groupID, userID).Count(&existing).Error; err != nil {
+			return err
+		}
+		if existing > 0 {
+			return ErrAlreadyMember
+		}
+		var adminUser, user models.User
+		if err := tx.Where("id = ?", adminID).First(&adminUser).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("id = ?", userID).First(&user).Error; err != nil {
+			return err
+		}
+		if err := checkVerification(adminUser, []models.User{user}); err != nil {
+			return err
+		}
+
+		if err := tx.Create(&models.GroupMember{GroupID: groupID, UserID: userID, JoinedAt: group.Epoch + 1}).Error; err != nil {
+			return err
+		}
+		return advanceEpoch(tx, group, adminID, privateKey)
+	})
+}
+
+// RemoveGroupMember removes a user from a group and starts a new epoch
+// without them, so they cannot read later messages. adminID must be an
+// admin holding the current epoch; privateKey is their unwrapped key.
+func RemoveGroupMember(adminID, groupID, userID uint, privateKey []byte, db *gorm.DB) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		group, admin, err := lockMembership(tx, groupID, adminID)
+		if err != nil {
+			return err
+		}
+		if !admin.Admin {
+			return ErrNotGroupAdmin
+		}
+		if userID == adminID {
+			if err := checkNotLastAdmin(tx, groupID, userID); err != nil {
+				return err
+			}
+		}
+		result := tx.Where("group_id = ? AND user_id = ?", groupID, userID).Delete(&models.GroupMember{})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrNotGroupMember
+		}
+		if userID == adminID {
+			// The remover knows the next epoch secret it would commit
+			return tx.Model(group).Update("pending_commit", true).Error
+		}
+		return advanceEpoch(tx, group, adminID, privateKey)
+	})
+}
+
+// LeaveGroup removes the user from a group. A member cannot exclude
+// themselves from a secret they commit, so the next member to send starts
+// the new epoch.
+func LeaveGroup(userID, groupID uint, db *gorm.DB) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		group, _, err := lockMembership(tx, groupID, userID)
+		if err != nil {
+			return err
+		}
+		if err := checkNotLastAdmin(tx, groupID, userID); err != nil {
+			return err
+		}
+		if err := tx.Where("group_id = ? AND user_id = ?", groupID, userID).Delete(&models.GroupMember{}).Error; err != nil {
+			return err
+		}
+		return tx.Model(group).Update("pending_commit", true).Error
+	})
+}
+
+// UpdateGroupEpoch starts a new epoch of the group with a fresh secret, for
+// members who suspect an epoch secret was exposed.
+func UpdateGroupEpoch(userID, groupID uint, privateKey []byte, db *gorm.DB) (uint64, error) {
+	var epoch uint64
+	err := db.Transaction(func(tx *gorm.DB) error {
+		group, _, err := lockMembership(tx, groupID, userID)
+		if err != nil {
+			return err
+		}
+		if err := advanceEpoch(tx, group, userID, privateKey); err != nil {
+			return err
+		}
+		epoch = group.Epoch
+		return nil
+	})
+	return epoch, err
+}
+
+// ForgetGroupEpochs deletes the user's epoch secrets, for when their key is
+// discarded, and flags each of their groups for a new epoch the next member
+// to send commits to the user's new key.
+func ForgetGroupEpochs(tx *gorm.DB, userID uint) error {
+	if err := tx.Where("user_id = ?", userID).Delete(&models.GroupEpochKey{}).Error; err != nil {
+		return err
+	}
+	groupIDs := tx.Model(&models.GroupMember{}).Select("group_id").Where("user_id = ?", userID)
+	return tx.Model(&models.Group{}).Where("id IN (?)", groupIDs).Update("pending_commit", true).Error
+}
+
+// lockMembership locks a group for a membership or epoch change and returns
+// it with the user's membership.
+func lockMembership(tx *gorm.DB, groupID, userID uint) (*models.Group, *models.GroupMember, error) {
+	var group models.Group
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ?", groupID).First(&group).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil, ErrGroupNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	var member models.GroupMember
+	err = tx.Where("group_id = ? AND user_id = ?", groupID, userID).First(&member).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil, ErrGroupNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return &group, &member, nil
+}
+
+// checkNotLastAdmin returns ErrLastGroupAdmin if userID is the only admin of
+// a group with other members.
+func checkNotLastAdmin(tx *gorm.DB, groupID, userID uint) error {
+	var admins, others int64
+	if err := tx.Model(&models.GroupMember{}).Where("group_id = ? AND admin AND user_id <> ?", groupID, userID).Count(&admins).Error; err != nil {
+		return err
+	}
+	if err := tx.Model(&models.GroupMember{}).Where("group_id = ? AND user_id <> ?", groupID, userID).Count(&others).Error; err != nil {
+		return err
+	}
+	if admins == 0 && others > 0 {
+		return ErrLastGroupAdmin
+	}
+	return nil
+}
+
+// advanceEpoch commits the next epoch of a locked group for its current
+// members, derived from the current epoch secret held by committerID.
+func advanceEpoch(tx *gorm.DB, group *models.Group, committerID uint, privateKey []byte) error {
+	previous, err := newKeyring(committerID, privateKey, tx).epochSecret(group.ID, group.Epoch)
+	if errors.Is(err, ErrMessageKeyErased) || errors.Is(err, ErrSessionKeyNotFound) {
+		return ErrGroupEpochUnavailable
+	}
+	if err != nil {
+		return err
+	}
+	var users []models.User
+	memberIDs := tx.Model(&models.GroupMember{}).Select("user_id").Where("group_id = ?", group.ID)
+	if err := tx.Where("id IN (?)", memberIDs).Find(&users).Error; err != nil {
+		return err
+	}
+	return commitEpoch(tx, group, previous, users, group.Epoch+1)
+}
+
+// commitEpoch derives the secret of the given epoch and encrypts it to each
+// member.
+func commitEpoch(tx *gorm.DB, group *models.Group, previousSecret []byte, members []models.User, epoch uint64) error {
+	ids := make([]uint, 0, len(members))
+	for _, member := range members {
+		ids = append(ids, member.ID)
+	}
+	secret, err := crypto.NewEpochSecret(previousSecret, crypto.GroupContext(group.ID, epoch, ids))
+	if err != nil {
+		return err
+	}
+
+	keys := make([]models.GroupEpochKey, 0, len(members))
+	for _, member := range members {
+		encrypted, err := crypto.EncryptRatchetKey(secret, member.PublicKey)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, models.GroupEpochKey{
+			GroupID:              group.ID,
+			Epoch:                epoch,
+			UserID:               member.ID,
+			KeyVersion:           currentVersion(member),
+			EncryptedEpochSecret: encrypted,
+		})
+	}
+	if len(keys) > 0 {
+		if err := tx.Create(&keys).Error; err != nil {
+			return err
+		}
+	}
+	group.Epoch = epoch
+	group.PendingCommit = false
+	return tx.Model(group).Updates(map[string]interface{}{"epoch": epoch, "pending_commit": false}).Error
+}
+
+// groupKeys wraps passphrase for each group the sender is a member of and
+// returns the keys with the IDs of the other members. Groups flagged for a
+// new epoch get it first.
+func groupKeys(senderID uint, groupIDs []uint, passphrase string, privateKey []byte, db *gorm.DB) ([]EncryptedKey, []uint, error) {
+	if privateKey == nil {
+		return nil, nil, ErrSessionKeyNotFound
+	}
+	ring := newKeyring(senderID, privateKey, db)
+	var keys []EncryptedKey
+	var recipients []uint
+	for _, groupID := range groupIDs {
+		var group *models.Group
+		err := db.Transaction(func(tx *gorm.DB) error {
+			var err error
+			if group, _, err = lockMembership(tx, groupID, senderID); err != nil {
+				return err
+			}
+			if group.PendingCommit {
+				return advanceEpoch(tx, group, senderID, privateKey)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+
+		secret, err := ring.epochSecret(group.ID, group.Epoch)
+		if errors.Is(err, ErrMessageKeyErased) || errors.Is(err, ErrSessionKeyNotFound) {
+			return nil, nil, ErrGroupEpochUnavailable
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		nonce := make([]byte, groupNonceSize)
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, nil, err
+		}
+		wrapped, err := crypto.SealWithKey(crypto.GroupMessageKey(secret, nonce), []byte(passphrase))
+		if err != nil {
+			return nil, nil, err
+		}
+		keys = append(keys, EncryptedKey{
+			EncryptedPassphrase: wrapped,
+			Group:               &GroupHeader{GroupID: group.ID, Epoch: group.Epoch, Nonce: nonce},
+		})
+
+		var members []models.GroupMember
+		if err := db.Select("user_id").Where("group_id = ? AND user_id <> ?", group.ID, senderID).Find(&members).Error; err != nil {
+			return nil, nil, err
+		}
+		for _, member := range members {
+			recipients = append(recipients, member.UserID)
+		}
+	}
+	return keys, recipients, nil
+}
+
+// groupPassphrase unwraps the passphrase of a group message with the
+// epoch secret.
+func (k *keyring) groupPassphrase(key EncryptedKey) (string, error) {
+	secret, err := k.epochSecret(key.Group.GroupID, key.Group.Epoch)
+	if err != nil {
+		return "", err
+	}
+	passphrase, err := crypto.OpenWithKey(crypto.GroupMessageKey(secret, key.Group.Nonce), key.EncryptedPassphrase)
+	if err != nil {
+		return "", err
+	}
+	return string(passphrase), nil
+}
+
+// epochSecret returns the secret of an epoch of a group the user was a
+// member of in that epoch, or ErrMessageKeyErased.
+func (k *keyring) epochSecret(groupID uint, epoch uint64) ([]byte, error) {
+	cacheKey := [2]uint64{uint64(groupID), epoch}
+	if secret, ok := k.epochs[cacheKey]; ok {
+		return secret, nil
+	}
+	var epochKey models.GroupEpochKey
+	err := k.db.Where("group_id = ? AND epoch = ? AND user_id = ?", groupID, epoch, k.userID).First(&epochKey).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrMessageKeyErased
+	}
+	if err != nil {
+		return nil, err
+	}
+	privateKey, err := k.key(epochKey.KeyVersion)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := crypto.DecryptRatchetKey(epochKey.EncryptedEpochSecret, privateKey)
+	if err != nil {
+		return nil, err
+	}
+	if k.epochs == nil {
+		k.epochs = make(map[[2]uint64][]byte)
+	}
+	k.epochs[cacheKey] = secret
+	return secret, nil
+}
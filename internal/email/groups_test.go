@@ -0,0 +1,38 @@
+package email
+
+import (
+	"errors"
+	"secmail/internal/models"
+	"testing"
+)
+
+func TestCreateGroupMembers(t *testing.T) {
+	db := openTestDB(t)
+	alice, alicePrivateKey := createTestUser(t, db, "alice@secmail.test")
+	bob, _ := createTestUser(t, db, "bob@secmail.test")
+
+	// A member that does not exist fails the whole group
+	if _, err := CreateGroup(alice.ID, "Team", []uint{bob.ID, bob.ID + 100}, alicePrivateKey, db); !errors.Is(err, ErrUsersNotFound) {
+		t.Fatalf("Expected ErrUsersNotFound, got %v", err)
+	}
+	var count int64
+	if err := db.Model(&models.Group{}).Count(&count).Error; err != nil {
+		t.Fatalf("Failed to count groups: %v", err)
+	}
+	if count != 0 {
+		t.Errorf("Expected no group to be created, got %d", count)
+	}
+
+	// The creator and repeated IDs are not missing members
+	group, err := CreateGroup(alice.ID, "Team", []uint{bob.ID, bob.ID, alice.ID}, alicePrivateKey, db)
+	if err != nil {
+		t.Fatalf("Failed to create group: %v", err)
+	}
+	info, err := GetGroup(bob.ID, group.ID, db)
+	if err != nil {
+		t.Fatalf("Failed to get group: %v", err)
+	}
+	if len(info.Members) != 2 || !info.Members[0].Admin || info.Members[1].UserID != bob.ID {
+		t.Errorf("Unexpected members: %+v", info.Members)
+	}
+}
@@ -0,0 +1,100 @@
+package email
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/emersion/go-message/mail"
+	"gorm.io/gorm"
+)
+
+// MaxImportMessageBytes is the largest message ImportMessage accepts,
+// matching the limit for mail received over SMTP.
+const MaxImportMessageBytes = 10 << 20
+
+var (
+	ErrMessageTooLarge = errors.New("message too large")
+	ErrInvalidMessage  = errors.New("not an RFC 5322 message")
+)
+
+// ImportMessage stores a raw RFC 5322 message in one of the user's
+// mailboxes, encrypted to their key like mail received over SMTP. Messages
+// imported into Sent are stored as sent by the user to no local recipient.
+// The message keeps its Date header as its time, falling back to the time of
+// import.
+func ImportMessage(userID uint, raw []byte, mailbox string, db *gorm.DB) (*Message, error) {
+	if mailbox != MailboxInbox && mailbox != MailboxSent {
+		return nil, ErrNoSuchMailbox
+	}
+	if len(raw) > MaxImportMessageBytes {
+		return nil, ErrMessageTooLarge
+	}
+	r, err := mail.CreateReader(bytes.NewReader(raw))
+	if err != nil {
+		return nil, ErrInvalidMessage
+	}
+	defer r.Close()
+	if r.Header.Len() == 0 {
+		return nil, ErrInvalidMessage
+	}
+
+	sentAt, err := r.Header.Date()
+	if err != nil || sentAt.IsZero() {
+		sentAt = time.Now()
+	}
+	if mailbox == MailboxSent {
+		return storeRaw(userID, nil, raw, map[string]string{"source": SourceImport}, sentAt, db)
+	}
+	return storeRaw(0, []uint{userID}, raw, map[string]string{"source": SourceImport}, sentAt, db)
+}
+
+// SplitMbox splits an mbox file into its messages. "From " separator lines
+// are dropped and ">From " quoting is undone as in the mboxrd format, which
+// also reads mboxo files correctly in all but rare cases.
+func SplitMbox(r io.Reader) ([][]byte, error) {
+	var messages [][]byte
+	var current *bytes.Buffer
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(line) > 0 {
+			switch {
+			case bytes.HasPrefix(line, []byte("From ")):
+				if current != nil {
+					messages = append(messages, current.Bytes())
+				}
+				current = &bytes.Buffer{}
+			case current == nil:
+				return nil, errors.New("mbox does not start with a From line")
+			default:
+				if unquoted := bytes.TrimLeft(line, ">"); len(unquoted) < len(line) && bytes.HasPrefix(unquoted, []byte("From ")) {
+					line = line[1:]
+				}
+				current.Write(line)
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if current != nil {
+		messages = append(messages, current.Bytes())
+	}
+
+	// Each message is followed by a blank line that is not part of it
+	for i, msg := range messages {
+		switch {
+		case bytes.HasSuffix(msg, []byte("\r\n\r\n")):
+			messages[i] = msg[:len(msg)-2]
+		case bytes.HasSuffix(msg, []byte("\n\n")):
+			messages[i] = msg[:len(msg)-1]
+		}
+	}
+	return messages, nil
+}
@@ -0,0 +1,51 @@
+package email
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestSplitMbox(t *testing.T) {
+	mbox := "From alice@example.org Mon Jan  1 00:00:00 2024\n" +
+		"Subject: First\n" +
+		"\n" +
+		">From the start, quoted.\n" +
+		">>From twice quoted.\n" +
+		"\n" +
+		"From bob@example.org Tue Jan  2 00:00:00 2024\n" +
+		"Subject: Second\n" +
+		"\n" +
+		"Hello\n" +
+		"\n"
+
+	messages, err := SplitMbox(strings.NewReader(mbox))
+	if err != nil {
+		t.Fatalf("Failed to split mbox: %v", err)
+	}
+	if len(messages) != 2 {
+		t.Fatalf("Expected 2 messages, got %d", len(messages))
+	}
+	first := "Subject: First\n\nFrom the start, quoted.\n>From twice quoted.\n"
+	if string(messages[0]) != first {
+		t.Errorf("Unexpected first message: %q", messages[0])
+	}
+	if string(messages[1]) != "Subject: Second\n\nHello\n" {
+		t.Errorf("Unexpected second message: %q", messages[1])
+	}
+
+	if _, err := SplitMbox(strings.NewReader("Subject: no separator\n")); err == nil {
+		t.Error("Mbox without a From line should fail")
+	}
+}
+
+func TestImportMessageRejectsInvalid(t *testing.T) {
+	if _, err := ImportMessage(1, []byte("not a message"), MailboxInbox, nil); !errors.Is(err, ErrInvalidMessage) {
+		t.Errorf("Expected ErrInvalidMessage, got %v", err)
+	}
+	large := append([]byte("Subject: big\r\n\r\n"), bytes.Repeat([]byte("a"), MaxImportMessageBytes)...)
+	if _, err := ImportMessage(1, large, MailboxInbox, nil); !errors.Is(err, ErrMessageTooLarge) {
+		t.Errorf("Expected ErrMessageTooLarge, got %v", err)
+	}
+}
@@ -0,0 +1,152 @@
+package email
+
+import (
+	"encoding/json"
+	"errors"
+	"secmail/internal/models"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Message sources recorded in Metadata.
+const (
+	SourceSMTP   = "smtp"
+	SourceImport = "import"
+	// SourceSecureLink marks replies sent through a secure link.
+	SourceSecureLink = "secure_link"
+)
+
+var ErrUnknownRecipient = errors.New("unknown recipient")
+
+// AuthResults are the outcomes of authenticating the sender of inbound mail
+// ("pass", "fail", "none", ...). They are recorded in the message metadata.
+type AuthResults struct {
+	SPF   string `json:"spf"`
+	DKIM  string `json:"dkim"`
+	DMARC string `json:"dmarc"`
+}
+
+// LookupLocalRecipient returns the ID of the local user with the given address
+// if they may receive mail under the current verification policy.
+func LookupLocalRecipient(address string, db *gorm.DB) (uint, error) {
+	var user models.User
+	err := db.Where("LOWER(email) = ?", strings.ToLower(strings.TrimSpace(address))).First(&user).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return 0, ErrUnknownRecipient
+	}
+	if err != nil {
+		return 0, err
+	}
+	if verificationPolicy == VerificationStrict && !user.IsVerified() {
+		return 0, ErrRecipientUnverified
+	}
+	return user.ID, nil
+}
+
+// StoreInbound encrypts a raw RFC 5322 message received from outside secmail
+// to the recipients' keys and stores it. The whole message, including its
+// headers, is encrypted so no plaintext reaches the database. auth, when
+// not nil, holds the results of sender authentication.
+func StoreInbound(recipients []uint, raw []byte, auth *AuthResults, db *gorm.DB) error {
+	metadata := map[string]string{"source": SourceSMTP}
+	if auth != nil {
+		metadata["spf"] = auth.SPF
+		metadata["dkim"] = auth.DKIM
+		metadata["dmarc"] = auth.DMARC
+	}
+	_, err := storeRaw(0, recipients, raw, metadata, time.Now(), db)
+	return err
+}
+
+// storeRaw encrypts a raw RFC 5322 message to the keys of the sender (when
+// senderID is not 0) and the recipients, and stores it with metadata, which
+// names its source.
+func storeRaw(senderID uint, recipients []uint, raw []byte, metadata map[string]string, sentAt time.Time, db *gorm.DB) (*Message, error) {
+	if len(recipients) == 0 && senderID == 0 {
+		return nil, errors.New("no recipients")
+	}
+	recipients = uniqueIDs(recipients)
+	if recipients == nil {
+		recipients = []uint{}
+	}
+
+	var users []models.User
+	if len(recipients) > 0 {
+		if err := db.Where("id IN ?", recipients).Find(&users).Error; err != nil {
+			return nil, err
+		}
+		if len(users) != len(recipients) {
+			return nil, ErrUsersNotFound
+		}
+	}
+	keyHolders := users
+	if senderID != 0 && !containsUser(users, senderID) {
+		var sender models.User
+		if err := db.Where("id = ?", senderID).First(&sender).Error; err != nil {
+			return nil, err
+		}
+		keyHolders = append(keyHolders, sender)
+	}
+
+	encryptedBody, encryptedKeysJSON, err := encryptForRecipients(raw, keyHolders)
+	if err != nil {
+		return nil, err
+	}
+
+	recipientsJSON, err := json.Marshal(recipients)
+	if err != nil {
+		return nil, err
+	}
+	metadataJSON, err := json.Marshal(metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	message := Message{
+		SenderID:             senderID,
+		RecipientsJSON:       string(recipientsJSON),
+		EncryptedBody:        encryptedBody,
+		EncryptedSessionKeys: encryptedKeysJSON,
+		Metadata:             string(metadataJSON),
+		Status:               StatusReceived,
+		SentAt:               sentAt,
+	}
+	if senderID != 0 {
+		message.Status = StatusSent
+	}
+	changed := recipients
+	if senderID != 0 {
+		changed = append([]uint{senderID}, recipients...)
+	}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&message).Error; err != nil {
+			return err
+		}
+		return recordChange(tx, changed, message.ID, ChangeCreated)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &message, nil
+}
+
+// authResults returns the sender authentication results recorded in a
+// message's metadata, or nil when it was not authenticated.
+func authResults(metadata map[string]string) *AuthResults {
+	if metadata["spf"] == "" && metadata["dkim"] == "" && metadata["dmarc"] == "" {
+		return nil
+	}
+	return &AuthResults{SPF: metadata["spf"], DKIM: metadata["dkim"], DMARC: metadata["dmarc"]}
+}
+
+// isRawSource reports whether a message's metadata marks it as stored in
+// its complete RFC 5322 form rather than as a secmail body.
+func isRawSource(metadata map[string]string) bool {
+	switch metadata["source"] {
+	case SourceSMTP, SourceImport, SourceSecureLink:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,318 @@
+package email
+
+import (
+	"errors"
+	"secmail/internal/crypto"
+	"secmail/internal/models"
+	"secmail/internal/transparency"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ErrKeyOutdated is returned by RotateKey when the given private key is not
+// the user's current key, because it was rotated by another session.
+var ErrKeyOutdated = errors.New("key was rotated by another session")
+
+// KeyVersion describes one version of a user's secmail key.
+type KeyVersion struct {
+	Version     int
+	Fingerprint string
+	Algorithm   string
+	Current     bool
+	CreatedAt   time.Time
+	RetiredAt   *time.Time
+}
+
+// keyring resolves the private key for each version of a user's key from
+// the unwrapped key of their session. Retired keys are encrypted to the
+// current key, so sessions opened before a rotation can only read mail
+// encrypted to the key they hold.
+type keyring struct {
+	userID     uint
+	privateKey []byte
+	db         *gorm.DB
+
+	loaded  bool
+	version int  // Version of privateKey, 0 if it matches no stored key
+	current bool // Whether privateKey is the user's current key
+	retired map[int][]byte
+	prekeys map[uint][]byte      // Prekey private keys by ID
+	epochs  map[[2]uint64][]byte // Group epoch secrets by group ID and epoch
+	chains  map[string]*receivingChain
+}
+
+// receivingChain is the position reached in a ratchet chain received by the
+// user, so that reading a conversation in order steps each chain once.
+type receivingChain struct {
+	start   []byte // First chain key
+	counter uint32 // Position of key
+	key     []byte
+}
+
+func newKeyring(userID uint, privateKey []byte, db *gorm.DB) *keyring {
+	return &keyring{userID: userID, privateKey: privateKey, db: db}
+}
+
+// load determines which version the session's key is.
+func (k *keyring) load() error {
+	if k.loaded {
+		return nil
+	}
+	var user models.User
+	if err := k.db.Where("id = ?", k.userID).First(&user).Error; err != nil {
+		return err
+	}
+	k.loaded = true
+	k.retired = make(map[int][]byte)
+	if crypto.PrivateKeyMatches(k.privateKey, user.PublicKey) {
+		k.version, k.current = currentVersion(user), true
+		return nil
+	}
+
+	// A session opened before the key was rotated
+	var keys []models.UserKey
+	if err := k.db.Select("version", "public_key").Where("user_id = ?", k.userID).Find(&keys).Error; err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if crypto.PrivateKeyMatches(k.privateKey, key.PublicKey) {
+			k.version = key.Version
+			break
+		}
+	}
+	return nil
+}
+
+// key returns the private key of the given version, or
+// ErrSessionKeyNotFound when the session cannot open it.
+func (k *keyring) key(version int) ([]byte, error) {
+	if version == 0 {
+		version = 1
+	}
+	if err := k.load(); err != nil {
+		return nil, err
+	}
+	if version == k.version {
+		return k.privateKey, nil
+	}
+	if !k.current {
+		return nil, ErrSessionKeyNotFound
+	}
+	if key, ok := k.retired[version]; ok {
+		return key, nil
+	}
+
+	var userKey models.UserKey
+	err := k.db.Where("user_id = ? AND version = ?", k.userID, version).First(&userKey).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrSessionKeyNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	key, err := openUserKey(userKey, k.privateKey)
+	if err != nil {
+		return nil, err
+	}
+	k.retired[version] = key
+	return key, nil
+}
+
+// retiredKeys returns every retired key with its record, when the session
+// holds the current key.
+func (k *keyring) retiredKeys() ([]models.UserKey, [][]byte, error) {
+	if err := k.load(); err != nil {
+		return nil, nil, err
+	}
+	if !k.current {
+		return nil, nil, nil
+	}
+	var userKeys []models.UserKey
+	if err := k.db.Where("user_id = ?", k.userID).Order("version DESC").Find(&userKeys).Error; err != nil {
+		return nil, nil, err
+	}
+	privateKeys := make([][]byte, 0, len(userKeys))
+	for _, userKey := range userKeys {
+		key, err := k.key(userKey.Version)
+		if err != nil {
+			return nil, nil, err
+		}
+		privateKeys = append(privateKeys, key)
+	}
+	return userKeys, privateKeys, nil
+}
+
+// currentVersion returns the version of the user's current key.
+func currentVersion(user models.User) int {
+	if user.KeyVersion == 0 {
+		return 1
+	}
+	return user.KeyVersion
+}
+
+// sealUserKey encrypts a private key, or other data only the owner of
+// publicKey may read, to publicKey.
+func sealUserKey(privateKey, publicKey []byte) (encryptedKey, encryptedPassphrase []byte, err error) {
+	encryptedKey, passphrase, err := crypto.EncryptBody(privateKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	encryptedPassphrase, err = crypto.EncryptPassphrase(passphrase, publicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return encryptedKey, encryptedPassphrase, nil
+}
+
+// openUserKey decrypts a retired private key with the current private key.
+func openUserKey(userKey models.UserKey, privateKey []byte) ([]byte, error) {
+	return openSealedKey(userKey.EncryptedPrivateKey, userKey.EncryptedPassphrase, privateKey)
+}
+
+// openSealedKey decrypts data sealed with sealUserKey.
+func openSealedKey(encryptedKey, encryptedPassphrase, privateKey []byte) ([]byte, error) {
+	passphrase, err := crypto.DecryptPassphrase(encryptedPassphrase, privateKey)
+	if err != nil {
+		return nil, err
+	}
+	return crypto.DecryptBody(encryptedKey, passphrase)
+}
+
+// RotateKey replaces the user's key pair with publicKey, whose private half
+// is given wrapped with the user's password (wrappedPrivateKey) and with a
+// new recovery phrase (recoveryKey). privateKey is the unwrapped current
+// key: it is retired along with the S/MIME certificate that certifies it,
+// and it and all earlier retired keys are re-encrypted to the new key, as is
+// the OpenPGP secret key. The new key is published in the key transparency
+// log. It returns the new key version.
+func RotateKey(userID uint, privateKey, publicKey, wrappedPrivateKey, recoveryKey []byte, db *gorm.DB) (int, error) {
+	var version int
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var user models.User
+		if err := tx.Where("id = ?", userID).First(&user).Error; err != nil {
+			return err
+		}
+		if !crypto.PrivateKeyMatches(privateKey, user.PublicKey) {
+			return ErrKeyOutdated
+		}
+
+		ring := newKeyring(userID, privateKey, tx)
+		retired, retiredKeys, err := ring.retiredKeys()
+		if err != nil {
+			return err
+		}
+		createdAt := user.CreatedAt
+		for i := range retired {
+			if retired[i].RetiredAt.After(createdAt) {
+				createdAt = retired[i].RetiredAt
+			}
+			encryptedKey, encryptedPassphrase, err := sealUserKey(retiredKeys[i], publicKey)
+			if err != nil {
+				return err
+			}
+			if err := tx.Model(&retired[i]).Updates(map[string]interface{}{
+				"encrypted_private_key": encryptedKey,
+				"encrypted_passphrase":  encryptedPassphrase,
+			}).Error; err != nil {
+				return err
+			}
+		}
+
+		encryptedKey, encryptedPassphrase, err := sealUserKey(privateKey, publicKey)
+		if err != nil {
+			return err
+		}
+		if err := tx.Create(&models.UserKey{
+			UserID:              userID,
+			Version:             currentVersion(user),
+			PublicKey:           user.PublicKey,
+			EncryptedPrivateKey: encryptedKey,
+			EncryptedPassphrase: encryptedPassphrase,
+			Certificate:         user.Certificate,
+			CreatedAt:           createdAt,
+			RetiredAt:           time.Now(),
+		}).Error; err != nil {
+			return err
+		}
+
+		var pgpKey models.PGPKey
+		err = tx.Where("user_id = ?", userID).First(&pgpKey).Error
+		switch {
+		case err == nil:
+			passphrase, err := crypto.DecryptPassphrase(pgpKey.EncryptedPassphrase, privateKey)
+			if err != nil {
+				return err
+			}
+			encryptedPassphrase, err := crypto.EncryptPassphrase(passphrase, publicKey)
+			if err != nil {
+				return err
+			}
+			if err := tx.Model(&pgpKey).Update("encrypted_passphrase", encryptedPassphrase).Error; err != nil {
+				return err
+			}
+		case !errors.Is(err, gorm.ErrRecordNotFound):
+			return err
+		}
+
+		version = currentVersion(user) + 1
+		if err := tx.Model(&user).Updates(map[string]interface{}{
+			"public_key":   publicKey,
+			"private_key":  wrappedPrivateKey,
+			"recovery_key": recoveryKey,
+			"certificate":  nil,
+			"key_version":  version,
+		}).Error; err != nil {
+			return err
+		}
+		return transparency.Append(tx, userID, user.Email, version, publicKey)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return version, nil
+}
+
+// ListKeyVersions returns every version of the user's key, newest first.
+func ListKeyVersions(userID uint, db *gorm.DB) ([]KeyVersion, error) {
+	var user models.User
+	if err := db.Where("id = ?", userID).First(&user).Error; err != nil {
+		return nil, err
+	}
+	var retired []models.UserKey
+	if err := db.Select("version", "public_key", "created_at", "retired_at").Where("user_id = ?", userID).
+		Order("version DESC").Find(&retired).Error; err != nil {
+		return nil, err
+	}
+
+	info, err := crypto.DescribePublicKey(user.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	currentCreatedAt := user.CreatedAt
+	if len(retired) > 0 {
+		currentCreatedAt = retired[0].RetiredAt
+	}
+	versions := []KeyVersion{{
+		Version:     currentVersion(user),
+		Fingerprint: info.Fingerprint,
+		Algorithm:   info.Algorithm,
+		Current:     true,
+		CreatedAt:   currentCreatedAt,
+	}}
+	for _, key := range retired {
+		info, err := crypto.DescribePublicKey(key.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		retiredAt := key.RetiredAt
+		versions = append(versions, KeyVersion{
+			Version:     key.Version,
+			Fingerprint: info.Fingerprint,
+			Algorithm:   info.Algorithm,
+			CreatedAt:   key.CreatedAt,
+			RetiredAt:   &retiredAt,
+		})
+	}
+	return versions, nil
+}
@@ -0,0 +1,87 @@
+package email
+
+import (
+	"bytes"
+	"secmail/internal/crypto"
+	"testing"
+)
+
+func TestInboxAcrossRotations(t *testing.T) {
+	db := openTestDB(t)
+	alice, firstKey := createTestUser(t, db, "alice@secmail.test")
+	bob, bobKey := createTestUser(t, db, "bob@secmail.test")
+
+	keys := [][]byte{firstKey}
+	var sent []uint
+	for i := 0; i < 3; i++ {
+		if i > 0 {
+			publicKey, privateKey, err := crypto.GenerateRSAKeyPair()
+			if err != nil {
+				t.Fatalf("Failed to generate key pair: %v", err)
+			}
+			if _, err := RotateKey(alice.ID, keys[i-1], publicKey, privateKey, nil, db); err != nil {
+				t.Fatalf("Failed to rotate key: %v", err)
+			}
+			keys = append(keys, privateKey)
+		}
+		msg, err := SendMessage(bob.ID, []uint{alice.ID}, nil, nil, "Hello", "Hi", Lifetime{}, bobKey, db)
+		if err != nil {
+			t.Fatalf("Failed to send message: %v", err)
+		}
+		sent = append(sent, msg.ID)
+	}
+
+	// A session holds the key it was opened with: the current key opens every
+	// retired one, an older key only the mail encrypted to it
+	tests := []struct {
+		name     string
+		key      []byte
+		readable []bool
+	}{
+		{"current session", keys[2], []bool{true, true, true}},
+		{"session opened after the first rotation", keys[1], []bool{false, true, false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inbox, err := GetInbox(alice.ID, tt.key, db)
+			if err != nil {
+				t.Fatalf("Failed to read inbox: %v", err)
+			}
+			if len(inbox) != len(sent) {
+				t.Fatalf("Expected %d messages, got %d", len(sent), len(inbox))
+			}
+			for _, msg := range inbox {
+				for i, id := range sent {
+					if msg.ID == id && msg.Unreadable == tt.readable[i] {
+						t.Errorf("Message %d: expected readable %v, got body %q", i+1, tt.readable[i], msg.Body)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestReceivingChainPositions(t *testing.T) {
+	publicKey, privateKey, err := crypto.GeneratePrekey()
+	if err != nil {
+		t.Fatalf("Failed to generate prekey: %v", err)
+	}
+	context := crypto.RatchetContext(1, 2, 3)
+	ephemeralKey, chainKey, err := crypto.StartChain(publicKey, context)
+	if err != nil {
+		t.Fatalf("Failed to start chain: %v", err)
+	}
+
+	// Messages are usually read in order, but not always
+	ring := newKeyring(3, nil, nil)
+	for _, counter := range []uint32{0, 1, 4, 2, 2, 7} {
+		header := &RatchetHeader{PrekeyID: 1, EphemeralKey: ephemeralKey, Counter: counter}
+		messageKey, err := ring.messageKey(privateKey, header, context)
+		if err != nil {
+			t.Fatalf("Failed to derive message key %d: %v", counter, err)
+		}
+		if !bytes.Equal(messageKey, crypto.MessageKeyAt(chainKey, counter)) {
+			t.Errorf("Message key %d does not match the sender's", counter)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package email
+
+import (
+	"errors"
+	"secmail/internal/crypto"
+	"secmail/internal/models"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// PublicKeys are the keys a user publishes in the key directory.
+type PublicKeys struct {
+	Email       string
+	SecmailKey  []byte // PEM
+	SecmailInfo crypto.PublicKeyInfo
+	// PGPKey is the armored public half of the user's OpenPGP key, if any.
+	PGPKey  []byte
+	PGPInfo crypto.PGPKeyInfo
+	// Certificate is the user's S/MIME certificate (PEM), if any.
+	Certificate     []byte
+	CertificateInfo crypto.CertificateInfo
+}
+
+// LookupPublicKeys returns the published keys of the local user with the
+// given address. Users who may not receive mail under the verification
+// policy are not listed.
+func LookupPublicKeys(address string, db *gorm.DB) (*PublicKeys, error) {
+	userID, err := LookupLocalRecipient(address, db)
+	if err != nil {
+		return nil, err
+	}
+	var user models.User
+	if err := db.Where("id = ?", userID).First(&user).Error; err != nil {
+		return nil, err
+	}
+	return publicKeys(user, db)
+}
+
+func publicKeys(user models.User, db *gorm.DB) (*PublicKeys, error) {
+	info, err := crypto.DescribePublicKey(user.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	keys := &PublicKeys{Email: user.Email, SecmailKey: user.PublicKey, SecmailInfo: info}
+
+	var pgpKey models.PGPKey
+	err = db.Where("user_id = ?", user.ID).First(&pgpKey).Error
+	switch {
+	case err == nil:
+		if keys.PGPInfo, err = crypto.DescribePGPPublicKey(pgpKey.PublicKey); err != nil {
+			return nil, err
+		}
+		keys.PGPKey = pgpKey.PublicKey
+	case !errors.Is(err, gorm.ErrRecordNotFound):
+		return nil, err
+	}
+
+	if len(user.Certificate) > 0 {
+		_, certInfo, err := crypto.ParseCertificate(user.Certificate)
+		if err != nil {
+			return nil, err
+		}
+		keys.Certificate = user.Certificate
+		keys.CertificateInfo = certInfo
+	}
+	return keys, nil
+}
+
+// LookupWKDKey returns the armored OpenPGP public key of the user at domain
+// whose local part has the Web Key Directory hash wkdHash, or
+// ErrUnknownRecipient.
+func LookupWKDKey(domain, wkdHash string, db *gorm.DB) ([]byte, error) {
+	domain = strings.ToLower(domain)
+	pattern := "%@" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(domain)
+	var users []models.User
+	if err := db.Where("LOWER(email) LIKE ?", pattern).Find(&users).Error; err != nil {
+		return nil, err
+	}
+	for _, user := range users {
+		localPart, userDomain, ok := strings.Cut(strings.ToLower(user.Email), "@")
+		if !ok || userDomain != domain || crypto.WKDHash(localPart) != wkdHash {
+			continue
+		}
+		if verificationPolicy == VerificationStrict && !user.IsVerified() {
+			continue
+		}
+		var pgpKey models.PGPKey
+		err := db.Where("user_id = ?", user.ID).First(&pgpKey).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return pgpKey.PublicKey, nil
+	}
+	return nil, ErrUnknownRecipient
+}
+
+// senderFingerprints caches the fingerprints of senders' secmail keys.
+type senderFingerprints map[uint]string
+
+// get returns the fingerprint of the current key of senderID, or "" when
+// the sender no longer exists.
+func (f senderFingerprints) get(senderID uint, db *gorm.DB) (string, error) {
+	if fingerprint, ok := f[senderID]; ok {
+		return fingerprint, nil
+	}
+	var sender models.User
+	err := db.Select("id", "public_key").Where("id = ?", senderID).First(&sender).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		f[senderID] = ""
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	info, err := crypto.DescribePublicKey(sender.PublicKey)
+	if err != nil {
+		return "", err
+	}
+	f[senderID] = info.Fingerprint
+	return info.Fingerprint, nil
+}
@@ -0,0 +1,575 @@
+package email
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"secmail/internal/models"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Posting policies of mailing lists.
+const (
+	ListPolicyOpen      = "open"
+	ListPolicyMembers   = "members"
+	ListPolicyModerated = "moderated"
+)
+
+// Moderation states of posts to moderated lists.
+const (
+	PostHeld     = "held"
+	PostApproved = "approved"
+	PostRejected = "rejected"
+)
+
+var (
+	// ErrAddressTaken is returned when a new list or shared mailbox would
+	// take the address of a user, list or shared mailbox.
+	ErrAddressTaken      = errors.New("address is already in use")
+	ErrListNotFound      = errors.New("mailing list not found")
+	ErrNotListOwner      = errors.New("only list owners can manage the list")
+	ErrAlreadySubscribed = errors.New("user is already subscribed to the list")
+	ErrNotSubscribed     = errors.New("user is not subscribed to the list")
+	ErrLastListOwner     = errors.New("the last owner cannot leave a list with other members")
+	ErrPostingRestricted = errors.New("posting to this list is restricted to its members")
+	ErrMultipleLists     = errors.New("a message can be posted to one mailing list at a time")
+	ErrPostNotFound      = errors.New("held post not found")
+)
+
+var publicBaseURL = "http://localhost:8080"
+
+// SetPublicBaseURL sets the base URL of the API, used in the
+// List-Unsubscribe header of list posts.
+func SetPublicBaseURL(url string) {
+	publicBaseURL = strings.TrimRight(url, "/")
+}
+
+// ParseListPolicy parses a posting policy name; an empty string selects
+// members-only posting.
+func ParseListPolicy(s string) (string, error) {
+	switch s {
+	case "":
+		return ListPolicyMembers, nil
+	case ListPolicyOpen, ListPolicyMembers, ListPolicyModerated:
+		return s, nil
+	default:
+		return "", fmt.Errorf("unsupported posting policy %q", s)
+	}
+}
+
+// ListInfo describes a mailing list to one of its members. Members are
+// only listed for owners.
+type ListInfo struct {
+	ID          uint
+	Address     string
+	Name        string
+	Description string
+	Policy      string
+	Owner       bool
+	Members     []ListMemberInfo
+	CreatedAt   time.Time
+}
+
+// ListMemberInfo describes a member of a mailing list.
+type ListMemberInfo struct {
+	UserID uint
+	Email  string
+	Owner  bool
+}
+
+// HeldPost is a post to a moderated list awaiting an owner's decision,
+// decrypted for the owner.
+type HeldPost struct {
+	ID        uint
+	MessageID uint
+	SenderID  uint
+	From      string
+	Subject   string
+	Body      string
+	SentAt    time.Time
+}
+
+// LookupList returns the mailing list with the given address.
+func LookupList(address string, db *gorm.DB) (*models.MailingList, error) {
+	var list models.MailingList
+	err := db.Where("address = ?", strings.ToLower(strings.TrimSpace(address))).First(&list).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrListNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
+
+// CreateList creates a mailing list with the given address, owned by
+// ownerID, who is its first member. Only administrators can create one, in
+// a local domain.
+func CreateList(ownerID uint, address, name, description, policy string, db *gorm.DB) (*models.MailingList, error) {
+	address = strings.ToLower(strings.TrimSpace(address))
+	var owner models.User
+	if err := db.Where("id = ?", ownerID).First(&owner).Error; err != nil {
+		return nil, err
+	}
+	if err := checkSharedAddress(owner, address, db); err != nil {
+		return nil, err
+	}
+
+	list := models.MailingList{Address: address, Name: name, Description: description, Policy: policy}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&list).Error; err != nil {
+			return err
+		}
+		return tx.Create(&models.MailingListMember{ListID: list.ID, UserID: ownerID, Owner: true}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
+
+// checkAddressFree returns ErrAddressTaken if a user, shared mailbox or list
+// has the lowercased address.
+func checkAddressFree(address string, db *gorm.DB) error {
+	var taken int64
+	if err := db.Model(&models.User{}).Where("LOWER(email) = ?", address).Count(&taken).Error; err != nil {
+		return err
+	}
+	if taken == 0 {
+		if err := db.Model(&models.MailingList{}).Where("address = ?", address).Count(&taken).Error; err != nil {
+			return err
+		}
+	}
+	if taken > 0 {
+		return ErrAddressTaken
+	}
+	return nil
+}
+
+// UpdateList changes the name, description and posting policy of a list.
+func UpdateList(ownerID, listID uint, name, description, policy string, db *gorm.DB) error {
+	list, err := ownedList(db, listID, ownerID)
+	if err != nil {
+		return err
+	}
+	return db.Model(list).Updates(map[string]interface{}{"name": name, "description": description, "policy": policy}).Error
+}
+
+// DeleteList deletes a list with its memberships and pending posts. Posts
+// already delivered stay in their recipients' mailboxes.
+func DeleteList(ownerID, listID uint, db *gorm.DB) error {
+	list, err := ownedList(db, listID, ownerID)
+	if err != nil {
+		return err
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("list_id = ?", list.ID).Delete(&models.MailingListMember{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("list_id = ? AND status = ?", list.ID, PostHeld).Delete(&models.MailingListPost{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(list).Error
+	})
+}
+
+// ListMailingLists returns the lists the user is subscribed to.
+func ListMailingLists(userID uint, db *gorm.DB) ([]ListInfo, error) {
+	var memberships []models.MailingListMember
+	if err := db.Where("user_id = ?", userID).Order("list_id").Find(&memberships).Error; err != nil {
+		return nil, err
+	}
+	lists := make([]ListInfo, 0, len(memberships))
+	for _, membership := range memberships {
+		info, err := GetList(userID, membership.ListID, db)
+		if err != nil {
+			return nil, err
+		}
+		lists = append(lists, *info)
+	}
+	return lists, nil
+}
+
+// GetList returns a list the user is subscribed to.
+func GetList(userID, listID uint, db *gorm.DB) (*ListInfo, error) {
+	list, member, err := listMembership(db, listID, userID)
+	if err != nil {
+		return nil, err
+	}
+	info := &ListInfo{
+		ID:          list.ID,
+		Address:     list.Address,
+		Name:        list.Name,
+		Description: list.Description,
+		Policy:      list.Policy,
+		Owner:       member.Owner,
+		CreatedAt:   list.CreatedAt,
+	}
+	if !member.Owner {
+		return info, nil
+	}
+
+	var members []models.MailingListMember
+	if err := db.Where("list_id = ?", listID).Order("id").Find(&members).Error; err != nil {
+		return nil, err
+	}
+	for _, m := range members {
+		var user models.User
+		if err := db.Select("id", "email").Where("id = ?", m.UserID).First(&user).Error; err != nil {
+			return nil, err
+		}
+		info.Members = append(info.Members, ListMemberInfo{UserID: user.ID, Email: user.Email, Owner: m.Owner})
+	}
+	return info, nil
+}
+
+// AddListMember subscribes a user to a list, optionally as an owner. They
+// receive posts sent from then on.
+func AddListMember(ownerID, listID, userID uint, owner bool, db *gorm.DB) error {
+	list, err := ownedList(db, listID, ownerID)
+	if err != nil {
+		return err
+	}
+	var user models.User
+	if err := db.Where("id = ?", userID).First(&user).Error; err != nil {
+		return err
+	}
+	var existing int64
+	if err := db.Model(&models.MailingListMember{}).Where("list_id = ? AND user_id = ?", list.ID, userID).Count(&existing).Error; err != nil {
+		return err
+	}
+	if existing > 0 {
+		return ErrAlreadySubscribed
+	}
+	return db.Create(&models.MailingListMember{ListID: list.ID, UserID: userID, Owner: owner}).Error
+}
+
+// RemoveListMember unsubscribes a user from a list.
+func RemoveListMember(ownerID, listID, userID uint, db *gorm.DB) error {
+	if _, err := ownedList(db, listID, ownerID); err != nil {
+		return err
+	}
+	return Unsubscribe(userID, listID, db)
+}
+
+// Unsubscribe removes the user from a list. Posts already delivered stay
+// readable.
+func Unsubscribe(userID, listID uint, db *gorm.DB) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		// Serialize membership changes so a list cannot lose its last owner
+		var list models.MailingList
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ?", listID).First(&list).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrListNotFound
+		}
+		if err != nil {
+			return err
+		}
+		var owners, others int64
+		if err := tx.Model(&models.MailingListMember{}).Where("list_id = ? AND owner AND user_id <> ?", listID, userID).Count(&owners).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&models.MailingListMember{}).Where("list_id = ? AND user_id <> ?", listID, userID).Count(&others).Error; err != nil {
+			return err
+		}
+
+		var member models.MailingListMember
+		err = tx.Where("list_id = ? AND user_id = ?", listID, userID).First(&member).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrNotSubscribed
+		}
+		if err != nil {
+			return err
+		}
+		if member.Owner && owners == 0 && others > 0 {
+			return ErrLastListOwner
+		}
+		return tx.Delete(&member).Error
+	})
+}
+
+// listPost is a post to a mailing list being sent.
+type listPost struct {
+	list *models.MailingList
+	// recipients are the members the post is encrypted to: all members but
+	// the sender, or only the owners while it is held for moderation
+	recipients []models.User
+	held       bool
+}
+
+// prepareListPost finds the mailing list among addresses, checks that the
+// sender may post to it and returns the post with the remaining addresses.
+// post is nil when no list is addressed.
+func prepareListPost(sender models.User, addresses []string, db *gorm.DB) (*listPost, []string, error) {
+	var post *listPost
+	var remaining []string
+	for _, addr := range addresses {
+		list, err := LookupList(addr, db)
+		if errors.Is(err, ErrListNotFound) {
+			remaining = append(remaining, addr)
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if post != nil {
+			if post.list.ID == list.ID {
+				continue
+			}
+			return nil, nil, ErrMultipleLists
+		}
+		post = &listPost{list: list}
+	}
+	if post == nil {
+		return nil, remaining, nil
+	}
+
+	var member models.MailingListMember
+	err := db.Where("list_id = ? AND user_id = ?", post.list.ID, sender.ID).First(&member).Error
+	isMember := err == nil
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil, err
+	}
+	if post.list.Policy != ListPolicyOpen && !isMember {
+		return nil, nil, ErrPostingRestricted
+	}
+	post.held = post.list.Policy == ListPolicyModerated && !member.Owner
+
+	if post.recipients, err = listRecipients(db, post.list.ID, sender.ID, post.held); err != nil {
+		return nil, nil, err
+	}
+	return post, remaining, nil
+}
+
+// listRecipients returns the members of a list other than the sender that
+// can receive mail, or only its owners.
+func listRecipients(db *gorm.DB, listID, senderID uint, ownersOnly bool) ([]models.User, error) {
+	memberIDs := db.Model(&models.MailingListMember{}).Select("user_id").Where("list_id = ?", listID)
+	if ownersOnly {
+		memberIDs = memberIDs.Where("owner")
+	}
+	var users []models.User
+	if err := db.Where("id IN (?) AND id <> ?", memberIDs, senderID).Order("id").Find(&users).Error; err != nil {
+		return nil, err
+	}
+	// One unverified member does not block posts to everyone else
+	if verificationPolicy == VerificationStrict {
+		users = slices.DeleteFunc(users, func(user models.User) bool { return !user.IsVerified() })
+	}
+	return users, nil
+}
+
+// HeldPosts returns the posts to a list awaiting moderation, decrypted with
+// the owner's unwrapped privateKey.
+func HeldPosts(ownerID, listID uint, privateKey []byte, db *gorm.DB) ([]HeldPost, error) {
+	list, err := ownedList(db, listID, ownerID)
+	if err != nil {
+		return nil, err
+	}
+	var posts []models.MailingListPost
+	if err := db.Where("list_id = ? AND status = ?", list.ID, PostHeld).Order("id").Find(&posts).Error; err != nil {
+		return nil, err
+	}
+
+	ring := newKeyring(ownerID, privateKey, db)
+	held := make([]HeldPost, 0, len(posts))
+	for _, post := range posts {
+		var msg Message
+		if err := db.Where("id = ?", post.MessageID).First(&msg).Error; err != nil {
+			return nil, err
+		}
+		body, metadata, err := decryptMessage(msg, ownerID, ring)
+		if errors.Is(err, ErrSessionKeyNotFound) {
+			// Held before this owner joined
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var sender models.User
+		if err := db.Select("id", "email").Where("id = ?", msg.SenderID).First(&sender).Error; err != nil {
+			return nil, err
+		}
+		held = append(held, HeldPost{
+			ID:        post.ID,
+			MessageID: msg.ID,
+			SenderID:  msg.SenderID,
+			From:      sender.Email,
+			Subject:   metadata["subject"],
+			Body:      string(body),
+			SentAt:    msg.SentAt,
+		})
+	}
+	return held, nil
+}
+
+// ApprovePost delivers a held post to the list's current members. The
+// owner's unwrapped privateKey opens the post's session key to wrap it for
+// them.
+func ApprovePost(ownerID, listID, postID uint, privateKey []byte, db *gorm.DB) error {
+	if _, err := ownedList(db, listID, ownerID); err != nil {
+		return err
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		post, err := lockHeldPost(tx, listID, postID)
+		if err != nil {
+			return err
+		}
+		var msg Message
+		if err := tx.Where("id = ?", post.MessageID).First(&msg).Error; err != nil {
+			return err
+		}
+		var encryptedKeys []EncryptedKey
+		if err := json.Unmarshal([]byte(msg.EncryptedSessionKeys), &encryptedKeys); err != nil {
+			return err
+		}
+		var recipients []uint
+		if err := json.Unmarshal([]byte(msg.RecipientsJSON), &recipients); err != nil {
+			return err
+		}
+
+		// The post was encrypted to the owners when it was held
+		var passphrase string
+		for _, key := range encryptedKeys {
+			if key.RecipientID == ownerID && key.Group == nil && key.Ratchet == nil {
+				if passphrase, err = decryptPassphrase(msg, key, newKeyring(ownerID, privateKey, tx)); err != nil {
+					return err
+				}
+				break
+			}
+		}
+		if passphrase == "" {
+			return ErrSessionKeyNotFound
+		}
+
+		members, err := listRecipients(tx, listID, msg.SenderID, false)
+		if err != nil {
+			return err
+		}
+		var newUsers []models.User
+		var delivered []uint
+		for _, member := range members {
+			if !slices.Contains(recipients, member.ID) {
+				recipients = append(recipients, member.ID)
+				delivered = append(delivered, member.ID)
+			}
+			if !slices.ContainsFunc(encryptedKeys, func(key EncryptedKey) bool { return key.RecipientID == member.ID && key.Group == nil }) {
+				newUsers = append(newUsers, member)
+			}
+		}
+		keys, err := wrapForUsers(passphrase, newUsers)
+		if err != nil {
+			return err
+		}
+		keysJSON, err := json.Marshal(append(encryptedKeys, keys...))
+		if err != nil {
+			return err
+		}
+		recipientsJSON, err := json.Marshal(recipients)
+		if err != nil {
+			return err
+		}
+
+		if err := tx.Model(&msg).Updates(map[string]interface{}{
+			"encrypted_session_keys": string(keysJSON),
+			"recipients_json":        string(recipientsJSON),
+		}).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(post).Updates(map[string]interface{}{"status": PostApproved, "moderator_id": ownerID}).Error; err != nil {
+			return err
+		}
+		return recordChange(tx, delivered, msg.ID, ChangeCreated)
+	})
+}
+
+// RejectPost discards a held post. The sender keeps it in their Sent
+// mailbox.
+func RejectPost(ownerID, listID, postID uint, db *gorm.DB) error {
+	if _, err := ownedList(db, listID, ownerID); err != nil {
+		return err
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		post, err := lockHeldPost(tx, listID, postID)
+		if err != nil {
+			return err
+		}
+		return tx.Model(post).Updates(map[string]interface{}{"status": PostRejected, "moderator_id": ownerID}).Error
+	})
+}
+
+// lockHeldPost locks a post to a list that is awaiting moderation.
+func lockHeldPost(tx *gorm.DB, listID, postID uint) (*models.MailingListPost, error) {
+	var post models.MailingListPost
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("id = ? AND list_id = ? AND status = ?", postID, listID, PostHeld).First(&post).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrPostNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &post, nil
+}
+
+// listMembership returns a list with the user's membership, or
+// ErrListNotFound when they are not subscribed.
+func listMembership(db *gorm.DB, listID, userID uint) (*models.MailingList, *models.MailingListMember, error) {
+	var member models.MailingListMember
+	err := db.Where("list_id = ? AND user_id = ?", listID, userID).First(&member).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil, ErrListNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	var list models.MailingList
+	if err := db.Where("id = ?", listID).First(&list).Error; err != nil {
+		return nil, nil, err
+	}
+	return &list, &member, nil
+}
+
+// ownedList returns a list the user owns.
+func ownedList(db *gorm.DB, listID, userID uint) (*models.MailingList, error) {
+	list, member, err := listMembership(db, listID, userID)
+	if err != nil {
+		return nil, err
+	}
+	if !member.Owner {
+		return nil, ErrNotListOwner
+	}
+	return list, nil
+}
+
+// listHeaders returns the RFC 2369 and RFC 2919 headers of a post to the
+// list recorded in metadata, or nil.
+func listHeaders(metadata map[string]string) map[string]string {
+	address := metadata["list_address"]
+	if address == "" {
+		return nil
+	}
+	return map[string]string{
+		"List-Id":          "<" + strings.Replace(address, "@", ".", 1) + ">",
+		"List-Post":        "<mailto:" + address + ">",
+		"List-Unsubscribe": "<" + publicBaseURL + "/lists/" + metadata["list_id"] + "/unsubscribe>",
+	}
+}
+
+// directRecipients returns the IDs recorded in the direct_recipients
+// metadata of a list post.
+func directRecipients(metadata map[string]string) []uint {
+	var ids []uint
+	for _, field := range strings.Split(metadata["direct_recipients"], ",") {
+		if id, err := strconv.ParseUint(field, 10, 64); err == nil {
+			ids = append(ids, uint(id))
+		}
+	}
+	return ids
+}
@@ -0,0 +1,183 @@
+package email
+
+import (
+	"encoding/json"
+	"errors"
+	"secmail/internal/models"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseListPolicy(t *testing.T) {
+	if p, err := ParseListPolicy(""); err != nil || p != ListPolicyMembers {
+		t.Errorf("Empty policy should default to members, got %q (%v)", p, err)
+	}
+	if p, err := ParseListPolicy(ListPolicyModerated); err != nil || p != ListPolicyModerated {
+		t.Errorf("Failed to parse moderated policy: %q (%v)", p, err)
+	}
+	if _, err := ParseListPolicy("anyone"); err == nil {
+		t.Error("Expected an error for an unknown policy")
+	}
+}
+
+func TestListHeaders(t *testing.T) {
+	defer SetPublicBaseURL("http://localhost:8080")
+	SetPublicBaseURL("https://mail.secmail.test/")
+
+	metadata := map[string]string{"subject": "Standup", "list_address": "team@secmail.test", "list_id": "4", "direct_recipients": "2,x,7"}
+	raw, err := ComposeMIME(OutgoingMessage{
+		From:    "alice@secmail.test",
+		To:      []string{"team@secmail.test"},
+		Subject: metadata["subject"],
+		Body:    "Hello team",
+		Headers: listHeaders(metadata),
+	})
+	if err != nil {
+		t.Fatalf("Failed to compose message: %v", err)
+	}
+	for _, header := range []string{
+		"List-Id: <team.secmail.test>",
+		"List-Post: <mailto:team@secmail.test>",
+		"List-Unsubscribe: <https://mail.secmail.test/lists/4/unsubscribe>",
+	} {
+		if !strings.Contains(string(raw), header+"\r\n") {
+			t.Errorf("Missing header %q", header)
+		}
+	}
+
+	if ids := directRecipients(metadata); len(ids) != 2 || ids[0] != 2 || ids[1] != 7 {
+		t.Errorf("Unexpected direct recipients: %v", ids)
+	}
+	if listHeaders(map[string]string{"subject": "Hi"}) != nil {
+		t.Error("Expected no list headers for a direct message")
+	}
+}
+
+// setTestAdmins makes address the only administrator, allowed to create
+// addresses in secmail.test, until the test ends.
+func setTestAdmins(t *testing.T, address string) {
+	SetAdmins([]string{address})
+	SetLocalDomains([]string{"secmail.test"})
+	t.Cleanup(func() {
+		SetAdmins(nil)
+		SetLocalDomains(nil)
+	})
+}
+
+func TestCreateListAddress(t *testing.T) {
+	db := openTestDB(t)
+	alice, _ := createTestUser(t, db, "alice@secmail.test")
+	bob, _ := createTestUser(t, db, "bob@secmail.test")
+	setTestAdmins(t, alice.Email)
+
+	tests := []struct {
+		ownerID uint
+		address string
+		want    error
+	}{
+		{bob.ID, "team@secmail.test", ErrNotAdmin},
+		{alice.ID, "team@example.org", ErrAddressNotLocal},
+		{alice.ID, "Bob@secmail.test", ErrAddressTaken},
+	}
+	for _, tc := range tests {
+		if _, err := CreateList(tc.ownerID, tc.address, "Team", "", ListPolicyMembers, db); !errors.Is(err, tc.want) {
+			t.Errorf("CreateList(%d, %q): expected %v, got %v", tc.ownerID, tc.address, tc.want, err)
+		}
+	}
+
+	if _, err := CreateList(alice.ID, "Team@secmail.test", "Team", "", ListPolicyMembers, db); err != nil {
+		t.Fatalf("Failed to create list: %v", err)
+	}
+	if _, err := CreateList(alice.ID, "team@secmail.test", "Team", "", ListPolicyMembers, db); !errors.Is(err, ErrAddressTaken) {
+		t.Errorf("Expected the list's address to be taken, got %v", err)
+	}
+}
+
+func TestListPostingAndModeration(t *testing.T) {
+	db := openTestDB(t)
+	alice, alicePrivateKey := createTestUser(t, db, "alice@secmail.test")
+	bob, _ := createTestUser(t, db, "bob@secmail.test")
+	carol, carolPrivateKey := createTestUser(t, db, "carol@secmail.test")
+	dave, _ := createTestUser(t, db, "dave@secmail.test")
+	setTestAdmins(t, alice.Email)
+
+	list, err := CreateList(alice.ID, "team@secmail.test", "Team", "", ListPolicyMembers, db)
+	if err != nil {
+		t.Fatalf("Failed to create list: %v", err)
+	}
+	for _, member := range []models.User{bob, carol} {
+		if err := AddListMember(alice.ID, list.ID, member.ID, false, db); err != nil {
+			t.Fatalf("Failed to add %s: %v", member.Email, err)
+		}
+	}
+	if err := AddListMember(bob.ID, list.ID, dave.ID, false, db); !errors.Is(err, ErrNotListOwner) {
+		t.Errorf("Expected only owners to add members, got %v", err)
+	}
+	recipientsOf := func(msg *Message) []uint {
+		var loaded Message
+		if err := db.Select("recipients_json").Where("id = ?", msg.ID).First(&loaded).Error; err != nil {
+			t.Fatalf("Failed to load message: %v", err)
+		}
+		var recipients []uint
+		if err := json.Unmarshal([]byte(loaded.RecipientsJSON), &recipients); err != nil {
+			t.Fatalf("Failed to parse recipients: %v", err)
+		}
+		return recipients
+	}
+
+	// Members-only lists refuse outsiders and deliver members' posts to the
+	// other members
+	if _, err := SendMessage(dave.ID, nil, nil, []string{list.Address}, "Hi", "Let me in", Lifetime{}, nil, db); !errors.Is(err, ErrPostingRestricted) {
+		t.Errorf("Expected a non-member post to be refused, got %v", err)
+	}
+	msg, err := SendMessage(bob.ID, nil, nil, []string{list.Address}, "Standup", "At ten", Lifetime{}, nil, db)
+	if err != nil {
+		t.Fatalf("Failed to post: %v", err)
+	}
+	if recipients := recipientsOf(msg); len(recipients) != 2 || !slices.Contains(recipients, alice.ID) || !slices.Contains(recipients, carol.ID) {
+		t.Errorf("Expected the post to reach alice and carol, got %v", recipients)
+	}
+
+	// Posts to moderated lists are held for the owners
+	if err := UpdateList(alice.ID, list.ID, list.Name, "", ListPolicyModerated, db); err != nil {
+		t.Fatalf("Failed to update list: %v", err)
+	}
+	msg, err = SendMessage(bob.ID, nil, nil, []string{list.Address}, "Party", "Friday", Lifetime{}, nil, db)
+	if err != nil {
+		t.Fatalf("Failed to post: %v", err)
+	}
+	if recipients := recipientsOf(msg); len(recipients) != 0 {
+		t.Errorf("Expected a held post to reach nobody, got %v", recipients)
+	}
+	if _, err := HeldPosts(carol.ID, list.ID, carolPrivateKey, db); !errors.Is(err, ErrNotListOwner) {
+		t.Errorf("Expected only owners to see held posts, got %v", err)
+	}
+	held, err := HeldPosts(alice.ID, list.ID, alicePrivateKey, db)
+	if err != nil {
+		t.Fatalf("Failed to list held posts: %v", err)
+	}
+	if len(held) != 1 || held[0].Body != "Friday" || held[0].From != bob.Email {
+		t.Fatalf("Unexpected held posts: %+v", held)
+	}
+
+	if err := ApprovePost(carol.ID, list.ID, held[0].ID, carolPrivateKey, db); !errors.Is(err, ErrNotListOwner) {
+		t.Errorf("Expected only owners to approve posts, got %v", err)
+	}
+	if err := ApprovePost(alice.ID, list.ID, held[0].ID, alicePrivateKey, db); err != nil {
+		t.Fatalf("Failed to approve post: %v", err)
+	}
+	if recipients := recipientsOf(msg); len(recipients) != 2 || !slices.Contains(recipients, carol.ID) {
+		t.Errorf("Expected the approved post to reach the members, got %v", recipients)
+	}
+	inbox, err := GetInbox(carol.ID, carolPrivateKey, db)
+	if err != nil {
+		t.Fatalf("Failed to read inbox: %v", err)
+	}
+	if !slices.ContainsFunc(inbox, func(m DecryptedMessage) bool { return m.ID == msg.ID && m.Body == "Friday" }) {
+		t.Errorf("Expected carol to read the approved post, got %+v", inbox)
+	}
+	if err := ApprovePost(alice.ID, list.ID, held[0].ID, alicePrivateKey, db); !errors.Is(err, ErrPostNotFound) {
+		t.Errorf("Expected a post to be approved once, got %v", err)
+	}
+}
@@ -0,0 +1,218 @@
+package email
+
+import (
+	"encoding/json"
+	"errors"
+	"secmail/internal/models"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Mailboxes a user's messages are presented in by mail access protocols.
+const (
+	MailboxInbox = "INBOX"
+	MailboxSent  = "Sent"
+)
+
+var ErrNoSuchMailbox = errors.New("no such mailbox")
+
+// MailboxMessage is the unencrypted summary of a message in a mailbox.
+type MailboxMessage struct {
+	ID             uint
+	ConversationID uint
+	SentAt         time.Time
+	Flags          []string
+	// Ephemeral is set for messages that expire or are burnt after reading.
+	Ephemeral        bool
+	BurnAfterReading bool
+}
+
+// ListMailbox returns the messages of one of the user's mailboxes in ID
+// order, with the user's flags. Nothing is decrypted.
+func ListMailbox(userID uint, mailbox string, db *gorm.DB) ([]MailboxMessage, error) {
+	var query *gorm.DB
+	switch mailbox {
+	case MailboxInbox:
+		query = recipientScope(db, userID)
+	case MailboxSent:
+		query = db.Where("sender_id = ?", userID)
+	default:
+		return nil, ErrNoSuchMailbox
+	}
+
+	var messages []Message
+	if err := unexpired(query).Select("id", "conversation_id", "sent_at", "expires_at", "burn_after_reading").Order("id").Find(&messages).Error; err != nil {
+		return nil, err
+	}
+
+	var flags []models.MessageFlags
+	if err := db.Where("user_id = ?", userID).Find(&flags).Error; err != nil {
+		return nil, err
+	}
+	flagsByMessage := make(map[uint][]string, len(flags))
+	for _, f := range flags {
+		flagsByMessage[f.MessageID] = strings.Fields(f.Flags)
+	}
+
+	result := make([]MailboxMessage, 0, len(messages))
+	for _, msg := range messages {
+		result = append(result, MailboxMessage{
+			ID:               msg.ID,
+			ConversationID:   msg.ConversationID,
+			SentAt:           msg.SentAt,
+			Flags:            flagsByMessage[msg.ID],
+			Ephemeral:        msg.ExpiresAt != nil || msg.BurnAfterReading,
+			BurnAfterReading: msg.BurnAfterReading,
+		})
+	}
+	return result, nil
+}
+
+// CountMessages returns the number of messages the user sent or received.
+func CountMessages(userID uint, db *gorm.DB) (int64, error) {
+	var count int64
+	err := recipientScope(db.Model(&Message{}), userID).Or("sender_id = ?", userID).Count(&count).Error
+	return count, err
+}
+
+// LoadMessages returns the messages with the given IDs that the user sent or
+// received, in ID order. Other IDs and expired messages are skipped.
+func LoadMessages(userID uint, ids []uint, db *gorm.DB) ([]Message, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	var messages []Message
+	if err := unexpired(db).Where("id IN ?", ids).Order("id").Find(&messages).Error; err != nil {
+		return nil, err
+	}
+	visible := messages[:0]
+	for _, msg := range messages {
+		if len(MessageMailboxes(msg, userID)) > 0 {
+			visible = append(visible, msg)
+		}
+	}
+	return visible, nil
+}
+
+// MessageMailboxes returns the user's mailboxes containing msg: INBOX if they
+// are a recipient and Sent if they are the sender.
+func MessageMailboxes(msg Message, userID uint) []string {
+	var mailboxes []string
+	var recipients []uint
+	if err := json.Unmarshal([]byte(msg.RecipientsJSON), &recipients); err == nil {
+		for _, id := range recipients {
+			if id == userID {
+				mailboxes = append(mailboxes, MailboxInbox)
+				break
+			}
+		}
+	}
+	if msg.SenderID == userID {
+		mailboxes = append(mailboxes, MailboxSent)
+	}
+	return mailboxes
+}
+
+// MessageFlags returns the user's flags on the given messages.
+func MessageFlags(userID uint, ids []uint, db *gorm.DB) (map[uint][]string, error) {
+	result := make(map[uint][]string, len(ids))
+	if len(ids) == 0 {
+		return result, nil
+	}
+	var flags []models.MessageFlags
+	if err := db.Where("user_id = ? AND message_id IN ?", userID, ids).Find(&flags).Error; err != nil {
+		return nil, err
+	}
+	for _, f := range flags {
+		result[f.MessageID] = strings.Fields(f.Flags)
+	}
+	return result, nil
+}
+
+// SetMessageFlags replaces the user's flags on a message.
+func SetMessageFlags(userID, messageID uint, flags []string, db *gorm.DB) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if len(flags) == 0 {
+			if err := tx.Where("user_id = ? AND message_id = ?", userID, messageID).Delete(&models.MessageFlags{}).Error; err != nil {
+				return err
+			}
+			return recordChange(tx, []uint{userID}, messageID, ChangeUpdated)
+		}
+
+		var record models.MessageFlags
+		if err := tx.Where("user_id = ? AND message_id = ?", userID, messageID).FirstOrInit(&record).Error; err != nil {
+			return err
+		}
+		record.UserID = userID
+		record.MessageID = messageID
+		record.Flags = strings.Join(flags, " ")
+		if err := tx.Save(&record).Error; err != nil {
+			return err
+		}
+		return recordChange(tx, []uint{userID}, messageID, ChangeUpdated)
+	})
+}
+
+// RenderMessage decrypts a message the user sent or received and returns it
+// as RFC 5322. Mail received over SMTP or imported is returned exactly as it
+// arrived, so PGP/MIME and S/MIME layers are left for the mail client;
+// messages sent within secmail are rendered with ComposeMIME using
+// messageIDHeader. Rendering does not count as reading a burn-after-reading
+// message, as mail clients render messages to index them: callers call
+// MarkRead when the body is actually read.
+func RenderMessage(userID, messageID uint, privateKey []byte, messageIDHeader string, db *gorm.DB) ([]byte, error) {
+	var msg Message
+	if err := unexpired(db).Where("id = ?", messageID).First(&msg).Error; err != nil {
+		return nil, err
+	}
+	return renderMessage(msg, userID, privateKey, messageIDHeader, db)
+}
+
+func renderMessage(msg Message, userID uint, privateKey []byte, messageIDHeader string, db *gorm.DB) ([]byte, error) {
+	body, metadata, err := decryptMessage(msg, userID, newKeyring(userID, privateKey, db))
+	if err != nil {
+		return nil, err
+	}
+	if isRawSource(metadata) {
+		return body, nil
+	}
+
+	var recipientIDs []uint
+	if err := json.Unmarshal([]byte(msg.RecipientsJSON), &recipientIDs); err != nil {
+		return nil, err
+	}
+	userIDs := append([]uint{msg.SenderID}, recipientIDs...)
+	var users []models.User
+	if err := db.Where("id IN ?", userIDs).Find(&users).Error; err != nil {
+		return nil, err
+	}
+	addresses := make(map[uint]string, len(users))
+	for _, user := range users {
+		addresses[user.ID] = user.Email
+	}
+
+	out := OutgoingMessage{
+		From:      addresses[msg.SenderID],
+		Subject:   metadata["subject"],
+		Body:      string(body),
+		Date:      msg.SentAt,
+		MessageID: messageIDHeader,
+		Headers:   listHeaders(metadata),
+	}
+	// Posts to a mailing list are addressed to the list, not its members
+	if list := metadata["list_address"]; list != "" {
+		out.To = append(out.To, list)
+		recipientIDs = directRecipients(metadata)
+	}
+	for _, id := range recipientIDs {
+		if addr, ok := addresses[id]; ok {
+			out.To = append(out.To, addr)
+		}
+	}
+	if external := metadata["external_recipients"]; external != "" {
+		out.To = append(out.To, strings.Split(external, ",")...)
+	}
+	return ComposeMIME(out)
+}
@@ -0,0 +1,179 @@
+package email
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	_ "github.com/emersion/go-message/charset"
+	"github.com/emersion/go-message/mail"
+)
+
+// ParsedMessage is the readable content of an RFC 5322 message.
+type ParsedMessage struct {
+	From      string
+	To        []string
+	Subject   string
+	MessageID string
+	Date      time.Time
+	Body      string
+	// PGPEncrypted is set when the body arrived as PGP/MIME ciphertext.
+	PGPEncrypted bool
+	// PGPSignature is one of the crypto.PGPSignature* values, or empty when
+	// the message carried no OpenPGP content.
+	PGPSignature string
+	// SMIMEEncrypted is set when the body arrived as S/MIME enveloped data.
+	SMIMEEncrypted bool
+	// SMIMESignature is one of the crypto.SMIMESignature* values, or empty
+	// when the message carried no S/MIME signature.
+	SMIMESignature string
+	// SMIMESigner is the address in the S/MIME signer's certificate.
+	SMIMESigner string
+}
+
+// ParseMIME parses a raw RFC 5322 message. The body is the first inline
+// text/plain part, falling back to text/html when no plain part exists.
+// Encrypted content is left unread; use ParseSecureMIME to open it.
+func ParseMIME(raw []byte) (*ParsedMessage, error) {
+	return ParseSecureMIME(raw, nil)
+}
+
+// ParseSecureMIME parses a raw RFC 5322 message like ParseMIME, decrypting and
+// verifying PGP/MIME (RFC 3156) and S/MIME (RFC 8551) bodies with keys.
+func ParseSecureMIME(raw []byte, keys *ReadKeys) (*ParsedMessage, error) {
+	r, err := mail.CreateReader(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	parsed := &ParsedMessage{}
+	if from, err := r.Header.AddressList("From"); err == nil && len(from) > 0 {
+		parsed.From = from[0].Address
+	}
+	if to, err := r.Header.AddressList("To"); err == nil {
+		for _, addr := range to {
+			parsed.To = append(parsed.To, addr.Address)
+		}
+	}
+	parsed.Subject, _ = r.Header.Subject()
+	parsed.MessageID, _ = r.Header.MessageID()
+	parsed.Date, _ = r.Header.Date()
+
+	body, err := readEntityBody(raw, keys, parsed)
+	if err != nil {
+		return nil, err
+	}
+	parsed.Body = strings.TrimRight(strings.ReplaceAll(body, "\r\n", "\n"), "\n")
+
+	return parsed, nil
+}
+
+// readPlainBody returns the first inline text/plain part of a MIME entity,
+// falling back to text/html.
+func readPlainBody(raw []byte) (string, error) {
+	r, err := mail.CreateReader(bytes.NewReader(raw))
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	var plain, html string
+	for {
+		part, err := r.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+
+		h, ok := part.Header.(*mail.InlineHeader)
+		if !ok {
+			continue
+		}
+		contentType, _, _ := h.ContentType()
+		body, err := io.ReadAll(part.Body)
+		if err != nil {
+			return "", err
+		}
+		switch {
+		case contentType == "text/plain" && plain == "":
+			plain = string(body)
+		case contentType == "text/html" && html == "":
+			html = string(body)
+		}
+	}
+
+	switch {
+	case plain != "":
+		return plain, nil
+	case html != "":
+		return html, nil
+	default:
+		return "", errors.New("message has no readable body")
+	}
+}
+
+// OutgoingMessage describes a message to be rendered as RFC 5322.
+type OutgoingMessage struct {
+	From      string
+	To        []string
+	Subject   string
+	Body      string
+	Date      time.Time
+	MessageID string
+	// Headers are added as they are, such as the List-* headers of posts to
+	// mailing lists.
+	Headers map[string]string
+}
+
+// ComposeMIME renders a plain text message as RFC 5322 with MIME headers.
+func ComposeMIME(m OutgoingMessage) ([]byte, error) {
+	h, err := outgoingHeader(m)
+	if err != nil {
+		return nil, err
+	}
+	h.SetContentType("text/plain", map[string]string{"charset": "utf-8"})
+
+	var buf bytes.Buffer
+	w, err := mail.CreateSingleInlineWriter(&buf, h)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.WriteString(w, m.Body); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// outgoingHeader returns the RFC 5322 header of m without a Content-Type.
+func outgoingHeader(m OutgoingMessage) (mail.Header, error) {
+	var h mail.Header
+	h.SetDate(m.Date)
+	h.SetAddressList("From", []*mail.Address{{Address: m.From}})
+	to := make([]*mail.Address, 0, len(m.To))
+	for _, addr := range m.To {
+		to = append(to, &mail.Address{Address: addr})
+	}
+	h.SetAddressList("To", to)
+	h.SetSubject(m.Subject)
+	if m.MessageID != "" {
+		h.SetMessageID(m.MessageID)
+	} else if err := h.GenerateMessageID(); err != nil {
+		return mail.Header{}, err
+	}
+	// Sorted so a message renders the same way every time
+	for _, key := range slices.Sorted(maps.Keys(m.Headers)) {
+		h.Set(key, m.Headers[key])
+	}
+	h.Set("MIME-Version", "1.0")
+	return h, nil
+}
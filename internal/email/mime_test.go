@@ -0,0 +1,44 @@
+package email
+
+import (
+	"testing"
+	"time"
+)
+
+func TestComposeParseMIME(t *testing.T) {
+	date := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	raw, err := ComposeMIME(OutgoingMessage{
+		From:      "alice@secmail.test",
+		To:        []string{"carol@example.org", "dave@example.org"},
+		Subject:   "Grüße",
+		Body:      "Hello,\nthis is a test.",
+		Date:      date,
+		MessageID: "secmail-1@secmail.test",
+	})
+	if err != nil {
+		t.Fatalf("Failed to compose message: %v", err)
+	}
+
+	parsed, err := ParseMIME(raw)
+	if err != nil {
+		t.Fatalf("Failed to parse message: %v", err)
+	}
+	if parsed.From != "alice@secmail.test" {
+		t.Errorf("Unexpected From: %s", parsed.From)
+	}
+	if len(parsed.To) != 2 || parsed.To[1] != "dave@example.org" {
+		t.Errorf("Unexpected To: %v", parsed.To)
+	}
+	if parsed.Subject != "Grüße" {
+		t.Errorf("Unexpected Subject: %s", parsed.Subject)
+	}
+	if parsed.MessageID != "secmail-1@secmail.test" {
+		t.Errorf("Unexpected Message-ID: %s", parsed.MessageID)
+	}
+	if !parsed.Date.Equal(date) {
+		t.Errorf("Unexpected Date: %v", parsed.Date)
+	}
+	if parsed.Body != "Hello,\nthis is a test." {
+		t.Errorf("Unexpected Body: %q", parsed.Body)
+	}
+}
@@ -0,0 +1,139 @@
+package email
+
+import (
+	"errors"
+	"secmail/internal/crypto"
+	"secmail/internal/models"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// ImportPGPKey stores the user's own OpenPGP secret key, replacing any
+// previous one. The key is unlocked with passphrase and re-encrypted to the
+// user's secmail public key.
+func ImportPGPKey(userID uint, armored []byte, passphrase string, db *gorm.DB) (*models.PGPKey, crypto.PGPKeyInfo, error) {
+	var user models.User
+	if err := db.Where("id = ?", userID).First(&user).Error; err != nil {
+		return nil, crypto.PGPKeyInfo{}, err
+	}
+
+	secretKey, publicKey, info, err := crypto.ImportPGPSecretKey(armored, passphrase)
+	if err != nil {
+		return nil, crypto.PGPKeyInfo{}, err
+	}
+	encryptedSecret, sessionPassphrase, err := crypto.EncryptBody(secretKey)
+	if err != nil {
+		return nil, crypto.PGPKeyInfo{}, err
+	}
+	encryptedPassphrase, err := crypto.EncryptPassphrase(sessionPassphrase, user.PublicKey)
+	if err != nil {
+		return nil, crypto.PGPKeyInfo{}, err
+	}
+
+	var key models.PGPKey
+	if err := db.Where("user_id = ?", userID).FirstOrInit(&key).Error; err != nil {
+		return nil, crypto.PGPKeyInfo{}, err
+	}
+	key.UserID = userID
+	key.Fingerprint = info.Fingerprint
+	key.PublicKey = publicKey
+	key.EncryptedSecretKey = encryptedSecret
+	key.EncryptedPassphrase = encryptedPassphrase
+	if err := db.Save(&key).Error; err != nil {
+		return nil, crypto.PGPKeyInfo{}, err
+	}
+	return &key, info, nil
+}
+
+// ImportPGPContactKey stores an external correspondent's OpenPGP public key
+// for each address, replacing keys previously stored for those addresses.
+// When no address is given, the addresses in the key's user IDs are used.
+func ImportPGPContactKey(userID uint, armored []byte, addresses []string, db *gorm.DB) ([]models.PGPContactKey, error) {
+	publicKey, info, err := crypto.ImportPGPPublicKey(armored)
+	if err != nil {
+		return nil, err
+	}
+	if len(addresses) == 0 {
+		addresses = info.Emails
+	}
+	if len(addresses) == 0 {
+		return nil, errors.New("OpenPGP key has no email address; specify one")
+	}
+
+	var contacts []models.PGPContactKey
+	err = db.Transaction(func(tx *gorm.DB) error {
+		for _, addr := range addresses {
+			addr = strings.ToLower(strings.TrimSpace(addr))
+			var contact models.PGPContactKey
+			if err := tx.Where("user_id = ? AND email = ?", userID, addr).FirstOrInit(&contact).Error; err != nil {
+				return err
+			}
+			contact.UserID = userID
+			contact.Email = addr
+			contact.Fingerprint = info.Fingerprint
+			contact.PublicKey = publicKey
+			if err := tx.Save(&contact).Error; err != nil {
+				return err
+			}
+			contacts = append(contacts, contact)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return contacts, nil
+}
+
+// LoadReadKeys returns the key material of a user for reading PGP/MIME and
+// S/MIME messages, including the S/MIME certificates of retired keys.
+func LoadReadKeys(userID uint, privateKey []byte, db *gorm.DB) (*ReadKeys, error) {
+	var user models.User
+	if err := db.Where("id = ?", userID).First(&user).Error; err != nil {
+		return nil, err
+	}
+	secretKey, err := userPGPSecretKey(userID, privateKey, db)
+	if err != nil {
+		return nil, err
+	}
+
+	var contacts []models.PGPContactKey
+	if err := db.Where("user_id = ?", userID).Find(&contacts).Error; err != nil {
+		return nil, err
+	}
+	keys := &ReadKeys{PGPSecretKey: secretKey, Certificate: user.Certificate, PrivateKey: privateKey}
+	for _, contact := range contacts {
+		keys.PGPContacts = append(keys.PGPContacts, contact.PublicKey)
+	}
+
+	retired, retiredKeys, err := newKeyring(userID, privateKey, db).retiredKeys()
+	if err != nil {
+		return nil, err
+	}
+	for i, userKey := range retired {
+		if userKey.Certificate != nil {
+			keys.RetiredSMIME = append(keys.RetiredSMIME, SMIMEKeyPair{Certificate: userKey.Certificate, PrivateKey: retiredKeys[i]})
+		}
+	}
+	return keys, nil
+}
+
+// userPGPSecretKey decrypts the user's OpenPGP secret key. It returns nil
+// without error when the user has not imported one.
+func userPGPSecretKey(userID uint, privateKey []byte, db *gorm.DB) ([]byte, error) {
+	var key models.PGPKey
+	err := db.Where("user_id = ?", userID).First(&key).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	passphrase, err := crypto.DecryptPassphrase(key.EncryptedPassphrase, privateKey)
+	if err != nil {
+		return nil, err
+	}
+	return crypto.DecryptBody(key.EncryptedSecretKey, passphrase)
+}
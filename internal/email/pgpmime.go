@@ -0,0 +1,119 @@
+package email
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"secmail/internal/crypto"
+
+	"github.com/emersion/go-message/textproto"
+)
+
+// Bodies shown in place of PGP/MIME content that cannot be opened.
+const (
+	pgpNoKeyBody       = "[This message is OpenPGP encrypted. Import your OpenPGP key to read it.]"
+	pgpUndecryptedBody = "[This message is OpenPGP encrypted and could not be decrypted with your OpenPGP key.]"
+)
+
+// ComposePGPMIME renders m as an RFC 3156 PGP/MIME message. The body is
+// encrypted (and signed, if signerKey is set) when recipientKeys are given,
+// otherwise it is only signed. With neither it falls back to ComposeMIME.
+func ComposePGPMIME(m OutgoingMessage, recipientKeys [][]byte, signerKey []byte) ([]byte, error) {
+	if len(recipientKeys) == 0 && signerKey == nil {
+		return ComposeMIME(m)
+	}
+
+	h, err := outgoingHeader(m)
+	if err != nil {
+		return nil, err
+	}
+	boundary, err := randomBoundary()
+	if err != nil {
+		return nil, err
+	}
+	inner := textPart(m.Body)
+
+	var body bytes.Buffer
+	if len(recipientKeys) > 0 {
+		ciphertext, err := crypto.EncryptPGP(inner, recipientKeys, signerKey)
+		if err != nil {
+			return nil, err
+		}
+		h.SetContentType("multipart/encrypted", map[string]string{
+			"protocol": "application/pgp-encrypted",
+			"boundary": boundary,
+		})
+		fmt.Fprintf(&body, "--%s\r\nContent-Type: application/pgp-encrypted\r\n\r\nVersion: 1\r\n", boundary)
+		fmt.Fprintf(&body, "--%s\r\nContent-Type: application/octet-stream; name=\"encrypted.asc\"\r\n\r\n", boundary)
+		body.Write(toCRLF(ciphertext))
+	} else {
+		signature, micalg, err := crypto.SignPGPDetached(inner, signerKey)
+		if err != nil {
+			return nil, err
+		}
+		h.SetContentType("multipart/signed", map[string]string{
+			"protocol": "application/pgp-signature",
+			"micalg":   micalg,
+			"boundary": boundary,
+		})
+		fmt.Fprintf(&body, "--%s\r\n", boundary)
+		body.Write(inner)
+		fmt.Fprintf(&body, "\r\n--%s\r\nContent-Type: application/pgp-signature; name=\"signature.asc\"\r\n\r\n", boundary)
+		body.Write(toCRLF(signature))
+	}
+	fmt.Fprintf(&body, "\r\n--%s--\r\n", boundary)
+
+	var buf bytes.Buffer
+	if err := textproto.WriteHeader(&buf, h.Header.Header); err != nil {
+		return nil, err
+	}
+	buf.Write(body.Bytes())
+	return buf.Bytes(), nil
+}
+
+// readPGPEncrypted opens a multipart/encrypted PGP/MIME body.
+func readPGPEncrypted(content []byte, boundary string, keys *ReadKeys, parsed *ParsedMessage) (string, error) {
+	parsed.PGPEncrypted = true
+	parts, err := splitMultipart(content, boundary)
+	if err != nil {
+		return "", err
+	}
+	if len(parts) != 2 {
+		return "", errors.New("malformed PGP/MIME encrypted message")
+	}
+	_, ciphertext, err := splitEntity(parts[1])
+	if err != nil {
+		return "", err
+	}
+	if keys == nil || keys.PGPSecretKey == nil {
+		return pgpNoKeyBody, nil
+	}
+	plaintext, signature, err := crypto.DecryptPGP(ciphertext, keys.PGPSecretKey, keys.PGPContacts)
+	if err != nil {
+		return pgpUndecryptedBody, nil
+	}
+	parsed.PGPSignature = signature
+	return readEntityBody(plaintext, keys, parsed)
+}
+
+// readPGPSigned verifies a multipart/signed PGP/MIME body.
+func readPGPSigned(content []byte, boundary string, keys *ReadKeys, parsed *ParsedMessage) (string, error) {
+	parts, err := splitMultipart(content, boundary)
+	if err != nil {
+		return "", err
+	}
+	if len(parts) != 2 {
+		return "", errors.New("malformed PGP/MIME signed message")
+	}
+	_, signature, err := splitEntity(parts[1])
+	if err != nil {
+		return "", err
+	}
+	var contacts [][]byte
+	if keys != nil {
+		contacts = keys.PGPContacts
+	}
+	// RFC 3156 section 5: the signature covers the first part in canonical form
+	parsed.PGPSignature = crypto.VerifyPGPDetached(toCRLF(parts[0]), signature, contacts)
+	return readEntityBody(parts[0], keys, parsed)
+}
@@ -0,0 +1,88 @@
+package email
+
+import (
+	"bytes"
+	"secmail/internal/crypto"
+	"testing"
+	"time"
+)
+
+// testPGPKey returns the binary secret key and armored public key of a new
+// OpenPGP key.
+func testPGPKey(t *testing.T, address string) (secretKey, publicKey []byte) {
+	t.Helper()
+	armored, err := crypto.GeneratePGPKey("Test", address)
+	if err != nil {
+		t.Fatalf("Failed to generate OpenPGP key: %v", err)
+	}
+	secretKey, publicKey, _, err = crypto.ImportPGPSecretKey(armored, "")
+	if err != nil {
+		t.Fatalf("Failed to import OpenPGP key: %v", err)
+	}
+	return secretKey, publicKey
+}
+
+func TestComposeParseSecureMIME(t *testing.T) {
+	aliceSecret, alicePublic := testPGPKey(t, "alice@secmail.test")
+	carolSecret, carolPublic := testPGPKey(t, "carol@example.org")
+
+	m := OutgoingMessage{
+		From:    "alice@secmail.test",
+		To:      []string{"carol@example.org"},
+		Subject: "Plans",
+		Body:    "Meet at noon.  \nBring the documents.",
+		Date:    time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+	carolKeys := &ReadKeys{PGPSecretKey: carolSecret, PGPContacts: [][]byte{alicePublic}}
+
+	encrypted, err := ComposePGPMIME(m, [][]byte{carolPublic}, aliceSecret)
+	if err != nil {
+		t.Fatalf("Failed to compose encrypted message: %v", err)
+	}
+	if bytes.Contains(encrypted, []byte("noon")) {
+		t.Error("Encrypted message contains plaintext")
+	}
+	parsed, err := ParseSecureMIME(encrypted, carolKeys)
+	if err != nil {
+		t.Fatalf("Failed to parse encrypted message: %v", err)
+	}
+	if parsed.Body != m.Body || parsed.Subject != m.Subject || !parsed.PGPEncrypted {
+		t.Errorf("Unexpected parsed message: %+v", parsed)
+	}
+	if parsed.PGPSignature != crypto.PGPSignatureValid {
+		t.Errorf("Expected valid signature, got %s", parsed.PGPSignature)
+	}
+
+	// Without the key the message is still listed
+	parsed, err = ParseMIME(encrypted)
+	if err != nil {
+		t.Fatalf("Failed to parse encrypted message without key: %v", err)
+	}
+	if parsed.Body != pgpNoKeyBody {
+		t.Errorf("Unexpected body without key: %q", parsed.Body)
+	}
+
+	signed, err := ComposePGPMIME(m, nil, aliceSecret)
+	if err != nil {
+		t.Fatalf("Failed to compose signed message: %v", err)
+	}
+	parsed, err = ParseSecureMIME(signed, carolKeys)
+	if err != nil {
+		t.Fatalf("Failed to parse signed message: %v", err)
+	}
+	if parsed.Body != m.Body || parsed.PGPEncrypted {
+		t.Errorf("Unexpected parsed message: %+v", parsed)
+	}
+	if parsed.PGPSignature != crypto.PGPSignatureValid {
+		t.Errorf("Expected valid signature, got %s", parsed.PGPSignature)
+	}
+
+	tampered := bytes.Replace(signed, []byte("documents"), []byte("money"), 1)
+	parsed, err = ParseSecureMIME(tampered, carolKeys)
+	if err != nil {
+		t.Fatalf("Failed to parse tampered message: %v", err)
+	}
+	if parsed.PGPSignature != crypto.PGPSignatureInvalid {
+		t.Errorf("Expected invalid signature, got %s", parsed.PGPSignature)
+	}
+}
@@ -0,0 +1,61 @@
+package email
+
+import (
+	"errors"
+	"fmt"
+	"secmail/internal/models"
+)
+
+// VerificationPolicy controls whether SendMessage requires verified addresses.
+type VerificationPolicy string
+
+const (
+	// VerificationOff delivers regardless of verification state.
+	VerificationOff VerificationPolicy = "off"
+	// VerificationSender requires only the sender to be verified.
+	VerificationSender VerificationPolicy = "sender"
+	// VerificationStrict requires the sender and every recipient to be verified.
+	VerificationStrict VerificationPolicy = "strict"
+)
+
+var (
+	ErrSenderUnverified    = errors.New("sender email address not verified")
+	ErrRecipientUnverified = errors.New("recipient email address not verified")
+)
+
+var verificationPolicy = VerificationStrict
+
+// ParseVerificationPolicy parses a policy name; an empty string selects the default.
+func ParseVerificationPolicy(s string) (VerificationPolicy, error) {
+	switch VerificationPolicy(s) {
+	case "":
+		return VerificationStrict, nil
+	case VerificationOff, VerificationSender, VerificationStrict:
+		return VerificationPolicy(s), nil
+	default:
+		return "", fmt.Errorf("unsupported verification policy %q", s)
+	}
+}
+
+// SetVerificationPolicy sets the policy enforced by SendMessage.
+func SetVerificationPolicy(policy VerificationPolicy) {
+	verificationPolicy = policy
+}
+
+// checkVerification enforces the verification policy for a send.
+func checkVerification(sender models.User, recipients []models.User) error {
+	if verificationPolicy == VerificationOff {
+		return nil
+	}
+	if !sender.IsVerified() {
+		return ErrSenderUnverified
+	}
+	if verificationPolicy == VerificationStrict {
+		for _, recipient := range recipients {
+			if !recipient.IsVerified() {
+				return ErrRecipientUnverified
+			}
+		}
+	}
+	return nil
+}
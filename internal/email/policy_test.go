@@ -0,0 +1,56 @@
+package email
+
+import (
+	"secmail/internal/models"
+	"testing"
+	"time"
+)
+
+func TestCheckVerification(t *testing.T) {
+	now := time.Now()
+	verified := models.User{ID: 1, EmailVerifiedAt: &now}
+	pending := models.User{ID: 2}
+
+	tests := []struct {
+		policy     VerificationPolicy
+		sender     models.User
+		recipients []models.User
+		want       error
+	}{
+		{VerificationOff, pending, []models.User{pending}, nil},
+		{VerificationSender, pending, []models.User{verified}, ErrSenderUnverified},
+		{VerificationSender, verified, []models.User{pending}, nil},
+		{VerificationStrict, verified, []models.User{verified, pending}, ErrRecipientUnverified},
+		{VerificationStrict, verified, []models.User{verified}, nil},
+	}
+
+	defer SetVerificationPolicy(VerificationStrict)
+	for _, tt := range tests {
+		SetVerificationPolicy(tt.policy)
+		if err := checkVerification(tt.sender, tt.recipients); err != tt.want {
+			t.Errorf("policy %s: got %v, want %v", tt.policy, err, tt.want)
+		}
+	}
+}
+
+func TestParseVerificationPolicy(t *testing.T) {
+	if p, err := ParseVerificationPolicy(""); err != nil || p != VerificationStrict {
+		t.Errorf("Empty policy should default to strict, got %q (%v)", p, err)
+	}
+	if _, err := ParseVerificationPolicy("sometimes"); err == nil {
+		t.Error("Unknown policy should return an error")
+	}
+}
+
+func TestParseForwardSecrecyPolicy(t *testing.T) {
+	p, err := ParseForwardSecrecyPolicy("", "48h")
+	if err != nil || p.PrekeyRotation != 7*24*time.Hour || p.PrekeyRetention != 48*time.Hour {
+		t.Errorf("Unexpected policy %+v (%v)", p, err)
+	}
+	if _, err := ParseForwardSecrecyPolicy("0s", ""); err == nil {
+		t.Error("Zero rotation should return an error")
+	}
+	if _, err := ParseForwardSecrecyPolicy("", "soon"); err == nil {
+		t.Error("Invalid retention should return an error")
+	}
+}
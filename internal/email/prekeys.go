@@ -0,0 +1,193 @@
+package email
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"secmail/internal/crypto"
+	"secmail/internal/models"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ErrForwardSecrecyDisabled is returned when a user has no prekey to start
+// ratchet chains to.
+var ErrForwardSecrecyDisabled = errors.New("forward secrecy is not enabled")
+
+// ForwardSecrecyPolicy controls the lifetime of prekeys. Messages sent with
+// forward secrecy stay readable until the prekey they were sent through is
+// erased, at most PrekeyRotation plus PrekeyRetention after it was created.
+type ForwardSecrecyPolicy struct {
+	// PrekeyRotation is the age at which a prekey is replaced when its owner
+	// next logs in.
+	PrekeyRotation time.Duration
+	// PrekeyRetention is how long a replaced prekey is kept before it is
+	// erased.
+	PrekeyRetention time.Duration
+}
+
+var forwardSecrecyPolicy = ForwardSecrecyPolicy{
+	PrekeyRotation:  7 * 24 * time.Hour,
+	PrekeyRetention: 30 * 24 * time.Hour,
+}
+
+// ParseForwardSecrecyPolicy parses prekey rotation and retention durations;
+// empty strings select the defaults.
+func ParseForwardSecrecyPolicy(rotation, retention string) (ForwardSecrecyPolicy, error) {
+	policy := forwardSecrecyPolicy
+	if rotation != "" {
+		d, err := time.ParseDuration(rotation)
+		if err != nil || d <= 0 {
+			return ForwardSecrecyPolicy{}, fmt.Errorf("invalid prekey rotation %q", rotation)
+		}
+		policy.PrekeyRotation = d
+	}
+	if retention != "" {
+		d, err := time.ParseDuration(retention)
+		if err != nil || d < 0 {
+			return ForwardSecrecyPolicy{}, fmt.Errorf("invalid prekey retention %q", retention)
+		}
+		policy.PrekeyRetention = d
+	}
+	return policy, nil
+}
+
+// SetForwardSecrecyPolicy sets the prekey lifetimes.
+func SetForwardSecrecyPolicy(policy ForwardSecrecyPolicy) {
+	forwardSecrecyPolicy = policy
+}
+
+// CurrentPrekey returns the user's current prekey, or
+// ErrForwardSecrecyDisabled.
+func CurrentPrekey(userID uint, db *gorm.DB) (*models.Prekey, error) {
+	var prekey models.Prekey
+	err := db.Where("user_id = ? AND retired_at IS NULL", userID).Order("id DESC").First(&prekey).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrForwardSecrecyDisabled
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &prekey, nil
+}
+
+// RotatePrekey enables forward secrecy for the user or replaces their
+// prekey. privateKey is the user's unwrapped current key, which signs the
+// new prekey. The previous prekey is retired, not erased, so messages sent
+// through it stay readable for the retention period.
+func RotatePrekey(userID uint, privateKey []byte, db *gorm.DB) (*models.Prekey, error) {
+	var user models.User
+	if err := db.Where("id = ?", userID).First(&user).Error; err != nil {
+		return nil, err
+	}
+	if !crypto.PrivateKeyMatches(privateKey, user.PublicKey) {
+		return nil, ErrKeyOutdated
+	}
+
+	publicPrekey, privatePrekey, err := crypto.GeneratePrekey()
+	if err != nil {
+		return nil, err
+	}
+	signature, err := crypto.SignPrekey(publicPrekey, privateKey)
+	if err != nil {
+		return nil, err
+	}
+	encryptedPrekey, err := crypto.EncryptRatchetKey(privatePrekey, user.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	prekey := models.Prekey{
+		UserID:              userID,
+		KeyVersion:          currentVersion(user),
+		PublicKey:           publicPrekey,
+		Signature:           signature,
+		EncryptedPrivateKey: encryptedPrekey,
+	}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := retirePrekeys(tx, userID); err != nil {
+			return err
+		}
+		return tx.Create(&prekey).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &prekey, nil
+}
+
+// DisableForwardSecrecy retires the user's prekey so no new chains are
+// started to them. Messages already sent stay readable for the retention
+// period.
+func DisableForwardSecrecy(userID uint, db *gorm.DB) error {
+	return retirePrekeys(db, userID)
+}
+
+func retirePrekeys(db *gorm.DB, userID uint) error {
+	return db.Model(&models.Prekey{}).Where("user_id = ? AND retired_at IS NULL", userID).
+		Update("retired_at", time.Now()).Error
+}
+
+// MaintainPrekey replaces the user's prekey when it is older than the
+// rotation period or was signed by a key that has since been rotated. Users
+// without forward secrecy are left alone.
+func MaintainPrekey(userID uint, privateKey []byte, db *gorm.DB) error {
+	prekey, err := CurrentPrekey(userID, db)
+	if errors.Is(err, ErrForwardSecrecyDisabled) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var user models.User
+	if err := db.Where("id = ?", userID).First(&user).Error; err != nil {
+		return err
+	}
+	if prekey.KeyVersion == currentVersion(user) && time.Since(prekey.CreatedAt) < forwardSecrecyPolicy.PrekeyRotation {
+		return nil
+	}
+	_, err = RotatePrekey(userID, privateKey, db)
+	if errors.Is(err, ErrKeyOutdated) {
+		// A session opened before a key rotation; a current one will do it
+		return nil
+	}
+	return err
+}
+
+// PurgePrekeys erases prekeys retired longer ago than the retention period,
+// along with the sending chains started to them. It returns the number of
+// prekeys erased.
+func PurgePrekeys(db *gorm.DB) (int64, error) {
+	cutoff := time.Now().Add(-forwardSecrecyPolicy.PrekeyRetention)
+	var purged int64
+	err := db.Transaction(func(tx *gorm.DB) error {
+		expired := tx.Model(&models.Prekey{}).Select("id").Where("retired_at IS NOT NULL AND retired_at < ?", cutoff)
+		if err := tx.Where("prekey_id IN (?)", expired).Delete(&models.SendingChain{}).Error; err != nil {
+			return err
+		}
+		result := tx.Where("retired_at IS NOT NULL AND retired_at < ?", cutoff).Delete(&models.Prekey{})
+		purged = result.RowsAffected
+		return result.Error
+	})
+	return purged, err
+}
+
+// RunPrekeyPurge erases expired prekeys every interval until ctx is
+// cancelled.
+func RunPrekeyPurge(ctx context.Context, db *gorm.DB, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := PurgePrekeys(db); err != nil {
+			log.Println("Prekey purge failed:", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
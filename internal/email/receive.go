@@ -1,92 +1,263 @@
 package email
 
 import (
+	"crypto/rsa"
 	"encoding/json"
 	"errors"
 	"secmail/internal/crypto"
-	"secmail/internal/models"
+	"slices"
 	"strconv"
 	"time"
 
 	"gorm.io/gorm"
 )
 
+var ErrSessionKeyNotFound = errors.New("session key not found for user")
+
+// unreadableBody replaces the body of a message that cannot be decrypted
+// with any key the session holds, such as mail encrypted to keys discarded
+// by a password reset.
+const unreadableBody = "[This message could not be decrypted with your key.]"
+
 type DecryptedMessage struct {
 	ID             uint
 	ConversationID uint
 	SenderID       uint
+	From           string
 	Subject        string
 	Body           string
 	Status         string
 	SentAt         time.Time
+	PGPEncrypted   bool   `json:",omitempty"`
+	PGPSignature   string `json:",omitempty"`
+	SMIMEEncrypted bool   `json:",omitempty"`
+	SMIMESignature string `json:",omitempty"`
+	SMIMESigner    string `json:",omitempty"`
+	// Authentication holds the SPF, DKIM and DMARC results of mail received
+	// over SMTP.
+	Authentication *AuthResults `json:",omitempty"`
+	// SenderFingerprint is the fingerprint of the secmail key of a local
+	// sender, to be compared with the one the sender sees out-of-band.
+	SenderFingerprint string `json:",omitempty"`
+	// ForwardSecrecy is set for messages sent through ratchet chains.
+	ForwardSecrecy bool `json:",omitempty"`
+	// List is the address of the mailing list a message was posted to.
+	List string `json:",omitempty"`
+	// ExpiresAt and BurnAfterReading are the lifetime the sender gave the
+	// message.
+	ExpiresAt        *time.Time `json:",omitempty"`
+	BurnAfterReading bool       `json:",omitempty"`
+	// Unreadable is set for messages listed without their content because
+	// the session holds no key that decrypts them.
+	Unreadable bool `json:",omitempty"`
 }
 
-// GetInbox retrieves and decrypts messages for the given user.
-func GetInbox(userID uint, db *gorm.DB) ([]DecryptedMessage, error) {
-	// Get user to access private key
-	var user models.User
-	if err := db.Where("id = ?", userID).First(&user).Error; err != nil {
-		return nil, err
-	}
-
-	// Query messages where user is recipient (simple LIKE check)
-	userIDStr := "\"" + strconv.Itoa(int(userID)) + "\""
+// GetInbox retrieves and decrypts messages for the given user using their
+// unwrapped private key. The user's keys of burn-after-reading messages are
+// erased once they are returned. Messages the key cannot decrypt are
+// returned as unreadable placeholders.
+func GetInbox(userID uint, privateKey []byte, db *gorm.DB) ([]DecryptedMessage, error) {
+	// Query messages where user is recipient
 	var messages []Message
-	if err := db.Where("recipients_json LIKE ?", "%"+userIDStr+"%").Find(&messages).Error; err != nil {
+	if err := unexpired(recipientScope(db, userID)).Find(&messages).Error; err != nil {
 		return nil, err
 	}
 
 	var decryptedMessages []DecryptedMessage
+	var readKeys *ReadKeys
+	fingerprints := senderFingerprints{}
+	ring := newKeyring(userID, privateKey, db)
+	var read []Message
 	for _, msg := range messages {
-		// Parse encrypted keys
-		var encryptedKeys []EncryptedKey
-		if err := json.Unmarshal([]byte(msg.EncryptedSessionKeys), &encryptedKeys); err != nil {
+		bodyBytes, metadata, err := decryptMessage(msg, userID, ring)
+		if undecryptable(err) {
+			decryptedMessages = append(decryptedMessages, unreadableMessage(msg))
+			continue
+		}
+		if err != nil {
 			return nil, err
 		}
+		read = append(read, msg)
+		subject := metadata["subject"]
+		from := ""
+		body := string(bodyBytes)
 
-		// Find the key for this user
-		var encryptedPass []byte
-		found := false
-		for _, key := range encryptedKeys {
-			if key.RecipientID == userID {
-				encryptedPass = key.EncryptedPassphrase
-				found = true
-				break
+		// Mail received over SMTP or imported is stored as the complete encrypted
+		// message
+		parsed := &ParsedMessage{}
+		if isRawSource(metadata) {
+			if readKeys == nil {
+				if readKeys, err = LoadReadKeys(userID, privateKey, db); err != nil {
+					return nil, err
+				}
+			}
+			if parsed, err = ParseSecureMIME(bodyBytes, readKeys); err != nil {
+				return nil, err
 			}
+			from = parsed.From
+			subject = parsed.Subject
+			body = parsed.Body
 		}
-		if !found {
-			return nil, errors.New("session key not found for user")
+
+		var senderFingerprint string
+		if msg.SenderID != 0 {
+			if senderFingerprint, err = fingerprints.get(msg.SenderID, db); err != nil {
+				return nil, err
+			}
 		}
 
-		// Decrypt passphrase
-		passphrase, err := crypto.DecryptPassphrase(encryptedPass, user.PrivateKey)
-		if err != nil {
+		decryptedMessages = append(decryptedMessages, DecryptedMessage{
+			ID:                msg.ID,
+			ConversationID:    msg.ConversationID,
+			SenderID:          msg.SenderID,
+			From:              from,
+			Subject:           subject,
+			Body:              body,
+			Status:            msg.Status,
+			SentAt:            msg.SentAt,
+			PGPEncrypted:      parsed.PGPEncrypted,
+			PGPSignature:      parsed.PGPSignature,
+			SMIMEEncrypted:    parsed.SMIMEEncrypted,
+			SMIMESignature:    parsed.SMIMESignature,
+			SMIMESigner:       parsed.SMIMESigner,
+			Authentication:    authResults(metadata),
+			SenderFingerprint: senderFingerprint,
+			ForwardSecrecy:    metadata["forward_secrecy"] == "true",
+			List:              metadata["list_address"],
+			ExpiresAt:         msg.ExpiresAt,
+			BurnAfterReading:  msg.BurnAfterReading,
+		})
+	}
+
+	for _, msg := range read {
+		if err := burnKey(db, msg, userID); err != nil {
 			return nil, err
 		}
+	}
+	return decryptedMessages, nil
+}
+
+// undecryptable reports whether err means the session's key cannot open a
+// message, as opposed to a failure to load it.
+func undecryptable(err error) bool {
+	return errors.Is(err, ErrSessionKeyNotFound) || errors.Is(err, rsa.ErrDecryption)
+}
+
+// unreadableMessage is listed in place of a message that cannot be
+// decrypted. The subject is kept when it is stored outside the body.
+func unreadableMessage(msg Message) DecryptedMessage {
+	var metadata map[string]string
+	_ = json.Unmarshal([]byte(msg.Metadata), &metadata)
+	subject := "[Unreadable message]"
+	if !isRawSource(metadata) && metadata["subject"] != "" {
+		subject = metadata["subject"]
+	}
+	return DecryptedMessage{
+		ID:               msg.ID,
+		ConversationID:   msg.ConversationID,
+		SenderID:         msg.SenderID,
+		Subject:          subject,
+		Body:             unreadableBody,
+		Status:           msg.Status,
+		SentAt:           msg.SentAt,
+		ExpiresAt:        msg.ExpiresAt,
+		BurnAfterReading: msg.BurnAfterReading,
+		Unreadable:       true,
+	}
+}
+
+// decryptMessage decrypts the body of msg with the version of userID's key
+// it was encrypted to and returns it with the message metadata.
+func decryptMessage(msg Message, userID uint, ring *keyring) ([]byte, map[string]string, error) {
+	// Parse encrypted keys
+	var encryptedKeys []EncryptedKey
+	if err := json.Unmarshal([]byte(msg.EncryptedSessionKeys), &encryptedKeys); err != nil {
+		return nil, nil, err
+	}
 
-		// Decrypt body
-		bodyBytes, err := crypto.DecryptBody(msg.EncryptedBody, passphrase)
+	// Find the key for this user, falling back to a group they were a
+	// member of when the message was sent
+	var userKey *EncryptedKey
+	for i, key := range encryptedKeys {
+		if key.RecipientID == userID && key.Group == nil {
+			userKey = &encryptedKeys[i]
+			break
+		}
+	}
+	groupKeyErased := false
+	for i, key := range encryptedKeys {
+		if userKey != nil {
+			break
+		}
+		if key.Group == nil {
+			continue
+		}
+		_, err := ring.epochSecret(key.Group.GroupID, key.Group.Epoch)
+		if errors.Is(err, ErrMessageKeyErased) {
+			groupKeyErased = true
+			continue
+		}
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
+		userKey = &encryptedKeys[i]
+	}
+	// A recipient's key of a burn-after-reading message is erased once read
+	burned := userKey == nil && msg.BurnAfterReading && slices.Contains(MessageMailboxes(msg, userID), MailboxInbox)
+	if userKey == nil && !groupKeyErased && !burned {
+		return nil, nil, ErrSessionKeyNotFound
+	}
 
-		// Parse metadata for subject
-		var metadata map[string]string
-		if err := json.Unmarshal([]byte(msg.Metadata), &metadata); err != nil {
-			return nil, err
-		}
-		subject := metadata["subject"]
+	// Parse metadata
+	var metadata map[string]string
+	if err := json.Unmarshal([]byte(msg.Metadata), &metadata); err != nil {
+		return nil, nil, err
+	}
 
-		decryptedMessages = append(decryptedMessages, DecryptedMessage{
-			ID:             msg.ID,
-			ConversationID: msg.ConversationID,
-			SenderID:       msg.SenderID,
-			Subject:        subject,
-			Body:           string(bodyBytes),
-			Status:         msg.Status,
-			SentAt:         msg.SentAt,
-		})
+	if burned {
+		return []byte(burnedBody), metadata, nil
+	}
+	if userKey == nil {
+		return []byte(erasedBody), metadata, nil
 	}
 
-	return decryptedMessages, nil
+	// Decrypt passphrase
+	passphrase, err := decryptPassphrase(msg, *userKey, ring)
+	if errors.Is(err, ErrMessageKeyErased) {
+		return []byte(erasedBody), metadata, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Decrypt body
+	body, err := crypto.DecryptBody(msg.EncryptedBody, passphrase)
+	if err != nil {
+		return nil, nil, err
+	}
+	return body, metadata, nil
+}
+
+// decryptPassphrase unwraps the session passphrase of msg from the user's
+// EncryptedKey.
+func decryptPassphrase(msg Message, key EncryptedKey, ring *keyring) (string, error) {
+	if key.Ratchet != nil {
+		return ring.ratchetPassphrase(msg, key)
+	}
+	if key.Group != nil {
+		return ring.groupPassphrase(key)
+	}
+	privateKey, err := ring.key(key.KeyVersion)
+	if err != nil {
+		return "", err
+	}
+	return crypto.DecryptPassphrase(key.EncryptedPassphrase, privateKey)
+}
+
+// recipientScope filters messages whose RecipientsJSON (a JSON array of IDs
+// such as [1,23]) contains userID.
+func recipientScope(db *gorm.DB, userID uint) *gorm.DB {
+	id := strconv.FormatUint(uint64(userID), 10)
+	return db.Where("recipients_json = ? OR recipients_json LIKE ? OR recipients_json LIKE ? OR recipients_json LIKE ?",
+		"["+id+"]", "["+id+",%", "%,"+id+",%", "%,"+id+"]")
 }
@@ -0,0 +1,154 @@
+package email
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"mime/quotedprintable"
+	"strings"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
+)
+
+var errUnterminatedMultipart = errors.New("unterminated multipart body")
+
+// ReadKeys is the key material used to open PGP/MIME and S/MIME messages.
+type ReadKeys struct {
+	// PGPSecretKey is the user's unprotected binary OpenPGP secret key, or nil.
+	PGPSecretKey []byte
+	// PGPContacts are armored public keys trusted to verify signatures.
+	PGPContacts [][]byte
+	// Certificate is the user's PEM S/MIME certificate, or nil.
+	Certificate []byte
+	// PrivateKey is the user's unwrapped secmail private key.
+	PrivateKey []byte
+	// RetiredSMIME are the certificates of retired keys with their private
+	// keys, newest first, for S/MIME mail encrypted before a key rotation.
+	RetiredSMIME []SMIMEKeyPair
+}
+
+// SMIMEKeyPair is an S/MIME certificate with its private key.
+type SMIMEKeyPair struct {
+	Certificate []byte
+	PrivateKey  []byte
+}
+
+// readEntityBody returns the readable body of a MIME entity, opening
+// PGP/MIME and S/MIME layers with keys and recording what it found in parsed.
+func readEntityBody(raw []byte, keys *ReadKeys, parsed *ParsedMessage) (string, error) {
+	header, content, err := splitEntity(raw)
+	if err != nil {
+		return "", err
+	}
+	mediaType, params, _ := header.ContentType()
+
+	switch {
+	case mediaType == "multipart/encrypted" && strings.EqualFold(params["protocol"], "application/pgp-encrypted"):
+		return readPGPEncrypted(content, params["boundary"], keys, parsed)
+	case mediaType == "multipart/signed" && strings.EqualFold(params["protocol"], "application/pgp-signature"):
+		return readPGPSigned(content, params["boundary"], keys, parsed)
+	case mediaType == "multipart/signed" && isSMIMESignatureType(params["protocol"]):
+		return readSMIMESigned(content, params["boundary"], keys, parsed)
+	case isSMIMEType(mediaType):
+		return readSMIMEObject(header, content, keys, parsed)
+	}
+
+	return readPlainBody(raw)
+}
+
+// attachEntity writes a message with header h whose content is the MIME
+// entity raw; the entity's own header fields are merged into h.
+func attachEntity(h textproto.Header, raw []byte) ([]byte, error) {
+	entityHeader, body, err := splitEntity(raw)
+	if err != nil {
+		return nil, err
+	}
+	fields := entityHeader.Fields()
+	for fields.Next() {
+		h.Add(fields.Key(), fields.Value())
+	}
+
+	var buf bytes.Buffer
+	if err := textproto.WriteHeader(&buf, h); err != nil {
+		return nil, err
+	}
+	buf.Write(body)
+	return buf.Bytes(), nil
+}
+
+// textPart renders body as a quoted-printable text/plain MIME entity with CRLF
+// line endings, safe to sign.
+func textPart(body string) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\n")
+	w := quotedprintable.NewWriter(&buf)
+	w.Write(toCRLF([]byte(body)))
+	w.Close()
+	return buf.Bytes()
+}
+
+// splitEntity separates the header of a MIME entity from its raw body.
+func splitEntity(raw []byte) (message.Header, []byte, error) {
+	br := bufio.NewReader(bytes.NewReader(raw))
+	h, err := textproto.ReadHeader(br)
+	if err != nil {
+		return message.Header{}, nil, err
+	}
+	var body bytes.Buffer
+	if _, err := body.ReadFrom(br); err != nil {
+		return message.Header{}, nil, err
+	}
+	return message.Header{Header: h}, body.Bytes(), nil
+}
+
+// splitMultipart returns the raw parts of a multipart body byte for byte, as
+// needed to verify multipart/signed content.
+func splitMultipart(body []byte, boundary string) ([][]byte, error) {
+	if boundary == "" {
+		return nil, errors.New("multipart body without boundary")
+	}
+	delim := []byte("\n--" + boundary)
+	rest := append([]byte("\n"), body...)
+
+	var parts [][]byte
+	first := true
+	for {
+		i := bytes.Index(rest, delim)
+		if i < 0 {
+			return nil, errUnterminatedMultipart
+		}
+		if !first {
+			// The line break before a delimiter belongs to the delimiter
+			parts = append(parts, bytes.TrimSuffix(rest[:i], []byte("\r")))
+		}
+		first = false
+
+		rest = rest[i+len(delim):]
+		if bytes.HasPrefix(rest, []byte("--")) {
+			return parts, nil
+		}
+		nl := bytes.IndexByte(rest, '\n')
+		if nl < 0 {
+			return nil, errUnterminatedMultipart
+		}
+		rest = rest[nl+1:]
+	}
+}
+
+// toCRLF converts all line endings to CRLF.
+func toCRLF(b []byte) []byte {
+	b = bytes.ReplaceAll(b, []byte("\r\n"), []byte("\n"))
+	return bytes.ReplaceAll(b, []byte("\n"), []byte("\r\n"))
+}
+
+// randomBoundary returns a fresh multipart boundary.
+func randomBoundary() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,342 @@
+package email
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"secmail/internal/crypto"
+	"secmail/internal/models"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// secureLinkTTL is how long a secure link can be used, unless the message
+	// expires earlier.
+	secureLinkTTL = 7 * 24 * time.Hour
+	// maxSecureLinkAttempts is the number of wrong passphrases after which a
+	// link is disabled.
+	maxSecureLinkAttempts = 5
+)
+
+var (
+	ErrSecureLinkNotFound = errors.New("secure link not found or expired")
+	ErrSecureLinkOpened   = errors.New("secure link has already been opened")
+	ErrSecureLinkReplied  = errors.New("secure link has already been replied through")
+	ErrSecureLinkDisabled = errors.New("secure link was disabled after too many wrong passphrases")
+)
+
+// SecureLinkGrant is what the sender shares with an external recipient: the
+// link is emailed, the passphrase must be given out-of-band.
+type SecureLinkGrant struct {
+	Recipient  string
+	URL        string
+	Passphrase string
+	ExpiresAt  time.Time
+}
+
+// SecureLinkMessage is a message as its external recipient reads it.
+type SecureLinkMessage struct {
+	From     string
+	Subject  string
+	Body     string
+	SentAt   time.Time
+	CanReply bool
+}
+
+// CreateSecureLinks gives each external recipient of msg a link to read it,
+// with the message's session passphrase sealed by a fresh one-time
+// passphrase. It returns the grants for the sender and the notices to
+// deliver, which carry the link but neither the subject nor the body.
+// privateKey is the sender's unwrapped key.
+func CreateSecureLinks(msg *Message, recipients []string, privateKey []byte, db *gorm.DB) ([]SecureLinkGrant, []ExternalDelivery, error) {
+	var sender models.User
+	if err := db.Where("id = ?", msg.SenderID).First(&sender).Error; err != nil {
+		return nil, nil, err
+	}
+	sessionPassphrase, err := senderPassphrase(*msg, newKeyring(sender.ID, privateKey, db))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	expiresAt := time.Now().Add(secureLinkTTL)
+	if msg.ExpiresAt != nil && msg.ExpiresAt.Before(expiresAt) {
+		expiresAt = *msg.ExpiresAt
+	}
+
+	grants := make([]SecureLinkGrant, 0, len(recipients))
+	deliveries := make([]ExternalDelivery, 0, len(recipients))
+	err = db.Transaction(func(tx *gorm.DB) error {
+		for _, recipient := range recipients {
+			token, err := newSecureLinkToken()
+			if err != nil {
+				return err
+			}
+			passphrase, err := crypto.GenerateOneTimePassphrase()
+			if err != nil {
+				return err
+			}
+			sealed, err := sealSecureLink(sessionPassphrase, passphrase)
+			if err != nil {
+				return err
+			}
+			link := models.SecureLink{
+				MessageID:        msg.ID,
+				SenderID:         sender.ID,
+				Recipient:        recipient,
+				TokenHash:        hashSecureLinkToken(token),
+				SealedPassphrase: sealed,
+				ExpiresAt:        expiresAt,
+			}
+			if err := tx.Create(&link).Error; err != nil {
+				return err
+			}
+
+			grant := SecureLinkGrant{
+				Recipient:  recipient,
+				URL:        publicBaseURL + "/secure/" + token,
+				Passphrase: passphrase,
+				ExpiresAt:  expiresAt,
+			}
+			raw, err := ComposeMIME(secureLinkNotice(sender.Email, grant, msg.SentAt))
+			if err != nil {
+				return err
+			}
+			grants = append(grants, grant)
+			deliveries = append(deliveries, ExternalDelivery{Recipients: []string{recipient}, Raw: raw})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return grants, deliveries, nil
+}
+
+// secureLinkNotice is the email telling an external recipient where to read
+// a message. The subject of the message is left out, as it is not encrypted
+// in transit.
+func secureLinkNotice(from string, grant SecureLinkGrant, date time.Time) OutgoingMessage {
+	body := fmt.Sprintf("%s sent you a secure message.\n\n"+
+		"Read it at:\n\n    %s\n\n"+
+		"You will need the passphrase %s gives you separately. The message can be\n"+
+		"read once, and answered once, until %s.\n",
+		from, grant.URL, from, grant.ExpiresAt.UTC().Format("2 January 2006 15:04 MST"))
+	return OutgoingMessage{
+		From:    from,
+		To:      []string{grant.Recipient},
+		Subject: "Secure message from " + from,
+		Body:    body,
+		Date:    date,
+	}
+}
+
+// OpenSecureLink decrypts the message behind a link with the passphrase its
+// recipient was given. A link can only be opened once. Wrong passphrases
+// return crypto.ErrWrongPassphrase and disable the link after
+// maxSecureLinkAttempts.
+func OpenSecureLink(token, passphrase string, db *gorm.DB) (*SecureLinkMessage, error) {
+	var opened *SecureLinkMessage
+	err := useSecureLink(token, passphrase, db, func(tx *gorm.DB, link *models.SecureLink, msg Message, sessionPassphrase string) error {
+		if link.OpenedAt != nil {
+			return ErrSecureLinkOpened
+		}
+		body, err := crypto.DecryptBody(msg.EncryptedBody, sessionPassphrase)
+		if err != nil {
+			return err
+		}
+		var metadata map[string]string
+		if err := json.Unmarshal([]byte(msg.Metadata), &metadata); err != nil {
+			return err
+		}
+		var sender models.User
+		if err := tx.Select("email").Where("id = ?", msg.SenderID).First(&sender).Error; err != nil {
+			return err
+		}
+
+		now := time.Now()
+		if err := tx.Model(link).Update("opened_at", now).Error; err != nil {
+			return err
+		}
+		opened = &SecureLinkMessage{
+			From:     sender.Email,
+			Subject:  metadata["subject"],
+			Body:     string(body),
+			SentAt:   msg.SentAt,
+			CanReply: link.RepliedAt == nil,
+		}
+		return nil
+	})
+	return opened, err
+}
+
+// ReplySecureLink delivers the external recipient's answer to the sender's
+// inbox, encrypted to the sender like mail received over SMTP. A link can
+// only be replied through once, after which it is spent.
+func ReplySecureLink(token, passphrase, body string, db *gorm.DB) error {
+	return useSecureLink(token, passphrase, db, func(tx *gorm.DB, link *models.SecureLink, msg Message, _ string) error {
+		if link.RepliedAt != nil {
+			return ErrSecureLinkReplied
+		}
+		var sender models.User
+		if err := tx.Select("email").Where("id = ?", msg.SenderID).First(&sender).Error; err != nil {
+			return err
+		}
+		var metadata map[string]string
+		if err := json.Unmarshal([]byte(msg.Metadata), &metadata); err != nil {
+			return err
+		}
+		subject := metadata["subject"]
+		if !strings.HasPrefix(strings.ToLower(subject), "re:") {
+			subject = "Re: " + subject
+		}
+
+		now := time.Now()
+		raw, err := ComposeMIME(OutgoingMessage{
+			From:    link.Recipient,
+			To:      []string{sender.Email},
+			Subject: subject,
+			Body:    body,
+			Date:    now,
+		})
+		if err != nil {
+			return err
+		}
+		if _, err := storeRaw(0, []uint{msg.SenderID}, raw, map[string]string{"source": SourceSecureLink}, now, tx); err != nil {
+			return err
+		}
+		return tx.Model(link).Updates(map[string]any{"replied_at": now, "sealed_passphrase": nil}).Error
+	})
+}
+
+// useSecureLink unseals the session passphrase of a link and calls fn with
+// the link locked. Wrong passphrases are counted even though fn is not
+// called.
+func useSecureLink(token, passphrase string, db *gorm.DB, fn func(tx *gorm.DB, link *models.SecureLink, msg Message, sessionPassphrase string) error) error {
+	var wrong bool
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var link models.SecureLink
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("token_hash = ? AND expires_at > ?", hashSecureLinkToken(token), time.Now()).First(&link).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrSecureLinkNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if link.SealedPassphrase == nil {
+			if link.RepliedAt != nil {
+				return ErrSecureLinkReplied
+			}
+			return ErrSecureLinkDisabled
+		}
+
+		var msg Message
+		err = unexpired(tx).Where("id = ?", link.MessageID).First(&msg).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrSecureLinkNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		sessionPassphrase, err := openSecureLink(link.SealedPassphrase, passphrase)
+		if errors.Is(err, crypto.ErrWrongPassphrase) {
+			wrong = true
+			updates := map[string]any{"attempts": link.Attempts + 1}
+			if link.Attempts+1 >= maxSecureLinkAttempts {
+				updates["sealed_passphrase"] = nil
+			}
+			return tx.Model(&link).Updates(updates).Error
+		}
+		if err != nil {
+			return err
+		}
+		return fn(tx, &link, msg, sessionPassphrase)
+	})
+	if err == nil && wrong {
+		return crypto.ErrWrongPassphrase
+	}
+	return err
+}
+
+// PurgeSecureLinks deletes expired links, including those of expired
+// messages, whose links never outlive them. It returns the number of links
+// purged.
+func PurgeSecureLinks(db *gorm.DB) (int64, error) {
+	result := db.Where("expires_at <= ?", time.Now()).Delete(&models.SecureLink{})
+	return result.RowsAffected, result.Error
+}
+
+// senderPassphrase unwraps the session passphrase of msg from the sender's
+// own EncryptedKey.
+func senderPassphrase(msg Message, ring *keyring) (string, error) {
+	var encryptedKeys []EncryptedKey
+	if err := json.Unmarshal([]byte(msg.EncryptedSessionKeys), &encryptedKeys); err != nil {
+		return "", err
+	}
+	for _, key := range encryptedKeys {
+		if key.RecipientID == msg.SenderID && key.Group == nil {
+			return decryptPassphrase(msg, key, ring)
+		}
+	}
+	return "", ErrSessionKeyNotFound
+}
+
+// sealSecureLink encrypts a session passphrase with a one-time passphrase.
+func sealSecureLink(sessionPassphrase, passphrase string) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := crypto.EncryptWithPassphrase(&buf, crypto.NormalizeRecoveryPhrase(passphrase))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.WriteString(w, sessionPassphrase); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// openSecureLink decrypts a session passphrase sealed by sealSecureLink.
+// Case, spaces and dashes in passphrase do not matter.
+func openSecureLink(sealed []byte, passphrase string) (string, error) {
+	passphrase = crypto.NormalizeRecoveryPhrase(passphrase)
+	if passphrase == "" {
+		return "", crypto.ErrWrongPassphrase
+	}
+	r, err := crypto.DecryptWithPassphrase(bytes.NewReader(sealed), passphrase)
+	if err != nil {
+		return "", err
+	}
+	sessionPassphrase, err := io.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	return string(sessionPassphrase), nil
+}
+
+// newSecureLinkToken returns a random URL-safe link token.
+func newSecureLinkToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashSecureLinkToken returns the hex-encoded SHA-256 of a link token.
+func hashSecureLinkToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
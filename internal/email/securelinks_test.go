@@ -0,0 +1,55 @@
+package email
+
+import (
+	"errors"
+	"secmail/internal/crypto"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSealSecureLink(t *testing.T) {
+	passphrase, err := crypto.GenerateOneTimePassphrase()
+	if err != nil {
+		t.Fatalf("Failed to generate passphrase: %v", err)
+	}
+	sealed, err := sealSecureLink("session passphrase", passphrase)
+	if err != nil {
+		t.Fatalf("Failed to seal session passphrase: %v", err)
+	}
+
+	// Recipients may type the passphrase without dashes or in lower case
+	opened, err := openSecureLink(sealed, strings.ToLower(strings.ReplaceAll(passphrase, "-", " ")))
+	if err != nil {
+		t.Fatalf("Failed to open sealed passphrase: %v", err)
+	}
+	if opened != "session passphrase" {
+		t.Errorf("Unexpected session passphrase: %q", opened)
+	}
+
+	for _, wrong := range []string{"", " - ", "AAAA-BBBB-CCCC-DDDD"} {
+		if _, err := openSecureLink(sealed, wrong); !errors.Is(err, crypto.ErrWrongPassphrase) {
+			t.Errorf("Expected ErrWrongPassphrase for %q, got %v", wrong, err)
+		}
+	}
+}
+
+func TestSecureLinkNotice(t *testing.T) {
+	grant := SecureLinkGrant{
+		Recipient:  "bob@example.org",
+		URL:        "https://mail.example.com/secure/token",
+		Passphrase: "ABCD-EFGH-IJKL-MNOP",
+		ExpiresAt:  time.Now().Add(secureLinkTTL),
+	}
+	notice := secureLinkNotice("alice@example.com", grant, time.Now())
+	if !strings.Contains(notice.Body, grant.URL) || notice.To[0] != grant.Recipient {
+		t.Errorf("Notice does not carry the link: %+v", notice)
+	}
+	if strings.Contains(notice.Body, grant.Passphrase) || strings.Contains(notice.Subject, grant.Passphrase) {
+		t.Error("Notice must not carry the passphrase")
+	}
+
+	if hashSecureLinkToken("token") == "token" || len(hashSecureLinkToken("token")) != 64 {
+		t.Error("Link tokens must be stored hashed")
+	}
+}
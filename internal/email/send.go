@@ -5,60 +5,140 @@ import (
 	"errors"
 	"secmail/internal/crypto"
 	"secmail/internal/models"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
 	"gorm.io/gorm"
 )
 
-// SendMessage sends an encrypted email from sender to recipients.
-func SendMessage(senderID uint, recipients []uint, subject, body string, db *gorm.DB) error {
-	if len(recipients) == 0 {
-		return errors.New("no recipients")
-	}
+// Message statuses.
+const (
+	StatusSent     = "sent"
+	StatusQueued   = "queued"
+	StatusReceived = "received"
+)
 
-	// Encrypt the body
-	encryptedBody, passphrase, err := crypto.EncryptBody([]byte(body))
-	if err != nil {
-		return err
+// SendMessage sends an encrypted email from sender to local recipients (by
+// user ID) and records external recipients (by address) for outbound relay.
+// The session key is also wrapped to the sender so they keep a readable copy.
+// Groups the sender is a member of are addressed with one key wrapped for the
+// group's current epoch, which requires the sender's unwrapped privateKey.
+// A mailing list address among externalRecipients is expanded into a key for
+// each member; posts to moderated lists are only encrypted to the owners
+// until one of them approves it. lifetime limits how long the local copies
+// stay readable.
+func SendMessage(senderID uint, recipients, groups []uint, externalRecipients []string, subject, body string, lifetime Lifetime, privateKey []byte, db *gorm.DB) (*Message, error) {
+	if len(recipients) == 0 && len(groups) == 0 && len(externalRecipients) == 0 {
+		return nil, errors.New("no recipients")
+	}
+	if err := lifetime.check(len(groups) > 0); err != nil {
+		return nil, err
 	}
 
 	// Get public keys for recipients
+	recipients = uniqueIDs(recipients)
 	var users []models.User
-	if err := db.Where("id IN ?", recipients).Find(&users).Error; err != nil {
-		return err
+	if len(recipients) > 0 {
+		if err := db.Where("id IN ?", recipients).Find(&users).Error; err != nil {
+			return nil, err
+		}
+		if len(users) != len(recipients) {
+			return nil, ErrUsersNotFound
+		}
+	}
+
+	// Enforce email verification policy
+	var sender models.User
+	if err := db.Where("id = ?", senderID).First(&sender).Error; err != nil {
+		return nil, err
 	}
-	if len(users) != len(recipients) {
-		return errors.New("some recipients not found")
+	if err := checkVerification(sender, users); err != nil {
+		return nil, err
+	}
+	post, externalRecipients, err := prepareListPost(sender, externalRecipients, db)
+	if err != nil {
+		return nil, err
 	}
 
-	// Encrypt passphrase for each recipient
-	var encryptedKeys []EncryptedKey
-	for _, user := range users {
-		encryptedPass, err := crypto.EncryptPassphrase(passphrase, user.PublicKey)
+	// Encrypt the body for all recipients and the sender
+	keyHolders := users
+	if !containsUser(users, sender.ID) {
+		keyHolders = append(keyHolders, sender)
+	}
+	encryptedBody, passphrase, err := crypto.EncryptBody([]byte(body))
+	if err != nil {
+		return nil, err
+	}
+	encryptedKeys, err := wrapForUsers(passphrase, keyHolders)
+	if err != nil {
+		return nil, err
+	}
+
+	// Group members read the message through the group's key
+	allRecipients := append([]uint{}, recipients...)
+	if len(groups) > 0 {
+		keys, members, err := groupKeys(senderID, groups, passphrase, privateKey, db)
 		if err != nil {
-			return err
+			return nil, err
+		}
+		encryptedKeys = append(encryptedKeys, keys...)
+		for _, memberID := range members {
+			if !slices.Contains(allRecipients, memberID) {
+				allRecipients = append(allRecipients, memberID)
+			}
 		}
-		encryptedKeys = append(encryptedKeys, EncryptedKey{
-			RecipientID:         user.ID,
-			EncryptedPassphrase: encryptedPass,
-		})
 	}
+	directIDs := slices.Clone(allRecipients)
 
-	// Marshal recipients and encrypted keys
-	recipientsJSON, err := json.Marshal(recipients)
-	if err != nil {
-		return err
+	// List members get their own key, unless they already hold one
+	if post != nil {
+		var listUsers []models.User
+		for _, user := range post.recipients {
+			if !containsUser(keyHolders, user.ID) {
+				listUsers = append(listUsers, user)
+			}
+			if !post.held && !slices.Contains(allRecipients, user.ID) {
+				allRecipients = append(allRecipients, user.ID)
+			}
+		}
+		keys, err := wrapForUsers(passphrase, listUsers)
+		if err != nil {
+			return nil, err
+		}
+		encryptedKeys = append(encryptedKeys, keys...)
 	}
 	encryptedKeysJSON, err := json.Marshal(encryptedKeys)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	// Marshal recipients
+	recipientsJSON, err := json.Marshal(allRecipients)
+	if err != nil {
+		return nil, err
 	}
 
 	// Create metadata
 	metadata := map[string]string{"subject": subject}
+	status := StatusSent
+	if len(externalRecipients) > 0 {
+		metadata["external_recipients"] = strings.Join(externalRecipients, ",")
+		status = StatusQueued
+	}
+	if post != nil {
+		metadata["list_address"] = post.list.Address
+		metadata["list_id"] = strconv.FormatUint(uint64(post.list.ID), 10)
+		direct := make([]string, 0, len(directIDs))
+		for _, id := range directIDs {
+			direct = append(direct, strconv.FormatUint(uint64(id), 10))
+		}
+		metadata["direct_recipients"] = strings.Join(direct, ",")
+	}
 	metadataJSON, err := json.Marshal(metadata)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// Create message
@@ -68,12 +148,86 @@ func SendMessage(senderID uint, recipients []uint, subject, body string, db *gor
 		EncryptedBody:        encryptedBody,
 		EncryptedSessionKeys: string(encryptedKeysJSON),
 		Metadata:             string(metadataJSON),
-		Status:               "sent",
+		Status:               status,
+		ExpiresAt:            lifetime.ExpiresAt,
+		BurnAfterReading:     lifetime.BurnAfterReading,
 		SentAt:               time.Now(),
 	}
-	if err := db.Create(&message).Error; err != nil {
-		return err
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&message).Error; err != nil {
+			return err
+		}
+		if post != nil && post.held {
+			if err := tx.Create(&models.MailingListPost{ListID: post.list.ID, MessageID: message.ID, Status: PostHeld}).Error; err != nil {
+				return err
+			}
+		}
+		return recordChange(tx, append([]uint{senderID}, allRecipients...), message.ID, ChangeCreated)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &message, nil
+}
+
+// containsUser reports whether users contains the user with the given ID.
+func containsUser(users []models.User, id uint) bool {
+	for _, user := range users {
+		if user.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// encryptForRecipients encrypts plaintext with a fresh session passphrase and
+// wraps the passphrase to each user's public key. It returns the ciphertext
+// and the JSON-encoded list of EncryptedKey.
+func encryptForRecipients(plaintext []byte, users []models.User) (ciphertext []byte, encryptedKeysJSON string, err error) {
+	// Encrypt the body
+	ciphertext, passphrase, err := crypto.EncryptBody(plaintext)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Encrypt passphrase for each recipient
+	encryptedKeys, err := wrapForUsers(passphrase, users)
+	if err != nil {
+		return nil, "", err
+	}
+
+	keysJSON, err := json.Marshal(encryptedKeys)
+	if err != nil {
+		return nil, "", err
 	}
+	return ciphertext, string(keysJSON), nil
+}
 
-	return nil
+// wrapForUsers encrypts a session passphrase to the current key of each user.
+func wrapForUsers(passphrase string, users []models.User) ([]EncryptedKey, error) {
+	var encryptedKeys []EncryptedKey
+	for _, user := range users {
+		encryptedPass, err := crypto.EncryptPassphrase(passphrase, user.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		encryptedKeys = append(encryptedKeys, EncryptedKey{
+			RecipientID:         user.ID,
+			EncryptedPassphrase: encryptedPass,
+			KeyVersion:          user.KeyVersion,
+		})
+	}
+	return encryptedKeys, nil
+}
+
+// uniqueIDs returns ids without repeats, in order of first appearance.
+func uniqueIDs(ids []uint) []uint {
+	var unique []uint
+	for _, id := range ids {
+		if !slices.Contains(unique, id) {
+			unique = append(unique, id)
+		}
+	}
+	return unique
 }
@@ -0,0 +1,457 @@
+package email
+
+import (
+	"errors"
+	"secmail/internal/crypto"
+	"secmail/internal/models"
+	"secmail/internal/transparency"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Permissions of delegates on a shared mailbox.
+const (
+	MailboxRead   = "read"
+	MailboxSendAs = "send_as"
+	MailboxManage = "manage"
+)
+
+// Actions recorded in the audit log of a shared mailbox.
+const (
+	AuditRead   = "read"
+	AuditSend   = "send"
+	AuditGrant  = "grant"
+	AuditRevoke = "revoke"
+)
+
+var (
+	ErrMailboxNotFound    = errors.New("shared mailbox not found")
+	ErrMailboxPermission  = errors.New("missing permission on the shared mailbox")
+	ErrNoMailboxRoles     = errors.New("at least one permission is required")
+	ErrLastMailboxManager = errors.New("a shared mailbox must keep at least one manager")
+)
+
+// MailboxRoles are the permissions of a delegate on a shared mailbox.
+type MailboxRoles struct {
+	Read   bool `json:"read"`
+	SendAs bool `json:"send_as"`
+	Manage bool `json:"manage"`
+}
+
+// String lists the permissions, such as "read,send_as".
+func (r MailboxRoles) String() string {
+	var roles []string
+	if r.Read {
+		roles = append(roles, MailboxRead)
+	}
+	if r.SendAs {
+		roles = append(roles, MailboxSendAs)
+	}
+	if r.Manage {
+		roles = append(roles, MailboxManage)
+	}
+	return strings.Join(roles, ",")
+}
+
+func (r MailboxRoles) has(permission string) bool {
+	switch permission {
+	case MailboxRead:
+		return r.Read
+	case MailboxSendAs:
+		return r.SendAs
+	case MailboxManage:
+		return r.Manage
+	}
+	return false
+}
+
+// SharedMailboxInfo describes a shared mailbox to one of its delegates.
+// Delegates are only listed for managers.
+type SharedMailboxInfo struct {
+	ID        uint
+	Address   string
+	Roles     MailboxRoles
+	Verified  bool // Whether the verification link sent to the address was opened
+	Delegates []DelegateInfo
+	CreatedAt time.Time
+}
+
+// DelegateInfo describes a delegate of a shared mailbox.
+type DelegateInfo struct {
+	UserID uint
+	Email  string
+	Roles  MailboxRoles
+}
+
+// CreateSharedMailbox creates a shared mailbox with its own key pair, whose
+// private key is encrypted to the creator. Only administrators can create
+// one, in a local domain. The creator gets every permission. The mailbox's
+// key is published in the key transparency log like a user's. Its address
+// is unverified until the verification link sent to it is opened.
+func CreateSharedMailbox(creatorID uint, address string, db *gorm.DB) (*models.User, error) {
+	address = strings.ToLower(strings.TrimSpace(address))
+	var creator models.User
+	if err := db.Where("id = ?", creatorID).First(&creator).Error; err != nil {
+		return nil, err
+	}
+	if err := checkSharedAddress(creator, address, db); err != nil {
+		return nil, err
+	}
+
+	publicKey, privateKey, err := crypto.GenerateRSAKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	mailbox := models.User{
+		Email:      address,
+		PublicKey:  publicKey,
+		PrivateKey: []byte{},
+		Shared:     true,
+	}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&mailbox).Error; err != nil {
+			return err
+		}
+		roles := MailboxRoles{Read: true, SendAs: true, Manage: true}
+		if err := createDelegate(tx, mailbox.ID, creator, roles, privateKey); err != nil {
+			return err
+		}
+		if err := recordMailboxEvent(tx, mailbox.ID, creatorID, AuditGrant, 0, creator.Email+": "+roles.String()); err != nil {
+			return err
+		}
+		return transparency.Append(tx, mailbox.ID, address, 1, publicKey)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &mailbox, nil
+}
+
+// ListSharedMailboxes returns the shared mailboxes the user is a delegate of.
+func ListSharedMailboxes(userID uint, db *gorm.DB) ([]SharedMailboxInfo, error) {
+	var delegations []models.MailboxDelegate
+	if err := db.Where("user_id = ?", userID).Order("mailbox_id").Find(&delegations).Error; err != nil {
+		return nil, err
+	}
+	mailboxes := make([]SharedMailboxInfo, 0, len(delegations))
+	for _, delegation := range delegations {
+		info, err := GetSharedMailbox(userID, delegation.MailboxID, db)
+		if err != nil {
+			return nil, err
+		}
+		mailboxes = append(mailboxes, *info)
+	}
+	return mailboxes, nil
+}
+
+// GetSharedMailbox returns a shared mailbox the user is a delegate of.
+func GetSharedMailbox(userID, mailboxID uint, db *gorm.DB) (*SharedMailboxInfo, error) {
+	delegate, err := loadDelegate(db, mailboxID, userID)
+	if err != nil {
+		return nil, err
+	}
+	var mailbox models.User
+	if err := db.Select("id", "email", "email_verified_at", "created_at").Where("id = ? AND shared", mailboxID).First(&mailbox).Error; err != nil {
+		return nil, err
+	}
+	info := &SharedMailboxInfo{ID: mailbox.ID, Address: mailbox.Email, Roles: delegateRoles(*delegate), Verified: mailbox.IsVerified(), CreatedAt: mailbox.CreatedAt}
+	if !delegate.CanManage {
+		return info, nil
+	}
+
+	var delegates []models.MailboxDelegate
+	if err := db.Where("mailbox_id = ?", mailboxID).Order("id").Find(&delegates).Error; err != nil {
+		return nil, err
+	}
+	for _, d := range delegates {
+		var user models.User
+		if err := db.Select("id", "email").Where("id = ?", d.UserID).First(&user).Error; err != nil {
+			return nil, err
+		}
+		info.Delegates = append(info.Delegates, DelegateInfo{UserID: user.ID, Email: user.Email, Roles: delegateRoles(d)})
+	}
+	return info, nil
+}
+
+// OpenSharedMailbox returns the private key of a shared mailbox for a
+// delegate with the given permission. privateKey is the delegate's unwrapped
+// key.
+func OpenSharedMailbox(userID, mailboxID uint, permission string, privateKey []byte, db *gorm.DB) ([]byte, error) {
+	delegate, err := loadDelegate(db, mailboxID, userID)
+	if err != nil {
+		return nil, err
+	}
+	if !delegateRoles(*delegate).has(permission) {
+		return nil, ErrMailboxPermission
+	}
+	key, err := newKeyring(userID, privateKey, db).key(delegate.KeyVersion)
+	if err != nil {
+		return nil, err
+	}
+	return openSealedKey(delegate.EncryptedPrivateKey, delegate.EncryptedPassphrase, key)
+}
+
+// ReadSharedInbox decrypts the inbox of a shared mailbox for a delegate with
+// the read permission, and records which messages they read.
+func ReadSharedInbox(userID, mailboxID uint, privateKey []byte, db *gorm.DB) ([]DecryptedMessage, error) {
+	mailboxKey, err := OpenSharedMailbox(userID, mailboxID, MailboxRead, privateKey, db)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := GetInbox(mailboxID, mailboxKey, db)
+	if err != nil {
+		return nil, err
+	}
+	events := make([]models.MailboxAuditEvent, 0, len(messages))
+	for _, msg := range messages {
+		if !msg.Unreadable {
+			events = append(events, models.MailboxAuditEvent{MailboxID: mailboxID, ActorID: userID, Action: AuditRead, MessageID: msg.ID})
+		}
+	}
+	if len(events) == 0 {
+		return messages, nil
+	}
+	if err := db.Create(&events).Error; err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+// RecordMailboxSend records that a delegate sent a message as a shared
+// mailbox.
+func RecordMailboxSend(mailboxID, userID, messageID uint, db *gorm.DB) error {
+	return recordMailboxEvent(db, mailboxID, userID, AuditSend, messageID, "")
+}
+
+// GrantMailboxAccess gives a user the given permissions on a shared mailbox,
+// replacing those they had. The manager's unwrapped privateKey opens the
+// mailbox's key to encrypt it to a new delegate.
+func GrantMailboxAccess(managerID, mailboxID, userID uint, roles MailboxRoles, privateKey []byte, db *gorm.DB) error {
+	if roles == (MailboxRoles{}) {
+		return ErrNoMailboxRoles
+	}
+	mailboxKey, err := OpenSharedMailbox(managerID, mailboxID, MailboxManage, privateKey, db)
+	if err != nil {
+		return err
+	}
+	var user models.User
+	if err := db.Where("id = ? AND NOT shared", userID).First(&user).Error; err != nil {
+		return err
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := lockMailbox(tx, mailboxID); err != nil {
+			return err
+		}
+		var delegate models.MailboxDelegate
+		err := tx.Where("mailbox_id = ? AND user_id = ?", mailboxID, userID).First(&delegate).Error
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			if err := createDelegate(tx, mailboxID, user, roles, mailboxKey); err != nil {
+				return err
+			}
+		case err != nil:
+			return err
+		default:
+			if delegate.CanManage && !roles.Manage {
+				if err := checkOtherManager(tx, mailboxID, userID); err != nil {
+					return err
+				}
+			}
+			if err := tx.Model(&delegate).Updates(map[string]interface{}{
+				"can_read":    roles.Read,
+				"can_send_as": roles.SendAs,
+				"can_manage":  roles.Manage,
+			}).Error; err != nil {
+				return err
+			}
+		}
+		return recordMailboxEvent(tx, mailboxID, managerID, AuditGrant, 0, user.Email+": "+roles.String())
+	})
+}
+
+// RevokeMailboxAccess removes a delegate from a shared mailbox. Delegates
+// can remove themselves; others need the manage permission. A revoked
+// delegate may have kept the mailbox's key, so its mail is only protected
+// from them by the server's access checks from then on.
+func RevokeMailboxAccess(managerID, mailboxID, userID uint, db *gorm.DB) error {
+	if managerID != userID {
+		manager, err := loadDelegate(db, mailboxID, managerID)
+		if err != nil {
+			return err
+		}
+		if !manager.CanManage {
+			return ErrMailboxPermission
+		}
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := lockMailbox(tx, mailboxID); err != nil {
+			return err
+		}
+		delegate, err := loadDelegate(tx, mailboxID, userID)
+		if err != nil {
+			return err
+		}
+		if delegate.CanManage {
+			if err := checkOtherManager(tx, mailboxID, userID); err != nil {
+				return err
+			}
+		}
+		if err := tx.Delete(delegate).Error; err != nil {
+			return err
+		}
+		var user models.User
+		if err := tx.Select("id", "email").Where("id = ?", userID).First(&user).Error; err != nil {
+			return err
+		}
+		return recordMailboxEvent(tx, mailboxID, managerID, AuditRevoke, 0, user.Email)
+	})
+}
+
+// MailboxAudit returns up to limit of the latest audit events of a shared
+// mailbox, newest first, for a delegate with the manage permission.
+func MailboxAudit(managerID, mailboxID uint, limit int, db *gorm.DB) ([]models.MailboxAuditEvent, error) {
+	manager, err := loadDelegate(db, mailboxID, managerID)
+	if err != nil {
+		return nil, err
+	}
+	if !manager.CanManage {
+		return nil, ErrMailboxPermission
+	}
+	var events []models.MailboxAuditEvent
+	if err := db.Where("mailbox_id = ?", mailboxID).Order("id DESC").Limit(limit).Find(&events).Error; err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// RevokeDelegations removes the user's access to every shared mailbox, for
+// when their key is discarded and the mailbox keys encrypted to it are lost.
+// A manager has to grant access again. Where the user is the last manager,
+// management passes to the earliest other delegate, who holds the mailbox's
+// key; ErrLastMailboxManager is returned when there is none, since the
+// mailbox's key would be lost with the user's.
+func RevokeDelegations(tx *gorm.DB, userID uint) error {
+	var delegations []models.MailboxDelegate
+	if err := tx.Where("user_id = ?", userID).Order("mailbox_id").Find(&delegations).Error; err != nil {
+		return err
+	}
+	if len(delegations) == 0 {
+		return nil
+	}
+	var user models.User
+	if err := tx.Select("id", "email").Where("id = ?", userID).First(&user).Error; err != nil {
+		return err
+	}
+	for _, delegate := range delegations {
+		if err := lockMailbox(tx, delegate.MailboxID); err != nil {
+			return err
+		}
+		if delegate.CanManage {
+			if err := handOverManagement(tx, delegate.MailboxID, userID); err != nil {
+				return err
+			}
+		}
+		if err := tx.Delete(&delegate).Error; err != nil {
+			return err
+		}
+		if err := recordMailboxEvent(tx, delegate.MailboxID, userID, AuditRevoke, 0, user.Email); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handOverManagement gives the manage permission to the earliest delegate
+// other than userID when userID is the mailbox's last manager.
+func handOverManagement(tx *gorm.DB, mailboxID, userID uint) error {
+	err := checkOtherManager(tx, mailboxID, userID)
+	if !errors.Is(err, ErrLastMailboxManager) {
+		return err
+	}
+	var heir models.MailboxDelegate
+	err = tx.Where("mailbox_id = ? AND user_id <> ?", mailboxID, userID).Order("id").First(&heir).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrLastMailboxManager
+	}
+	if err != nil {
+		return err
+	}
+	if err := tx.Model(&heir).Update("can_manage", true).Error; err != nil {
+		return err
+	}
+	heir.CanManage = true
+	var user models.User
+	if err := tx.Select("id", "email").Where("id = ?", heir.UserID).First(&user).Error; err != nil {
+		return err
+	}
+	return recordMailboxEvent(tx, mailboxID, userID, AuditGrant, 0, user.Email+": "+delegateRoles(heir).String())
+}
+
+// createDelegate encrypts a mailbox's private key to the user's current key
+// and stores their delegation.
+func createDelegate(tx *gorm.DB, mailboxID uint, user models.User, roles MailboxRoles, mailboxKey []byte) error {
+	encryptedKey, encryptedPassphrase, err := sealUserKey(mailboxKey, user.PublicKey)
+	if err != nil {
+		return err
+	}
+	return tx.Create(&models.MailboxDelegate{
+		MailboxID:           mailboxID,
+		UserID:              user.ID,
+		CanRead:             roles.Read,
+		CanSendAs:           roles.SendAs,
+		CanManage:           roles.Manage,
+		KeyVersion:          currentVersion(user),
+		EncryptedPrivateKey: encryptedKey,
+		EncryptedPassphrase: encryptedPassphrase,
+	}).Error
+}
+
+// loadDelegate returns the user's delegation to a shared mailbox, or
+// ErrMailboxNotFound when they have none.
+func loadDelegate(db *gorm.DB, mailboxID, userID uint) (*models.MailboxDelegate, error) {
+	var delegate models.MailboxDelegate
+	err := db.Where("mailbox_id = ? AND user_id = ?", mailboxID, userID).First(&delegate).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrMailboxNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &delegate, nil
+}
+
+// lockMailbox locks a shared mailbox for a change of its delegates.
+func lockMailbox(tx *gorm.DB, mailboxID uint) error {
+	var mailbox models.User
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id").Where("id = ? AND shared", mailboxID).First(&mailbox).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrMailboxNotFound
+	}
+	return err
+}
+
+// checkOtherManager returns ErrLastMailboxManager unless a delegate other
+// than userID can manage the mailbox.
+func checkOtherManager(tx *gorm.DB, mailboxID, userID uint) error {
+	var managers int64
+	if err := tx.Model(&models.MailboxDelegate{}).Where("mailbox_id = ? AND can_manage AND user_id <> ?", mailboxID, userID).Count(&managers).Error; err != nil {
+		return err
+	}
+	if managers == 0 {
+		return ErrLastMailboxManager
+	}
+	return nil
+}
+
+func recordMailboxEvent(db *gorm.DB, mailboxID, actorID uint, action string, messageID uint, detail string) error {
+	return db.Create(&models.MailboxAuditEvent{MailboxID: mailboxID, ActorID: actorID, Action: action, MessageID: messageID, Detail: detail}).Error
+}
+
+func delegateRoles(delegate models.MailboxDelegate) MailboxRoles {
+	return MailboxRoles{Read: delegate.CanRead, SendAs: delegate.CanSendAs, Manage: delegate.CanManage}
+}
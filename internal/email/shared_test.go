@@ -0,0 +1,223 @@
+package email
+
+import (
+	"bytes"
+	"errors"
+	"secmail/internal/crypto"
+	"secmail/internal/models"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+func TestMailboxRoles(t *testing.T) {
+	roles := MailboxRoles{Read: true, Manage: true}
+	if roles.String() != "read,manage" {
+		t.Errorf("Unexpected roles: %s", roles.String())
+	}
+	if !roles.has(MailboxRead) || roles.has(MailboxSendAs) || !roles.has(MailboxManage) {
+		t.Errorf("Unexpected permissions for %s", roles)
+	}
+	if roles.has("delete") {
+		t.Error("Expected unknown permissions to be refused")
+	}
+}
+
+func TestSealOpenMailboxKey(t *testing.T) {
+	_, mailboxKey, err := crypto.GenerateRSAKeyPair()
+	if err != nil {
+		t.Fatalf("Failed to generate mailbox key: %v", err)
+	}
+	delegatePublic, delegatePrivate, err := crypto.GenerateRSAKeyPair()
+	if err != nil {
+		t.Fatalf("Failed to generate delegate key: %v", err)
+	}
+
+	encryptedKey, encryptedPassphrase, err := sealUserKey(mailboxKey, delegatePublic)
+	if err != nil {
+		t.Fatalf("Failed to seal mailbox key: %v", err)
+	}
+	opened, err := openSealedKey(encryptedKey, encryptedPassphrase, delegatePrivate)
+	if err != nil {
+		t.Fatalf("Failed to open mailbox key: %v", err)
+	}
+	if !bytes.Equal(opened, mailboxKey) {
+		t.Error("Opened mailbox key does not match")
+	}
+}
+
+func TestCreateSharedMailboxAddress(t *testing.T) {
+	db := openTestDB(t)
+	alice, _ := createTestUser(t, db, "alice@secmail.test")
+	bob, _ := createTestUser(t, db, "bob@secmail.test")
+	setTestAdmins(t, alice.Email)
+
+	tests := []struct {
+		creatorID uint
+		address   string
+		want      error
+	}{
+		{bob.ID, "support@secmail.test", ErrNotAdmin},
+		{alice.ID, "support@example.org", ErrAddressNotLocal},
+		{alice.ID, "BOB@secmail.test", ErrAddressTaken},
+	}
+	for _, tc := range tests {
+		if _, err := CreateSharedMailbox(tc.creatorID, tc.address, db); !errors.Is(err, tc.want) {
+			t.Errorf("CreateSharedMailbox(%d, %q): expected %v, got %v", tc.creatorID, tc.address, tc.want, err)
+		}
+	}
+
+	// An unverified administrator is not trusted with the address either
+	if err := db.Model(&alice).Update("email_verified_at", nil).Error; err != nil {
+		t.Fatalf("Failed to unverify user: %v", err)
+	}
+	if _, err := CreateSharedMailbox(alice.ID, "support@secmail.test", db); !errors.Is(err, ErrNotAdmin) {
+		t.Errorf("Expected an unverified administrator to be refused, got %v", err)
+	}
+}
+
+func TestSharedMailboxAccess(t *testing.T) {
+	db := openTestDB(t)
+	alice, alicePrivateKey := createTestUser(t, db, "alice@secmail.test")
+	bob, bobPrivateKey := createTestUser(t, db, "bob@secmail.test")
+	carol, _ := createTestUser(t, db, "carol@secmail.test")
+	setTestAdmins(t, alice.Email)
+
+	mailbox, err := CreateSharedMailbox(alice.ID, "support@secmail.test", db)
+	if err != nil {
+		t.Fatalf("Failed to create shared mailbox: %v", err)
+	}
+	info, err := GetSharedMailbox(alice.ID, mailbox.ID, db)
+	if err != nil {
+		t.Fatalf("Failed to get shared mailbox: %v", err)
+	}
+	if info.Verified || info.Roles != (MailboxRoles{Read: true, SendAs: true, Manage: true}) {
+		t.Errorf("Expected an unverified mailbox with every permission for its creator, got %+v", info)
+	}
+
+	// Mail is only delivered once the address is verified
+	if _, err := SendMessage(carol.ID, []uint{mailbox.ID}, nil, nil, "Help", "It broke", Lifetime{}, nil, db); !errors.Is(err, ErrRecipientUnverified) {
+		t.Errorf("Expected the unverified mailbox to refuse mail, got %v", err)
+	}
+	if err := db.Model(mailbox).Update("email_verified_at", time.Now()).Error; err != nil {
+		t.Fatalf("Failed to verify mailbox: %v", err)
+	}
+	msg, err := SendMessage(carol.ID, []uint{mailbox.ID}, nil, nil, "Help", "It broke", Lifetime{}, nil, db)
+	if err != nil {
+		t.Fatalf("Failed to send to the mailbox: %v", err)
+	}
+
+	// Delegates only get the permissions they were granted
+	if _, err := OpenSharedMailbox(bob.ID, mailbox.ID, MailboxRead, bobPrivateKey, db); !errors.Is(err, ErrMailboxNotFound) {
+		t.Errorf("Expected a non-delegate to be refused, got %v", err)
+	}
+	if err := GrantMailboxAccess(alice.ID, mailbox.ID, bob.ID, MailboxRoles{Read: true}, alicePrivateKey, db); err != nil {
+		t.Fatalf("Failed to grant access: %v", err)
+	}
+	if _, err := OpenSharedMailbox(bob.ID, mailbox.ID, MailboxSendAs, bobPrivateKey, db); !errors.Is(err, ErrMailboxPermission) {
+		t.Errorf("Expected a reader to be refused send_as, got %v", err)
+	}
+	if err := GrantMailboxAccess(bob.ID, mailbox.ID, carol.ID, MailboxRoles{Read: true}, bobPrivateKey, db); !errors.Is(err, ErrMailboxPermission) {
+		t.Errorf("Expected a reader to be refused granting access, got %v", err)
+	}
+	if _, err := MailboxAudit(bob.ID, mailbox.ID, 10, db); !errors.Is(err, ErrMailboxPermission) {
+		t.Errorf("Expected a reader to be refused the audit log, got %v", err)
+	}
+	inbox, err := ReadSharedInbox(bob.ID, mailbox.ID, bobPrivateKey, db)
+	if err != nil {
+		t.Fatalf("Failed to read shared inbox: %v", err)
+	}
+	if len(inbox) != 1 || inbox[0].ID != msg.ID || inbox[0].Body != "It broke" {
+		t.Errorf("Unexpected shared inbox: %+v", inbox)
+	}
+
+	// Managers with send_as answer as the mailbox
+	mailboxKey, err := OpenSharedMailbox(alice.ID, mailbox.ID, MailboxSendAs, alicePrivateKey, db)
+	if err != nil {
+		t.Fatalf("Failed to open the mailbox to send: %v", err)
+	}
+	reply, err := SendMessage(mailbox.ID, []uint{carol.ID}, nil, nil, "Re: Help", "Fixed", Lifetime{}, mailboxKey, db)
+	if err != nil {
+		t.Fatalf("Failed to send as the mailbox: %v", err)
+	}
+	if err := RecordMailboxSend(mailbox.ID, alice.ID, reply.ID, db); err != nil {
+		t.Fatalf("Failed to record send: %v", err)
+	}
+
+	if err := RevokeMailboxAccess(alice.ID, mailbox.ID, alice.ID, db); !errors.Is(err, ErrLastMailboxManager) {
+		t.Errorf("Expected the last manager to stay, got %v", err)
+	}
+	if err := RevokeMailboxAccess(alice.ID, mailbox.ID, bob.ID, db); err != nil {
+		t.Fatalf("Failed to revoke access: %v", err)
+	}
+	if _, err := ReadSharedInbox(bob.ID, mailbox.ID, bobPrivateKey, db); !errors.Is(err, ErrMailboxNotFound) {
+		t.Errorf("Expected a revoked delegate to be refused, got %v", err)
+	}
+
+	// Every grant, read and revocation is audited, newest first
+	events, err := MailboxAudit(alice.ID, mailbox.ID, 10, db)
+	if err != nil {
+		t.Fatalf("Failed to read audit log: %v", err)
+	}
+	want := []models.MailboxAuditEvent{
+		{ActorID: alice.ID, Action: AuditRevoke, Detail: bob.Email},
+		{ActorID: alice.ID, Action: AuditSend, MessageID: reply.ID},
+		{ActorID: bob.ID, Action: AuditRead, MessageID: msg.ID},
+		{ActorID: alice.ID, Action: AuditGrant, Detail: bob.Email + ": read"},
+		{ActorID: alice.ID, Action: AuditGrant, Detail: alice.Email + ": read,send_as,manage"},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("Expected %d audit events, got %+v", len(want), events)
+	}
+	for i, event := range events {
+		if event.ActorID != want[i].ActorID || event.Action != want[i].Action || event.MessageID != want[i].MessageID || event.Detail != want[i].Detail {
+			t.Errorf("Audit event %d: expected %+v, got %+v", i, want[i], event)
+		}
+	}
+}
+
+func TestRevokeDelegations(t *testing.T) {
+	db := openTestDB(t)
+	alice, alicePrivateKey := createTestUser(t, db, "alice@secmail.test")
+	bob, bobPrivateKey := createTestUser(t, db, "bob@secmail.test")
+	setTestAdmins(t, alice.Email)
+
+	mailbox, err := CreateSharedMailbox(alice.ID, "support@secmail.test", db)
+	if err != nil {
+		t.Fatalf("Failed to create shared mailbox: %v", err)
+	}
+	revoke := func(userID uint) error {
+		return db.Transaction(func(tx *gorm.DB) error { return RevokeDelegations(tx, userID) })
+	}
+
+	// The only delegate holds the only copy of the mailbox's key
+	if err := revoke(alice.ID); !errors.Is(err, ErrLastMailboxManager) {
+		t.Fatalf("Expected the only delegate to stay, got %v", err)
+	}
+	if _, err := OpenSharedMailbox(alice.ID, mailbox.ID, MailboxManage, alicePrivateKey, db); err != nil {
+		t.Fatalf("Expected the only delegate to keep access, got %v", err)
+	}
+
+	// Otherwise management passes to another delegate
+	if err := GrantMailboxAccess(alice.ID, mailbox.ID, bob.ID, MailboxRoles{Read: true}, alicePrivateKey, db); err != nil {
+		t.Fatalf("Failed to grant access: %v", err)
+	}
+	if err := revoke(alice.ID); err != nil {
+		t.Fatalf("Failed to revoke delegations: %v", err)
+	}
+	if _, err := OpenSharedMailbox(alice.ID, mailbox.ID, MailboxRead, alicePrivateKey, db); !errors.Is(err, ErrMailboxNotFound) {
+		t.Errorf("Expected the revoked delegate to be refused, got %v", err)
+	}
+	if _, err := OpenSharedMailbox(bob.ID, mailbox.ID, MailboxManage, bobPrivateKey, db); err != nil {
+		t.Errorf("Expected the remaining delegate to manage the mailbox, got %v", err)
+	}
+	events, err := MailboxAudit(bob.ID, mailbox.ID, 2, db)
+	if err != nil {
+		t.Fatalf("Failed to read audit log: %v", err)
+	}
+	if len(events) != 2 || events[0].Action != AuditRevoke || events[0].Detail != alice.Email ||
+		events[1].Action != AuditGrant || events[1].Detail != bob.Email+": read,manage" {
+		t.Errorf("Unexpected audit events: %+v", events)
+	}
+}
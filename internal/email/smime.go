@@ -0,0 +1,268 @@
+package email
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"secmail/internal/crypto"
+	"secmail/internal/models"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message"
+	"gorm.io/gorm"
+)
+
+// Bodies shown in place of S/MIME content that cannot be opened.
+const (
+	smimeNoKeyBody       = "[This message is S/MIME encrypted. Add a certificate to your account to read future messages.]"
+	smimeUndecryptedBody = "[This message is S/MIME encrypted and could not be decrypted with your certificate.]"
+)
+
+// selfSignedValidity is the lifetime of certificates issued by
+// IssueSelfSignedCertificate.
+const selfSignedValidity = 365 * 24 * time.Hour
+
+var ErrCertificateMismatch = errors.New("certificate does not match the account's public key")
+
+// smimeTrustStore holds the CA certificates S/MIME signatures must chain to.
+// A nil pool trusts nothing, so every signature is reported as untrusted.
+var smimeTrustStore *x509.CertPool
+
+// SetSMIMETrustStore sets the CA certificates used to verify inbound S/MIME
+// signatures.
+func SetSMIMETrustStore(pool *x509.CertPool) {
+	smimeTrustStore = pool
+}
+
+// SetCertificate attaches a PEM X.509 certificate for the user's public key,
+// typically issued by a CA from a request made with that key.
+func SetCertificate(userID uint, certPEM []byte, db *gorm.DB) (crypto.CertificateInfo, error) {
+	var user models.User
+	if err := db.Where("id = ?", userID).First(&user).Error; err != nil {
+		return crypto.CertificateInfo{}, err
+	}
+	_, info, err := crypto.ParseCertificate(certPEM)
+	if err != nil {
+		return crypto.CertificateInfo{}, err
+	}
+	if !crypto.CertificateMatchesKey(certPEM, user.PublicKey) {
+		return crypto.CertificateInfo{}, ErrCertificateMismatch
+	}
+	if err := db.Model(&user).Update("certificate", certPEM).Error; err != nil {
+		return crypto.CertificateInfo{}, err
+	}
+	return info, nil
+}
+
+// IssueSelfSignedCertificate attaches a self-signed certificate for the
+// user's key pair. privateKey is the user's unwrapped private key.
+func IssueSelfSignedCertificate(userID uint, privateKey []byte, db *gorm.DB) ([]byte, crypto.CertificateInfo, error) {
+	var user models.User
+	if err := db.Where("id = ?", userID).First(&user).Error; err != nil {
+		return nil, crypto.CertificateInfo{}, err
+	}
+	certPEM, err := crypto.CreateSelfSignedCertificate(user.PublicKey, privateKey, user.Email, selfSignedValidity)
+	if err != nil {
+		return nil, crypto.CertificateInfo{}, err
+	}
+	_, info, err := crypto.ParseCertificate(certPEM)
+	if err != nil {
+		return nil, crypto.CertificateInfo{}, err
+	}
+	if err := db.Model(&user).Update("certificate", certPEM).Error; err != nil {
+		return nil, crypto.CertificateInfo{}, err
+	}
+	return certPEM, info, nil
+}
+
+// ImportSMIMEContactCert stores an external correspondent's certificate for
+// each address, replacing certificates previously stored for those
+// addresses. When no address is given, the certificate's addresses are used.
+func ImportSMIMEContactCert(userID uint, certPEM []byte, addresses []string, db *gorm.DB) ([]models.SMIMEContactCert, error) {
+	cert, info, err := crypto.ParseCertificate(certPEM)
+	if err != nil {
+		return nil, err
+	}
+	if time.Now().After(cert.NotAfter) {
+		return nil, errors.New("certificate has expired")
+	}
+	if len(addresses) == 0 {
+		addresses = info.Emails
+	}
+	if len(addresses) == 0 {
+		return nil, errors.New("certificate has no email address; specify one")
+	}
+
+	var contacts []models.SMIMEContactCert
+	err = db.Transaction(func(tx *gorm.DB) error {
+		for _, addr := range addresses {
+			addr = strings.ToLower(strings.TrimSpace(addr))
+			var contact models.SMIMEContactCert
+			if err := tx.Where("user_id = ? AND email = ?", userID, addr).FirstOrInit(&contact).Error; err != nil {
+				return err
+			}
+			contact.UserID = userID
+			contact.Email = addr
+			contact.Fingerprint = info.Fingerprint
+			contact.Certificate = certPEM
+			contact.NotAfter = info.NotAfter
+			if err := tx.Save(&contact).Error; err != nil {
+				return err
+			}
+			contacts = append(contacts, contact)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return contacts, nil
+}
+
+// ComposeSMIME renders m as an RFC 8551 S/MIME message. The body is signed
+// when signerCert is set and then enveloped to recipientCerts when any are
+// given. With neither it falls back to ComposeMIME.
+func ComposeSMIME(m OutgoingMessage, recipientCerts [][]byte, signerCert, signerKey []byte) ([]byte, error) {
+	if len(recipientCerts) == 0 && signerCert == nil {
+		return ComposeMIME(m)
+	}
+
+	h, err := outgoingHeader(m)
+	if err != nil {
+		return nil, err
+	}
+	entity := textPart(m.Body)
+
+	if signerCert != nil {
+		boundary, err := randomBoundary()
+		if err != nil {
+			return nil, err
+		}
+		signature, err := crypto.SignSMIME(entity, signerCert, signerKey, true)
+		if err != nil {
+			return nil, err
+		}
+		var signed bytes.Buffer
+		fmt.Fprintf(&signed, "Content-Type: multipart/signed; protocol=\"application/pkcs7-signature\"; micalg=%s; boundary=\"%s\"\r\n\r\n", crypto.SMIMEMicalg, boundary)
+		fmt.Fprintf(&signed, "--%s\r\n", boundary)
+		signed.Write(entity)
+		fmt.Fprintf(&signed, "\r\n--%s\r\nContent-Type: application/pkcs7-signature; name=\"smime.p7s\"\r\nContent-Transfer-Encoding: base64\r\nContent-Disposition: attachment; filename=\"smime.p7s\"\r\n\r\n", boundary)
+		signed.Write(base64Lines(signature))
+		fmt.Fprintf(&signed, "--%s--\r\n", boundary)
+		entity = signed.Bytes()
+	}
+
+	if len(recipientCerts) > 0 {
+		enveloped, err := crypto.EncryptSMIME(entity, recipientCerts)
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		buf.WriteString("Content-Type: application/pkcs7-mime; smime-type=enveloped-data; name=\"smime.p7m\"\r\nContent-Transfer-Encoding: base64\r\nContent-Disposition: attachment; filename=\"smime.p7m\"\r\n\r\n")
+		buf.Write(base64Lines(enveloped))
+		entity = buf.Bytes()
+	}
+
+	return attachEntity(h.Header.Header, entity)
+}
+
+// readSMIMESigned verifies a multipart/signed S/MIME body.
+func readSMIMESigned(content []byte, boundary string, keys *ReadKeys, parsed *ParsedMessage) (string, error) {
+	parts, err := splitMultipart(content, boundary)
+	if err != nil {
+		return "", err
+	}
+	if len(parts) != 2 {
+		return "", errors.New("malformed S/MIME signed message")
+	}
+	signatureHeader, signatureContent, err := splitEntity(parts[1])
+	if err != nil {
+		return "", err
+	}
+	signature, err := decodedBody(signatureHeader, signatureContent)
+	if err != nil {
+		return "", err
+	}
+	// RFC 8551 section 3.1.1: the signature covers the first part in canonical form
+	_, parsed.SMIMESignature, parsed.SMIMESigner = crypto.VerifySMIME(signature, toCRLF(parts[0]), smimeTrustStore)
+	return readEntityBody(parts[0], keys, parsed)
+}
+
+// readSMIMEObject opens an application/pkcs7-mime body, either enveloped
+// (encrypted) or opaque signed data.
+func readSMIMEObject(header message.Header, content []byte, keys *ReadKeys, parsed *ParsedMessage) (string, error) {
+	der, err := decodedBody(header, content)
+	if err != nil {
+		return "", err
+	}
+	_, params, _ := header.ContentType()
+
+	if strings.EqualFold(params["smime-type"], "signed-data") {
+		signed, status, signer := crypto.VerifySMIME(der, nil, smimeTrustStore)
+		if signed == nil {
+			return "", errors.New("malformed S/MIME signed message")
+		}
+		parsed.SMIMESignature = status
+		parsed.SMIMESigner = signer
+		return readEntityBody(signed, keys, parsed)
+	}
+
+	parsed.SMIMEEncrypted = true
+	if keys == nil {
+		return smimeNoKeyBody, nil
+	}
+	pairs := keys.RetiredSMIME
+	if keys.Certificate != nil && keys.PrivateKey != nil {
+		pairs = append([]SMIMEKeyPair{{Certificate: keys.Certificate, PrivateKey: keys.PrivateKey}}, pairs...)
+	}
+	if len(pairs) == 0 {
+		return smimeNoKeyBody, nil
+	}
+	for _, pair := range pairs {
+		plaintext, err := crypto.DecryptSMIME(der, pair.Certificate, pair.PrivateKey)
+		if err == nil {
+			return readEntityBody(plaintext, keys, parsed)
+		}
+	}
+	return smimeUndecryptedBody, nil
+}
+
+// isSMIMEType reports whether mediaType is an S/MIME object.
+func isSMIMEType(mediaType string) bool {
+	return mediaType == "application/pkcs7-mime" || mediaType == "application/x-pkcs7-mime"
+}
+
+// isSMIMESignatureType reports whether protocol names a detached S/MIME
+// signature.
+func isSMIMESignatureType(protocol string) bool {
+	protocol = strings.ToLower(protocol)
+	return protocol == "application/pkcs7-signature" || protocol == "application/x-pkcs7-signature"
+}
+
+// decodedBody returns the body of a MIME entity with its
+// Content-Transfer-Encoding removed.
+func decodedBody(header message.Header, content []byte) ([]byte, error) {
+	entity, err := message.New(header, bytes.NewReader(content))
+	if err != nil && entity == nil {
+		return nil, err
+	}
+	return io.ReadAll(entity.Body)
+}
+
+// base64Lines encodes data as base64 wrapped at 76 columns with CRLF.
+func base64Lines(data []byte) []byte {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	var buf bytes.Buffer
+	for len(encoded) > 76 {
+		buf.WriteString(encoded[:76])
+		buf.WriteString("\r\n")
+		encoded = encoded[76:]
+	}
+	buf.WriteString(encoded)
+	buf.WriteString("\r\n")
+	return buf.Bytes()
+}
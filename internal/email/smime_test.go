@@ -0,0 +1,93 @@
+package email
+
+import (
+	"bytes"
+	"crypto/x509"
+	"secmail/internal/crypto"
+	"testing"
+	"time"
+)
+
+// testCertificate returns a self-signed certificate and its private key.
+func testCertificate(t *testing.T, address string) (certPEM, privateKey []byte) {
+	t.Helper()
+	publicKey, privateKey, err := crypto.GenerateRSAKeyPair()
+	if err != nil {
+		t.Fatalf("Failed to generate key pair: %v", err)
+	}
+	certPEM, err = crypto.CreateSelfSignedCertificate(publicKey, privateKey, address, time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	return certPEM, privateKey
+}
+
+func TestComposeParseSMIME(t *testing.T) {
+	aliceCert, aliceKey := testCertificate(t, "alice@secmail.test")
+	carolCert, carolKey := testCertificate(t, "carol@example.org")
+
+	cert, _, err := crypto.ParseCertificate(aliceCert)
+	if err != nil {
+		t.Fatalf("Failed to parse certificate: %v", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	SetSMIMETrustStore(roots)
+	defer SetSMIMETrustStore(nil)
+
+	m := OutgoingMessage{
+		From:    "alice@secmail.test",
+		To:      []string{"carol@example.org"},
+		Subject: "Contract",
+		Body:    "Signed copy attached.\nRegards",
+		Date:    time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+	carolKeys := &ReadKeys{Certificate: carolCert, PrivateKey: carolKey}
+
+	encrypted, err := ComposeSMIME(m, [][]byte{carolCert}, aliceCert, aliceKey)
+	if err != nil {
+		t.Fatalf("Failed to compose encrypted message: %v", err)
+	}
+	if bytes.Contains(encrypted, []byte("Signed copy")) {
+		t.Error("Encrypted message contains plaintext")
+	}
+	parsed, err := ParseSecureMIME(encrypted, carolKeys)
+	if err != nil {
+		t.Fatalf("Failed to parse encrypted message: %v", err)
+	}
+	if parsed.Body != m.Body || parsed.Subject != m.Subject || !parsed.SMIMEEncrypted {
+		t.Errorf("Unexpected parsed message: %+v", parsed)
+	}
+	if parsed.SMIMESignature != crypto.SMIMESignatureValid || parsed.SMIMESigner != "alice@secmail.test" {
+		t.Errorf("Expected valid signature by alice, got %s by %s", parsed.SMIMESignature, parsed.SMIMESigner)
+	}
+
+	parsed, err = ParseMIME(encrypted)
+	if err != nil {
+		t.Fatalf("Failed to parse encrypted message without key: %v", err)
+	}
+	if parsed.Body != smimeNoKeyBody {
+		t.Errorf("Unexpected body without key: %q", parsed.Body)
+	}
+
+	signed, err := ComposeSMIME(m, nil, aliceCert, aliceKey)
+	if err != nil {
+		t.Fatalf("Failed to compose signed message: %v", err)
+	}
+	parsed, err = ParseMIME(signed)
+	if err != nil {
+		t.Fatalf("Failed to parse signed message: %v", err)
+	}
+	if parsed.Body != m.Body || parsed.SMIMESignature != crypto.SMIMESignatureValid {
+		t.Errorf("Unexpected parsed message: %+v", parsed)
+	}
+
+	SetSMIMETrustStore(nil)
+	parsed, err = ParseMIME(signed)
+	if err != nil {
+		t.Fatalf("Failed to parse signed message: %v", err)
+	}
+	if parsed.SMIMESignature != crypto.SMIMESignatureUntrusted {
+		t.Errorf("Expected untrusted signature, got %s", parsed.SMIMESignature)
+	}
+}
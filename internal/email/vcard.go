@@ -0,0 +1,177 @@
+package email
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"strings"
+)
+
+// vCard support covers what the address book stores: FN (or N), EMAIL,
+// NOTE and the pinned key fingerprint as X-SECMAIL-FINGERPRINT. Other
+// properties are ignored on import.
+
+var ErrInvalidVCard = errors.New("invalid vCard")
+
+// vcardLineLength is the line length vCards are folded at (RFC 6350
+// section 3.2), in octets.
+const vcardLineLength = 75
+
+// ParseVCards parses the vCards (versions 3.0 and 4.0) in data.
+func ParseVCards(data []byte) ([]ContactData, error) {
+	var contacts []ContactData
+	var current *ContactData
+	var familyGiven string
+	for _, line := range unfoldVCard(data) {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		name, value, ok := splitVCardLine(line)
+		if !ok {
+			return nil, ErrInvalidVCard
+		}
+		switch {
+		case name == "BEGIN" && strings.EqualFold(value, "VCARD"):
+			if current != nil {
+				return nil, ErrInvalidVCard
+			}
+			current = &ContactData{}
+			familyGiven = ""
+		case name == "END" && strings.EqualFold(value, "VCARD"):
+			if current == nil {
+				return nil, ErrInvalidVCard
+			}
+			if current.Name == "" {
+				current.Name = familyGiven
+			}
+			contacts = append(contacts, *current)
+			current = nil
+		case current == nil:
+			return nil, ErrInvalidVCard
+		case name == "FN":
+			current.Name = unescapeVCard(value)
+		case name == "N":
+			familyGiven = structuredName(value)
+		case name == "EMAIL":
+			if address := strings.TrimPrefix(unescapeVCard(value), "mailto:"); address != "" {
+				current.Emails = append(current.Emails, address)
+			}
+		case name == "NOTE":
+			current.Notes = unescapeVCard(value)
+		case name == "X-SECMAIL-FINGERPRINT":
+			current.PinnedFingerprint = normalizeFingerprint(value)
+		}
+	}
+	if current != nil {
+		return nil, ErrInvalidVCard
+	}
+	return contacts, nil
+}
+
+// FormatVCards renders contacts as vCard 4.0.
+func FormatVCards(contacts []ContactData) []byte {
+	var buf bytes.Buffer
+	for _, contact := range contacts {
+		writeVCardLine(&buf, "BEGIN:VCARD")
+		writeVCardLine(&buf, "VERSION:4.0")
+		writeVCardLine(&buf, "FN:"+escapeVCard(contact.Name))
+		for _, address := range contact.Emails {
+			writeVCardLine(&buf, "EMAIL:"+escapeVCard(address))
+		}
+		if contact.Notes != "" {
+			writeVCardLine(&buf, "NOTE:"+escapeVCard(contact.Notes))
+		}
+		if contact.PinnedFingerprint != "" {
+			writeVCardLine(&buf, "X-SECMAIL-FINGERPRINT:"+contact.PinnedFingerprint)
+		}
+		writeVCardLine(&buf, "END:VCARD")
+	}
+	return buf.Bytes()
+}
+
+// unfoldVCard splits data into logical lines, joining continuation lines
+// that start with a space or tab.
+func unfoldVCard(data []byte) []string {
+	var lines []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if len(lines) > 0 && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// splitVCardLine splits a content line into its uppercased property name,
+// without group or parameters, and its value.
+func splitVCardLine(line string) (name, value string, ok bool) {
+	colon := strings.IndexByte(line, ':')
+	if colon < 0 {
+		return "", "", false
+	}
+	name, value = line[:colon], line[colon+1:]
+	if semicolon := strings.IndexByte(name, ';'); semicolon >= 0 {
+		name = name[:semicolon]
+	}
+	if dot := strings.LastIndexByte(name, '.'); dot >= 0 {
+		name = name[dot+1:]
+	}
+	return strings.ToUpper(name), value, true
+}
+
+// structuredName turns an N value (family;given;additional;prefix;suffix)
+// into a display name.
+func structuredName(value string) string {
+	parts := strings.Split(value, ";")
+	var names []string
+	for _, i := range []int{3, 1, 2, 0, 4} {
+		if i < len(parts) && parts[i] != "" {
+			names = append(names, unescapeVCard(parts[i]))
+		}
+	}
+	return strings.Join(names, " ")
+}
+
+func escapeVCard(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, ",", `\,`, ";", `\;`).Replace(s)
+}
+
+func unescapeVCard(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+			if s[i] == 'n' || s[i] == 'N' {
+				b.WriteByte('\n')
+			} else {
+				b.WriteByte(s[i])
+			}
+			continue
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// writeVCardLine writes a content line folded at vcardLineLength octets,
+// without splitting UTF-8 sequences.
+func writeVCardLine(buf *bytes.Buffer, line string) {
+	limit := vcardLineLength
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && line[cut]&0xC0 == 0x80 {
+			cut--
+		}
+		buf.WriteString(line[:cut])
+		buf.WriteString("\r\n ")
+		line = line[cut:]
+		// Continuation lines start with a space
+		limit = vcardLineLength - 1
+	}
+	buf.WriteString(line)
+	buf.WriteString("\r\n")
+}
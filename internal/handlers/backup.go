@@ -0,0 +1,109 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"mime"
+	"net/http"
+	"secmail/internal/auth"
+	"secmail/internal/backup"
+	"secmail/internal/crypto"
+	"secmail/internal/relay"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// maxBackupBytes bounds uploaded backup archives.
+const maxBackupBytes = 1 << 30
+
+type ExportBackupRequest struct {
+	Passphrase string `json:"passphrase" binding:"required,min=12,max=128"`
+}
+
+// ExportBackup handles downloading the user's account as an encrypted archive
+func ExportBackup(c *gin.Context, db *gorm.DB, queue *relay.Queue) {
+	userIDVal, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	userID := userIDVal.(uint)
+
+	privateKey, ok := auth.SessionPrivateKey(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Key session expired, please log in again", "code": "key_session_expired"})
+		return
+	}
+
+	var req ExportBackupRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Header("Content-Type", "application/octet-stream")
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+		"filename": "secmail-backup-" + time.Now().UTC().Format("2006-01-02") + ".tar.gz.age",
+	}))
+	if err := backup.Export(c.Writer, userID, privateKey, req.Passphrase, queue, db); err != nil {
+		if !c.Writer.Written() {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		// The archive is already streaming; the client sees a truncated file
+		log.Printf("Backup export for user %d failed: %v", userID, err)
+	}
+}
+
+// RestoreBackup handles restoring an encrypted archive into the user's account
+func RestoreBackup(c *gin.Context, db *gorm.DB) {
+	userIDVal, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	userID := userIDVal.(uint)
+
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxBackupBytes)
+	passphrase := c.PostForm("passphrase")
+	header, err := c.FormFile("archive")
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Upload too large"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing archive file"})
+		return
+	}
+	if passphrase == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing passphrase"})
+		return
+	}
+	archive, err := header.Open()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer archive.Close()
+
+	result, err := backup.Restore(archive, userID, passphrase, db)
+	switch {
+	case errors.Is(err, crypto.ErrWrongPassphrase):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Wrong passphrase", "code": "wrong_passphrase"})
+		return
+	case errors.Is(err, backup.ErrInvalidArchive):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, backup.ErrAccountNotEmpty):
+		c.JSON(http.StatusConflict, gin.H{"error": "Backups can only be restored into an account without messages"})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
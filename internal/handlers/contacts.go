@@ -0,0 +1,383 @@
+package handlers
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"secmail/internal/auth"
+	"secmail/internal/email"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	// maxVCardBytes bounds the size of an uploaded vCard file.
+	maxVCardBytes = 5 << 20
+	// defaultSuggestions and maxSuggestions bound the autocompletion results.
+	defaultSuggestions = 10
+	maxSuggestions     = 50
+)
+
+type ContactRequest struct {
+	Name              string   `json:"name" binding:"max=100"`
+	Emails            []string `json:"emails" binding:"max=20,dive,email,max=254"`
+	Notes             string   `json:"notes" binding:"max=2000"`
+	PinnedFingerprint string   `json:"pinned_fingerprint" binding:"max=128"`
+}
+
+type ContactResponse struct {
+	ID                uint                 `json:"id"`
+	Name              string               `json:"name"`
+	Emails            []string             `json:"emails"`
+	Notes             string               `json:"notes"`
+	PinnedFingerprint string               `json:"pinned_fingerprint,omitempty"`
+	Keys              []ContactKeyResponse `json:"keys"`
+	KeyChanged        bool                 `json:"key_changed"`
+	Warning           string               `json:"warning,omitempty"`
+	CreatedAt         time.Time            `json:"created_at"`
+	UpdatedAt         time.Time            `json:"updated_at"`
+}
+
+type ContactKeyResponse struct {
+	Email       string `json:"email"`
+	UserID      uint   `json:"user_id"`
+	Fingerprint string `json:"fingerprint"`
+	Pinned      bool   `json:"pinned"`
+}
+
+type ContactSuggestionResponse struct {
+	ContactID uint   `json:"contact_id"`
+	Name      string `json:"name"`
+	Email     string `json:"email"`
+	UserID    uint   `json:"user_id,omitempty"`
+}
+
+// CreateContact handles adding an entry to the user's encrypted address book
+func CreateContact(c *gin.Context, db *gorm.DB) {
+	userIDVal, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	userID := userIDVal.(uint)
+
+	var req ContactRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	contact, err := email.CreateContact(userID, contactData(req), db)
+	if err != nil {
+		contactError(c, err, "Failed to create contact")
+		return
+	}
+	c.JSON(http.StatusCreated, contactResponse(*contact))
+}
+
+// ListContacts handles retrieving the user's decrypted address book, with a
+// warning on each contact whose published key differs from the pinned one
+func ListContacts(c *gin.Context, db *gorm.DB) {
+	userIDVal, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	userID := userIDVal.(uint)
+
+	privateKey, ok := auth.SessionPrivateKey(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Key session expired, please log in again", "code": "key_session_expired"})
+		return
+	}
+
+	contacts, err := email.ListContacts(userID, privateKey, db)
+	if err != nil {
+		contactError(c, err, "Failed to list contacts")
+		return
+	}
+	response := make([]ContactResponse, 0, len(contacts))
+	for _, contact := range contacts {
+		response = append(response, contactResponse(contact))
+	}
+	c.JSON(http.StatusOK, gin.H{"contacts": response})
+}
+
+// GetContact handles retrieving one decrypted entry of the address book
+func GetContact(c *gin.Context, db *gorm.DB) {
+	userIDVal, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	userID := userIDVal.(uint)
+
+	contactID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid contact ID"})
+		return
+	}
+
+	privateKey, ok := auth.SessionPrivateKey(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Key session expired, please log in again", "code": "key_session_expired"})
+		return
+	}
+
+	contact, err := email.GetContact(userID, uint(contactID), privateKey, db)
+	if err != nil {
+		contactError(c, err, "Failed to load contact")
+		return
+	}
+	c.JSON(http.StatusOK, contactResponse(*contact))
+}
+
+// UpdateContact handles replacing an entry of the address book
+func UpdateContact(c *gin.Context, db *gorm.DB) {
+	userIDVal, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	userID := userIDVal.(uint)
+
+	contactID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid contact ID"})
+		return
+	}
+
+	var req ContactRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	contact, err := email.UpdateContact(userID, uint(contactID), contactData(req), db)
+	if err != nil {
+		contactError(c, err, "Failed to update contact")
+		return
+	}
+	c.JSON(http.StatusOK, contactResponse(*contact))
+}
+
+// DeleteContact handles removing an entry from the address book
+func DeleteContact(c *gin.Context, db *gorm.DB) {
+	userIDVal, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	userID := userIDVal.(uint)
+
+	contactID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid contact ID"})
+		return
+	}
+
+	if err := email.DeleteContact(userID, uint(contactID), db); err != nil {
+		contactError(c, err, "Failed to delete contact")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Contact deleted"})
+}
+
+// PinContactKey handles pinning the key a contact currently publishes,
+// which clears a key change warning
+func PinContactKey(c *gin.Context, db *gorm.DB) {
+	userIDVal, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	userID := userIDVal.(uint)
+
+	contactID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid contact ID"})
+		return
+	}
+
+	privateKey, ok := auth.SessionPrivateKey(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Key session expired, please log in again", "code": "key_session_expired"})
+		return
+	}
+
+	contact, err := email.PinContactKey(userID, uint(contactID), privateKey, db)
+	if err != nil {
+		contactError(c, err, "Failed to pin contact key")
+		return
+	}
+	c.JSON(http.StatusOK, contactResponse(*contact))
+}
+
+// AutocompleteContacts handles suggesting recipients from the address book
+// for the prefix in the q query parameter
+func AutocompleteContacts(c *gin.Context, db *gorm.DB) {
+	userIDVal, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	userID := userIDVal.(uint)
+
+	// Sanitize inputs
+	query := strings.TrimSpace(c.Query("q"))
+	if query == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "q is required"})
+		return
+	}
+	limit, err := queryInt(c, "limit", false)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if limit == 0 {
+		limit = defaultSuggestions
+	}
+	limit = min(limit, maxSuggestions)
+
+	privateKey, ok := auth.SessionPrivateKey(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Key session expired, please log in again", "code": "key_session_expired"})
+		return
+	}
+
+	suggestions, err := email.AutocompleteContacts(userID, query, int(limit), privateKey, db)
+	if err != nil {
+		contactError(c, err, "Failed to search contacts")
+		return
+	}
+	response := make([]ContactSuggestionResponse, 0, len(suggestions))
+	for _, suggestion := range suggestions {
+		response = append(response, ContactSuggestionResponse{
+			ContactID: suggestion.ContactID,
+			Name:      suggestion.Name,
+			Email:     suggestion.Email,
+			UserID:    suggestion.UserID,
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"suggestions": response})
+}
+
+// ImportContacts handles importing a vCard file into the address book. The
+// request body is the file itself; nothing is imported if a card is invalid.
+func ImportContacts(c *gin.Context, db *gorm.DB) {
+	userIDVal, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	userID := userIDVal.(uint)
+
+	body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxVCardBytes))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Upload too large"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	cards, err := email.ParseVCards(body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(cards) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No contacts found"})
+		return
+	}
+
+	imported, err := email.ImportContacts(userID, cards, db)
+	if err != nil {
+		contactError(c, err, "Failed to import contacts")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"imported": imported})
+}
+
+// ExportContacts handles downloading the decrypted address book as a vCard
+// file
+func ExportContacts(c *gin.Context, db *gorm.DB) {
+	userIDVal, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	userID := userIDVal.(uint)
+
+	privateKey, ok := auth.SessionPrivateKey(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Key session expired, please log in again", "code": "key_session_expired"})
+		return
+	}
+
+	cards, err := email.ExportContacts(userID, privateKey, db)
+	if err != nil {
+		contactError(c, err, "Failed to export contacts")
+		return
+	}
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": "contacts.vcf"}))
+	c.Data(http.StatusOK, "text/vcard; charset=utf-8", cards)
+}
+
+// contactError maps errors of the address book to responses.
+func contactError(c *gin.Context, err error, message string) {
+	switch {
+	case errors.Is(err, email.ErrContactNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Contact not found"})
+	case errors.Is(err, email.ErrInvalidContact), errors.Is(err, email.ErrEmptyContact), errors.Is(err, email.ErrInvalidFingerprint):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, email.ErrNoPublishedKey):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, email.ErrSessionKeyNotFound), errors.Is(err, email.ErrKeyOutdated):
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Keys were rotated, please log in again", "code": "key_session_expired"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": message})
+	}
+}
+
+func contactData(req ContactRequest) email.ContactData {
+	return email.ContactData{
+		Name:              req.Name,
+		Emails:            req.Emails,
+		Notes:             req.Notes,
+		PinnedFingerprint: req.PinnedFingerprint,
+	}
+}
+
+func contactResponse(contact email.ContactInfo) ContactResponse {
+	keys := make([]ContactKeyResponse, 0, len(contact.Keys))
+	var changed []string
+	for _, key := range contact.Keys {
+		keys = append(keys, ContactKeyResponse{Email: key.Email, UserID: key.UserID, Fingerprint: key.Fingerprint, Pinned: key.Pinned})
+		if contact.PinnedFingerprint != "" && !key.Pinned {
+			changed = append(changed, key.Email)
+		}
+	}
+	response := ContactResponse{
+		ID:                contact.ID,
+		Name:              contact.Name,
+		Emails:            contact.Emails,
+		Notes:             contact.Notes,
+		PinnedFingerprint: contact.PinnedFingerprint,
+		Keys:              keys,
+		KeyChanged:        contact.KeyChanged,
+		CreatedAt:         contact.CreatedAt,
+		UpdatedAt:         contact.UpdatedAt,
+	}
+	if contact.KeyChanged {
+		response.Warning = "The key published for " + strings.Join(changed, ", ") + " differs from the pinned key. Verify it with the contact before pinning it."
+	}
+	return response
+}
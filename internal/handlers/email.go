@@ -1,26 +1,64 @@
 package handlers
 
 import (
+	"bytes"
+	"errors"
+	"io"
+	"mime"
 	"net/http"
+	"secmail/internal/auth"
 	"secmail/internal/email"
+	"secmail/internal/relay"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
 )
 
 type SendEmailRequest struct {
-	Recipients []uint `json:"recipients" binding:"required,dive,min=1,max=10"`
-	Subject    string `json:"subject" binding:"required,max=100"`
-	Body       string `json:"body" binding:"required,max=10000"`
+	Recipients []uint   `json:"recipients" binding:"omitempty,dive,min=1,max=10"`
+	To         []string `json:"to" binding:"omitempty,max=50,dive,email,max=254"` // Local or external addresses
+	Groups     []uint   `json:"groups" binding:"omitempty,max=10,dive,min=1"`
+	Subject    string   `json:"subject" binding:"required,max=100"`
+	Body       string   `json:"body" binding:"required,max=10000"`
+	// ForwardSecrecy sends through per-conversation ratchet chains; only
+	// local recipients with forward secrecy enabled can be addressed.
+	ForwardSecrecy bool `json:"forward_secrecy"`
+	ConversationID uint `json:"conversation_id"`
+	// ExpiresAt purges the message once passed; BurnAfterReading erases each
+	// recipient's key after their first read. Neither applies to copies
+	// delivered outside secmail.
+	ExpiresAt        *time.Time `json:"expires_at"`
+	BurnAfterReading bool       `json:"burn_after_reading"`
+	// SecureLinks sends external recipients a link to read the message on a
+	// web page with a one-time passphrase, instead of the message itself.
+	SecureLinks bool `json:"secure_links"`
+}
+
+type DeliveryStatusResponse struct {
+	MessageID  uint             `json:"message_id"`
+	Status     string           `json:"status"`
+	Deliveries []DeliveryStatus `json:"deliveries"`
+}
+
+type DeliveryStatus struct {
+	Recipient     string     `json:"recipient"`
+	Status        string     `json:"status"`
+	Attempts      int        `json:"attempts"`
+	LastError     string     `json:"last_error,omitempty"`
+	NextAttemptAt *time.Time `json:"next_attempt_at,omitempty"`
+	DeliveredAt   *time.Time `json:"delivered_at,omitempty"`
 }
 
 type InboxResponse struct {
 	Messages []email.DecryptedMessage `json:"messages"`
 }
 
-// SendEmail handles sending an email
-func SendEmail(c *gin.Context, db *gorm.DB) {
+// SendEmail handles sending an email. Addresses in To that belong to local
+// users are delivered directly; all others are queued for outbound relay.
+func SendEmail(c *gin.Context, db *gorm.DB, queue *relay.Queue) {
 	userIDVal, exists := c.Get("user_id")
 	if !exists {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
@@ -33,18 +71,198 @@ func SendEmail(c *gin.Context, db *gorm.DB) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	if len(req.Recipients) == 0 && len(req.To) == 0 && len(req.Groups) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "At least one recipient is required"})
+		return
+	}
 
 	// Sanitize inputs
 	req.Subject = strings.TrimSpace(req.Subject)
 	req.Body = strings.TrimSpace(req.Body)
 
-	err := email.SendMessage(userID, req.Recipients, req.Subject, req.Body, db)
+	if req.ForwardSecrecy {
+		if req.SecureLinks {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Secure links cannot be used with forward secrecy"})
+			return
+		}
+		if len(req.Groups) > 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Groups cannot be addressed with forward secrecy"})
+			return
+		}
+		sendForwardSecret(c, db, userID, req)
+		return
+	}
+
+	// Signing external copies with the sender's OpenPGP key or certificate
+	// needs their key session, and so does addressing groups or creating
+	// secure links
+	privateKey, ok := auth.SessionPrivateKey(c)
+	if !ok && (len(req.Groups) > 0 || req.SecureLinks) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Key session expired, please log in again", "code": "key_session_expired"})
+		return
+	}
+	var message *email.Message
+	var grants []email.SecureLinkGrant
+	var err error
+	if req.SecureLinks {
+		message, grants, err = queue.SubmitSecureLinks(userID, req.Recipients, req.Groups, req.To, req.Subject, req.Body, lifetime(req), privateKey)
+	} else {
+		message, err = queue.Submit(userID, req.Recipients, req.Groups, req.To, req.Subject, req.Body, lifetime(req), privateKey)
+	}
+	if errors.Is(err, email.ErrExpiryInPast) || errors.Is(err, email.ErrBurnGroups) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, email.ErrUnknownRecipient) || errors.Is(err, email.ErrUsersNotFound) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, email.ErrSenderUnverified) || errors.Is(err, email.ErrRecipientUnverified) {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, email.ErrGroupNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Group not found"})
+		return
+	}
+	if errors.Is(err, email.ErrPostingRestricted) {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, email.ErrMultipleLists) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, email.ErrGroupEpochUnavailable) {
+		c.JSON(http.StatusConflict, gin.H{"error": "The group's current key is not available to you, ask another member to update it", "code": "group_epoch_unavailable"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// The passphrases are only ever shown here, for the sender to share
+	// out-of-band
+	if len(grants) > 0 {
+		c.JSON(http.StatusAccepted, gin.H{"message": "Email sent; secure links queued", "id": message.ID, "secure_links": secureLinkResponses(grants)})
+		return
+	}
+	if message.Status == email.StatusQueued {
+		c.JSON(http.StatusAccepted, gin.H{"message": "Email sent; external delivery queued", "id": message.ID})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Email sent successfully", "id": message.ID})
+}
+
+// sendForwardSecret sends a SendEmail request with forward secrecy.
+func sendForwardSecret(c *gin.Context, db *gorm.DB, userID uint, req SendEmailRequest) {
+	privateKey, ok := auth.SessionPrivateKey(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Key session expired, please log in again", "code": "key_session_expired"})
+		return
+	}
+
+	recipients := req.Recipients
+	for _, addr := range req.To {
+		recipientID, err := email.LookupLocalRecipient(strings.TrimSpace(addr), db)
+		if errors.Is(err, email.ErrUnknownRecipient) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Forward secret messages can only be sent to local users"})
+			return
+		}
+		if errors.Is(err, email.ErrRecipientUnverified) {
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		recipients = append(recipients, recipientID)
+	}
+
+	message, err := email.SendForwardSecret(userID, req.ConversationID, recipients, req.Subject, req.Body, lifetime(req), privateKey, db)
+	if errors.Is(err, email.ErrExpiryInPast) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, email.ErrSenderUnverified) || errors.Is(err, email.ErrRecipientUnverified) {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, email.ErrUsersNotFound) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, email.ErrForwardSecrecyDisabled) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "code": "forward_secrecy_disabled"})
+		return
+	}
+	if errors.Is(err, email.ErrConversationNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Conversation not found"})
+		return
+	}
+	if errors.Is(err, email.ErrKeyOutdated) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Keys were rotated, please log in again", "code": "key_session_expired"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Email sent successfully", "id": message.ID, "conversation_id": message.ConversationID})
+}
+
+// lifetime returns the lifetime requested for a message.
+func lifetime(req SendEmailRequest) email.Lifetime {
+	return email.Lifetime{ExpiresAt: req.ExpiresAt, BurnAfterReading: req.BurnAfterReading}
+}
+
+// GetDeliveryStatus handles retrieving the outbound delivery status of a sent message
+func GetDeliveryStatus(c *gin.Context, db *gorm.DB) {
+	userIDVal, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	userID := userIDVal.(uint)
+
+	messageID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message ID"})
+		return
+	}
+
+	var message email.Message
+	if err := db.Where("id = ? AND sender_id = ?", messageID, userID).First(&message).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
+		return
+	}
+
+	entries, err := relay.DeliveryStatus(db, message.ID, userID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Email sent successfully"})
+	response := DeliveryStatusResponse{MessageID: message.ID, Status: message.Status, Deliveries: []DeliveryStatus{}}
+	for _, entry := range entries {
+		status := DeliveryStatus{
+			Recipient:   entry.Recipient,
+			Status:      entry.Status,
+			Attempts:    entry.Attempts,
+			LastError:   entry.LastError,
+			DeliveredAt: entry.DeliveredAt,
+		}
+		if entry.Status == relay.StatusQueued || entry.Status == relay.StatusDeferred {
+			next := entry.NextAttemptAt
+			status.NextAttemptAt = &next
+		}
+		response.Deliveries = append(response.Deliveries, status)
+	}
+	c.JSON(http.StatusOK, response)
 }
 
 // GetInbox handles retrieving the user's inbox
@@ -56,7 +274,13 @@ func GetInbox(c *gin.Context, db *gorm.DB) {
 	}
 	userID := userIDVal.(uint)
 
-	messages, err := email.GetInbox(userID, db)
+	privateKey, ok := auth.SessionPrivateKey(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Key session expired, please log in again", "code": "key_session_expired"})
+		return
+	}
+
+	messages, err := email.GetInbox(userID, privateKey, db)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -65,3 +289,122 @@ func GetInbox(c *gin.Context, db *gorm.DB) {
 	response := InboxResponse{Messages: messages}
 	c.JSON(http.StatusOK, response)
 }
+
+// maxImportBytes bounds the size of an uploaded .eml or mbox file.
+const maxImportBytes = 50 << 20
+
+type ImportResponse struct {
+	Imported []uint          `json:"imported"`
+	Failed   []ImportFailure `json:"failed"`
+}
+
+type ImportFailure struct {
+	Index int    `json:"index"` // Position of the message in the upload, from 0
+	Error string `json:"error"`
+}
+
+// ExportEmail handles downloading a message the user sent or received as a
+// decrypted .eml file
+func ExportEmail(c *gin.Context, db *gorm.DB, queue *relay.Queue) {
+	userIDVal, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	userID := userIDVal.(uint)
+
+	privateKey, ok := auth.SessionPrivateKey(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Key session expired, please log in again", "code": "key_session_expired"})
+		return
+	}
+
+	messageID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message ID"})
+		return
+	}
+	messages, err := email.LoadMessages(userID, []uint{uint(messageID)}, db)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if len(messages) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
+		return
+	}
+
+	raw, err := email.RenderMessage(userID, messages[0].ID, privateKey, queue.MessageID(&messages[0]), db)
+	if errors.Is(err, email.ErrSessionKeyNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Message cannot be decrypted with your key"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := email.MarkRead(userID, messages[0].ID, db); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+		"filename": "message-" + strconv.FormatUint(messageID, 10) + ".eml",
+	}))
+	c.Data(http.StatusOK, "message/rfc822", raw)
+}
+
+// ImportEmails handles importing an .eml file or an mbox file into the
+// user's inbox. The request body is the file itself; it is read as mbox when
+// sent as application/mbox or when it starts with a "From " line.
+func ImportEmails(c *gin.Context, db *gorm.DB) {
+	userIDVal, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	userID := userIDVal.(uint)
+
+	body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxImportBytes))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Upload too large"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	raws := [][]byte{body}
+	if c.ContentType() == "application/mbox" || bytes.HasPrefix(body, []byte("From ")) {
+		if raws, err = email.SplitMbox(bytes.NewReader(body)); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid mbox file: " + err.Error()})
+			return
+		}
+	}
+	if len(raws) == 0 || len(bytes.TrimSpace(raws[0])) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No messages found"})
+		return
+	}
+
+	response := ImportResponse{Imported: []uint{}, Failed: []ImportFailure{}}
+	for i, raw := range raws {
+		message, err := email.ImportMessage(userID, raw, email.MailboxInbox, db)
+		if errors.Is(err, email.ErrMessageTooLarge) || errors.Is(err, email.ErrInvalidMessage) {
+			response.Failed = append(response.Failed, ImportFailure{Index: i, Error: err.Error()})
+			continue
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		response.Imported = append(response.Imported, message.ID)
+	}
+
+	if len(response.Imported) == 0 {
+		c.JSON(http.StatusBadRequest, response)
+		return
+	}
+	c.JSON(http.StatusOK, response)
+}
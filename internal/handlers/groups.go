@@ -0,0 +1,280 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"secmail/internal/auth"
+	"secmail/internal/email"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type CreateGroupRequest struct {
+	Name    string `json:"name" binding:"required,max=100"`
+	Members []uint `json:"members" binding:"omitempty,max=100,dive,min=1"`
+}
+
+type AddGroupMemberRequest struct {
+	UserID uint `json:"user_id" binding:"required,min=1"`
+}
+
+type GroupResponse struct {
+	ID        uint                  `json:"id"`
+	Name      string                `json:"name"`
+	Epoch     uint64                `json:"epoch"`
+	Admin     bool                  `json:"admin"`
+	Members   []GroupMemberResponse `json:"members"`
+	CreatedAt time.Time             `json:"created_at"`
+}
+
+type GroupMemberResponse struct {
+	UserID uint   `json:"user_id"`
+	Email  string `json:"email"`
+	Admin  bool   `json:"admin"`
+}
+
+// CreateGroup handles creating a group with the user as its admin
+func CreateGroup(c *gin.Context, db *gorm.DB) {
+	userIDVal, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	userID := userIDVal.(uint)
+
+	var req CreateGroupRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Sanitize inputs
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Group name is required"})
+		return
+	}
+
+	privateKey, ok := auth.SessionPrivateKey(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Key session expired, please log in again", "code": "key_session_expired"})
+		return
+	}
+
+	group, err := email.CreateGroup(userID, req.Name, req.Members, privateKey, db)
+	if err != nil {
+		groupError(c, err, "Failed to create group")
+		return
+	}
+	info, err := email.GetGroup(userID, group.ID, db)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load group"})
+		return
+	}
+	c.JSON(http.StatusCreated, groupResponse(*info))
+}
+
+// ListGroups handles listing the groups the user is a member of
+func ListGroups(c *gin.Context, db *gorm.DB) {
+	userIDVal, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	userID := userIDVal.(uint)
+
+	groups, err := email.ListGroups(userID, db)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list groups"})
+		return
+	}
+	response := make([]GroupResponse, 0, len(groups))
+	for _, group := range groups {
+		response = append(response, groupResponse(group))
+	}
+	c.JSON(http.StatusOK, gin.H{"groups": response})
+}
+
+// GetGroup handles retrieving a group the user is a member of
+func GetGroup(c *gin.Context, db *gorm.DB) {
+	userIDVal, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	userID := userIDVal.(uint)
+
+	groupID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid group ID"})
+		return
+	}
+
+	info, err := email.GetGroup(userID, uint(groupID), db)
+	if err != nil {
+		groupError(c, err, "Failed to load group")
+		return
+	}
+	c.JSON(http.StatusOK, groupResponse(*info))
+}
+
+// AddGroupMember handles adding a user to a group, which starts a new epoch
+func AddGroupMember(c *gin.Context, db *gorm.DB) {
+	userIDVal, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	userID := userIDVal.(uint)
+
+	groupID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid group ID"})
+		return
+	}
+	var req AddGroupMemberRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	privateKey, ok := auth.SessionPrivateKey(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Key session expired, please log in again", "code": "key_session_expired"})
+		return
+	}
+
+	if err := email.AddGroupMember(userID, uint(groupID), req.UserID, privateKey, db); err != nil {
+		groupError(c, err, "Failed to add member")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Member added. They can read messages sent to the group from now on."})
+}
+
+// RemoveGroupMember handles removing a user from a group, which starts a new
+// epoch without them
+func RemoveGroupMember(c *gin.Context, db *gorm.DB) {
+	userIDVal, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	userID := userIDVal.(uint)
+
+	groupID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid group ID"})
+		return
+	}
+	memberID, err := strconv.ParseUint(c.Param("userId"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	privateKey, ok := auth.SessionPrivateKey(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Key session expired, please log in again", "code": "key_session_expired"})
+		return
+	}
+
+	if err := email.RemoveGroupMember(userID, uint(groupID), uint(memberID), privateKey, db); err != nil {
+		groupError(c, err, "Failed to remove member")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Member removed. They cannot read messages sent to the group from now on."})
+}
+
+// LeaveGroup handles the user leaving a group
+func LeaveGroup(c *gin.Context, db *gorm.DB) {
+	userIDVal, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	userID := userIDVal.(uint)
+
+	groupID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid group ID"})
+		return
+	}
+
+	if err := email.LeaveGroup(userID, uint(groupID), db); err != nil {
+		groupError(c, err, "Failed to leave group")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "You left the group"})
+}
+
+// UpdateGroupKey handles starting a new epoch of a group with a fresh secret
+func UpdateGroupKey(c *gin.Context, db *gorm.DB) {
+	userIDVal, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	userID := userIDVal.(uint)
+
+	groupID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid group ID"})
+		return
+	}
+
+	privateKey, ok := auth.SessionPrivateKey(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Key session expired, please log in again", "code": "key_session_expired"})
+		return
+	}
+
+	epoch, err := email.UpdateGroupEpoch(userID, uint(groupID), privateKey, db)
+	if err != nil {
+		groupError(c, err, "Failed to update group key")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Group key updated", "epoch": epoch})
+}
+
+// groupError responds with the status of a group operation's error.
+func groupError(c *gin.Context, err error, message string) {
+	switch {
+	case errors.Is(err, email.ErrGroupNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Group not found"})
+	case errors.Is(err, email.ErrNotGroupMember), errors.Is(err, gorm.ErrRecordNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+	case errors.Is(err, email.ErrNotGroupAdmin):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case errors.Is(err, email.ErrUsersNotFound):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, email.ErrSenderUnverified), errors.Is(err, email.ErrRecipientUnverified):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case errors.Is(err, email.ErrAlreadyMember), errors.Is(err, email.ErrLastGroupAdmin):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, email.ErrGroupEpochUnavailable):
+		c.JSON(http.StatusConflict, gin.H{"error": "The group's current key is not available to you, ask another member to update it", "code": "group_epoch_unavailable"})
+	case errors.Is(err, email.ErrKeyOutdated):
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Keys were rotated, please log in again", "code": "key_session_expired"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": message})
+	}
+}
+
+func groupResponse(group email.GroupInfo) GroupResponse {
+	members := make([]GroupMemberResponse, 0, len(group.Members))
+	for _, member := range group.Members {
+		members = append(members, GroupMemberResponse{UserID: member.UserID, Email: member.Email, Admin: member.Admin})
+	}
+	return GroupResponse{
+		ID:        group.ID,
+		Name:      group.Name,
+		Epoch:     group.Epoch,
+		Admin:     group.Admin,
+		Members:   members,
+		CreatedAt: group.CreatedAt,
+	}
+}
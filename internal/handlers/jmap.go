@@ -0,0 +1,117 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+	"secmail/internal/auth"
+	"secmail/internal/jmap"
+	"secmail/internal/models"
+	"secmail/internal/relay"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// jmapAccount returns the JMAP account of the authenticated user. Decrypting
+// messages needs their key session, so requests fail without one.
+func jmapAccount(c *gin.Context, db *gorm.DB, queue *relay.Queue) (*jmap.Account, bool) {
+	userIDVal, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return nil, false
+	}
+	userID := userIDVal.(uint)
+
+	privateKey, ok := auth.SessionPrivateKey(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Key session expired, please log in again", "code": "key_session_expired"})
+		return nil, false
+	}
+	return &jmap.Account{DB: db, Queue: queue, UserID: userID, PrivateKey: privateKey}, true
+}
+
+// GetJMAPSession handles retrieving the JMAP session resource
+func GetJMAPSession(c *gin.Context, db *gorm.DB, queue *relay.Queue) {
+	account, ok := jmapAccount(c, db, queue)
+	if !ok {
+		return
+	}
+
+	var user models.User
+	if err := db.Where("id = ?", account.UserID).First(&user).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	c.JSON(http.StatusOK, jmap.NewSession(account, user.Email, auth.PublicBaseURL()))
+}
+
+// JMAPAPI handles a JMAP API request. Request-level errors are sent as
+// problem details as RFC 8620 requires.
+func JMAPAPI(c *gin.Context, db *gorm.DB, queue *relay.Queue) {
+	account, ok := jmapAccount(c, db, queue)
+	if !ok {
+		return
+	}
+
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, jmap.MaxSizeRequest)
+	var req jmap.Request
+	if err := json.NewDecoder(c.Request.Body).Decode(&req); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			c.JSON(http.StatusRequestEntityTooLarge, &jmap.RequestError{
+				Type:   "urn:ietf:params:jmap:error:limit",
+				Status: http.StatusRequestEntityTooLarge,
+				Detail: "Request is too large",
+				Limit:  "maxSizeRequest",
+			})
+			return
+		}
+		c.JSON(http.StatusBadRequest, &jmap.RequestError{
+			Type:   "urn:ietf:params:jmap:error:notRequest",
+			Status: http.StatusBadRequest,
+			Detail: err.Error(),
+		})
+		return
+	}
+
+	resp, err := account.Handle(&req)
+	var reqErr *jmap.RequestError
+	if errors.As(err, &reqErr) {
+		c.JSON(reqErr.Status, reqErr)
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// DownloadJMAPBlob handles downloading a message as RFC 5322
+func DownloadJMAPBlob(c *gin.Context, db *gorm.DB, queue *relay.Queue) {
+	account, ok := jmapAccount(c, db, queue)
+	if !ok {
+		return
+	}
+	if c.Param("accountId") != account.ID() {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Account not found"})
+		return
+	}
+
+	raw, err := account.Blob(c.Param("blobId"))
+	if errors.Is(err, jmap.ErrBlobNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Blob not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// The type parameter is ignored so decrypted mail is never served as
+	// something a browser would render
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": c.Param("name")}))
+	c.Data(http.StatusOK, "message/rfc822", raw)
+}
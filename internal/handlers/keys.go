@@ -0,0 +1,127 @@
+package handlers
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"regexp"
+	"secmail/internal/crypto"
+	"secmail/internal/email"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Key types listed by the key directory.
+const (
+	KeyTypeSecmail = "secmail"
+	KeyTypeOpenPGP = "openpgp"
+	KeyTypeSMIME   = "smime"
+)
+
+var (
+	wkdHashPattern   = regexp.MustCompile(`^[ybndrfg8ejkmcpqxot1uwisza345h769]{32}$`)
+	wkdDomainPattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9.-]{0,251}[a-z0-9])?$`)
+)
+
+type PublicKeyResponse struct {
+	Type        string     `json:"type"`
+	Algorithm   string     `json:"algorithm"`
+	Fingerprint string     `json:"fingerprint"`
+	KeyID       string     `json:"key_id,omitempty"`
+	PublicKey   string     `json:"public_key,omitempty"`
+	Certificate string     `json:"certificate,omitempty"`
+	NotAfter    *time.Time `json:"not_after,omitempty"`
+}
+
+type PublicKeysResponse struct {
+	Email string              `json:"email"`
+	Keys  []PublicKeyResponse `json:"keys"`
+}
+
+// GetPublicKeys handles looking up a user's current public keys
+func GetPublicKeys(c *gin.Context, db *gorm.DB) {
+	// Sanitize inputs
+	address := strings.TrimSpace(c.Param("email"))
+
+	keys, err := email.LookupPublicKeys(address, db)
+	if errors.Is(err, email.ErrUnknownRecipient) || errors.Is(err, email.ErrRecipientUnverified) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No keys published for this address"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	response := PublicKeysResponse{Email: keys.Email, Keys: []PublicKeyResponse{{
+		Type:        KeyTypeSecmail,
+		Algorithm:   keys.SecmailInfo.Algorithm,
+		Fingerprint: keys.SecmailInfo.Fingerprint,
+		PublicKey:   string(keys.SecmailKey),
+	}}}
+	if keys.PGPKey != nil {
+		response.Keys = append(response.Keys, PublicKeyResponse{
+			Type:        KeyTypeOpenPGP,
+			Algorithm:   keys.PGPInfo.Algorithm,
+			Fingerprint: keys.PGPInfo.Fingerprint,
+			KeyID:       keys.PGPInfo.KeyID,
+			PublicKey:   string(keys.PGPKey),
+		})
+	}
+	if keys.Certificate != nil {
+		notAfter := keys.CertificateInfo.NotAfter
+		response.Keys = append(response.Keys, PublicKeyResponse{
+			Type:        KeyTypeSMIME,
+			Algorithm:   keys.CertificateInfo.Algorithm,
+			Fingerprint: keys.CertificateInfo.Fingerprint,
+			Certificate: string(keys.Certificate),
+			NotAfter:    &notAfter,
+		})
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// GetWKDKey handles Web Key Directory lookups. The domain is taken from the
+// path in the advanced method and from the Host header in the direct method.
+func GetWKDKey(c *gin.Context, db *gorm.DB) {
+	// Sanitize inputs
+	domain := strings.ToLower(c.Param("domain"))
+	if domain == "" {
+		domain = strings.ToLower(c.Request.Host)
+		if host, _, err := net.SplitHostPort(domain); err == nil {
+			domain = host
+		}
+	}
+	hash := c.Param("hash")
+	if !wkdDomainPattern.MatchString(domain) || !wkdHashPattern.MatchString(hash) {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	armored, err := email.LookupWKDKey(domain, hash, db)
+	if errors.Is(err, email.ErrUnknownRecipient) {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	key, err := crypto.DearmorPGPPublicKey(armored)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	c.Header("Access-Control-Allow-Origin", "*")
+	c.Data(http.StatusOK, "application/octet-stream", key)
+}
+
+// GetWKDPolicy handles the Web Key Directory policy file. It is empty: no
+// policy flags are set.
+func GetWKDPolicy(c *gin.Context) {
+	c.Header("Access-Control-Allow-Origin", "*")
+	c.Data(http.StatusOK, "text/plain", nil)
+}
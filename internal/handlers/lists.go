@@ -0,0 +1,373 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"secmail/internal/auth"
+	"secmail/internal/email"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type CreateListRequest struct {
+	Address     string `json:"address" binding:"required,email,max=254"`
+	Name        string `json:"name" binding:"required,max=100"`
+	Description string `json:"description" binding:"max=1000"`
+	Policy      string `json:"policy" binding:"omitempty,oneof=open members moderated"`
+}
+
+type UpdateListRequest struct {
+	Name        string `json:"name" binding:"required,max=100"`
+	Description string `json:"description" binding:"max=1000"`
+	Policy      string `json:"policy" binding:"required,oneof=open members moderated"`
+}
+
+type AddListMemberRequest struct {
+	UserID uint `json:"user_id" binding:"required,min=1"`
+	Owner  bool `json:"owner"`
+}
+
+type ListResponse struct {
+	ID          uint                 `json:"id"`
+	Address     string               `json:"address"`
+	Name        string               `json:"name"`
+	Description string               `json:"description"`
+	Policy      string               `json:"policy"`
+	Owner       bool                 `json:"owner"`
+	Members     []ListMemberResponse `json:"members,omitempty"`
+	CreatedAt   time.Time            `json:"created_at"`
+}
+
+type ListMemberResponse struct {
+	UserID uint   `json:"user_id"`
+	Email  string `json:"email"`
+	Owner  bool   `json:"owner"`
+}
+
+// CreateList handles creating a mailing list owned by the user
+func CreateList(c *gin.Context, db *gorm.DB) {
+	userIDVal, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	userID := userIDVal.(uint)
+
+	var req CreateListRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Sanitize inputs
+	req.Address = strings.TrimSpace(req.Address)
+	req.Name = strings.TrimSpace(req.Name)
+	req.Description = strings.TrimSpace(req.Description)
+
+	policy, err := email.ParseListPolicy(req.Policy)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	list, err := email.CreateList(userID, req.Address, req.Name, req.Description, policy, db)
+	if err != nil {
+		listError(c, err, "Failed to create list")
+		return
+	}
+	info, err := email.GetList(userID, list.ID, db)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load list"})
+		return
+	}
+	c.JSON(http.StatusCreated, listResponse(*info))
+}
+
+// ListMailingLists handles listing the lists the user is subscribed to
+func ListMailingLists(c *gin.Context, db *gorm.DB) {
+	userIDVal, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	userID := userIDVal.(uint)
+
+	lists, err := email.ListMailingLists(userID, db)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list mailing lists"})
+		return
+	}
+	response := make([]ListResponse, 0, len(lists))
+	for _, list := range lists {
+		response = append(response, listResponse(list))
+	}
+	c.JSON(http.StatusOK, gin.H{"lists": response})
+}
+
+// GetList handles retrieving a list the user is subscribed to
+func GetList(c *gin.Context, db *gorm.DB) {
+	userIDVal, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	userID := userIDVal.(uint)
+
+	listID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid list ID"})
+		return
+	}
+
+	info, err := email.GetList(userID, uint(listID), db)
+	if err != nil {
+		listError(c, err, "Failed to load list")
+		return
+	}
+	c.JSON(http.StatusOK, listResponse(*info))
+}
+
+// UpdateList handles changing a list's name, description and posting policy
+func UpdateList(c *gin.Context, db *gorm.DB) {
+	userIDVal, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	userID := userIDVal.(uint)
+
+	listID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid list ID"})
+		return
+	}
+	var req UpdateListRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Sanitize inputs
+	req.Name = strings.TrimSpace(req.Name)
+	req.Description = strings.TrimSpace(req.Description)
+
+	if err := email.UpdateList(userID, uint(listID), req.Name, req.Description, req.Policy, db); err != nil {
+		listError(c, err, "Failed to update list")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "List updated"})
+}
+
+// DeleteList handles deleting a list
+func DeleteList(c *gin.Context, db *gorm.DB) {
+	userIDVal, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	userID := userIDVal.(uint)
+
+	listID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid list ID"})
+		return
+	}
+
+	if err := email.DeleteList(userID, uint(listID), db); err != nil {
+		listError(c, err, "Failed to delete list")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "List deleted"})
+}
+
+// AddListMember handles subscribing a user to a list
+func AddListMember(c *gin.Context, db *gorm.DB) {
+	userIDVal, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	userID := userIDVal.(uint)
+
+	listID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid list ID"})
+		return
+	}
+	var req AddListMemberRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := email.AddListMember(userID, uint(listID), req.UserID, req.Owner, db); err != nil {
+		listError(c, err, "Failed to add member")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Member added"})
+}
+
+// RemoveListMember handles unsubscribing a user from a list
+func RemoveListMember(c *gin.Context, db *gorm.DB) {
+	userIDVal, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	userID := userIDVal.(uint)
+
+	listID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid list ID"})
+		return
+	}
+	memberID, err := strconv.ParseUint(c.Param("userId"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	if err := email.RemoveListMember(userID, uint(listID), uint(memberID), db); err != nil {
+		listError(c, err, "Failed to remove member")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Member removed"})
+}
+
+// Unsubscribe handles the user leaving a list; it is the target of the
+// List-Unsubscribe header of list posts
+func Unsubscribe(c *gin.Context, db *gorm.DB) {
+	userIDVal, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	userID := userIDVal.(uint)
+
+	listID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid list ID"})
+		return
+	}
+
+	if err := email.Unsubscribe(userID, uint(listID), db); err != nil {
+		listError(c, err, "Failed to unsubscribe")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "You were unsubscribed from the list"})
+}
+
+// GetHeldPosts handles listing the posts to a moderated list awaiting a
+// decision
+func GetHeldPosts(c *gin.Context, db *gorm.DB) {
+	userIDVal, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	userID := userIDVal.(uint)
+
+	listID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid list ID"})
+		return
+	}
+
+	privateKey, ok := auth.SessionPrivateKey(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Key session expired, please log in again", "code": "key_session_expired"})
+		return
+	}
+
+	posts, err := email.HeldPosts(userID, uint(listID), privateKey, db)
+	if err != nil {
+		listError(c, err, "Failed to load held posts")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"posts": posts})
+}
+
+// ModeratePost handles approving or rejecting a held post
+func ModeratePost(c *gin.Context, db *gorm.DB, approve bool) {
+	userIDVal, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	userID := userIDVal.(uint)
+
+	listID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid list ID"})
+		return
+	}
+	postID, err := strconv.ParseUint(c.Param("postId"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid post ID"})
+		return
+	}
+
+	if !approve {
+		if err := email.RejectPost(userID, uint(listID), uint(postID), db); err != nil {
+			listError(c, err, "Failed to reject post")
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Post rejected"})
+		return
+	}
+
+	privateKey, ok := auth.SessionPrivateKey(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Key session expired, please log in again", "code": "key_session_expired"})
+		return
+	}
+	if err := email.ApprovePost(userID, uint(listID), uint(postID), privateKey, db); err != nil {
+		listError(c, err, "Failed to approve post")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Post approved and delivered to the list"})
+}
+
+// listError responds with the status of a mailing list operation's error.
+func listError(c *gin.Context, err error, message string) {
+	switch {
+	case errors.Is(err, email.ErrListNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "List not found"})
+	case errors.Is(err, email.ErrPostNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Held post not found"})
+	case errors.Is(err, email.ErrNotSubscribed), errors.Is(err, gorm.ErrRecordNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+	case errors.Is(err, email.ErrNotListOwner), errors.Is(err, email.ErrNotAdmin):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case errors.Is(err, email.ErrAddressNotLocal):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, email.ErrAddressTaken), errors.Is(err, email.ErrAlreadySubscribed), errors.Is(err, email.ErrLastListOwner):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, email.ErrSessionKeyNotFound):
+		c.JSON(http.StatusConflict, gin.H{"error": "This post cannot be opened with your key; it may have been held before you became an owner"})
+	case errors.Is(err, email.ErrKeyOutdated):
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Keys were rotated, please log in again", "code": "key_session_expired"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": message})
+	}
+}
+
+func listResponse(list email.ListInfo) ListResponse {
+	var members []ListMemberResponse
+	for _, member := range list.Members {
+		members = append(members, ListMemberResponse{UserID: member.UserID, Email: member.Email, Owner: member.Owner})
+	}
+	return ListResponse{
+		ID:          list.ID,
+		Address:     list.Address,
+		Name:        list.Name,
+		Description: list.Description,
+		Policy:      list.Policy,
+		Owner:       list.Owner,
+		Members:     members,
+		CreatedAt:   list.CreatedAt,
+	}
+}
@@ -0,0 +1,197 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"secmail/internal/crypto"
+	"secmail/internal/email"
+	"secmail/internal/models"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type ImportPGPKeyRequest struct {
+	ArmoredKey string `json:"armored_key" binding:"required,max=65536"`
+	Passphrase string `json:"passphrase" binding:"max=256"`
+}
+
+type ImportPGPContactRequest struct {
+	ArmoredKey string   `json:"armored_key" binding:"required,max=65536"`
+	Emails     []string `json:"emails" binding:"omitempty,max=20,dive,email,max=254"`
+}
+
+type PGPKeyResponse struct {
+	Fingerprint string    `json:"fingerprint"`
+	PublicKey   string    `json:"public_key"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+type PGPContactResponse struct {
+	ID          uint      `json:"id"`
+	Email       string    `json:"email"`
+	Fingerprint string    `json:"fingerprint"`
+	PublicKey   string    `json:"public_key"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// ImportPGPKey handles importing the user's own OpenPGP secret key
+func ImportPGPKey(c *gin.Context, db *gorm.DB) {
+	userIDVal, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	userID := userIDVal.(uint)
+
+	var req ImportPGPKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	key, info, err := email.ImportPGPKey(userID, []byte(strings.TrimSpace(req.ArmoredKey)), req.Passphrase, db)
+	if errors.Is(err, crypto.ErrPGPKeyLocked) {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error(), "code": "pgp_key_locked"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid OpenPGP secret key: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"fingerprint": key.Fingerprint,
+		"key_id":      info.KeyID,
+		"emails":      info.Emails,
+		"public_key":  string(key.PublicKey),
+	})
+}
+
+// GetPGPKey handles retrieving the public half of the user's OpenPGP key
+func GetPGPKey(c *gin.Context, db *gorm.DB) {
+	userIDVal, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	userID := userIDVal.(uint)
+
+	var key models.PGPKey
+	if err := db.Where("user_id = ?", userID).First(&key).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No OpenPGP key imported"})
+		return
+	}
+
+	c.JSON(http.StatusOK, PGPKeyResponse{
+		Fingerprint: key.Fingerprint,
+		PublicKey:   string(key.PublicKey),
+		CreatedAt:   key.CreatedAt,
+	})
+}
+
+// DeletePGPKey handles removing the user's OpenPGP key
+func DeletePGPKey(c *gin.Context, db *gorm.DB) {
+	userIDVal, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	userID := userIDVal.(uint)
+
+	if err := db.Where("user_id = ?", userID).Delete(&models.PGPKey{}).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "OpenPGP key deleted"})
+}
+
+// ImportPGPContact handles importing an external correspondent's public key
+func ImportPGPContact(c *gin.Context, db *gorm.DB) {
+	userIDVal, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	userID := userIDVal.(uint)
+
+	var req ImportPGPContactRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	contacts, err := email.ImportPGPContactKey(userID, []byte(strings.TrimSpace(req.ArmoredKey)), req.Emails, db)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid OpenPGP public key: " + err.Error()})
+		return
+	}
+
+	response := make([]PGPContactResponse, 0, len(contacts))
+	for _, contact := range contacts {
+		response = append(response, pgpContactResponse(contact))
+	}
+	c.JSON(http.StatusOK, gin.H{"contacts": response})
+}
+
+// ListPGPContacts handles listing the user's external correspondent keys
+func ListPGPContacts(c *gin.Context, db *gorm.DB) {
+	userIDVal, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	userID := userIDVal.(uint)
+
+	var contacts []models.PGPContactKey
+	if err := db.Where("user_id = ?", userID).Order("email").Find(&contacts).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	response := make([]PGPContactResponse, 0, len(contacts))
+	for _, contact := range contacts {
+		response = append(response, pgpContactResponse(contact))
+	}
+	c.JSON(http.StatusOK, gin.H{"contacts": response})
+}
+
+// DeletePGPContact handles removing an external correspondent's key
+func DeletePGPContact(c *gin.Context, db *gorm.DB) {
+	userIDVal, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	userID := userIDVal.(uint)
+
+	contactID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid contact ID"})
+		return
+	}
+
+	result := db.Where("id = ? AND user_id = ?", contactID, userID).Delete(&models.PGPContactKey{})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": result.Error.Error()})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Contact key not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Contact key deleted"})
+}
+
+func pgpContactResponse(contact models.PGPContactKey) PGPContactResponse {
+	return PGPContactResponse{
+		ID:          contact.ID,
+		Email:       contact.Email,
+		Fingerprint: contact.Fingerprint,
+		PublicKey:   string(contact.PublicKey),
+		UpdatedAt:   contact.UpdatedAt,
+	}
+}
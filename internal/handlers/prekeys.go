@@ -0,0 +1,103 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"secmail/internal/auth"
+	"secmail/internal/email"
+	"secmail/internal/models"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type PrekeyResponse struct {
+	ID         uint      `json:"id"`
+	KeyVersion int       `json:"key_version"`
+	PublicKey  []byte    `json:"public_key"` // X25519
+	Signature  []byte    `json:"signature"`  // RSA-PSS by the owner's secmail key
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// RotatePrekey handles enabling forward secrecy or replacing the user's
+// prekey
+func RotatePrekey(c *gin.Context, db *gorm.DB) {
+	userIDVal, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	userID := userIDVal.(uint)
+
+	privateKey, ok := auth.SessionPrivateKey(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Key session expired, please log in again", "code": "key_session_expired"})
+		return
+	}
+
+	prekey, err := email.RotatePrekey(userID, privateKey, db)
+	if errors.Is(err, email.ErrKeyOutdated) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Keys were rotated, please log in again", "code": "key_session_expired"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate prekey"})
+		return
+	}
+	c.JSON(http.StatusOK, prekeyResponse(prekey))
+}
+
+// DisableForwardSecrecy handles retiring the user's prekey
+func DisableForwardSecrecy(c *gin.Context, db *gorm.DB) {
+	userIDVal, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	userID := userIDVal.(uint)
+
+	if err := email.DisableForwardSecrecy(userID, db); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to disable forward secrecy"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Forward secrecy disabled. Messages already received stay readable until their prekey is erased."})
+}
+
+// GetPrekey handles looking up a user's current signed prekey
+func GetPrekey(c *gin.Context, db *gorm.DB) {
+	// Sanitize inputs
+	address := strings.TrimSpace(c.Param("email"))
+
+	userID, err := email.LookupLocalRecipient(address, db)
+	if errors.Is(err, email.ErrUnknownRecipient) || errors.Is(err, email.ErrRecipientUnverified) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No prekey published for this address"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	prekey, err := email.CurrentPrekey(userID, db)
+	if errors.Is(err, email.ErrForwardSecrecyDisabled) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No prekey published for this address"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, prekeyResponse(prekey))
+}
+
+func prekeyResponse(prekey *models.Prekey) PrekeyResponse {
+	return PrekeyResponse{
+		ID:         prekey.ID,
+		KeyVersion: prekey.KeyVersion,
+		PublicKey:  prekey.PublicKey,
+		Signature:  prekey.Signature,
+		CreatedAt:  prekey.CreatedAt,
+	}
+}
@@ -0,0 +1,145 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	_ "embed"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"secmail/internal/crypto"
+	"secmail/internal/email"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+var (
+	//go:embed static/securelink.html
+	secureLinkHTML string
+	//go:embed static/securelink.js
+	secureLinkScript string
+)
+
+// secureLinkPage is the page external recipients open secure links on, with
+// its script inlined and allowed by hash so that nothing else can run.
+var secureLinkPage, secureLinkCSP = func() (string, string) {
+	sum := sha256.Sum256([]byte(secureLinkScript))
+	csp := "default-src 'none'; script-src 'sha256-" + base64.StdEncoding.EncodeToString(sum[:]) + "'; " +
+		"style-src 'unsafe-inline'; connect-src 'self'; form-action 'none'; base-uri 'none'; frame-ancestors 'none'"
+	return strings.Replace(secureLinkHTML, "{{script}}", secureLinkScript, 1), csp
+}()
+
+type SecureLinkResponse struct {
+	Recipient  string    `json:"recipient"`
+	URL        string    `json:"url"`
+	Passphrase string    `json:"passphrase"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+type SecureLinkOpenRequest struct {
+	Passphrase string `json:"passphrase" binding:"required,max=100"`
+}
+
+type SecureLinkReplyRequest struct {
+	Passphrase string `json:"passphrase" binding:"required,max=100"`
+	Body       string `json:"body" binding:"required,max=10000"`
+}
+
+type SecureLinkMessageResponse struct {
+	From     string    `json:"from"`
+	Subject  string    `json:"subject"`
+	Body     string    `json:"body"`
+	SentAt   time.Time `json:"sent_at"`
+	CanReply bool      `json:"can_reply"`
+}
+
+// SecureLinkPage serves the page on which an external recipient enters the
+// passphrase of a secure link. The token stays in the URL path and is never
+// sent to third parties.
+func SecureLinkPage(c *gin.Context) {
+	c.Header("Content-Security-Policy", secureLinkCSP)
+	c.Header("Referrer-Policy", "no-referrer")
+	c.Header("Cache-Control", "no-store")
+	c.Header("X-Frame-Options", "DENY")
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(secureLinkPage))
+}
+
+// OpenSecureLink handles an external recipient reading a message through a
+// secure link. It needs no account, only the link and its passphrase.
+func OpenSecureLink(c *gin.Context, db *gorm.DB) {
+	var req SecureLinkOpenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	msg, err := email.OpenSecureLink(c.Param("token"), req.Passphrase, db)
+	if err != nil {
+		secureLinkError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, SecureLinkMessageResponse{
+		From:     msg.From,
+		Subject:  msg.Subject,
+		Body:     msg.Body,
+		SentAt:   msg.SentAt,
+		CanReply: msg.CanReply,
+	})
+}
+
+// ReplySecureLink handles the one reply an external recipient can send to
+// the sender through a secure link.
+func ReplySecureLink(c *gin.Context, db *gorm.DB) {
+	var req SecureLinkReplyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Sanitize inputs
+	req.Body = strings.TrimSpace(req.Body)
+	if req.Body == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Reply cannot be empty"})
+		return
+	}
+
+	if err := email.ReplySecureLink(c.Param("token"), req.Passphrase, req.Body, db); err != nil {
+		secureLinkError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Reply sent"})
+}
+
+// secureLinkError maps secure link errors to HTTP responses.
+func secureLinkError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, email.ErrSecureLinkNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Secure link not found or expired"})
+	case errors.Is(err, crypto.ErrWrongPassphrase):
+		c.JSON(http.StatusForbidden, gin.H{"error": "Wrong passphrase"})
+	case errors.Is(err, email.ErrSecureLinkOpened), errors.Is(err, email.ErrSecureLinkReplied), errors.Is(err, email.ErrSecureLinkDisabled):
+		c.JSON(http.StatusGone, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+// secureLinkResponses converts the grants of a send for the sender.
+func secureLinkResponses(grants []email.SecureLinkGrant) []SecureLinkResponse {
+	responses := make([]SecureLinkResponse, 0, len(grants))
+	for _, grant := range grants {
+		responses = append(responses, SecureLinkResponse{
+			Recipient:  grant.Recipient,
+			URL:        grant.URL,
+			Passphrase: grant.Passphrase,
+			ExpiresAt:  grant.ExpiresAt,
+		})
+	}
+	return responses
+}
@@ -0,0 +1,375 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"secmail/internal/auth"
+	"secmail/internal/email"
+	"secmail/internal/notify"
+	"secmail/internal/relay"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// maxAuditEvents bounds the audit events returned at once.
+const maxAuditEvents = 1000
+
+type CreateSharedMailboxRequest struct {
+	Address string `json:"address" binding:"required,email,max=254"`
+}
+
+type SharedSendRequest struct {
+	Recipients []uint   `json:"recipients" binding:"omitempty,dive,min=1,max=10"`
+	To         []string `json:"to" binding:"omitempty,max=50,dive,email,max=254"`
+	Subject    string   `json:"subject" binding:"required,max=100"`
+	Body       string   `json:"body" binding:"required,max=10000"`
+}
+
+type SharedMailboxResponse struct {
+	ID        uint               `json:"id"`
+	Address   string             `json:"address"`
+	Roles     email.MailboxRoles `json:"roles"`
+	Verified  bool               `json:"verified"`
+	Delegates []DelegateResponse `json:"delegates,omitempty"`
+	CreatedAt time.Time          `json:"created_at"`
+}
+
+type DelegateResponse struct {
+	UserID uint               `json:"user_id"`
+	Email  string             `json:"email"`
+	Roles  email.MailboxRoles `json:"roles"`
+}
+
+type AuditEventResponse struct {
+	ID        uint      `json:"id"`
+	ActorID   uint      `json:"actor_id"`
+	Action    string    `json:"action"`
+	MessageID uint      `json:"message_id,omitempty"`
+	Detail    string    `json:"detail,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// CreateSharedMailbox handles creating a shared mailbox with the user as its
+// manager
+func CreateSharedMailbox(c *gin.Context, db *gorm.DB, notifier notify.Notifier) {
+	userIDVal, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	userID := userIDVal.(uint)
+
+	var req CreateSharedMailboxRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Sanitize inputs
+	req.Address = strings.TrimSpace(req.Address)
+
+	mailbox, err := email.CreateSharedMailbox(userID, req.Address, db)
+	if err != nil {
+		sharedMailboxError(c, err, "Failed to create shared mailbox")
+		return
+	}
+	if err := auth.SendVerification(*mailbox, notifier); err != nil {
+		log.Println("Failed to deliver verification notification:", err)
+	}
+	info, err := email.GetSharedMailbox(userID, mailbox.ID, db)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load shared mailbox"})
+		return
+	}
+	c.JSON(http.StatusCreated, sharedMailboxResponse(*info))
+}
+
+// ListSharedMailboxes handles listing the shared mailboxes the user is a
+// delegate of
+func ListSharedMailboxes(c *gin.Context, db *gorm.DB) {
+	userIDVal, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	userID := userIDVal.(uint)
+
+	mailboxes, err := email.ListSharedMailboxes(userID, db)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list shared mailboxes"})
+		return
+	}
+	response := make([]SharedMailboxResponse, 0, len(mailboxes))
+	for _, mailbox := range mailboxes {
+		response = append(response, sharedMailboxResponse(mailbox))
+	}
+	c.JSON(http.StatusOK, gin.H{"mailboxes": response})
+}
+
+// GetSharedMailbox handles retrieving a shared mailbox the user is a
+// delegate of
+func GetSharedMailbox(c *gin.Context, db *gorm.DB) {
+	userIDVal, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	userID := userIDVal.(uint)
+
+	mailboxID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid mailbox ID"})
+		return
+	}
+
+	info, err := email.GetSharedMailbox(userID, uint(mailboxID), db)
+	if err != nil {
+		sharedMailboxError(c, err, "Failed to load shared mailbox")
+		return
+	}
+	c.JSON(http.StatusOK, sharedMailboxResponse(*info))
+}
+
+// GetSharedInbox handles retrieving the decrypted inbox of a shared mailbox.
+// Each message returned is recorded in the mailbox's audit log.
+func GetSharedInbox(c *gin.Context, db *gorm.DB) {
+	userIDVal, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	userID := userIDVal.(uint)
+
+	mailboxID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid mailbox ID"})
+		return
+	}
+
+	privateKey, ok := auth.SessionPrivateKey(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Key session expired, please log in again", "code": "key_session_expired"})
+		return
+	}
+
+	messages, err := email.ReadSharedInbox(userID, uint(mailboxID), privateKey, db)
+	if err != nil {
+		sharedMailboxError(c, err, "Failed to read shared mailbox")
+		return
+	}
+	c.JSON(http.StatusOK, InboxResponse{Messages: messages})
+}
+
+// SendAsSharedMailbox handles sending an email from a shared mailbox. The
+// sending delegate is recorded in the mailbox's audit log.
+func SendAsSharedMailbox(c *gin.Context, db *gorm.DB, queue *relay.Queue) {
+	userIDVal, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	userID := userIDVal.(uint)
+
+	mailboxID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid mailbox ID"})
+		return
+	}
+	var req SharedSendRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(req.Recipients) == 0 && len(req.To) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "At least one recipient is required"})
+		return
+	}
+
+	// Sanitize inputs
+	req.Subject = strings.TrimSpace(req.Subject)
+	req.Body = strings.TrimSpace(req.Body)
+
+	privateKey, ok := auth.SessionPrivateKey(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Key session expired, please log in again", "code": "key_session_expired"})
+		return
+	}
+	mailboxKey, err := email.OpenSharedMailbox(userID, uint(mailboxID), email.MailboxSendAs, privateKey, db)
+	if err != nil {
+		sharedMailboxError(c, err, "Failed to open shared mailbox")
+		return
+	}
+
+	message, err := queue.Submit(uint(mailboxID), req.Recipients, nil, req.To, req.Subject, req.Body, email.Lifetime{}, mailboxKey)
+	if errors.Is(err, email.ErrSenderUnverified) || errors.Is(err, email.ErrRecipientUnverified) || errors.Is(err, email.ErrPostingRestricted) {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, email.ErrMultipleLists) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := email.RecordMailboxSend(uint(mailboxID), userID, message.ID, db); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Email sent but could not be recorded in the audit log", "id": message.ID})
+		return
+	}
+
+	if message.Status == email.StatusQueued {
+		c.JSON(http.StatusAccepted, gin.H{"message": "Email sent; external delivery queued", "id": message.ID})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Email sent successfully", "id": message.ID})
+}
+
+// SetDelegate handles granting a user permissions on a shared mailbox
+func SetDelegate(c *gin.Context, db *gorm.DB) {
+	userIDVal, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	userID := userIDVal.(uint)
+
+	mailboxID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid mailbox ID"})
+		return
+	}
+	delegateID, err := strconv.ParseUint(c.Param("userId"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+	var roles email.MailboxRoles
+	if err := c.ShouldBindJSON(&roles); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	privateKey, ok := auth.SessionPrivateKey(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Key session expired, please log in again", "code": "key_session_expired"})
+		return
+	}
+
+	if err := email.GrantMailboxAccess(userID, uint(mailboxID), uint(delegateID), roles, privateKey, db); err != nil {
+		sharedMailboxError(c, err, "Failed to grant access")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Access granted", "roles": roles})
+}
+
+// RemoveDelegate handles revoking a user's access to a shared mailbox
+func RemoveDelegate(c *gin.Context, db *gorm.DB) {
+	userIDVal, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	userID := userIDVal.(uint)
+
+	mailboxID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid mailbox ID"})
+		return
+	}
+	delegateID, err := strconv.ParseUint(c.Param("userId"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	if err := email.RevokeMailboxAccess(userID, uint(mailboxID), uint(delegateID), db); err != nil {
+		sharedMailboxError(c, err, "Failed to revoke access")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Access revoked"})
+}
+
+// GetMailboxAudit handles listing the latest audit events of a shared
+// mailbox
+func GetMailboxAudit(c *gin.Context, db *gorm.DB) {
+	userIDVal, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	userID := userIDVal.(uint)
+
+	mailboxID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid mailbox ID"})
+		return
+	}
+	limit, err := queryInt(c, "limit", false)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if limit == 0 || limit > maxAuditEvents {
+		limit = maxAuditEvents
+	}
+
+	events, err := email.MailboxAudit(userID, uint(mailboxID), int(limit), db)
+	if err != nil {
+		sharedMailboxError(c, err, "Failed to load audit log")
+		return
+	}
+	response := make([]AuditEventResponse, 0, len(events))
+	for _, event := range events {
+		response = append(response, AuditEventResponse{
+			ID:        event.ID,
+			ActorID:   event.ActorID,
+			Action:    event.Action,
+			MessageID: event.MessageID,
+			Detail:    event.Detail,
+			CreatedAt: event.CreatedAt,
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"events": response})
+}
+
+// sharedMailboxError responds with the status of a shared mailbox
+// operation's error.
+func sharedMailboxError(c *gin.Context, err error, message string) {
+	switch {
+	case errors.Is(err, email.ErrMailboxNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Shared mailbox not found"})
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+	case errors.Is(err, email.ErrMailboxPermission), errors.Is(err, email.ErrNotAdmin):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case errors.Is(err, email.ErrNoMailboxRoles), errors.Is(err, email.ErrAddressNotLocal):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, email.ErrAddressTaken), errors.Is(err, email.ErrLastMailboxManager):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, email.ErrSessionKeyNotFound), errors.Is(err, email.ErrKeyOutdated):
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Keys were rotated, please log in again", "code": "key_session_expired"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": message})
+	}
+}
+
+func sharedMailboxResponse(mailbox email.SharedMailboxInfo) SharedMailboxResponse {
+	var delegates []DelegateResponse
+	for _, delegate := range mailbox.Delegates {
+		delegates = append(delegates, DelegateResponse{UserID: delegate.UserID, Email: delegate.Email, Roles: delegate.Roles})
+	}
+	return SharedMailboxResponse{
+		ID:        mailbox.ID,
+		Address:   mailbox.Address,
+		Roles:     mailbox.Roles,
+		Verified:  mailbox.Verified,
+		Delegates: delegates,
+		CreatedAt: mailbox.CreatedAt,
+	}
+}
@@ -0,0 +1,225 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"secmail/internal/auth"
+	"secmail/internal/crypto"
+	"secmail/internal/email"
+	"secmail/internal/models"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type SetCertificateRequest struct {
+	// Certificate is a PEM certificate for the account's key; when empty a
+	// self-signed certificate is issued.
+	Certificate string `json:"certificate" binding:"max=65536"`
+}
+
+type ImportSMIMEContactRequest struct {
+	Certificate string   `json:"certificate" binding:"required,max=65536"`
+	Emails      []string `json:"emails" binding:"omitempty,max=20,dive,email,max=254"`
+}
+
+type CertificateResponse struct {
+	Fingerprint string    `json:"fingerprint"`
+	Subject     string    `json:"subject"`
+	Emails      []string  `json:"emails"`
+	NotBefore   time.Time `json:"not_before"`
+	NotAfter    time.Time `json:"not_after"`
+	Certificate string    `json:"certificate"`
+}
+
+type SMIMEContactResponse struct {
+	ID          uint      `json:"id"`
+	Email       string    `json:"email"`
+	Fingerprint string    `json:"fingerprint"`
+	NotAfter    time.Time `json:"not_after"`
+	Certificate string    `json:"certificate"`
+}
+
+// SetCertificate handles attaching an X.509 certificate to the user's key
+func SetCertificate(c *gin.Context, db *gorm.DB) {
+	userIDVal, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	userID := userIDVal.(uint)
+
+	var req SetCertificateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Sanitize inputs
+	certPEM := []byte(strings.TrimSpace(req.Certificate))
+
+	if len(certPEM) == 0 {
+		privateKey, ok := auth.SessionPrivateKey(c)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Key session expired, please log in again", "code": "key_session_expired"})
+			return
+		}
+		issued, info, err := email.IssueSelfSignedCertificate(userID, privateKey, db)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to issue certificate"})
+			return
+		}
+		c.JSON(http.StatusOK, certificateResponse(info, issued))
+		return
+	}
+
+	info, err := email.SetCertificate(userID, certPEM, db)
+	if errors.Is(err, email.ErrCertificateMismatch) {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error(), "code": "certificate_key_mismatch"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid certificate: " + err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, certificateResponse(info, certPEM))
+}
+
+// GetCertificate handles retrieving the user's certificate
+func GetCertificate(c *gin.Context, db *gorm.DB) {
+	userIDVal, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	userID := userIDVal.(uint)
+
+	var user models.User
+	if err := db.Where("id = ?", userID).First(&user).Error; err != nil || user.Certificate == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No certificate attached"})
+		return
+	}
+	_, info, err := crypto.ParseCertificate(user.Certificate)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, certificateResponse(info, user.Certificate))
+}
+
+// DeleteCertificate handles removing the user's certificate
+func DeleteCertificate(c *gin.Context, db *gorm.DB) {
+	userIDVal, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	userID := userIDVal.(uint)
+
+	if err := db.Model(&models.User{}).Where("id = ?", userID).Update("certificate", nil).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Certificate removed"})
+}
+
+// ImportSMIMEContact handles importing an external correspondent's certificate
+func ImportSMIMEContact(c *gin.Context, db *gorm.DB) {
+	userIDVal, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	userID := userIDVal.(uint)
+
+	var req ImportSMIMEContactRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	contacts, err := email.ImportSMIMEContactCert(userID, []byte(strings.TrimSpace(req.Certificate)), req.Emails, db)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid certificate: " + err.Error()})
+		return
+	}
+
+	response := make([]SMIMEContactResponse, 0, len(contacts))
+	for _, contact := range contacts {
+		response = append(response, smimeContactResponse(contact))
+	}
+	c.JSON(http.StatusOK, gin.H{"contacts": response})
+}
+
+// ListSMIMEContacts handles listing the user's external correspondent certificates
+func ListSMIMEContacts(c *gin.Context, db *gorm.DB) {
+	userIDVal, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	userID := userIDVal.(uint)
+
+	var contacts []models.SMIMEContactCert
+	if err := db.Where("user_id = ?", userID).Order("email").Find(&contacts).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	response := make([]SMIMEContactResponse, 0, len(contacts))
+	for _, contact := range contacts {
+		response = append(response, smimeContactResponse(contact))
+	}
+	c.JSON(http.StatusOK, gin.H{"contacts": response})
+}
+
+// DeleteSMIMEContact handles removing an external correspondent's certificate
+func DeleteSMIMEContact(c *gin.Context, db *gorm.DB) {
+	userIDVal, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	userID := userIDVal.(uint)
+
+	contactID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid contact ID"})
+		return
+	}
+
+	result := db.Where("id = ? AND user_id = ?", contactID, userID).Delete(&models.SMIMEContactCert{})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": result.Error.Error()})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Contact certificate not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Contact certificate deleted"})
+}
+
+func certificateResponse(info crypto.CertificateInfo, certPEM []byte) CertificateResponse {
+	return CertificateResponse{
+		Fingerprint: info.Fingerprint,
+		Subject:     info.Subject,
+		Emails:      info.Emails,
+		NotBefore:   info.NotBefore,
+		NotAfter:    info.NotAfter,
+		Certificate: string(certPEM),
+	}
+}
+
+func smimeContactResponse(contact models.SMIMEContactCert) SMIMEContactResponse {
+	return SMIMEContactResponse{
+		ID:          contact.ID,
+		Email:       contact.Email,
+		Fingerprint: contact.Fingerprint,
+		NotAfter:    contact.NotAfter,
+		Certificate: string(contact.Certificate),
+	}
+}
@@ -0,0 +1,50 @@
+(function () {
+  "use strict";
+  var base = window.location.pathname.replace(/\/+$/, "");
+  var passphrase = "";
+
+  function byId(id) { return document.getElementById(id); }
+
+  function show(text, isError) {
+    var status = byId("status");
+    status.textContent = text;
+    status.className = isError ? "error" : "";
+  }
+
+  function post(path, payload) {
+    return fetch(base + path, {
+      method: "POST",
+      headers: { "Content-Type": "application/json" },
+      body: JSON.stringify(payload)
+    }).then(function (res) {
+      return res.json().then(function (data) {
+        if (!res.ok) { throw new Error(data.error || "Request failed"); }
+        return data;
+      });
+    });
+  }
+
+  byId("open-form").addEventListener("submit", function (event) {
+    event.preventDefault();
+    passphrase = byId("passphrase").value;
+    post("/open", { passphrase: passphrase }).then(function (msg) {
+      byId("open-form").hidden = true;
+      byId("from").textContent = msg.from;
+      byId("subject").textContent = msg.subject;
+      byId("sent").textContent = new Date(msg.sent_at).toLocaleString();
+      byId("body").textContent = msg.body;
+      byId("message").hidden = false;
+      byId("reply-form").hidden = !msg.can_reply;
+      show("This message will not be shown again. Copy anything you need to keep.", false);
+    }).catch(function (err) { show(err.message, true); });
+  });
+
+  byId("reply-form").addEventListener("submit", function (event) {
+    event.preventDefault();
+    post("/reply", { passphrase: passphrase, body: byId("reply").value }).then(function () {
+      byId("reply-form").hidden = true;
+      passphrase = "";
+      show("Your reply was sent.", false);
+    }).catch(function (err) { show(err.message, true); });
+  });
+})();
@@ -0,0 +1,152 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"secmail/internal/transparency"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+type LogEntryResponse struct {
+	Index int64  `json:"index"`
+	Leaf  []byte `json:"leaf"`
+}
+
+type ConsistencyProofResponse struct {
+	First  int64    `json:"first"`
+	Second int64    `json:"second"`
+	Proof  [][]byte `json:"proof"`
+}
+
+// GetLogPublicKey handles returning the key that signs the transparency
+// log's tree heads
+func GetLogPublicKey(c *gin.Context, keyLog *transparency.Log) {
+	c.JSON(http.StatusOK, gin.H{
+		"algorithm":  "Ed25519",
+		"public_key": base64.StdEncoding.EncodeToString(keyLog.PublicKey()),
+	})
+}
+
+// GetTreeHead handles returning a signed tree head of the transparency log
+func GetTreeHead(c *gin.Context, keyLog *transparency.Log) {
+	head, err := keyLog.TreeHead()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to compute tree head"})
+		return
+	}
+	c.JSON(http.StatusOK, head)
+}
+
+// GetLogEntries handles listing entries of the transparency log for
+// monitors replaying it
+func GetLogEntries(c *gin.Context, keyLog *transparency.Log) {
+	start, err := queryInt(c, "start", true)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	end, err := queryInt(c, "end", true)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	entries, err := keyLog.Entries(start, end)
+	if errors.Is(err, transparency.ErrInvalidTreeSize) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid range"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list entries"})
+		return
+	}
+
+	response := make([]LogEntryResponse, 0, len(entries))
+	for _, entry := range entries {
+		response = append(response, LogEntryResponse{Index: entry.LeafIndex, Leaf: entry.Leaf})
+	}
+	c.JSON(http.StatusOK, gin.H{"entries": response})
+}
+
+// GetInclusionProof handles proving that a key of an address is in the
+// transparency log
+func GetInclusionProof(c *gin.Context, keyLog *transparency.Log) {
+	// Sanitize inputs
+	address := strings.TrimSpace(c.Query("email"))
+	if address == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "email is required"})
+		return
+	}
+	version, err := queryInt(c, "version", false)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	treeSize, err := queryInt(c, "tree_size", false)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	proof, err := keyLog.Inclusion(address, int(version), treeSize)
+	if errors.Is(err, transparency.ErrEntryNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Key not found in the log"})
+		return
+	}
+	if errors.Is(err, transparency.ErrInvalidTreeSize) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tree size"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to compute proof"})
+		return
+	}
+	c.JSON(http.StatusOK, proof)
+}
+
+// GetConsistencyProof handles proving that an earlier tree of the
+// transparency log is a prefix of a later one
+func GetConsistencyProof(c *gin.Context, keyLog *transparency.Log) {
+	first, err := queryInt(c, "first", true)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	second, err := queryInt(c, "second", true)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	proof, err := keyLog.Consistency(first, second)
+	if errors.Is(err, transparency.ErrInvalidTreeSize) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tree size"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to compute proof"})
+		return
+	}
+	c.JSON(http.StatusOK, ConsistencyProofResponse{First: first, Second: second, Proof: proof})
+}
+
+// queryInt parses a non-negative integer query parameter, which is 0 when
+// it is optional and absent.
+func queryInt(c *gin.Context, name string, required bool) (int64, error) {
+	value := strings.TrimSpace(c.Query(name))
+	if value == "" {
+		if required {
+			return 0, errors.New(name + " is required")
+		}
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, errors.New(name + " must be a non-negative integer")
+	}
+	return n, nil
+}
@@ -0,0 +1,304 @@
+package imapd
+
+import (
+	"errors"
+	"secmail/internal/email"
+	"sync"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapserver"
+)
+
+// unreadableMessage is served in place of a message the user holds no
+// session key for, such as a message sent before senders kept a copy.
+const unreadableMessage = "Subject: [Unreadable message]\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"\r\n" +
+	"This message could not be decrypted with your key.\r\n"
+
+// mailbox is the selected mailbox of a session. Messages are listed without
+// being decrypted; they are decrypted when a client fetches or searches
+// their content and kept until the mailbox is closed.
+type mailbox struct {
+	name     string
+	readOnly bool
+
+	mu             sync.Mutex
+	messages       []email.MailboxMessage
+	mailboxTracker *imapserver.MailboxTracker
+	tracker        *imapserver.SessionTracker
+	rendered       map[uint][]byte
+	searchRes      imap.UIDSet
+}
+
+func newMailbox(name string, messages []email.MailboxMessage, readOnly bool) *mailbox {
+	mailboxTracker := imapserver.NewMailboxTracker(uint32(len(messages)))
+	return &mailbox{
+		name:           name,
+		readOnly:       readOnly,
+		messages:       messages,
+		mailboxTracker: mailboxTracker,
+		tracker:        mailboxTracker.NewSession(),
+		rendered:       make(map[uint][]byte),
+	}
+}
+
+// close releases the tracker and drops decrypted messages.
+func (mbox *mailbox) close() {
+	mbox.mu.Lock()
+	defer mbox.mu.Unlock()
+	mbox.tracker.Close()
+	mbox.rendered = nil
+}
+
+func (mbox *mailbox) selectData() *imap.SelectData {
+	mbox.mu.Lock()
+	defer mbox.mu.Unlock()
+
+	permanentFlags := append(append([]imap.Flag(nil), systemFlags...), imap.FlagWildcard)
+	data := &imap.SelectData{
+		Flags:          systemFlags,
+		PermanentFlags: permanentFlags,
+		NumMessages:    uint32(len(mbox.messages)),
+		UIDNext:        uidNext(mbox.messages),
+		UIDValidity:    uidValidity,
+	}
+	if mbox.readOnly {
+		data.PermanentFlags = nil
+	}
+	for i, msg := range mbox.messages {
+		if !hasFlag(msg.Flags, imap.FlagSeen) {
+			data.FirstUnseenSeqNum = uint32(i) + 1
+			break
+		}
+	}
+	return data
+}
+
+// update replaces the message list with a fresh one from the store and
+// queues the differences for the client: vanished messages, changed flags
+// and new messages. UIDs only grow, so new messages are at the end.
+func (mbox *mailbox) update(latest []email.MailboxMessage) {
+	mbox.mu.Lock()
+	defer mbox.mu.Unlock()
+
+	index := make(map[uint]int, len(latest))
+	for i, msg := range latest {
+		index[msg.ID] = i
+	}
+
+	// Iterate in reverse order, to keep sequence numbers consistent
+	var kept []email.MailboxMessage
+	for i := len(mbox.messages) - 1; i >= 0; i-- {
+		msg := mbox.messages[i]
+		if _, ok := index[msg.ID]; !ok {
+			mbox.mailboxTracker.QueueExpunge(uint32(i) + 1)
+			delete(mbox.rendered, msg.ID)
+			continue
+		}
+		kept = append(kept, msg)
+	}
+	for i, j := 0, len(kept)-1; i < j; i, j = i+1, j-1 {
+		kept[i], kept[j] = kept[j], kept[i]
+	}
+
+	for i := range kept {
+		flags := latest[index[kept[i].ID]].Flags
+		if !sameFlags(kept[i].Flags, flags) {
+			kept[i].Flags = flags
+			mbox.mailboxTracker.QueueMessageFlags(uint32(i)+1, imap.UID(kept[i].ID), flagList(flags), nil)
+		}
+	}
+
+	var lastID uint
+	if len(mbox.messages) > 0 {
+		lastID = mbox.messages[len(mbox.messages)-1].ID
+	}
+	added := false
+	for _, msg := range latest {
+		if msg.ID > lastID {
+			kept = append(kept, msg)
+			added = true
+		}
+	}
+	mbox.messages = kept
+	if added {
+		mbox.mailboxTracker.QueueNumMessages(uint32(len(mbox.messages)))
+	}
+}
+
+// renderLocked returns a decrypted message, decrypting it on first use. The
+// caller must hold mbox.mu.
+func (mbox *mailbox) renderLocked(store Store, userID uint, privateKey []byte, id uint) ([]byte, error) {
+	if raw, ok := mbox.rendered[id]; ok {
+		return raw, nil
+	}
+	raw, err := store.Render(userID, id, privateKey)
+	if errors.Is(err, email.ErrSessionKeyNotFound) {
+		raw, err = []byte(unreadableMessage), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	mbox.rendered[id] = raw
+	return raw, nil
+}
+
+func (mbox *mailbox) search(kind imapserver.NumKind, criteria *imap.SearchCriteria, options *imap.SearchOptions, render func(id uint) ([]byte, error)) (*imap.SearchData, error) {
+	mbox.mu.Lock()
+	defer mbox.mu.Unlock()
+
+	mbox.staticSearchCriteria(criteria)
+
+	var (
+		data   imap.SearchData
+		seqSet imap.SeqSet
+		uidSet imap.UIDSet
+	)
+	for i := range mbox.messages {
+		msg := &mbox.messages[i]
+		seqNum := mbox.tracker.EncodeSeqNum(uint32(i) + 1)
+
+		matched, err := matchMessage(seqNum, msg, criteria, func() ([]byte, error) {
+			return render(msg.ID)
+		})
+		if err != nil {
+			return nil, err
+		}
+		if !matched {
+			continue
+		}
+
+		// Always populate the UID set, since it may be saved later for SEARCHRES
+		uid := imap.UID(msg.ID)
+		uidSet.AddNum(uid)
+
+		var num uint32
+		switch kind {
+		case imapserver.NumKindSeq:
+			if seqNum == 0 {
+				continue
+			}
+			seqSet.AddNum(seqNum)
+			num = seqNum
+		case imapserver.NumKindUID:
+			num = uint32(uid)
+		}
+		if data.Min == 0 || num < data.Min {
+			data.Min = num
+		}
+		if data.Max == 0 || num > data.Max {
+			data.Max = num
+		}
+		data.Count++
+	}
+
+	switch kind {
+	case imapserver.NumKindSeq:
+		data.All = seqSet
+	case imapserver.NumKindUID:
+		data.All = uidSet
+	}
+
+	if options.ReturnSave {
+		mbox.searchRes = uidSet
+	}
+	return &data, nil
+}
+
+func (mbox *mailbox) staticSearchCriteria(criteria *imap.SearchCriteria) {
+	seqNums := make([]imap.SeqSet, 0, len(criteria.SeqNum))
+	for _, seqSet := range criteria.SeqNum {
+		switch numSet := mbox.staticNumSet(seqSet).(type) {
+		case imap.SeqSet:
+			seqNums = append(seqNums, numSet)
+		case imap.UIDSet: // can happen with SEARCHRES
+			criteria.UID = append(criteria.UID, numSet)
+		}
+	}
+	criteria.SeqNum = seqNums
+
+	for i, uidSet := range criteria.UID {
+		criteria.UID[i] = mbox.staticNumSet(uidSet).(imap.UIDSet)
+	}
+	for i := range criteria.Not {
+		mbox.staticSearchCriteria(&criteria.Not[i])
+	}
+	for i := range criteria.Or {
+		for j := range criteria.Or[i] {
+			mbox.staticSearchCriteria(&criteria.Or[i][j])
+		}
+	}
+}
+
+// forEach calls f for each message in numSet with its sequence number. f
+// runs with mbox.mu held.
+func (mbox *mailbox) forEach(numSet imap.NumSet, f func(seqNum uint32, msg *email.MailboxMessage)) {
+	mbox.mu.Lock()
+	defer mbox.mu.Unlock()
+
+	numSet = mbox.staticNumSet(numSet)
+	for i := range mbox.messages {
+		msg := &mbox.messages[i]
+		seqNum := uint32(i) + 1
+
+		var contains bool
+		switch numSet := numSet.(type) {
+		case imap.SeqSet:
+			encoded := mbox.tracker.EncodeSeqNum(seqNum)
+			contains = encoded != 0 && numSet.Contains(encoded)
+		case imap.UIDSet:
+			contains = numSet.Contains(imap.UID(msg.ID))
+		}
+		if contains {
+			f(seqNum, msg)
+		}
+	}
+}
+
+// staticNumSet converts a dynamic sequence set into a static one, resolving
+// "*" to the last message and "$" to the saved search result.
+func (mbox *mailbox) staticNumSet(numSet imap.NumSet) imap.NumSet {
+	if imap.IsSearchRes(numSet) {
+		return mbox.searchRes
+	}
+
+	switch numSet := numSet.(type) {
+	case imap.SeqSet:
+		max := uint32(len(mbox.messages))
+		for i := range numSet {
+			r := &numSet[i]
+			staticNumRange(&r.Start, &r.Stop, max)
+		}
+	case imap.UIDSet:
+		max := uint32(uidNext(mbox.messages)) - 1
+		for i := range numSet {
+			r := &numSet[i]
+			staticNumRange((*uint32)(&r.Start), (*uint32)(&r.Stop), max)
+		}
+	}
+	return numSet
+}
+
+func staticNumRange(start, stop *uint32, max uint32) {
+	dyn := false
+	if *start == 0 {
+		*start = max
+		dyn = true
+	}
+	if *stop == 0 {
+		*stop = max
+		dyn = true
+	}
+	if dyn && *start > *stop {
+		*start, *stop = *stop, *start
+	}
+}
+
+// uidNext returns the UID following the last message.
+func uidNext(messages []email.MailboxMessage) imap.UID {
+	if len(messages) == 0 {
+		return 1
+	}
+	return imap.UID(messages[len(messages)-1].ID) + 1
+}
@@ -0,0 +1,351 @@
+package imapd
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"secmail/internal/email"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapserver"
+	gomessage "github.com/emersion/go-message"
+	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-message/textproto"
+)
+
+// writeMessage writes the requested items of msg. raw decrypts the message
+// and is only called when an item needs its content.
+func writeMessage(w *imapserver.FetchResponseWriter, msg *email.MailboxMessage, options *imap.FetchOptions, raw func() ([]byte, error)) error {
+	w.WriteUID(imap.UID(msg.ID))
+
+	if options.Flags {
+		w.WriteFlags(flagList(msg.Flags))
+	}
+	if options.InternalDate {
+		w.WriteInternalDate(msg.SentAt)
+	}
+
+	needsContent := options.RFC822Size || options.Envelope || options.BodyStructure != nil ||
+		len(options.BodySection) > 0 || len(options.BinarySection) > 0 || len(options.BinarySectionSize) > 0
+	if !needsContent {
+		return w.Close()
+	}
+	buf, err := raw()
+	if err != nil {
+		return err
+	}
+
+	if options.RFC822Size {
+		w.WriteRFC822Size(int64(len(buf)))
+	}
+	if options.Envelope {
+		header, err := textproto.ReadHeader(bufio.NewReader(bytes.NewReader(buf)))
+		if err == nil {
+			w.WriteEnvelope(imapserver.ExtractEnvelope(header))
+		}
+	}
+	if options.BodyStructure != nil {
+		w.WriteBodyStructure(imapserver.ExtractBodyStructure(bytes.NewReader(buf)))
+	}
+
+	for _, bs := range options.BodySection {
+		section := imapserver.ExtractBodySection(bytes.NewReader(buf), bs)
+		if err := writeSection(w.WriteBodySection(bs, int64(len(section))), section); err != nil {
+			return err
+		}
+	}
+	for _, bs := range options.BinarySection {
+		section := imapserver.ExtractBinarySection(bytes.NewReader(buf), bs)
+		if err := writeSection(w.WriteBinarySection(bs, int64(len(section))), section); err != nil {
+			return err
+		}
+	}
+	for _, bss := range options.BinarySectionSize {
+		w.WriteBinarySectionSize(bss, imapserver.ExtractBinarySectionSize(bytes.NewReader(buf), bss))
+	}
+
+	return w.Close()
+}
+
+// readsBody reports whether a fetch reads message content rather than
+// indexing it: a body or binary section fetched without PEEK, other than a
+// header. ENVELOPE, RFC822.SIZE, BODYSTRUCTURE and PEEK fetches do not count.
+func readsBody(options *imap.FetchOptions) bool {
+	for _, bs := range options.BodySection {
+		if !bs.Peek && bs.Specifier != imap.PartSpecifierHeader && bs.Specifier != imap.PartSpecifierMIME {
+			return true
+		}
+	}
+	for _, bs := range options.BinarySection {
+		if !bs.Peek {
+			return true
+		}
+	}
+	return false
+}
+
+func writeSection(wc io.WriteCloser, section []byte) error {
+	_, writeErr := wc.Write(section)
+	closeErr := wc.Close()
+	if writeErr != nil {
+		return writeErr
+	}
+	return closeErr
+}
+
+// matchMessage reports whether msg matches the SEARCH criteria. raw is only
+// called for criteria on the message content, which is searched decrypted.
+func matchMessage(seqNum uint32, msg *email.MailboxMessage, criteria *imap.SearchCriteria, raw func() ([]byte, error)) (bool, error) {
+	for _, seqSet := range criteria.SeqNum {
+		if seqNum == 0 || !seqSet.Contains(seqNum) {
+			return false, nil
+		}
+	}
+	for _, uidSet := range criteria.UID {
+		if !uidSet.Contains(imap.UID(msg.ID)) {
+			return false, nil
+		}
+	}
+	if !matchDate(msg.SentAt, criteria.Since, criteria.Before) {
+		return false, nil
+	}
+	for _, flag := range criteria.Flag {
+		if !hasFlag(msg.Flags, flag) {
+			return false, nil
+		}
+	}
+	for _, flag := range criteria.NotFlag {
+		if hasFlag(msg.Flags, flag) {
+			return false, nil
+		}
+	}
+
+	needsContent := criteria.Larger != 0 || criteria.Smaller != 0 || len(criteria.Header) > 0 ||
+		!criteria.SentSince.IsZero() || !criteria.SentBefore.IsZero() || len(criteria.Text) > 0 || len(criteria.Body) > 0
+	if needsContent {
+		buf, err := raw()
+		if err != nil {
+			return false, err
+		}
+		if !matchContent(buf, criteria, !msg.BurnAfterReading) {
+			return false, nil
+		}
+	}
+
+	for _, not := range criteria.Not {
+		matched, err := matchMessage(seqNum, msg, &not, raw)
+		if err != nil || matched {
+			return false, err
+		}
+	}
+	for _, or := range criteria.Or {
+		left, err := matchMessage(seqNum, msg, &or[0], raw)
+		if err != nil {
+			return false, err
+		}
+		right, err := matchMessage(seqNum, msg, &or[1], raw)
+		if err != nil {
+			return false, err
+		}
+		if !left && !right {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// matchContent checks the criteria on the size, header and text of a
+// message. Unless searchBody is set, TEXT only searches the header and BODY
+// never matches, so that searching does not reveal the body of a
+// burn-after-reading message without burning it.
+func matchContent(buf []byte, criteria *imap.SearchCriteria, searchBody bool) bool {
+	if criteria.Larger != 0 && int64(len(buf)) <= criteria.Larger {
+		return false
+	}
+	if criteria.Smaller != 0 && int64(len(buf)) >= criteria.Smaller {
+		return false
+	}
+
+	header := mail.Header{Header: readEntity(buf).Header}
+	for _, field := range criteria.Header {
+		if !matchHeaderFields(header.FieldsByKey(field.Key), field.Value) {
+			return false
+		}
+	}
+	if !criteria.SentSince.IsZero() || !criteria.SentBefore.IsZero() {
+		t, err := header.Date()
+		if err != nil || !matchDate(t, criteria.SentSince, criteria.SentBefore) {
+			return false
+		}
+	}
+
+	searched := buf
+	if !searchBody {
+		if i := bytes.Index(buf, []byte("\r\n\r\n")); i >= 0 {
+			searched = buf[:i+4]
+		}
+		if len(criteria.Body) > 0 {
+			return false
+		}
+	}
+	for _, text := range criteria.Text {
+		if !matchEntity(readEntity(searched), text, true) {
+			return false
+		}
+	}
+	for _, body := range criteria.Body {
+		if !matchEntity(readEntity(buf), body, false) {
+			return false
+		}
+	}
+	return true
+}
+
+func readEntity(buf []byte) *gomessage.Entity {
+	e, _ := gomessage.Read(bytes.NewReader(buf))
+	if e == nil {
+		e, _ = gomessage.New(gomessage.Header{}, bytes.NewReader(nil))
+	}
+	return e
+}
+
+func matchDate(t, since, before time.Time) bool {
+	// RFC 3501 requires time zone unaware date comparison
+	t = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+
+	if !since.IsZero() && t.Before(since) {
+		return false
+	}
+	if !before.IsZero() && !t.Before(before) {
+		return false
+	}
+	return true
+}
+
+func matchHeaderFields(fields gomessage.HeaderFields, pattern string) bool {
+	if pattern == "" {
+		return fields.Len() > 0
+	}
+
+	pattern = strings.ToLower(pattern)
+	for fields.Next() {
+		v, _ := fields.Text()
+		if strings.Contains(strings.ToLower(v), pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchEntity(e *gomessage.Entity, pattern string, includeHeader bool) bool {
+	if pattern == "" {
+		return true
+	}
+	if includeHeader && matchHeaderFields(e.Header.Fields(), pattern) {
+		return true
+	}
+
+	if mr := e.MultipartReader(); mr != nil {
+		for {
+			part, err := mr.NextPart()
+			if err != nil {
+				return false
+			}
+			if matchEntity(part, pattern, includeHeader) {
+				return true
+			}
+		}
+	}
+
+	t, _, err := e.Header.ContentType()
+	if err != nil && e.Header.Get("Content-Type") != "" {
+		return false
+	}
+	if t != "" && !strings.HasPrefix(t, "text/") && !strings.HasPrefix(t, "message/") {
+		return false
+	}
+	buf, err := io.ReadAll(e.Body)
+	if err != nil {
+		return false
+	}
+	return bytes.Contains(bytes.ToLower(buf), bytes.ToLower([]byte(pattern)))
+}
+
+// applyStore returns flags updated by a STORE command. Flags are compared
+// case-insensitively and \Recent cannot be set.
+func applyStore(flags []string, store *imap.StoreFlags) []string {
+	var result []string
+	switch store.Op {
+	case imap.StoreFlagsSet:
+	case imap.StoreFlagsAdd:
+		result = append(result, flags...)
+	case imap.StoreFlagsDel:
+		for _, flag := range flags {
+			if !containsFlag(store.Flags, flag) {
+				result = append(result, flag)
+			}
+		}
+		return result
+	default:
+		panic(fmt.Errorf("unknown STORE flag operation: %v", store.Op))
+	}
+
+	for _, flag := range store.Flags {
+		if strings.EqualFold(string(flag), `\Recent`) || hasFlag(result, flag) {
+			continue
+		}
+		result = append(result, string(flag))
+	}
+	return result
+}
+
+func hasFlag(flags []string, flag imap.Flag) bool {
+	for _, f := range flags {
+		if strings.EqualFold(f, string(flag)) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFlag(flags []imap.Flag, flag string) bool {
+	for _, f := range flags {
+		if strings.EqualFold(string(f), flag) {
+			return true
+		}
+	}
+	return false
+}
+
+func sameFlags(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, flag := range a {
+		if !hasFlag(b, imap.Flag(flag)) {
+			return false
+		}
+	}
+	return true
+}
+
+func countFlag(messages []email.MailboxMessage, flag imap.Flag) uint32 {
+	var n uint32
+	for _, msg := range messages {
+		if hasFlag(msg.Flags, flag) {
+			n++
+		}
+	}
+	return n
+}
+
+func flagList(flags []string) []imap.Flag {
+	list := make([]imap.Flag, 0, len(flags))
+	for _, flag := range flags {
+		list = append(list, imap.Flag(flag))
+	}
+	return list
+}
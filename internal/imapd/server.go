@@ -0,0 +1,84 @@
+package imapd
+
+import (
+	"crypto/tls"
+	"secmail/internal/auth"
+	"secmail/internal/email"
+	"secmail/internal/relay"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapserver"
+	"gorm.io/gorm"
+)
+
+// Store authenticates users and gives access to their encrypted mailboxes.
+type Store interface {
+	// Authenticate checks secmail credentials and returns the user ID and
+	// the unwrapped private key.
+	Authenticate(username, password, clientIP string) (uint, []byte, error)
+	// ListMailbox returns the messages of a mailbox in ID order.
+	ListMailbox(userID uint, mailbox string) ([]email.MailboxMessage, error)
+	// Render decrypts a message as RFC 5322.
+	Render(userID, messageID uint, privateKey []byte) ([]byte, error)
+	// MarkRead records that the user has read the body of a message.
+	MarkRead(userID, messageID uint) error
+	// SetFlags replaces the user's flags on a message.
+	SetFlags(userID, messageID uint, flags []string) error
+}
+
+// DBStore is the Store backed by the secmail database. Queue names the
+// Message-ID of messages sent within secmail, matching the copies relayed
+// to external recipients.
+type DBStore struct {
+	DB    *gorm.DB
+	Queue *relay.Queue
+}
+
+// Authenticate checks secmail credentials, subject to login throttling.
+func (s DBStore) Authenticate(username, password, clientIP string) (uint, []byte, error) {
+	user, privateKey, err := auth.Authenticate(s.DB, username, password, clientIP)
+	if err != nil {
+		return 0, nil, err
+	}
+	return user.ID, privateKey, nil
+}
+
+// ListMailbox returns the messages of a mailbox in ID order.
+func (s DBStore) ListMailbox(userID uint, mailbox string) ([]email.MailboxMessage, error) {
+	return email.ListMailbox(userID, mailbox, s.DB)
+}
+
+// Render decrypts a message as RFC 5322.
+func (s DBStore) Render(userID, messageID uint, privateKey []byte) ([]byte, error) {
+	messageIDHeader := s.Queue.MessageID(&email.Message{ID: messageID})
+	return email.RenderMessage(userID, messageID, privateKey, messageIDHeader, s.DB)
+}
+
+// MarkRead records that the user has read the body of a message, erasing
+// their key to it if it is a burn-after-reading message.
+func (s DBStore) MarkRead(userID, messageID uint) error {
+	return email.MarkRead(userID, messageID, s.DB)
+}
+
+// SetFlags replaces the user's flags on a message.
+func (s DBStore) SetFlags(userID, messageID uint, flags []string) error {
+	return email.SetMessageFlags(userID, messageID, flags, s.DB)
+}
+
+// NewServer returns an IMAP4rev2 server giving mail clients access to the
+// users' mailboxes with their secmail credentials. Messages are decrypted
+// with the user's key as they are fetched. Without a TLS config, STARTTLS is
+// not offered and passwords are accepted in the clear.
+func NewServer(store Store, tlsConfig *tls.Config) *imapserver.Server {
+	return imapserver.New(&imapserver.Options{
+		NewSession: func(conn *imapserver.Conn) (imapserver.Session, *imapserver.GreetingData, error) {
+			return &session{store: store, conn: conn}, nil, nil
+		},
+		Caps: imap.CapSet{
+			imap.CapIMAP4rev1: {},
+			imap.CapIMAP4rev2: {},
+		},
+		TLSConfig:    tlsConfig,
+		InsecureAuth: tlsConfig == nil,
+	})
+}
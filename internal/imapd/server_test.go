@@ -0,0 +1,283 @@
+package imapd
+
+import (
+	"net"
+	"secmail/internal/auth"
+	"secmail/internal/email"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapclient"
+)
+
+type fakeStore struct {
+	mu       sync.Mutex
+	password string
+	messages map[string][]email.MailboxMessage
+	raw      map[uint]string
+	read     []uint
+}
+
+func (f *fakeStore) Authenticate(username, password, clientIP string) (uint, []byte, error) {
+	if username != "alice@secmail.test" || password != f.password {
+		return 0, nil, auth.ErrInvalidCredentials
+	}
+	return 1, []byte("private key"), nil
+}
+
+func (f *fakeStore) ListMailbox(userID uint, mailbox string) ([]email.MailboxMessage, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	messages, ok := f.messages[mailbox]
+	if !ok {
+		return nil, email.ErrNoSuchMailbox
+	}
+	return append([]email.MailboxMessage(nil), messages...), nil
+}
+
+func (f *fakeStore) Render(userID, messageID uint, privateKey []byte) ([]byte, error) {
+	if string(privateKey) != "private key" {
+		return nil, email.ErrSessionKeyNotFound
+	}
+	return []byte(f.raw[messageID]), nil
+}
+
+func (f *fakeStore) MarkRead(userID, messageID uint) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.read = append(f.read, messageID)
+	return nil
+}
+
+func (f *fakeStore) readIDs() []uint {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]uint(nil), f.read...)
+}
+
+func (f *fakeStore) SetFlags(userID, messageID uint, flags []string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for name, messages := range f.messages {
+		for i := range messages {
+			if messages[i].ID == messageID {
+				f.messages[name][i].Flags = flags
+			}
+		}
+	}
+	return nil
+}
+
+func (f *fakeStore) flags(mailbox string, messageID uint) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, msg := range f.messages[mailbox] {
+		if msg.ID == messageID {
+			return msg.Flags
+		}
+	}
+	return nil
+}
+
+func (f *fakeStore) deliver(mailbox string, messageID uint, raw string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.messages[mailbox] = append(f.messages[mailbox], email.MailboxMessage{ID: messageID, SentAt: time.Now()})
+	f.raw[messageID] = raw
+}
+
+func newFakeStore() *fakeStore {
+	sentAt := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	return &fakeStore{
+		password: "correct horse",
+		messages: map[string][]email.MailboxMessage{
+			email.MailboxInbox: {
+				{ID: 3, SentAt: sentAt},
+				{ID: 7, SentAt: sentAt, Flags: []string{`\Seen`}, BurnAfterReading: true},
+			},
+			email.MailboxSent: {},
+		},
+		raw: map[uint]string{
+			3: "From: bob@secmail.test\r\nTo: alice@secmail.test\r\nSubject: Lunch\r\nContent-Type: text/plain\r\n\r\nSee you at noon.\r\n",
+			7: "From: carol@example.org\r\nTo: alice@secmail.test\r\nSubject: Your invoice\r\nContent-Type: text/plain\r\n\r\nPlease pay by Friday.\r\n",
+		},
+	}
+}
+
+func startTestServer(t *testing.T, store Store) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	s := NewServer(store, nil)
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+	return l.Addr().String()
+}
+
+func TestIMAPSession(t *testing.T) {
+	store := newFakeStore()
+	addr := startTestServer(t, store)
+
+	c, err := imapclient.DialInsecure(addr, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer c.Close()
+
+	if err := c.Login("alice@secmail.test", "wrong").Wait(); err == nil {
+		t.Fatal("Login with a wrong password should fail")
+	}
+	if err := c.Login("alice@secmail.test", "correct horse").Wait(); err != nil {
+		t.Fatalf("Failed to log in: %v", err)
+	}
+
+	mailboxes, err := c.List("", "*", nil).Collect()
+	if err != nil {
+		t.Fatalf("Failed to list mailboxes: %v", err)
+	}
+	if len(mailboxes) != 2 || mailboxes[0].Mailbox != "INBOX" || mailboxes[1].Mailbox != "Sent" {
+		t.Fatalf("Unexpected mailboxes: %+v", mailboxes)
+	}
+
+	selected, err := c.Select("inbox", nil).Wait()
+	if err != nil {
+		t.Fatalf("Failed to select INBOX: %v", err)
+	}
+	if selected.NumMessages != 2 || selected.UIDValidity != uidValidity || selected.UIDNext != 8 {
+		t.Errorf("Unexpected select data: %+v", selected)
+	}
+
+	// Fetching the envelope and size decrypts the message without reading it
+	if _, err := c.Fetch(imap.SeqSetNum(1), &imap.FetchOptions{
+		Envelope:      true,
+		RFC822Size:    true,
+		BodyStructure: &imap.FetchItemBodyStructure{},
+		BodySection:   []*imap.FetchItemBodySection{{Peek: true}},
+	}).Collect(); err != nil {
+		t.Fatalf("Failed to fetch: %v", err)
+	}
+	if read := store.readIDs(); len(read) != 0 {
+		t.Errorf("Expected no message to be read, got %v", read)
+	}
+
+	// Fetching the body decrypts the message, reads it and marks it seen
+	bodySection := &imap.FetchItemBodySection{}
+	msgs, err := c.Fetch(imap.SeqSetNum(1), &imap.FetchOptions{
+		UID:         true,
+		Envelope:    true,
+		BodySection: []*imap.FetchItemBodySection{bodySection},
+	}).Collect()
+	if err != nil {
+		t.Fatalf("Failed to fetch: %v", err)
+	}
+	if len(msgs) != 1 || msgs[0].UID != 3 || msgs[0].Envelope.Subject != "Lunch" {
+		t.Fatalf("Unexpected fetch result: %+v", msgs)
+	}
+	if body := string(msgs[0].FindBodySection(bodySection)); !strings.Contains(body, "See you at noon.") {
+		t.Errorf("Unexpected body: %q", body)
+	}
+	if read := store.readIDs(); len(read) != 1 || read[0] != 3 {
+		t.Errorf("Expected message 3 to be read, got %v", read)
+	}
+	if flags := store.flags(email.MailboxInbox, 3); len(flags) != 1 || flags[0] != `\Seen` {
+		t.Errorf("Expected message to be marked seen, got %v", flags)
+	}
+
+	// Search matches the decrypted content
+	data, err := c.UIDSearch(&imap.SearchCriteria{Text: []string{"INVOICE"}}, nil).Wait()
+	if err != nil {
+		t.Fatalf("Failed to search: %v", err)
+	}
+	if uids := data.AllUIDs(); len(uids) != 1 || uids[0] != 7 {
+		t.Errorf("Unexpected search result: %v", uids)
+	}
+
+	// The body of a burn-after-reading message is not searched
+	data, err = c.UIDSearch(&imap.SearchCriteria{Body: []string{"pay"}}, nil).Wait()
+	if err != nil {
+		t.Fatalf("Failed to search: %v", err)
+	}
+	if uids := data.AllUIDs(); len(uids) != 0 {
+		t.Errorf("Expected the body of message 7 not to be searched, got %v", uids)
+	}
+	data, err = c.UIDSearch(&imap.SearchCriteria{Body: []string{"noon"}}, nil).Wait()
+	if err != nil {
+		t.Fatalf("Failed to search: %v", err)
+	}
+	if uids := data.AllUIDs(); len(uids) != 1 || uids[0] != 3 {
+		t.Errorf("Unexpected search result: %v", uids)
+	}
+	if read := store.readIDs(); len(read) != 1 {
+		t.Errorf("Expected searching not to read messages, got %v", read)
+	}
+
+	if _, err := c.Store(imap.UIDSetNum(7), &imap.StoreFlags{
+		Op:     imap.StoreFlagsAdd,
+		Flags:  []imap.Flag{imap.FlagFlagged},
+		Silent: true,
+	}, nil).Collect(); err != nil {
+		t.Fatalf("Failed to store flags: %v", err)
+	}
+	if flags := store.flags(email.MailboxInbox, 7); len(flags) != 2 || flags[1] != `\Flagged` {
+		t.Errorf("Unexpected flags after STORE: %v", flags)
+	}
+
+	if err := c.Create("Archive", nil).Wait(); err == nil {
+		t.Error("Creating a mailbox should fail")
+	}
+}
+
+func TestIMAPIdle(t *testing.T) {
+	idlePollInterval = 20 * time.Millisecond
+	defer func() { idlePollInterval = 10 * time.Second }()
+
+	store := newFakeStore()
+	addr := startTestServer(t, store)
+
+	exists := make(chan uint32, 1)
+	c, err := imapclient.DialInsecure(addr, &imapclient.Options{
+		UnilateralDataHandler: &imapclient.UnilateralDataHandler{
+			Mailbox: func(data *imapclient.UnilateralDataMailbox) {
+				if data.NumMessages != nil {
+					exists <- *data.NumMessages
+				}
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer c.Close()
+
+	if err := c.Login("alice@secmail.test", "correct horse").Wait(); err != nil {
+		t.Fatalf("Failed to log in: %v", err)
+	}
+	if _, err := c.Select("INBOX", nil).Wait(); err != nil {
+		t.Fatalf("Failed to select INBOX: %v", err)
+	}
+
+	idle, err := c.Idle()
+	if err != nil {
+		t.Fatalf("Failed to start IDLE: %v", err)
+	}
+	store.deliver(email.MailboxInbox, 9, "Subject: New\r\n\r\nHello\r\n")
+
+	select {
+	case n := <-exists:
+		if n != 3 {
+			t.Errorf("Expected 3 messages, got %d", n)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for new message notification")
+	}
+	if err := idle.Close(); err != nil {
+		t.Fatalf("Failed to stop IDLE: %v", err)
+	}
+	if err := idle.Wait(); err != nil {
+		t.Fatalf("IDLE failed: %v", err)
+	}
+}
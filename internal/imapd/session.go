@@ -0,0 +1,404 @@
+package imapd
+
+import (
+	"errors"
+	"log"
+	"net"
+	"secmail/internal/auth"
+	"secmail/internal/email"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapserver"
+)
+
+const (
+	mailboxDelim = '/'
+	// uidValidity never changes: UIDs are message IDs, which are not reused.
+	uidValidity = 1
+)
+
+// idlePollInterval is how often the store is checked for changes while a
+// client is idling.
+var idlePollInterval = 10 * time.Second
+
+// mailboxes lists the mailboxes of every user with their special-use
+// attributes.
+var mailboxes = []struct {
+	name  string
+	attrs []imap.MailboxAttr
+}{
+	{email.MailboxInbox, nil},
+	{email.MailboxSent, []imap.MailboxAttr{imap.MailboxAttrSent}},
+}
+
+// Mailbox flags offered to clients; any keyword may be set as well.
+var systemFlags = []imap.Flag{imap.FlagSeen, imap.FlagAnswered, imap.FlagFlagged, imap.FlagDeleted, imap.FlagDraft}
+
+var (
+	errNoSuchMailbox = &imap.Error{
+		Type: imap.StatusResponseTypeNo,
+		Code: imap.ResponseCodeNonExistent,
+		Text: "No such mailbox",
+	}
+	errFixedMailboxes = &imap.Error{
+		Type: imap.StatusResponseTypeNo,
+		Code: imap.ResponseCodeCannot,
+		Text: "Mailboxes are fixed to INBOX and Sent",
+	}
+	errReadOnlyMessages = &imap.Error{
+		Type: imap.StatusResponseTypeNo,
+		Code: imap.ResponseCodeCannot,
+		Text: "Messages can only be added by sending mail and cannot be deleted",
+	}
+	errReadOnlyMailbox = &imap.Error{
+		Type: imap.StatusResponseTypeNo,
+		Code: imap.ResponseCodeCannot,
+		Text: "Mailbox is read-only",
+	}
+	errThrottled = &imap.Error{
+		Type: imap.StatusResponseTypeNo,
+		Code: imap.ResponseCodeUnavailable,
+		Text: "Too many failed login attempts, try again later",
+	}
+	errServer = &imap.Error{
+		Type: imap.StatusResponseTypeNo,
+		Code: imap.ResponseCodeServerBug,
+		Text: "Internal server error",
+	}
+)
+
+// session is one IMAP connection. The user's private key is held for the
+// lifetime of the connection so messages can be decrypted on FETCH.
+type session struct {
+	store      Store
+	conn       *imapserver.Conn
+	userID     uint
+	privateKey []byte
+	mailbox    *mailbox // selected mailbox, may be nil
+}
+
+var _ imapserver.SessionIMAP4rev2 = (*session)(nil)
+
+func (s *session) Close() error {
+	if s.mailbox != nil {
+		s.mailbox.close()
+		s.mailbox = nil
+	}
+	s.privateKey = nil
+	return nil
+}
+
+func (s *session) Login(username, password string) error {
+	// Sanitize inputs
+	username = strings.TrimSpace(username)
+	password = strings.TrimSpace(password)
+
+	clientIP := ""
+	if host, _, err := net.SplitHostPort(s.conn.NetConn().RemoteAddr().String()); err == nil {
+		clientIP = host
+	}
+
+	userID, privateKey, err := s.store.Authenticate(username, password, clientIP)
+	var throttled *auth.ThrottledError
+	if errors.As(err, &throttled) {
+		return errThrottled
+	}
+	if errors.Is(err, auth.ErrInvalidCredentials) {
+		return imapserver.ErrAuthFailed
+	}
+	if err != nil {
+		log.Println("IMAP login failed:", err)
+		return errServer
+	}
+	s.userID = userID
+	s.privateKey = privateKey
+	return nil
+}
+
+func (s *session) Select(name string, options *imap.SelectOptions) (*imap.SelectData, error) {
+	name, err := mailboxName(name)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := s.store.ListMailbox(s.userID, name)
+	if err != nil {
+		return nil, s.storeError(err)
+	}
+
+	if s.mailbox != nil {
+		s.mailbox.close()
+	}
+	s.mailbox = newMailbox(name, messages, options.ReadOnly)
+	return s.mailbox.selectData(), nil
+}
+
+func (s *session) Unselect() error {
+	s.mailbox.close()
+	s.mailbox = nil
+	return nil
+}
+
+func (s *session) Create(name string, options *imap.CreateOptions) error {
+	return errFixedMailboxes
+}
+
+func (s *session) Delete(name string) error {
+	return errFixedMailboxes
+}
+
+func (s *session) Rename(name, newName string, options *imap.RenameOptions) error {
+	return errFixedMailboxes
+}
+
+// Subscribe and Unsubscribe are accepted but have no effect: both mailboxes
+// are always subscribed.
+func (s *session) Subscribe(name string) error {
+	_, err := mailboxName(name)
+	return err
+}
+
+func (s *session) Unsubscribe(name string) error {
+	_, err := mailboxName(name)
+	return err
+}
+
+func (s *session) Namespace() (*imap.NamespaceData, error) {
+	return &imap.NamespaceData{
+		Personal: []imap.NamespaceDescriptor{{Delim: mailboxDelim}},
+	}, nil
+}
+
+func (s *session) List(w *imapserver.ListWriter, ref string, patterns []string, options *imap.ListOptions) error {
+	if len(patterns) == 0 {
+		return w.WriteList(&imap.ListData{
+			Attrs: []imap.MailboxAttr{imap.MailboxAttrNoSelect},
+			Delim: mailboxDelim,
+		})
+	}
+
+	for _, mbox := range mailboxes {
+		match := false
+		for _, pattern := range patterns {
+			if imapserver.MatchList(mbox.name, mailboxDelim, ref, pattern) {
+				match = true
+				break
+			}
+		}
+		if !match || (options.SelectSpecialUse && len(mbox.attrs) == 0) {
+			continue
+		}
+
+		data := imap.ListData{
+			Mailbox: mbox.name,
+			Delim:   mailboxDelim,
+			Attrs:   []imap.MailboxAttr{imap.MailboxAttrHasNoChildren, imap.MailboxAttrSubscribed},
+		}
+		data.Attrs = append(data.Attrs, mbox.attrs...)
+		if options.ReturnStatus != nil {
+			status, err := s.Status(mbox.name, options.ReturnStatus)
+			if err != nil {
+				return err
+			}
+			data.Status = status
+		}
+		if err := w.WriteList(&data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *session) Status(name string, options *imap.StatusOptions) (*imap.StatusData, error) {
+	name, err := mailboxName(name)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := s.store.ListMailbox(s.userID, name)
+	if err != nil {
+		return nil, s.storeError(err)
+	}
+
+	data := imap.StatusData{Mailbox: name}
+	if options.NumMessages {
+		num := uint32(len(messages))
+		data.NumMessages = &num
+	}
+	if options.UIDNext {
+		data.UIDNext = uidNext(messages)
+	}
+	if options.UIDValidity {
+		data.UIDValidity = uidValidity
+	}
+	if options.NumUnseen {
+		num := uint32(len(messages)) - countFlag(messages, imap.FlagSeen)
+		data.NumUnseen = &num
+	}
+	if options.NumDeleted {
+		num := countFlag(messages, imap.FlagDeleted)
+		data.NumDeleted = &num
+	}
+	if options.NumRecent {
+		num := uint32(0)
+		data.NumRecent = &num
+	}
+	return &data, nil
+}
+
+func (s *session) Append(name string, r imap.LiteralReader, options *imap.AppendOptions) (*imap.AppendData, error) {
+	return nil, errReadOnlyMessages
+}
+
+func (s *session) Expunge(w *imapserver.ExpungeWriter, uids *imap.UIDSet) error {
+	return errReadOnlyMessages
+}
+
+func (s *session) Copy(numSet imap.NumSet, dest string) (*imap.CopyData, error) {
+	return nil, errReadOnlyMessages
+}
+
+func (s *session) Move(w *imapserver.MoveWriter, numSet imap.NumSet, dest string) error {
+	return errReadOnlyMessages
+}
+
+func (s *session) Poll(w *imapserver.UpdateWriter, allowExpunge bool) error {
+	if s.mailbox == nil {
+		return nil
+	}
+	if err := s.refresh(); err != nil {
+		return err
+	}
+	return s.mailbox.tracker.Poll(w, allowExpunge)
+}
+
+func (s *session) Idle(w *imapserver.UpdateWriter, stop <-chan struct{}) error {
+	if s.mailbox == nil {
+		<-stop
+		return nil
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(idlePollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := s.refresh(); err != nil {
+					log.Println("IMAP idle refresh failed:", err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return s.mailbox.tracker.Idle(w, stop)
+}
+
+func (s *session) Fetch(w *imapserver.FetchWriter, numSet imap.NumSet, options *imap.FetchOptions) error {
+	mbox := s.mailbox
+	markSeen := false
+	if !mbox.readOnly {
+		for _, bs := range options.BodySection {
+			if !bs.Peek {
+				markSeen = true
+				break
+			}
+		}
+	}
+
+	readBody := readsBody(options)
+
+	var err error
+	mbox.forEach(numSet, func(seqNum uint32, msg *email.MailboxMessage) {
+		if err != nil {
+			return
+		}
+		if markSeen && !hasFlag(msg.Flags, imap.FlagSeen) {
+			flags := append(append([]string(nil), msg.Flags...), string(imap.FlagSeen))
+			if err = s.store.SetFlags(s.userID, msg.ID, flags); err != nil {
+				return
+			}
+			msg.Flags = flags
+			mbox.mailboxTracker.QueueMessageFlags(seqNum, imap.UID(msg.ID), flagList(msg.Flags), nil)
+		}
+
+		respWriter := w.CreateMessage(mbox.tracker.EncodeSeqNum(seqNum))
+		err = writeMessage(respWriter, msg, options, func() ([]byte, error) {
+			return mbox.renderLocked(s.store, s.userID, s.privateKey, msg.ID)
+		})
+		if err == nil && readBody {
+			err = s.store.MarkRead(s.userID, msg.ID)
+		}
+	})
+	return err
+}
+
+func (s *session) Search(kind imapserver.NumKind, criteria *imap.SearchCriteria, options *imap.SearchOptions) (*imap.SearchData, error) {
+	return s.mailbox.search(kind, criteria, options, func(id uint) ([]byte, error) {
+		return s.mailbox.renderLocked(s.store, s.userID, s.privateKey, id)
+	})
+}
+
+func (s *session) Store(w *imapserver.FetchWriter, numSet imap.NumSet, flags *imap.StoreFlags, options *imap.StoreOptions) error {
+	mbox := s.mailbox
+	if mbox.readOnly {
+		return errReadOnlyMailbox
+	}
+
+	var err error
+	mbox.forEach(numSet, func(seqNum uint32, msg *email.MailboxMessage) {
+		if err != nil {
+			return
+		}
+		updated := applyStore(msg.Flags, flags)
+		if err = s.store.SetFlags(s.userID, msg.ID, updated); err != nil {
+			return
+		}
+		msg.Flags = updated
+		mbox.mailboxTracker.QueueMessageFlags(seqNum, imap.UID(msg.ID), flagList(msg.Flags), mbox.tracker)
+	})
+	if err != nil {
+		return err
+	}
+	if !flags.Silent {
+		return s.Fetch(w, numSet, &imap.FetchOptions{Flags: true})
+	}
+	return nil
+}
+
+// refresh reloads the selected mailbox so changes made by other sessions
+// and newly arrived mail are reported to the client.
+func (s *session) refresh() error {
+	messages, err := s.store.ListMailbox(s.userID, s.mailbox.name)
+	if err != nil {
+		return s.storeError(err)
+	}
+	s.mailbox.update(messages)
+	return nil
+}
+
+// storeError logs err and returns a generic error for the client.
+func (s *session) storeError(err error) error {
+	if errors.Is(err, email.ErrNoSuchMailbox) {
+		return errNoSuchMailbox
+	}
+	log.Println("IMAP store error:", err)
+	return errServer
+}
+
+// mailboxName resolves a mailbox name sent by a client. INBOX is case
+// insensitive.
+func mailboxName(name string) (string, error) {
+	if strings.EqualFold(name, email.MailboxInbox) {
+		return email.MailboxInbox, nil
+	}
+	for _, mbox := range mailboxes {
+		if mbox.name == name {
+			return name, nil
+		}
+	}
+	return "", errNoSuchMailbox
+}
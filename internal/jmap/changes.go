@@ -0,0 +1,115 @@
+package jmap
+
+import (
+	"encoding/json"
+	"secmail/internal/email"
+	"secmail/internal/models"
+)
+
+type changesArgs struct {
+	accountArgs
+	SinceState string `json:"sinceState"`
+	MaxChanges *int   `json:"maxChanges"`
+}
+
+type changesResponse struct {
+	AccountID      string   `json:"accountId"`
+	OldState       string   `json:"oldState"`
+	NewState       string   `json:"newState"`
+	HasMoreChanges bool     `json:"hasMoreChanges"`
+	Created        []string `json:"created"`
+	Updated        []string `json:"updated"`
+	Destroyed      []string `json:"destroyed"`
+}
+
+// messageChanges are the messages changed between two states.
+type messageChanges struct {
+	oldState, newState          string
+	hasMore                     bool
+	created, updated, destroyed []uint
+}
+
+// changesSince decodes /changes arguments and collects the message changes
+// they ask for.
+func (c *call) changesSince(rawArgs json.RawMessage) (*messageChanges, error) {
+	var args changesArgs
+	if err := c.decodeArgs(rawArgs, &args); err != nil {
+		return nil, err
+	}
+	limit := 0
+	if args.MaxChanges != nil {
+		if *args.MaxChanges <= 0 {
+			return nil, invalidArguments("maxChanges must be positive")
+		}
+		limit = *args.MaxChanges
+	}
+
+	latest, err := email.LatestChange(c.UserID, c.DB)
+	if err != nil {
+		return nil, err
+	}
+	since, ok := parseState(args.SinceState)
+	if !ok || since > latest {
+		return nil, &MethodError{Type: "cannotCalculateChanges"}
+	}
+
+	fetch := 0
+	if limit > 0 {
+		fetch = limit + 1
+	}
+	changes, err := email.ChangesSince(c.UserID, since, fetch, c.DB)
+	if err != nil {
+		return nil, err
+	}
+	result := &messageChanges{oldState: args.SinceState, newState: formatState(latest)}
+	if limit > 0 && len(changes) > limit {
+		changes = changes[:limit]
+		result.hasMore = true
+		result.newState = formatState(changes[len(changes)-1].ID)
+	}
+	result.created, result.updated, result.destroyed = collapseChanges(changes)
+	return result, nil
+}
+
+// collapseChanges reduces a change log to the messages created, updated and
+// destroyed over it. A message created and destroyed within the log is left
+// out; one created and updated is only reported as created.
+func collapseChanges(changes []models.MessageChange) (created, updated, destroyed []uint) {
+	kinds := make(map[uint]string)
+	var order []uint
+	for _, change := range changes {
+		kind, seen := kinds[change.MessageID]
+		if !seen {
+			order = append(order, change.MessageID)
+			kinds[change.MessageID] = change.Kind
+			continue
+		}
+		switch {
+		case change.Kind == email.ChangeDestroyed && kind == email.ChangeCreated:
+			kinds[change.MessageID] = ""
+		case change.Kind == email.ChangeDestroyed:
+			kinds[change.MessageID] = email.ChangeDestroyed
+		}
+	}
+
+	created, updated, destroyed = []uint{}, []uint{}, []uint{}
+	for _, id := range order {
+		switch kinds[id] {
+		case email.ChangeCreated:
+			created = append(created, id)
+		case email.ChangeUpdated:
+			updated = append(updated, id)
+		case email.ChangeDestroyed:
+			destroyed = append(destroyed, id)
+		}
+	}
+	return created, updated, destroyed
+}
+
+func formatIDs(prefix string, ids []uint) []string {
+	result := make([]string, 0, len(ids))
+	for _, id := range ids {
+		result = append(result, formatID(prefix, id))
+	}
+	return result
+}
@@ -0,0 +1,769 @@
+package jmap
+
+import (
+	"encoding/json"
+	"errors"
+	"secmail/internal/email"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Keywords with an IMAP system flag counterpart. Flags are stored in their
+// IMAP form; other system flags such as \Deleted have no keyword and are
+// kept but not shown.
+var systemKeywords = map[string]string{
+	`\Seen`:     "$seen",
+	`\Flagged`:  "$flagged",
+	`\Answered`: "$answered",
+	`\Draft`:    "$draft",
+}
+
+// flagKeyword returns the keyword of a stored flag, or "" for flags with none.
+func flagKeyword(flag string) string {
+	if keyword, ok := systemKeywords[flag]; ok {
+		return keyword
+	}
+	if strings.HasPrefix(flag, `\`) {
+		return ""
+	}
+	return strings.ToLower(flag)
+}
+
+// keywordFlag returns the stored flag of a keyword.
+func keywordFlag(keyword string) string {
+	keyword = strings.ToLower(keyword)
+	for flag, k := range systemKeywords {
+		if k == keyword {
+			return flag
+		}
+	}
+	return keyword
+}
+
+// keywords returns the keywords of a message's flags.
+func keywords(flags []string) map[string]bool {
+	result := make(map[string]bool, len(flags))
+	for _, flag := range flags {
+		if keyword := flagKeyword(flag); keyword != "" {
+			result[keyword] = true
+		}
+	}
+	return result
+}
+
+func hasKeyword(flags []string, keyword string) bool {
+	return keywords(flags)[strings.ToLower(keyword)]
+}
+
+// validKeyword reports whether a keyword may be set (RFC 8621 section 4.1.1).
+func validKeyword(keyword string) bool {
+	if keyword == "" || len(keyword) > 255 {
+		return false
+	}
+	for _, r := range keyword {
+		if r <= ' ' || r > '~' || strings.ContainsRune(`()]{%*"\`, r) {
+			return false
+		}
+	}
+	return true
+}
+
+// applyKeywords returns the flags with the given keywords, keeping flags
+// that have no keyword.
+func applyKeywords(flags []string, set map[string]bool) []string {
+	var result []string
+	for _, flag := range flags {
+		if flagKeyword(flag) == "" {
+			result = append(result, flag)
+		}
+	}
+	names := make([]string, 0, len(set))
+	for keyword, on := range set {
+		if on {
+			names = append(names, keyword)
+		}
+	}
+	sort.Strings(names)
+	for _, keyword := range names {
+		result = append(result, keywordFlag(keyword))
+	}
+	return result
+}
+
+// content is the decrypted form of a message.
+type content struct {
+	parsed *email.ParsedMessage
+	size   int
+}
+
+// content decrypts and parses a message. ok is false when the user's key
+// cannot open it.
+func (c *call) content(msg email.Message) (*content, bool, error) {
+	if cached, ok := c.contents[msg.ID]; ok {
+		return cached, cached != nil, nil
+	}
+	raw, err := c.render(msg)
+	if errors.Is(err, email.ErrSessionKeyNotFound) {
+		c.contents[msg.ID] = nil
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	keys, err := c.readKeysFor()
+	if err != nil {
+		return nil, false, err
+	}
+	parsed, err := email.ParseSecureMIME(raw, keys)
+	if err != nil {
+		// Malformed mail is still listed, just without content
+		parsed = &email.ParsedMessage{}
+	}
+	result := &content{parsed: parsed, size: len(raw)}
+	c.contents[msg.ID] = result
+	return result, true, nil
+}
+
+// Properties returned by Email/get when none are requested.
+var defaultEmailProperties = []string{
+	"id", "blobId", "threadId", "mailboxIds", "keywords", "size", "receivedAt",
+	"messageId", "from", "to", "subject", "sentAt", "preview", "textBody", "htmlBody",
+}
+
+// Properties that need the message decrypted.
+var contentProperties = map[string]bool{
+	"size": true, "messageId": true, "from": true, "to": true, "subject": true,
+	"sentAt": true, "preview": true, "textBody": true, "htmlBody": true, "bodyValues": true,
+}
+
+const previewLength = 256
+
+func addresses(list ...string) []map[string]interface{} {
+	result := []map[string]interface{}{}
+	for _, addr := range list {
+		if addr != "" {
+			result = append(result, map[string]interface{}{"name": nil, "email": addr})
+		}
+	}
+	return result
+}
+
+func preview(body string) string {
+	text := strings.Join(strings.Fields(body), " ")
+	if utf8.RuneCountInString(text) <= previewLength {
+		return text
+	}
+	return string([]rune(text)[:previewLength])
+}
+
+// emailGet implements Email/get. Bodies are exposed as a single text part
+// with ID "1".
+func emailGet(c *call, rawArgs json.RawMessage) (interface{}, error) {
+	var args struct {
+		getArgs
+		FetchTextBodyValues bool `json:"fetchTextBodyValues"`
+		FetchHTMLBodyValues bool `json:"fetchHTMLBodyValues"`
+		FetchAllBodyValues  bool `json:"fetchAllBodyValues"`
+		MaxBodyValueBytes   int  `json:"maxBodyValueBytes"`
+	}
+	if err := c.decodeArgs(rawArgs, &args); err != nil {
+		return nil, err
+	}
+	if args.IDs == nil {
+		return nil, &MethodError{Type: "requestTooLarge", Description: "ids must be given"}
+	}
+	if len(*args.IDs) > maxObjectsInGet {
+		return nil, &MethodError{Type: "requestTooLarge"}
+	}
+	properties := args.Properties
+	if properties == nil {
+		properties = defaultEmailProperties
+	}
+	needContent := false
+	for _, p := range properties {
+		needContent = needContent || contentProperties[p]
+	}
+	fetchValues := args.FetchTextBodyValues || args.FetchHTMLBodyValues || args.FetchAllBodyValues
+
+	state, err := c.state()
+	if err != nil {
+		return nil, err
+	}
+	resp := &getResponse{AccountID: c.ID(), State: state, List: []interface{}{}, NotFound: []string{}}
+
+	var messageIDs []uint
+	for _, id := range *args.IDs {
+		if messageID, ok := parseID(id, emailPrefix); ok {
+			messageIDs = append(messageIDs, messageID)
+		}
+	}
+	messages, err := email.LoadMessages(c.UserID, messageIDs, c.DB)
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[uint]email.Message, len(messages))
+	for _, msg := range messages {
+		byID[msg.ID] = msg
+	}
+	flags, err := email.MessageFlags(c.UserID, messageIDs, c.DB)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, id := range *args.IDs {
+		messageID, _ := parseID(id, emailPrefix)
+		msg, ok := byID[messageID]
+		if !ok {
+			resp.NotFound = append(resp.NotFound, id)
+			continue
+		}
+
+		obj := map[string]interface{}{
+			"id":         id,
+			"blobId":     formatID(blobPrefix, msg.ID),
+			"threadId":   threadID(msg.ID, msg.ConversationID),
+			"keywords":   keywords(flags[msg.ID]),
+			"receivedAt": msg.SentAt.UTC().Format(time.RFC3339),
+		}
+		mailboxIDs := map[string]bool{}
+		for _, mailbox := range email.MessageMailboxes(msg, c.UserID) {
+			mailboxIDs[mailboxID(mailbox)] = true
+		}
+		obj["mailboxIds"] = mailboxIDs
+
+		if needContent {
+			cont, ok, err := c.content(msg)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				resp.NotFound = append(resp.NotFound, id)
+				continue
+			}
+			parsed := cont.parsed
+			sentAt := parsed.Date
+			if sentAt.IsZero() {
+				sentAt = msg.SentAt
+			}
+			part := []map[string]interface{}{{
+				"partId": "1",
+				"blobId": nil,
+				"size":   len(parsed.Body),
+				"type":   "text/plain",
+			}}
+			obj["size"] = cont.size
+			obj["messageId"] = nil
+			if parsed.MessageID != "" {
+				obj["messageId"] = []string{parsed.MessageID}
+			}
+			obj["from"] = addresses(parsed.From)
+			obj["to"] = addresses(parsed.To...)
+			obj["subject"] = parsed.Subject
+			obj["sentAt"] = sentAt.Format(time.RFC3339)
+			// Previewing a burn-after-reading message would reveal its body
+			// without burning it
+			obj["preview"] = ""
+			if !msg.BurnAfterReading || fetchValues {
+				obj["preview"] = preview(parsed.Body)
+			}
+			obj["textBody"] = part
+			obj["htmlBody"] = part
+			bodyValues := map[string]interface{}{}
+			if fetchValues {
+				value, truncated := parsed.Body, false
+				if args.MaxBodyValueBytes > 0 && len(value) > args.MaxBodyValueBytes {
+					value = value[:args.MaxBodyValueBytes]
+					for !utf8.ValidString(value) {
+						value = value[:len(value)-1]
+					}
+					truncated = true
+				}
+				bodyValues["1"] = map[string]interface{}{
+					"value":             value,
+					"isEncodingProblem": false,
+					"isTruncated":       truncated,
+				}
+				if err := email.MarkRead(c.UserID, msg.ID, c.DB); err != nil {
+					return nil, err
+				}
+			}
+			obj["bodyValues"] = bodyValues
+		}
+		resp.List = append(resp.List, selectProperties(obj, properties))
+	}
+	return resp, nil
+}
+
+// emailChanges implements Email/changes.
+func emailChanges(c *call, rawArgs json.RawMessage) (interface{}, error) {
+	changes, err := c.changesSince(rawArgs)
+	if err != nil {
+		return nil, err
+	}
+	return &changesResponse{
+		AccountID:      c.ID(),
+		OldState:       changes.oldState,
+		NewState:       changes.newState,
+		HasMoreChanges: changes.hasMore,
+		Created:        formatIDs(emailPrefix, changes.created),
+		Updated:        formatIDs(emailPrefix, changes.updated),
+		Destroyed:      formatIDs(emailPrefix, changes.destroyed),
+	}, nil
+}
+
+// listedMessage is a message of one of the user's mailboxes.
+type listedMessage struct {
+	email.MailboxMessage
+	mailboxes []string
+}
+
+// listMessages returns the messages of all of the user's mailboxes in ID
+// order. A message the user sent to themselves is listed once.
+func (c *call) listMessages() ([]*listedMessage, error) {
+	byID := make(map[uint]*listedMessage)
+	var result []*listedMessage
+	for _, m := range mailboxes {
+		messages, err := email.ListMailbox(c.UserID, m.store, c.DB)
+		if err != nil {
+			return nil, err
+		}
+		for _, msg := range messages {
+			listed, ok := byID[msg.ID]
+			if !ok {
+				listed = &listedMessage{MailboxMessage: msg}
+				byID[msg.ID] = listed
+				result = append(result, listed)
+			}
+			listed.mailboxes = append(listed.mailboxes, m.store)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].ID < result[j].ID })
+	return result, nil
+}
+
+// emailFilter is an Email/query FilterCondition. Operators are not supported.
+type emailFilter struct {
+	InMailbox          string     `json:"inMailbox"`
+	InMailboxOtherThan []string   `json:"inMailboxOtherThan"`
+	Before             *time.Time `json:"before"`
+	After              *time.Time `json:"after"`
+	HasKeyword         string     `json:"hasKeyword"`
+	NotKeyword         string     `json:"notKeyword"`
+	Text               string     `json:"text"`
+	From               string     `json:"from"`
+	To                 string     `json:"to"`
+	Subject            string     `json:"subject"`
+	Body               string     `json:"body"`
+}
+
+// needsContent reports whether the filter matches decrypted content.
+func (f *emailFilter) needsContent() bool {
+	return f.Text != "" || f.From != "" || f.To != "" || f.Subject != "" || f.Body != ""
+}
+
+func (f *emailFilter) matchSummary(msg *listedMessage) bool {
+	in := func(id string) bool {
+		store, ok := mailboxStore(id)
+		if !ok {
+			return false
+		}
+		for _, mailbox := range msg.mailboxes {
+			if mailbox == store {
+				return true
+			}
+		}
+		return false
+	}
+	if f.InMailbox != "" && !in(f.InMailbox) {
+		return false
+	}
+	if len(f.InMailboxOtherThan) > 0 {
+		other := false
+		for _, m := range mailboxes {
+			excluded := false
+			for _, id := range f.InMailboxOtherThan {
+				excluded = excluded || id == m.id
+			}
+			other = other || (!excluded && in(m.id))
+		}
+		if !other {
+			return false
+		}
+	}
+	if f.Before != nil && !msg.SentAt.Before(*f.Before) {
+		return false
+	}
+	if f.After != nil && msg.SentAt.Before(*f.After) {
+		return false
+	}
+	if f.HasKeyword != "" && !hasKeyword(msg.Flags, f.HasKeyword) {
+		return false
+	}
+	if f.NotKeyword != "" && hasKeyword(msg.Flags, f.NotKeyword) {
+		return false
+	}
+	return true
+}
+
+// matchContent checks the filter against decrypted content. The body of a
+// burn-after-reading message is not searched, so that it is only revealed by
+// reading it.
+func (f *emailFilter) matchContent(parsed *email.ParsedMessage, burnAfterReading bool) bool {
+	contains := func(s, substr string) bool {
+		return substr == "" || strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+	}
+	body := parsed.Body
+	if burnAfterReading {
+		if f.Body != "" {
+			return false
+		}
+		body = ""
+	}
+	to := strings.Join(parsed.To, " ")
+	text := strings.Join([]string{parsed.From, to, parsed.Subject, body}, " ")
+	return contains(parsed.From, f.From) && contains(to, f.To) &&
+		contains(parsed.Subject, f.Subject) && contains(body, f.Body) &&
+		contains(text, f.Text)
+}
+
+type comparator struct {
+	Property    string `json:"property"`
+	IsAscending *bool  `json:"isAscending"`
+}
+
+// emailQuery implements Email/query. Matching on content decrypts each
+// candidate message; messages the user's key cannot open never match.
+// receivedAt and sentAt both sort by the time the message was stored.
+func emailQuery(c *call, rawArgs json.RawMessage) (interface{}, error) {
+	var args struct {
+		accountArgs
+		Filter         json.RawMessage `json:"filter"`
+		Sort           []comparator    `json:"sort"`
+		Position       int             `json:"position"`
+		Limit          *int            `json:"limit"`
+		CalculateTotal bool            `json:"calculateTotal"`
+	}
+	if err := c.decodeArgs(rawArgs, &args); err != nil {
+		return nil, err
+	}
+
+	var filter emailFilter
+	if len(args.Filter) > 0 && string(args.Filter) != "null" {
+		dec := json.NewDecoder(strings.NewReader(string(args.Filter)))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&filter); err != nil {
+			return nil, &MethodError{Type: "unsupportedFilter", Description: err.Error()}
+		}
+	}
+	ascending := false
+	if len(args.Sort) > 1 {
+		return nil, &MethodError{Type: "unsupportedSort", Description: "only one comparator is supported"}
+	}
+	for _, comp := range args.Sort {
+		if comp.Property != "receivedAt" && comp.Property != "sentAt" {
+			return nil, &MethodError{Type: "unsupportedSort", Description: comp.Property}
+		}
+		ascending = comp.IsAscending == nil || *comp.IsAscending
+	}
+	if args.Limit != nil && *args.Limit < 0 {
+		return nil, invalidArguments("limit must not be negative")
+	}
+
+	state, err := c.state()
+	if err != nil {
+		return nil, err
+	}
+	messages, err := c.listMessages()
+	if err != nil {
+		return nil, err
+	}
+
+	var matched []*listedMessage
+	for _, msg := range messages {
+		if !filter.matchSummary(msg) {
+			continue
+		}
+		if filter.needsContent() {
+			full, err := email.LoadMessages(c.UserID, []uint{msg.ID}, c.DB)
+			if err != nil {
+				return nil, err
+			}
+			if len(full) == 0 {
+				continue
+			}
+			cont, ok, err := c.content(full[0])
+			if err != nil {
+				return nil, err
+			}
+			if !ok || !filter.matchContent(cont.parsed, msg.BurnAfterReading) {
+				continue
+			}
+		}
+		matched = append(matched, msg)
+	}
+	sort.SliceStable(matched, func(i, j int) bool {
+		a, b := matched[i], matched[j]
+		if !a.SentAt.Equal(b.SentAt) {
+			return a.SentAt.Before(b.SentAt) == ascending
+		}
+		return (a.ID < b.ID) == ascending
+	})
+
+	position := args.Position
+	if position < 0 {
+		position += len(matched)
+		if position < 0 {
+			position = 0
+		}
+	}
+	if position > len(matched) {
+		position = len(matched)
+	}
+	end := len(matched)
+	if args.Limit != nil && position+*args.Limit < end {
+		end = position + *args.Limit
+	}
+	ids := []string{}
+	for _, msg := range matched[position:end] {
+		ids = append(ids, formatID(emailPrefix, msg.ID))
+	}
+
+	resp := map[string]interface{}{
+		"accountId":           c.ID(),
+		"queryState":          state,
+		"canCalculateChanges": false,
+		"position":            position,
+		"ids":                 ids,
+	}
+	if args.CalculateTotal {
+		resp["total"] = len(matched)
+	}
+	return resp, nil
+}
+
+// draft is an email created with Email/set. Drafts are not stored: they
+// only live for the rest of the request, which must submit them.
+type draft struct {
+	to      []string
+	subject string
+	body    string
+	// sent is the message a submission turned the draft into.
+	sent uint
+}
+
+type setResponse struct {
+	AccountID    string                 `json:"accountId"`
+	OldState     string                 `json:"oldState"`
+	NewState     string                 `json:"newState"`
+	Created      map[string]interface{} `json:"created"`
+	Updated      map[string]interface{} `json:"updated"`
+	Destroyed    []string               `json:"destroyed"`
+	NotCreated   map[string]*SetError   `json:"notCreated"`
+	NotUpdated   map[string]*SetError   `json:"notUpdated"`
+	NotDestroyed map[string]*SetError   `json:"notDestroyed"`
+}
+
+type setArgs struct {
+	accountArgs
+	IfInState *string                               `json:"ifInState"`
+	Create    map[string]json.RawMessage            `json:"create"`
+	Update    map[string]map[string]json.RawMessage `json:"update"`
+	Destroy   []string                              `json:"destroy"`
+}
+
+// decodeSetArgs decodes /set arguments, checking ifInState and the number of
+// objects against maxObjectsInSet.
+func (c *call) decodeSetArgs(rawArgs json.RawMessage, state string) (*setArgs, error) {
+	var args setArgs
+	if err := c.decodeArgs(rawArgs, &args); err != nil {
+		return nil, err
+	}
+	if len(args.Create)+len(args.Update)+len(args.Destroy) > maxObjectsInSet {
+		return nil, &MethodError{Type: "requestTooLarge"}
+	}
+	if args.IfInState != nil && *args.IfInState != state {
+		return nil, &MethodError{Type: "stateMismatch"}
+	}
+	return &args, nil
+}
+
+func newSetResponse(accountID, state string) *setResponse {
+	return &setResponse{
+		AccountID:    accountID,
+		OldState:     state,
+		NewState:     state,
+		Created:      map[string]interface{}{},
+		Updated:      map[string]interface{}{},
+		Destroyed:    []string{},
+		NotCreated:   map[string]*SetError{},
+		NotUpdated:   map[string]*SetError{},
+		NotDestroyed: map[string]*SetError{},
+	}
+}
+
+// resolveEmailID resolves a creation reference and maps submitted drafts to
+// the messages they became.
+func (c *call) resolveEmailID(id string) string {
+	if strings.HasPrefix(id, "#") {
+		if created, ok := c.createdIDs[id[1:]]; ok {
+			id = created
+		}
+	}
+	if d, ok := c.drafts[id]; ok && d.sent != 0 {
+		return formatID(emailPrefix, d.sent)
+	}
+	return id
+}
+
+// emailSet implements Email/set. Stored messages are immutable apart from
+// their keywords and cannot be destroyed; created emails become drafts for
+// EmailSubmission/set.
+func emailSet(c *call, rawArgs json.RawMessage) (interface{}, error) {
+	state, err := c.state()
+	if err != nil {
+		return nil, err
+	}
+	args, err := c.decodeSetArgs(rawArgs, state)
+	if err != nil {
+		return nil, err
+	}
+	resp := newSetResponse(c.ID(), state)
+
+	for creationID, raw := range args.Create {
+		d, setErr := parseDraft(raw)
+		if setErr != nil {
+			resp.NotCreated[creationID] = setErr
+			continue
+		}
+		id := formatID(draftPrefix, uint(len(c.drafts)+1))
+		c.drafts[id] = d
+		c.createdIDs[creationID] = id
+		resp.Created[creationID] = map[string]interface{}{
+			"id":       id,
+			"blobId":   nil,
+			"threadId": nil,
+			"size":     len(d.body),
+		}
+	}
+
+	for id, patch := range args.Update {
+		if setErr := c.updateEmail(c.resolveEmailID(id), patch); setErr != nil {
+			resp.NotUpdated[id] = setErr
+			continue
+		}
+		resp.Updated[id] = nil
+	}
+
+	for _, id := range args.Destroy {
+		resolved := id
+		if strings.HasPrefix(id, "#") {
+			resolved = c.createdIDs[id[1:]]
+		}
+		if _, ok := c.drafts[resolved]; ok {
+			delete(c.drafts, resolved)
+			resp.Destroyed = append(resp.Destroyed, id)
+			continue
+		}
+		if _, ok := parseID(resolved, emailPrefix); ok {
+			resp.NotDestroyed[id] = &SetError{Type: "forbidden", Description: "Messages cannot be deleted"}
+			continue
+		}
+		resp.NotDestroyed[id] = &SetError{Type: "notFound"}
+	}
+
+	if resp.NewState, err = c.state(); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// parseDraft reads the recipients, subject and text body of a created email.
+func parseDraft(raw json.RawMessage) (*draft, *SetError) {
+	var obj struct {
+		To       []struct{ Email string } `json:"to"`
+		Subject  string                   `json:"subject"`
+		TextBody []struct {
+			PartID string `json:"partId"`
+		} `json:"textBody"`
+		BodyValues map[string]struct {
+			Value string `json:"value"`
+		} `json:"bodyValues"`
+	}
+	if err := json.Unmarshal(raw, &obj); err != nil {
+		return nil, &SetError{Type: "invalidProperties", Description: err.Error()}
+	}
+	if len(obj.TextBody) != 1 {
+		return nil, &SetError{Type: "invalidProperties", Description: "exactly one text body part is required", Properties: []string{"textBody"}}
+	}
+	value, ok := obj.BodyValues[obj.TextBody[0].PartID]
+	if !ok {
+		return nil, &SetError{Type: "invalidProperties", Description: "text body part has no value", Properties: []string{"bodyValues"}}
+	}
+	d := &draft{subject: obj.Subject, body: value.Value}
+	for _, addr := range obj.To {
+		d.to = append(d.to, addr.Email)
+	}
+	return d, nil
+}
+
+// updateEmail applies an Email/set patch to a stored message. Only keywords
+// can change; mailboxIds patches are accepted and ignored since a message's
+// mailboxes follow from who sent and received it.
+func (c *call) updateEmail(id string, patch map[string]json.RawMessage) *SetError {
+	messageID, ok := parseID(id, emailPrefix)
+	if !ok {
+		return &SetError{Type: "notFound"}
+	}
+	messages, err := email.LoadMessages(c.UserID, []uint{messageID}, c.DB)
+	if err != nil {
+		return &SetError{Type: "serverFail", Description: err.Error()}
+	}
+	if len(messages) == 0 {
+		return &SetError{Type: "notFound"}
+	}
+	flags, err := email.MessageFlags(c.UserID, []uint{messageID}, c.DB)
+	if err != nil {
+		return &SetError{Type: "serverFail", Description: err.Error()}
+	}
+
+	set := keywords(flags[messageID])
+	for property, value := range patch {
+		switch {
+		case property == "keywords":
+			var replaced map[string]bool
+			if err := json.Unmarshal(value, &replaced); err != nil {
+				return &SetError{Type: "invalidProperties", Properties: []string{property}}
+			}
+			set = make(map[string]bool, len(replaced))
+			for keyword, on := range replaced {
+				if !on || !validKeyword(keyword) {
+					return &SetError{Type: "invalidProperties", Properties: []string{property}}
+				}
+				set[strings.ToLower(keyword)] = true
+			}
+		case strings.HasPrefix(property, "keywords/"):
+			keyword := strings.ToLower(strings.TrimPrefix(property, "keywords/"))
+			if !validKeyword(keyword) {
+				return &SetError{Type: "invalidProperties", Properties: []string{property}}
+			}
+			switch string(value) {
+			case "true":
+				set[keyword] = true
+			case "null":
+				delete(set, keyword)
+			default:
+				return &SetError{Type: "invalidProperties", Properties: []string{property}}
+			}
+		case property == "mailboxIds", strings.HasPrefix(property, "mailboxIds/"):
+		default:
+			return &SetError{Type: "invalidProperties", Description: "only keywords can be changed", Properties: []string{property}}
+		}
+	}
+
+	if err := email.SetMessageFlags(c.UserID, messageID, applyKeywords(flags[messageID], set), c.DB); err != nil {
+		return &SetError{Type: "serverFail", Description: err.Error()}
+	}
+	return nil
+}
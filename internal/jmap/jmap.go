@@ -0,0 +1,413 @@
+// Package jmap implements the JMAP core (RFC 8620) and mail (RFC 8621)
+// protocols over the encrypted message store.
+package jmap
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"secmail/internal/email"
+	"secmail/internal/relay"
+	"strconv"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// Capabilities supported by the server.
+const (
+	CapabilityCore       = "urn:ietf:params:jmap:core"
+	CapabilityMail       = "urn:ietf:params:jmap:mail"
+	CapabilitySubmission = "urn:ietf:params:jmap:submission"
+)
+
+// Limits advertised in the core capability.
+const (
+	MaxSizeRequest    = 10 << 20
+	maxCallsInRequest = 16
+	maxObjectsInGet   = 256
+	maxObjectsInSet   = 128
+)
+
+// sessionState identifies the session resource; it only changes when the
+// capabilities or accounts of a session do.
+const sessionState = "1"
+
+// Request is a JMAP API request.
+type Request struct {
+	Using       []string          `json:"using"`
+	MethodCalls []Invocation      `json:"methodCalls"`
+	CreatedIDs  map[string]string `json:"createdIds,omitempty"`
+}
+
+// Response is a JMAP API response.
+type Response struct {
+	MethodResponses []Invocation      `json:"methodResponses"`
+	CreatedIDs      map[string]string `json:"createdIds,omitempty"`
+	SessionState    string            `json:"sessionState"`
+}
+
+// Invocation is a method call or response, encoded as a [name, arguments,
+// call ID] triple.
+type Invocation struct {
+	Name   string
+	Args   json.RawMessage
+	CallID string
+}
+
+func (inv Invocation) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]interface{}{inv.Name, inv.Args, inv.CallID})
+}
+
+func (inv *Invocation) UnmarshalJSON(data []byte) error {
+	var triple []json.RawMessage
+	if err := json.Unmarshal(data, &triple); err != nil {
+		return err
+	}
+	if len(triple) != 3 {
+		return errors.New("invocation must have 3 elements")
+	}
+	if err := json.Unmarshal(triple[0], &inv.Name); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(triple[2], &inv.CallID); err != nil {
+		return err
+	}
+	inv.Args = triple[1]
+	return nil
+}
+
+// RequestError is a request-level error, sent as RFC 7807 problem details.
+type RequestError struct {
+	Type   string `json:"type"`
+	Status int    `json:"status"`
+	Detail string `json:"detail"`
+	Limit  string `json:"limit,omitempty"`
+}
+
+func (e *RequestError) Error() string {
+	return e.Detail
+}
+
+// MethodError is an error response to a single method call.
+type MethodError struct {
+	Type        string `json:"type"`
+	Description string `json:"description,omitempty"`
+}
+
+func (e *MethodError) Error() string {
+	return e.Type + ": " + e.Description
+}
+
+func invalidArguments(description string) *MethodError {
+	return &MethodError{Type: "invalidArguments", Description: description}
+}
+
+// SetError describes why one object of a /set call was not changed.
+type SetError struct {
+	Type        string   `json:"type"`
+	Description string   `json:"description,omitempty"`
+	Properties  []string `json:"properties,omitempty"`
+}
+
+// Account is the authenticated user a JMAP request runs as. PrivateKey is
+// the user's unwrapped key, used to decrypt messages.
+type Account struct {
+	DB         *gorm.DB
+	Queue      *relay.Queue
+	UserID     uint
+	PrivateKey []byte
+}
+
+// ID returns the JMAP account ID.
+func (a *Account) ID() string {
+	return "A" + strconv.FormatUint(uint64(a.UserID), 10)
+}
+
+// method handles one method call, returning its response arguments.
+type method func(c *call, args json.RawMessage) (interface{}, error)
+
+var methods map[string]method
+
+func init() {
+	methods = map[string]method{
+		"Core/echo":           coreEcho,
+		"Mailbox/get":         mailboxGet,
+		"Mailbox/changes":     mailboxChanges,
+		"Mailbox/query":       mailboxQuery,
+		"Email/get":           emailGet,
+		"Email/changes":       emailChanges,
+		"Email/query":         emailQuery,
+		"Email/set":           emailSet,
+		"Thread/get":          threadGet,
+		"Thread/changes":      threadChanges,
+		"Identity/get":        identityGet,
+		"EmailSubmission/get": submissionGet,
+		"EmailSubmission/set": submissionSet,
+	}
+}
+
+// call holds the state shared by the method calls of one request.
+type call struct {
+	*Account
+	using      map[string]bool
+	createdIDs map[string]string
+	drafts     map[string]*draft
+	contents   map[uint]*content
+	responses  []Invocation
+	readKeys   *email.ReadKeys
+	// implicit holds the arguments of an Email/set call requested by the
+	// previous method, run right after it.
+	implicit json.RawMessage
+}
+
+// Handle runs the method calls of a request in order.
+func (a *Account) Handle(req *Request) (*Response, error) {
+	using := make(map[string]bool, len(req.Using))
+	for _, capability := range req.Using {
+		switch capability {
+		case CapabilityCore, CapabilityMail, CapabilitySubmission:
+			using[capability] = true
+		default:
+			return nil, &RequestError{
+				Type:   "urn:ietf:params:jmap:error:unknownCapability",
+				Status: http.StatusBadRequest,
+				Detail: "Unknown capability " + capability,
+			}
+		}
+	}
+	if len(req.MethodCalls) > maxCallsInRequest {
+		return nil, &RequestError{
+			Type:   "urn:ietf:params:jmap:error:limit",
+			Status: http.StatusBadRequest,
+			Detail: fmt.Sprintf("At most %d method calls are allowed per request", maxCallsInRequest),
+			Limit:  "maxCallsInRequest",
+		}
+	}
+
+	c := &call{
+		Account:    a,
+		using:      using,
+		createdIDs: make(map[string]string),
+		drafts:     make(map[string]*draft),
+		contents:   make(map[uint]*content),
+	}
+	for id, created := range req.CreatedIDs {
+		c.createdIDs[id] = created
+	}
+
+	for _, inv := range req.MethodCalls {
+		result, err := c.invoke(inv)
+		var methodErr *MethodError
+		if errors.As(err, &methodErr) {
+			c.respond("error", methodErr, inv.CallID)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		c.respond(inv.Name, result, inv.CallID)
+
+		if c.implicit != nil {
+			args := c.implicit
+			c.implicit = nil
+			result, err := emailSet(c, args)
+			if err != nil {
+				return nil, err
+			}
+			c.respond("Email/set", result, inv.CallID)
+		}
+	}
+
+	resp := &Response{MethodResponses: c.responses, SessionState: sessionState}
+	if req.CreatedIDs != nil {
+		resp.CreatedIDs = c.createdIDs
+	}
+	return resp, nil
+}
+
+func (c *call) invoke(inv Invocation) (interface{}, error) {
+	m, ok := methods[inv.Name]
+	if !ok {
+		return nil, &MethodError{Type: "unknownMethod", Description: inv.Name}
+	}
+	capability := CapabilityMail
+	switch {
+	case strings.HasPrefix(inv.Name, "Core/"):
+		capability = CapabilityCore
+	case strings.HasPrefix(inv.Name, "Identity/"), strings.HasPrefix(inv.Name, "EmailSubmission/"):
+		capability = CapabilitySubmission
+	}
+	if !c.using[capability] {
+		return nil, &MethodError{Type: "unknownMethod", Description: inv.Name + " requires " + capability}
+	}
+
+	args, err := c.resolveReferences(inv.Args)
+	if err != nil {
+		return nil, err
+	}
+	return m(c, args)
+}
+
+// respond appends a method response. Responses are kept encoded so later
+// calls can reference them.
+func (c *call) respond(name string, result interface{}, callID string) {
+	data, err := json.Marshal(result)
+	if err != nil {
+		name = "error"
+		data, _ = json.Marshal(&MethodError{Type: "serverFail", Description: err.Error()})
+	}
+	c.responses = append(c.responses, Invocation{Name: name, Args: data, CallID: callID})
+}
+
+// checkAccount reports an error unless accountID is the user's account.
+func (c *call) checkAccount(accountID string) error {
+	if accountID != c.ID() {
+		return &MethodError{Type: "accountNotFound"}
+	}
+	return nil
+}
+
+// decodeArgs unmarshals method arguments and checks the account ID.
+func (c *call) decodeArgs(args json.RawMessage, v interface{ account() string }) error {
+	if err := json.Unmarshal(args, v); err != nil {
+		return invalidArguments(err.Error())
+	}
+	return c.checkAccount(v.account())
+}
+
+// accountArgs is embedded in the arguments of every method on an account.
+type accountArgs struct {
+	AccountID string `json:"accountId"`
+}
+
+func (a accountArgs) account() string {
+	return a.AccountID
+}
+
+// resultReference points to part of an earlier method response (RFC 8620
+// section 3.7).
+type resultReference struct {
+	ResultOf string `json:"resultOf"`
+	Name     string `json:"name"`
+	Path     string `json:"path"`
+}
+
+// resolveReferences replaces "#name" arguments with the values they refer to.
+func (c *call) resolveReferences(args json.RawMessage) (json.RawMessage, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(args, &fields); err != nil {
+		return nil, invalidArguments("arguments must be an object")
+	}
+
+	resolved := false
+	for key, value := range fields {
+		if !strings.HasPrefix(key, "#") {
+			continue
+		}
+		name := key[1:]
+		if _, ok := fields[name]; ok {
+			return nil, invalidArguments("both " + name + " and " + key + " are set")
+		}
+		var ref resultReference
+		if err := json.Unmarshal(value, &ref); err != nil {
+			return nil, &MethodError{Type: "invalidResultReference", Description: err.Error()}
+		}
+		result, err := c.lookupReference(ref)
+		if err != nil {
+			return nil, err
+		}
+		fields[name] = result
+		delete(fields, key)
+		resolved = true
+	}
+	if !resolved {
+		return args, nil
+	}
+	return json.Marshal(fields)
+}
+
+func (c *call) lookupReference(ref resultReference) (json.RawMessage, error) {
+	for _, resp := range c.responses {
+		if resp.CallID != ref.ResultOf || resp.Name != ref.Name {
+			continue
+		}
+		var doc interface{}
+		if err := json.Unmarshal(resp.Args, &doc); err != nil {
+			return nil, err
+		}
+		value, err := evaluatePointer(doc, ref.Path)
+		if err != nil {
+			return nil, &MethodError{Type: "invalidResultReference", Description: err.Error()}
+		}
+		return json.Marshal(value)
+	}
+	return nil, &MethodError{Type: "invalidResultReference", Description: "no response " + ref.Name + " for call " + ref.ResultOf}
+}
+
+// evaluatePointer evaluates a JSON Pointer with the JMAP "*" extension: "*"
+// maps the rest of the path over an array, flattening nested arrays.
+func evaluatePointer(doc interface{}, path string) (interface{}, error) {
+	if path == "" {
+		return doc, nil
+	}
+	if !strings.HasPrefix(path, "/") {
+		return nil, errors.New("path must start with /")
+	}
+	token, rest := path[1:], ""
+	if i := strings.IndexByte(token, '/'); i >= 0 {
+		token, rest = token[:i], token[i:]
+	}
+	token = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+
+	switch node := doc.(type) {
+	case map[string]interface{}:
+		value, ok := node[token]
+		if !ok {
+			return nil, errors.New("no property " + token)
+		}
+		return evaluatePointer(value, rest)
+	case []interface{}:
+		if token == "*" {
+			result := []interface{}{}
+			for _, item := range node {
+				value, err := evaluatePointer(item, rest)
+				if err != nil {
+					return nil, err
+				}
+				if values, ok := value.([]interface{}); ok {
+					result = append(result, values...)
+				} else {
+					result = append(result, value)
+				}
+			}
+			return result, nil
+		}
+		i, err := strconv.Atoi(token)
+		if err != nil || i < 0 || i >= len(node) {
+			return nil, errors.New("invalid array index " + token)
+		}
+		return evaluatePointer(node[i], rest)
+	default:
+		return nil, errors.New("cannot evaluate " + token + " on a scalar")
+	}
+}
+
+// coreEcho implements Core/echo.
+func coreEcho(c *call, args json.RawMessage) (interface{}, error) {
+	return args, nil
+}
+
+// readKeysFor returns the user's keys for reading PGP/MIME and S/MIME
+// messages, loading them on first use.
+func (c *call) readKeysFor() (*email.ReadKeys, error) {
+	if c.readKeys == nil {
+		keys, err := email.LoadReadKeys(c.UserID, c.PrivateKey, c.DB)
+		if err != nil {
+			return nil, err
+		}
+		c.readKeys = keys
+	}
+	return c.readKeys, nil
+}
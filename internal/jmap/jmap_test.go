@@ -0,0 +1,155 @@
+package jmap
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"secmail/internal/email"
+	"secmail/internal/models"
+	"testing"
+)
+
+func TestInvocationJSON(t *testing.T) {
+	var inv Invocation
+	if err := json.Unmarshal([]byte(`["Email/get", {"accountId": "A1"}, "c1"]`), &inv); err != nil {
+		t.Fatalf("Failed to unmarshal invocation: %v", err)
+	}
+	if inv.Name != "Email/get" || inv.CallID != "c1" || string(inv.Args) != `{"accountId": "A1"}` {
+		t.Errorf("Unexpected invocation: %+v", inv)
+	}
+
+	data, err := json.Marshal(inv)
+	if err != nil {
+		t.Fatalf("Failed to marshal invocation: %v", err)
+	}
+	if string(data) != `["Email/get",{"accountId":"A1"},"c1"]` {
+		t.Errorf("Unexpected encoding: %s", data)
+	}
+
+	if err := json.Unmarshal([]byte(`["Email/get", {}]`), &inv); err == nil {
+		t.Error("Invocation with 2 elements should fail to unmarshal")
+	}
+}
+
+func TestHandle(t *testing.T) {
+	account := &Account{UserID: 1}
+	req := &Request{
+		Using: []string{CapabilityCore},
+		MethodCalls: []Invocation{
+			{Name: "Core/echo", Args: json.RawMessage(`{"hello": [1, 2]}`), CallID: "c1"},
+			{Name: "Core/echo", Args: json.RawMessage(`{"#value": {"resultOf": "c1", "name": "Core/echo", "path": "/hello/1"}}`), CallID: "c2"},
+			{Name: "Mailbox/get", Args: json.RawMessage(`{"accountId": "A1"}`), CallID: "c3"},
+			{Name: "Foo/bar", Args: json.RawMessage(`{}`), CallID: "c4"},
+		},
+	}
+	resp, err := account.Handle(req)
+	if err != nil {
+		t.Fatalf("Failed to handle request: %v", err)
+	}
+	if len(resp.MethodResponses) != 4 {
+		t.Fatalf("Expected 4 responses, got %d", len(resp.MethodResponses))
+	}
+
+	if got := resp.MethodResponses[1]; got.Name != "Core/echo" || string(got.Args) != `{"value":2}` {
+		t.Errorf("Unexpected resolved reference: %s %s", got.Name, got.Args)
+	}
+	// Mail methods need the mail capability in using
+	for _, i := range []int{2, 3} {
+		got := resp.MethodResponses[i]
+		var methodErr MethodError
+		if err := json.Unmarshal(got.Args, &methodErr); err != nil {
+			t.Fatalf("Failed to decode error: %v", err)
+		}
+		if got.Name != "error" || methodErr.Type != "unknownMethod" {
+			t.Errorf("Expected unknownMethod for %s, got %s %s", got.CallID, got.Name, got.Args)
+		}
+	}
+
+	_, err = account.Handle(&Request{Using: []string{"urn:example:unknown"}})
+	var reqErr *RequestError
+	if !errors.As(err, &reqErr) || reqErr.Type != "urn:ietf:params:jmap:error:unknownCapability" {
+		t.Errorf("Expected unknownCapability, got %v", err)
+	}
+}
+
+func TestEvaluatePointer(t *testing.T) {
+	var doc interface{}
+	if err := json.Unmarshal([]byte(`{"list": [{"emailIds": ["M1", "M2"]}, {"emailIds": ["M3"]}], "a/b": 1}`), &doc); err != nil {
+		t.Fatalf("Failed to unmarshal document: %v", err)
+	}
+
+	value, err := evaluatePointer(doc, "/list/*/emailIds")
+	if err != nil {
+		t.Fatalf("Failed to evaluate pointer: %v", err)
+	}
+	if !reflect.DeepEqual(value, []interface{}{"M1", "M2", "M3"}) {
+		t.Errorf("Unexpected value: %v", value)
+	}
+
+	value, err = evaluatePointer(doc, "/a~1b")
+	if err != nil || value != float64(1) {
+		t.Errorf("Unexpected value for escaped token: %v, %v", value, err)
+	}
+
+	if _, err := evaluatePointer(doc, "/list/5"); err == nil {
+		t.Error("Out of range index should fail")
+	}
+}
+
+func TestCollapseChanges(t *testing.T) {
+	changes := []models.MessageChange{
+		{MessageID: 1, Kind: email.ChangeCreated},
+		{MessageID: 2, Kind: email.ChangeUpdated},
+		{MessageID: 1, Kind: email.ChangeUpdated},
+		{MessageID: 3, Kind: email.ChangeCreated},
+		{MessageID: 3, Kind: email.ChangeDestroyed},
+		{MessageID: 2, Kind: email.ChangeDestroyed},
+	}
+	created, updated, destroyed := collapseChanges(changes)
+	if !reflect.DeepEqual(created, []uint{1}) || len(updated) != 0 || !reflect.DeepEqual(destroyed, []uint{2}) {
+		t.Errorf("Unexpected changes: created %v, updated %v, destroyed %v", created, updated, destroyed)
+	}
+}
+
+func TestKeywords(t *testing.T) {
+	flags := []string{`\Seen`, `\Deleted`, "$Forwarded"}
+	got := keywords(flags)
+	if !reflect.DeepEqual(got, map[string]bool{"$seen": true, "$forwarded": true}) {
+		t.Errorf("Unexpected keywords: %v", got)
+	}
+
+	// \Deleted has no keyword, so it survives replacing the keywords
+	updated := applyKeywords(flags, map[string]bool{"$flagged": true, "$draft": true})
+	if !reflect.DeepEqual(updated, []string{`\Deleted`, `\Draft`, `\Flagged`}) {
+		t.Errorf("Unexpected flags: %v", updated)
+	}
+
+	if validKeyword("bad keyword") || validKeyword(`\Seen`) || !validKeyword("$junk") {
+		t.Error("Unexpected keyword validation result")
+	}
+}
+
+func TestFilterMatchContent(t *testing.T) {
+	parsed := &email.ParsedMessage{From: "bob@secmail.test", Subject: "Door code", Body: "It is 4711"}
+	tests := []struct {
+		name             string
+		filter           emailFilter
+		burnAfterReading bool
+		want             bool
+	}{
+		{"subject", emailFilter{Subject: "door"}, false, true},
+		{"body", emailFilter{Body: "4711"}, false, true},
+		{"text in body", emailFilter{Text: "4711"}, false, true},
+		{"burn after reading subject", emailFilter{Subject: "door"}, true, true},
+		{"burn after reading text in subject", emailFilter{Text: "code"}, true, true},
+		{"burn after reading body", emailFilter{Body: "4711"}, true, false},
+		{"burn after reading text in body", emailFilter{Text: "4711"}, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.filter.matchContent(parsed, tt.burnAfterReading); got != tt.want {
+				t.Errorf("Expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,223 @@
+package jmap
+
+import (
+	"encoding/json"
+	"secmail/internal/email"
+)
+
+// mailboxes maps the JMAP mailboxes to the store's. Each has the role of the
+// same name.
+var mailboxes = []struct {
+	id, name, role, store string
+}{
+	{"inbox", "Inbox", "inbox", email.MailboxInbox},
+	{"sent", "Sent", "sent", email.MailboxSent},
+}
+
+// mailboxStore returns the store mailbox behind a JMAP mailbox ID.
+func mailboxStore(id string) (string, bool) {
+	for _, m := range mailboxes {
+		if m.id == id {
+			return m.store, true
+		}
+	}
+	return "", false
+}
+
+// mailboxID returns the JMAP mailbox ID of a store mailbox.
+func mailboxID(store string) string {
+	for _, m := range mailboxes {
+		if m.store == store {
+			return m.id
+		}
+	}
+	return ""
+}
+
+type getArgs struct {
+	accountArgs
+	IDs        *[]string `json:"ids"`
+	Properties []string  `json:"properties"`
+}
+
+type getResponse struct {
+	AccountID string        `json:"accountId"`
+	State     string        `json:"state"`
+	List      []interface{} `json:"list"`
+	NotFound  []string      `json:"notFound"`
+}
+
+// decodeGetArgs decodes /get arguments and checks the number of IDs against
+// maxObjectsInGet.
+func (c *call) decodeGetArgs(rawArgs json.RawMessage) (*getArgs, error) {
+	var args getArgs
+	if err := c.decodeArgs(rawArgs, &args); err != nil {
+		return nil, err
+	}
+	if args.IDs != nil && len(*args.IDs) > maxObjectsInGet {
+		return nil, &MethodError{Type: "requestTooLarge"}
+	}
+	return &args, nil
+}
+
+// selectProperties drops the properties of obj not listed in properties; the
+// id is always kept. A nil list keeps everything.
+func selectProperties(obj map[string]interface{}, properties []string) map[string]interface{} {
+	if properties == nil {
+		return obj
+	}
+	selected := map[string]interface{}{"id": obj["id"]}
+	for _, p := range properties {
+		if value, ok := obj[p]; ok {
+			selected[p] = value
+		}
+	}
+	return selected
+}
+
+// mailboxGet implements Mailbox/get.
+func mailboxGet(c *call, rawArgs json.RawMessage) (interface{}, error) {
+	args, err := c.decodeGetArgs(rawArgs)
+	if err != nil {
+		return nil, err
+	}
+	state, err := c.state()
+	if err != nil {
+		return nil, err
+	}
+
+	ids := []string{}
+	if args.IDs == nil {
+		for _, m := range mailboxes {
+			ids = append(ids, m.id)
+		}
+	} else {
+		ids = *args.IDs
+	}
+
+	resp := &getResponse{AccountID: c.ID(), State: state, List: []interface{}{}, NotFound: []string{}}
+	for _, id := range ids {
+		obj, err := c.mailbox(id)
+		if err != nil {
+			return nil, err
+		}
+		if obj == nil {
+			resp.NotFound = append(resp.NotFound, id)
+			continue
+		}
+		resp.List = append(resp.List, selectProperties(obj, args.Properties))
+	}
+	return resp, nil
+}
+
+// mailbox returns a Mailbox object, or nil when id is unknown.
+func (c *call) mailbox(id string) (map[string]interface{}, error) {
+	for i, m := range mailboxes {
+		if m.id != id {
+			continue
+		}
+		messages, err := email.ListMailbox(c.UserID, m.store, c.DB)
+		if err != nil {
+			return nil, err
+		}
+		threads := make(map[string]bool)
+		unreadThreads := make(map[string]bool)
+		unread := 0
+		for _, msg := range messages {
+			thread := threadID(msg.ID, msg.ConversationID)
+			threads[thread] = true
+			if !hasKeyword(msg.Flags, "$seen") {
+				unread++
+				unreadThreads[thread] = true
+			}
+		}
+		return map[string]interface{}{
+			"id":            m.id,
+			"name":          m.name,
+			"parentId":      nil,
+			"role":          m.role,
+			"sortOrder":     i + 1,
+			"totalEmails":   len(messages),
+			"unreadEmails":  unread,
+			"totalThreads":  len(threads),
+			"unreadThreads": len(unreadThreads),
+			"myRights": map[string]bool{
+				"mayReadItems":   true,
+				"mayAddItems":    false,
+				"mayRemoveItems": false,
+				"maySetSeen":     true,
+				"maySetKeywords": true,
+				"mayCreateChild": false,
+				"mayRename":      false,
+				"mayDelete":      false,
+				"maySubmit":      false,
+			},
+			"isSubscribed": true,
+		}, nil
+	}
+	return nil, nil
+}
+
+// mailboxChanges implements Mailbox/changes. The mailboxes themselves never
+// change; any message change updates their counts.
+func mailboxChanges(c *call, rawArgs json.RawMessage) (interface{}, error) {
+	changes, err := c.changesSince(rawArgs)
+	if err != nil {
+		return nil, err
+	}
+	resp := struct {
+		changesResponse
+		UpdatedProperties []string `json:"updatedProperties"`
+	}{
+		changesResponse: changesResponse{
+			AccountID: c.ID(),
+			OldState:  changes.oldState,
+			NewState:  changes.newState,
+			Created:   []string{},
+			Updated:   []string{},
+			Destroyed: []string{},
+		},
+	}
+	if changes.oldState != changes.newState {
+		for _, m := range mailboxes {
+			resp.Updated = append(resp.Updated, m.id)
+		}
+		resp.UpdatedProperties = []string{"totalEmails", "unreadEmails", "totalThreads", "unreadThreads"}
+	}
+	return resp, nil
+}
+
+// mailboxQuery implements Mailbox/query. Filters and sorts are not
+// supported; the mailboxes are always returned in sortOrder.
+func mailboxQuery(c *call, rawArgs json.RawMessage) (interface{}, error) {
+	var args struct {
+		accountArgs
+		Filter json.RawMessage `json:"filter"`
+		Sort   json.RawMessage `json:"sort"`
+	}
+	if err := c.decodeArgs(rawArgs, &args); err != nil {
+		return nil, err
+	}
+	if len(args.Filter) > 0 && string(args.Filter) != "null" {
+		return nil, &MethodError{Type: "unsupportedFilter"}
+	}
+	if len(args.Sort) > 0 && string(args.Sort) != "null" {
+		return nil, &MethodError{Type: "unsupportedSort"}
+	}
+	state, err := c.state()
+	if err != nil {
+		return nil, err
+	}
+	ids := []string{}
+	for _, m := range mailboxes {
+		ids = append(ids, m.id)
+	}
+	return map[string]interface{}{
+		"accountId":           c.ID(),
+		"queryState":          state,
+		"canCalculateChanges": false,
+		"position":            0,
+		"ids":                 ids,
+		"total":               len(ids),
+	}, nil
+}
@@ -0,0 +1,176 @@
+package jmap
+
+import (
+	"errors"
+	"secmail/internal/email"
+	"strconv"
+
+	"gorm.io/gorm"
+)
+
+var ErrBlobNotFound = errors.New("blob not found")
+
+// Session is the JMAP session resource (RFC 8620 section 2).
+type Session struct {
+	Capabilities    map[string]interface{}    `json:"capabilities"`
+	Accounts        map[string]SessionAccount `json:"accounts"`
+	PrimaryAccounts map[string]string         `json:"primaryAccounts"`
+	Username        string                    `json:"username"`
+	APIURL          string                    `json:"apiUrl"`
+	DownloadURL     string                    `json:"downloadUrl"`
+	UploadURL       string                    `json:"uploadUrl"`
+	EventSourceURL  string                    `json:"eventSourceUrl"`
+	State           string                    `json:"state"`
+}
+
+// SessionAccount describes an account available in a session.
+type SessionAccount struct {
+	Name                string                 `json:"name"`
+	IsPersonal          bool                   `json:"isPersonal"`
+	IsReadOnly          bool                   `json:"isReadOnly"`
+	AccountCapabilities map[string]interface{} `json:"accountCapabilities"`
+}
+
+// NewSession returns the session resource of a user. baseURL is where the
+// API is reachable. Uploads and push are not supported, so their URLs are
+// advertised as required but not served.
+func NewSession(account *Account, username, baseURL string) *Session {
+	accountID := account.ID()
+	return &Session{
+		Capabilities: map[string]interface{}{
+			CapabilityCore: map[string]interface{}{
+				"maxSizeUpload":         0,
+				"maxConcurrentUpload":   1,
+				"maxSizeRequest":        MaxSizeRequest,
+				"maxConcurrentRequests": 4,
+				"maxCallsInRequest":     maxCallsInRequest,
+				"maxObjectsInGet":       maxObjectsInGet,
+				"maxObjectsInSet":       maxObjectsInSet,
+				"collationAlgorithms":   []string{},
+			},
+			CapabilityMail:       map[string]interface{}{},
+			CapabilitySubmission: map[string]interface{}{},
+		},
+		Accounts: map[string]SessionAccount{
+			accountID: {
+				Name:       username,
+				IsPersonal: true,
+				AccountCapabilities: map[string]interface{}{
+					CapabilityMail: map[string]interface{}{
+						"maxMailboxesPerEmail":       nil,
+						"maxMailboxDepth":            1,
+						"maxSizeMailboxName":         255,
+						"maxSizeAttachmentsPerEmail": 0,
+						"emailQuerySortOptions":      []string{"receivedAt", "sentAt"},
+						"mayCreateTopLevelMailbox":   false,
+					},
+					CapabilitySubmission: map[string]interface{}{
+						"maxDelayedSend":       0,
+						"submissionExtensions": map[string]interface{}{},
+					},
+				},
+			},
+		},
+		PrimaryAccounts: map[string]string{
+			CapabilityMail:       accountID,
+			CapabilitySubmission: accountID,
+		},
+		Username:       username,
+		APIURL:         baseURL + "/jmap",
+		DownloadURL:    baseURL + "/jmap/download/{accountId}/{blobId}/{name}?type={type}",
+		UploadURL:      baseURL + "/jmap/upload/{accountId}/",
+		EventSourceURL: baseURL + "/jmap/eventsource?types={types}&closeafter={closeafter}&ping={ping}",
+		State:          sessionState,
+	}
+}
+
+// Blob returns the content of a blob. Each message is a blob holding its
+// decrypted RFC 5322 form; downloading it counts as reading the message.
+func (a *Account) Blob(blobID string) ([]byte, error) {
+	messageID, ok := parseID(blobID, blobPrefix)
+	if !ok {
+		return nil, ErrBlobNotFound
+	}
+	messages, err := email.LoadMessages(a.UserID, []uint{messageID}, a.DB)
+	if err != nil {
+		return nil, err
+	}
+	if len(messages) == 0 {
+		return nil, ErrBlobNotFound
+	}
+	raw, err := a.render(messages[0])
+	if errors.Is(err, email.ErrSessionKeyNotFound) || errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrBlobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := email.MarkRead(a.UserID, messageID, a.DB); err != nil {
+		return nil, err
+	}
+	return raw, nil
+}
+
+// render decrypts a message as RFC 5322.
+func (a *Account) render(msg email.Message) ([]byte, error) {
+	return email.RenderMessage(a.UserID, msg.ID, a.PrivateKey, a.Queue.MessageID(&msg), a.DB)
+}
+
+// Prefixes of the IDs of each object type. Messages, their blobs, threads
+// and submissions all derive their IDs from the message ID.
+const (
+	emailPrefix        = "M"
+	blobPrefix         = "B"
+	threadPrefix       = "T"
+	conversationPrefix = "C"
+	submissionPrefix   = "S"
+	identityPrefix     = "I"
+	draftPrefix        = "D"
+)
+
+func formatID(prefix string, id uint) string {
+	return prefix + strconv.FormatUint(uint64(id), 10)
+}
+
+func parseID(id, prefix string) (uint, bool) {
+	if len(id) <= len(prefix) || id[:len(prefix)] != prefix {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(id[len(prefix):], 10, 64)
+	if err != nil || n == 0 {
+		return 0, false
+	}
+	return uint(n), true
+}
+
+// threadID returns the thread of a message: its conversation, or a thread
+// of its own.
+func threadID(messageID, conversationID uint) string {
+	if conversationID != 0 {
+		return formatID(conversationPrefix, conversationID)
+	}
+	return formatID(threadPrefix, messageID)
+}
+
+// formatState encodes a change ID as a state string.
+func formatState(changeID uint) string {
+	return strconv.FormatUint(uint64(changeID), 10)
+}
+
+// parseState decodes a state string; ok is false for states this server
+// never issued.
+func parseState(state string) (uint, bool) {
+	n, err := strconv.ParseUint(state, 10, 64)
+	return uint(n), err == nil
+}
+
+// state returns the current state string of the account's messages. Email,
+// Mailbox, Thread and EmailSubmission objects all derive from messages, so
+// they share it.
+func (c *call) state() (string, error) {
+	latest, err := email.LatestChange(c.UserID, c.DB)
+	if err != nil {
+		return "", err
+	}
+	return formatState(latest), nil
+}
@@ -0,0 +1,328 @@
+package jmap
+
+import (
+	"encoding/json"
+	"errors"
+	"net/mail"
+	"secmail/internal/email"
+	"secmail/internal/models"
+	"secmail/internal/relay"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Limits on submitted messages, matching the REST send endpoint.
+const (
+	maxSubjectLength = 100
+	maxBodyLength    = 10000
+	maxRecipients    = 50
+)
+
+// identityState is the state of Identity objects, which never change.
+const identityState = "1"
+
+// identityGet implements Identity/get. Each user has one identity: their
+// account address.
+func identityGet(c *call, rawArgs json.RawMessage) (interface{}, error) {
+	args, err := c.decodeGetArgs(rawArgs)
+	if err != nil {
+		return nil, err
+	}
+	var user models.User
+	if err := c.DB.Where("id = ?", c.UserID).First(&user).Error; err != nil {
+		return nil, err
+	}
+
+	id := formatID(identityPrefix, c.UserID)
+	ids := []string{id}
+	if args.IDs != nil {
+		ids = *args.IDs
+	}
+	resp := &getResponse{AccountID: c.ID(), State: identityState, List: []interface{}{}, NotFound: []string{}}
+	for _, requested := range ids {
+		if requested != id {
+			resp.NotFound = append(resp.NotFound, requested)
+			continue
+		}
+		obj := map[string]interface{}{
+			"id":            id,
+			"name":          "",
+			"email":         user.Email,
+			"replyTo":       nil,
+			"bcc":           nil,
+			"textSignature": "",
+			"htmlSignature": "",
+			"mayDelete":     false,
+		}
+		resp.List = append(resp.List, selectProperties(obj, args.Properties))
+	}
+	return resp, nil
+}
+
+// submissionGet implements EmailSubmission/get. Every message the user sent
+// is a submission; deliveryStatus covers external recipients only.
+func submissionGet(c *call, rawArgs json.RawMessage) (interface{}, error) {
+	args, err := c.decodeGetArgs(rawArgs)
+	if err != nil {
+		return nil, err
+	}
+	state, err := c.state()
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	if args.IDs == nil {
+		sent, err := email.ListMailbox(c.UserID, email.MailboxSent, c.DB)
+		if err != nil {
+			return nil, err
+		}
+		for _, msg := range sent {
+			ids = append(ids, formatID(submissionPrefix, msg.ID))
+		}
+	} else {
+		ids = *args.IDs
+	}
+
+	var messageIDs []uint
+	for _, id := range ids {
+		if messageID, ok := parseID(id, submissionPrefix); ok {
+			messageIDs = append(messageIDs, messageID)
+		}
+	}
+	messages, err := email.LoadMessages(c.UserID, messageIDs, c.DB)
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[uint]email.Message, len(messages))
+	for _, msg := range messages {
+		if msg.SenderID == c.UserID {
+			byID[msg.ID] = msg
+		}
+	}
+
+	resp := &getResponse{AccountID: c.ID(), State: state, List: []interface{}{}, NotFound: []string{}}
+	for _, id := range ids {
+		messageID, _ := parseID(id, submissionPrefix)
+		msg, ok := byID[messageID]
+		if !ok {
+			resp.NotFound = append(resp.NotFound, id)
+			continue
+		}
+		deliveryStatus, err := c.deliveryStatus(msg.ID)
+		if err != nil {
+			return nil, err
+		}
+		obj := map[string]interface{}{
+			"id":             id,
+			"identityId":     formatID(identityPrefix, c.UserID),
+			"emailId":        formatID(emailPrefix, msg.ID),
+			"threadId":       threadID(msg.ID, msg.ConversationID),
+			"envelope":       nil,
+			"sendAt":         msg.SentAt.UTC().Format(time.RFC3339),
+			"undoStatus":     "final",
+			"deliveryStatus": deliveryStatus,
+			"dsnBlobIds":     []string{},
+			"mdnBlobIds":     []string{},
+		}
+		resp.List = append(resp.List, selectProperties(obj, args.Properties))
+	}
+	return resp, nil
+}
+
+// deliveryStatus maps the relay queue entries of a message to JMAP delivery
+// statuses, or nil when it had no external recipients.
+func (c *call) deliveryStatus(messageID uint) (map[string]interface{}, error) {
+	entries, err := relay.DeliveryStatus(c.DB, messageID, c.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	result := make(map[string]interface{}, len(entries))
+	for _, entry := range entries {
+		delivered := "queued"
+		switch entry.Status {
+		case relay.StatusSent:
+			delivered = "yes"
+		case relay.StatusBounced:
+			delivered = "no"
+		}
+		result[entry.Recipient] = map[string]interface{}{
+			"smtpReply": entry.LastError,
+			"delivered": delivered,
+			"displayed": "unknown",
+		}
+	}
+	return result, nil
+}
+
+type submissionCreate struct {
+	IdentityID string `json:"identityId"`
+	EmailID    string `json:"emailId"`
+	Envelope   *struct {
+		RcptTo []struct {
+			Email string `json:"email"`
+		} `json:"rcptTo"`
+	} `json:"envelope"`
+}
+
+// submissionSet implements EmailSubmission/set. Creating a submission sends
+// a draft made earlier in the request; submissions cannot be changed or
+// cancelled once made.
+func submissionSet(c *call, rawArgs json.RawMessage) (interface{}, error) {
+	state, err := c.state()
+	if err != nil {
+		return nil, err
+	}
+	var args struct {
+		setArgs
+		OnSuccessUpdateEmail  map[string]json.RawMessage `json:"onSuccessUpdateEmail"`
+		OnSuccessDestroyEmail []string                   `json:"onSuccessDestroyEmail"`
+	}
+	if err := c.decodeArgs(rawArgs, &args); err != nil {
+		return nil, err
+	}
+	if len(args.Create)+len(args.Update)+len(args.Destroy) > maxObjectsInSet {
+		return nil, &MethodError{Type: "requestTooLarge"}
+	}
+	if args.IfInState != nil && *args.IfInState != state {
+		return nil, &MethodError{Type: "stateMismatch"}
+	}
+	resp := newSetResponse(c.ID(), state)
+
+	// Drafts sent by each successful creation, for the onSuccess arguments
+	submitted := make(map[string]string)
+	for creationID, raw := range args.Create {
+		draftID, messageID, setErr := c.submit(raw)
+		if setErr != nil {
+			resp.NotCreated[creationID] = setErr
+			continue
+		}
+		id := formatID(submissionPrefix, messageID)
+		submitted[creationID] = draftID
+		c.createdIDs[creationID] = id
+		resp.Created[creationID] = map[string]interface{}{
+			"id":         id,
+			"threadId":   formatID(threadPrefix, messageID),
+			"sendAt":     time.Now().UTC().Format(time.RFC3339),
+			"undoStatus": "final",
+		}
+	}
+	for id := range args.Update {
+		resp.NotUpdated[id] = &SetError{Type: "forbidden", Description: "Submissions cannot be changed"}
+	}
+	for _, id := range args.Destroy {
+		resp.NotDestroyed[id] = &SetError{Type: "forbidden", Description: "Submissions cannot be cancelled"}
+	}
+
+	if resp.NewState, err = c.state(); err != nil {
+		return nil, err
+	}
+	if err := c.queueImplicitSet(submitted, args.OnSuccessUpdateEmail, args.OnSuccessDestroyEmail); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// submit sends the draft a submission refers to, returning the draft's ID and
+// the sent message's ID.
+func (c *call) submit(raw json.RawMessage) (string, uint, *SetError) {
+	var create submissionCreate
+	if err := json.Unmarshal(raw, &create); err != nil {
+		return "", 0, &SetError{Type: "invalidProperties", Description: err.Error()}
+	}
+	if create.IdentityID != formatID(identityPrefix, c.UserID) {
+		return "", 0, &SetError{Type: "invalidProperties", Description: "unknown identity", Properties: []string{"identityId"}}
+	}
+	draftID := create.EmailID
+	if strings.HasPrefix(draftID, "#") {
+		draftID = c.createdIDs[draftID[1:]]
+	}
+	d, ok := c.drafts[draftID]
+	if !ok || d.sent != 0 {
+		return "", 0, &SetError{Type: "invalidProperties", Description: "emailId must be an unsent email created in this request", Properties: []string{"emailId"}}
+	}
+
+	to := d.to
+	if create.Envelope != nil {
+		to = nil
+		for _, rcpt := range create.Envelope.RcptTo {
+			to = append(to, rcpt.Email)
+		}
+	}
+	if len(to) == 0 {
+		return "", 0, &SetError{Type: "noRecipients"}
+	}
+	if len(to) > maxRecipients {
+		return "", 0, &SetError{Type: "tooManyRecipients"}
+	}
+	for _, addr := range to {
+		if _, err := mail.ParseAddress(addr); err != nil {
+			return "", 0, &SetError{Type: "invalidRecipients", Description: addr}
+		}
+	}
+
+	// Sanitize inputs
+	subject := strings.TrimSpace(d.subject)
+	body := strings.TrimSpace(d.body)
+	if subject == "" || utf8.RuneCountInString(subject) > maxSubjectLength {
+		return "", 0, &SetError{Type: "invalidEmail", Description: "subject must be 1 to 100 characters", Properties: []string{"subject"}}
+	}
+	if body == "" || utf8.RuneCountInString(body) > maxBodyLength {
+		return "", 0, &SetError{Type: "invalidEmail", Description: "body must be 1 to 10000 characters", Properties: []string{"textBody"}}
+	}
+
+	message, err := c.Queue.Submit(c.UserID, nil, nil, to, subject, body, email.Lifetime{}, c.PrivateKey)
+	switch {
+	case errors.Is(err, email.ErrSenderUnverified):
+		return "", 0, &SetError{Type: "forbiddenFrom", Description: err.Error()}
+	case errors.Is(err, email.ErrRecipientUnverified):
+		return "", 0, &SetError{Type: "forbiddenToSend", Description: err.Error()}
+	case err != nil:
+		return "", 0, &SetError{Type: "serverFail", Description: err.Error()}
+	}
+	d.sent = message.ID
+	return draftID, message.ID, nil
+}
+
+// queueImplicitSet prepares the Email/set call made on behalf of the
+// onSuccessUpdateEmail and onSuccessDestroyEmail arguments. "#" references
+// name submissions; they are only followed for ones that succeeded.
+func (c *call) queueImplicitSet(submitted map[string]string, update map[string]json.RawMessage, destroy []string) error {
+	if len(update) == 0 && len(destroy) == 0 {
+		return nil
+	}
+	resolve := func(id string) (string, bool) {
+		if !strings.HasPrefix(id, "#") {
+			return id, true
+		}
+		draftID, ok := submitted[id[1:]]
+		return draftID, ok
+	}
+
+	set := map[string]interface{}{"accountId": c.ID()}
+	updates := make(map[string]json.RawMessage)
+	for id, patch := range update {
+		if resolved, ok := resolve(id); ok {
+			updates[c.resolveEmailID(resolved)] = patch
+		}
+	}
+	set["update"] = updates
+	destroys := []string{}
+	for _, id := range destroy {
+		if resolved, ok := resolve(id); ok {
+			destroys = append(destroys, resolved)
+		}
+	}
+	set["destroy"] = destroys
+
+	args, err := json.Marshal(set)
+	if err != nil {
+		return err
+	}
+	c.implicit = args
+	return nil
+}
@@ -0,0 +1,83 @@
+package jmap
+
+import (
+	"encoding/json"
+	"secmail/internal/email"
+)
+
+// threadGet implements Thread/get. A thread is a conversation, or a single
+// message that belongs to none.
+func threadGet(c *call, rawArgs json.RawMessage) (interface{}, error) {
+	args, err := c.decodeGetArgs(rawArgs)
+	if err != nil {
+		return nil, err
+	}
+	if args.IDs == nil {
+		return nil, &MethodError{Type: "requestTooLarge", Description: "ids must be given"}
+	}
+	state, err := c.state()
+	if err != nil {
+		return nil, err
+	}
+	messages, err := c.listMessages()
+	if err != nil {
+		return nil, err
+	}
+
+	threads := make(map[string][]string)
+	for _, msg := range messages {
+		thread := threadID(msg.ID, msg.ConversationID)
+		threads[thread] = append(threads[thread], formatID(emailPrefix, msg.ID))
+	}
+
+	resp := &getResponse{AccountID: c.ID(), State: state, List: []interface{}{}, NotFound: []string{}}
+	for _, id := range *args.IDs {
+		emailIDs, ok := threads[id]
+		if !ok {
+			resp.NotFound = append(resp.NotFound, id)
+			continue
+		}
+		obj := map[string]interface{}{"id": id, "emailIds": emailIDs}
+		resp.List = append(resp.List, selectProperties(obj, args.Properties))
+	}
+	return resp, nil
+}
+
+// threadChanges implements Thread/changes. Keyword updates do not change a
+// thread, so only created and destroyed messages are reported.
+func threadChanges(c *call, rawArgs json.RawMessage) (interface{}, error) {
+	changes, err := c.changesSince(rawArgs)
+	if err != nil {
+		return nil, err
+	}
+	resp := &changesResponse{
+		AccountID:      c.ID(),
+		OldState:       changes.oldState,
+		NewState:       changes.newState,
+		HasMoreChanges: changes.hasMore,
+		Created:        []string{},
+		Updated:        []string{},
+		Destroyed:      formatIDs(threadPrefix, changes.destroyed),
+	}
+
+	messages, err := email.LoadMessages(c.UserID, changes.created, c.DB)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	for _, msg := range messages {
+		thread := threadID(msg.ID, msg.ConversationID)
+		if seen[thread] {
+			continue
+		}
+		seen[thread] = true
+		// The conversation may predate the change, so it is reported as
+		// updated; clients treat an unknown updated ID as new.
+		if msg.ConversationID != 0 {
+			resp.Updated = append(resp.Updated, thread)
+		} else {
+			resp.Created = append(resp.Created, thread)
+		}
+	}
+	return resp, nil
+}
@@ -0,0 +1,77 @@
+// Package mailauth authenticates mail crossing the secmail boundary: it
+// signs outbound mail with DKIM (RFC 6376) and checks SPF (RFC 7208), DKIM
+// and DMARC (RFC 7489) on inbound mail, reporting the outcome as an
+// Authentication-Results header (RFC 8601).
+package mailauth
+
+import (
+	"context"
+	"net"
+
+	"github.com/emersion/go-msgauth/authres"
+)
+
+// Resolver performs the DNS lookups of sender authentication. *net.Resolver
+// implements it; tests inject a fake so verification runs offline.
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+}
+
+// Result is an authentication result keyword (RFC 8601 section 2.7).
+type Result string
+
+const (
+	None      Result = "none"
+	Pass      Result = "pass"
+	Fail      Result = "fail"
+	SoftFail  Result = "softfail"
+	Neutral   Result = "neutral"
+	TempError Result = "temperror"
+	PermError Result = "permerror"
+)
+
+// DKIMSignature is the verification result of one DKIM signature.
+type DKIMSignature struct {
+	Domain string
+	Result Result
+	Reason string
+}
+
+// Results are the outcomes of authenticating one inbound message.
+type Results struct {
+	SPF Result
+	// SPFDomain is the domain SPF was checked for: the MAIL FROM domain, or
+	// the HELO name for null reverse-paths.
+	SPFDomain string
+	MailFrom  string
+	Helo      string
+
+	DKIM           Result
+	DKIMSignatures []DKIMSignature
+
+	DMARC Result
+	// FromDomain is the RFC5322.From domain DMARC was evaluated for.
+	FromDomain string
+	// DMARCPolicy is the policy the domain owner asks for when DMARC fails
+	// ("none", "quarantine" or "reject"), empty when there is no record.
+	DMARCPolicy string
+}
+
+// Header returns the Authentication-Results header value for r, naming
+// authservID as the authenticating server.
+func (r *Results) Header(authservID string) string {
+	results := []authres.Result{
+		&authres.SPFResult{Value: authres.ResultValue(r.SPF), From: r.MailFrom, Helo: r.Helo},
+	}
+	if len(r.DKIMSignatures) == 0 {
+		results = append(results, &authres.DKIMResult{Value: authres.ResultNone})
+	}
+	for _, sig := range r.DKIMSignatures {
+		results = append(results, &authres.DKIMResult{Value: authres.ResultValue(sig.Result), Reason: sig.Reason, Domain: sig.Domain})
+	}
+	results = append(results, &authres.DMARCResult{Value: authres.ResultValue(r.DMARC), From: r.FromDomain})
+	return authres.Format(authservID, results)
+}
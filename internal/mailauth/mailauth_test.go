@@ -0,0 +1,108 @@
+package mailauth
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"net"
+	"strings"
+	"testing"
+)
+
+// fakeResolver answers TXT queries from a map; every other lookup finds
+// nothing.
+type fakeResolver map[string][]string
+
+func (r fakeResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if txts, ok := r[strings.TrimSuffix(name, ".")]; ok {
+		return txts, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r fakeResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r fakeResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func (r fakeResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	return nil, &net.DNSError{Err: "no such host", Name: addr, IsNotFound: true}
+}
+
+func TestSignAndVerify(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	signer := NewSigner(map[string]DKIMKey{"Example.org": {Selector: "mail", Key: privateKey}})
+	verifier := &Verifier{Resolver: fakeResolver{
+		"example.org":                 {"v=spf1 ip4:192.0.2.1 -all"},
+		"mail._domainkey.example.org": {"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(publicKey)},
+		"_dmarc.example.org":          {"v=DMARC1; p=reject"},
+	}}
+
+	msg := []byte("From: Alice <alice@example.org>\r\n" +
+		"To: bob@secmail.test\r\n" +
+		"Subject: Signed\r\n" +
+		"\r\n" +
+		"Hello Bob\r\n")
+	signed, err := signer.Sign("alice@example.org", msg)
+	if err != nil {
+		t.Fatalf("Failed to sign message: %v", err)
+	}
+	if !bytes.HasPrefix(signed, []byte("DKIM-Signature: ")) {
+		t.Fatal("Signed message is missing the DKIM-Signature header")
+	}
+	if unsigned, _ := signer.Sign("carol@other.test", msg); !bytes.Equal(unsigned, msg) {
+		t.Error("Mail from domains without a key should not be signed")
+	}
+
+	ctx := context.Background()
+	results := verifier.Verify(ctx, net.ParseIP("192.0.2.1"), "mx.example.org", "alice@example.org", signed)
+	if results.SPF != Pass || results.DKIM != Pass || results.DMARC != Pass {
+		t.Fatalf("Expected all checks to pass, got %+v", results)
+	}
+	if results.DMARCPolicy != "reject" || results.FromDomain != "example.org" {
+		t.Errorf("Unexpected DMARC details: %+v", results)
+	}
+	header := results.Header("mx.secmail.test")
+	if !strings.HasPrefix(header, "mx.secmail.test; spf=pass") || !strings.Contains(header, "dkim=pass header.d=example.org") || !strings.Contains(header, "dmarc=pass header.from=example.org") {
+		t.Errorf("Unexpected Authentication-Results: %s", header)
+	}
+
+	// An aligned DKIM signature is enough for DMARC when SPF fails
+	results = verifier.Verify(ctx, net.ParseIP("198.51.100.7"), "mx.forwarder.test", "alice@example.org", signed)
+	if results.SPF != Fail || results.DKIM != Pass || results.DMARC != Pass {
+		t.Errorf("Expected SPF fail, DKIM pass, DMARC pass, got %+v", results)
+	}
+
+	// A modified body breaks the signature, and with it DMARC
+	tampered := bytes.Replace(signed, []byte("Hello Bob"), []byte("Pay Mallory"), 1)
+	results = verifier.Verify(ctx, net.ParseIP("198.51.100.7"), "mx.forwarder.test", "alice@example.org", tampered)
+	if results.DKIM != Fail || results.DMARC != Fail {
+		t.Errorf("Expected DKIM and DMARC to fail, got %+v", results)
+	}
+
+	// Unsigned mail from a domain without records
+	results = verifier.Verify(ctx, net.ParseIP("198.51.100.7"), "mx.other.test", "carol@other.test", []byte("From: carol@other.test\r\n\r\nHi\r\n"))
+	if results.SPF != None || results.DKIM != None || results.DMARC != None {
+		t.Errorf("Expected no results, got %+v", results)
+	}
+}
+
+func TestAligned(t *testing.T) {
+	if !aligned("mail.example.org", "example.org", "r") {
+		t.Error("Subdomains should be aligned in relaxed mode")
+	}
+	if aligned("mail.example.org", "example.org", "s") {
+		t.Error("Subdomains should not be aligned in strict mode")
+	}
+	if aligned("example.co.uk", "other.co.uk", "r") {
+		t.Error("Domains under a public suffix should not be aligned")
+	}
+}
@@ -0,0 +1,117 @@
+package mailauth
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/emersion/go-msgauth/dkim"
+)
+
+// signedHeaders are the header fields covered by DKIM signatures, following
+// RFC 6376 section 5.4.1.
+var signedHeaders = []string{
+	"From", "Reply-To", "Subject", "Date", "To", "Cc", "Message-ID",
+	"In-Reply-To", "References", "MIME-Version", "Content-Type",
+	"Content-Transfer-Encoding",
+}
+
+// DKIMKey is the signing key of one domain.
+type DKIMKey struct {
+	Selector string
+	Key      crypto.Signer
+}
+
+// Signer signs outbound mail with the DKIM key of the sender's domain.
+type Signer struct {
+	keys map[string]DKIMKey
+}
+
+// NewSigner returns a Signer with keys by domain.
+func NewSigner(keys map[string]DKIMKey) *Signer {
+	s := &Signer{keys: make(map[string]DKIMKey, len(keys))}
+	for domain, key := range keys {
+		s.keys[strings.ToLower(domain)] = key
+	}
+	return s
+}
+
+// SignerFromEnv loads the keys listed in DKIM_KEYS, a comma-separated list
+// of domain:selector:path entries where path is a PEM private key (RSA or
+// Ed25519). It returns nil when DKIM_KEYS is not set.
+func SignerFromEnv() (*Signer, error) {
+	spec := os.Getenv("DKIM_KEYS")
+	if spec == "" {
+		return nil, nil
+	}
+	keys := make(map[string]DKIMKey)
+	for _, entry := range strings.Split(spec, ",") {
+		parts := strings.SplitN(strings.TrimSpace(entry), ":", 3)
+		if len(parts) != 3 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid DKIM_KEYS entry %q, expected domain:selector:path", entry)
+		}
+		data, err := os.ReadFile(parts[2])
+		if err != nil {
+			return nil, fmt.Errorf("failed to read DKIM key for %s: %w", parts[0], err)
+		}
+		key, err := ParsePrivateKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid DKIM key for %s: %w", parts[0], err)
+		}
+		keys[parts[0]] = DKIMKey{Selector: parts[1], Key: key}
+	}
+	return NewSigner(keys), nil
+}
+
+// ParsePrivateKey parses a PEM encoded PKCS #8 or PKCS #1 private key usable
+// for DKIM.
+func ParsePrivateKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	if block.Type == "RSA PRIVATE KEY" {
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("unsupported key type")
+	}
+	return signer, nil
+}
+
+// Sign returns raw with a DKIM-Signature header for the domain of from
+// prepended. raw is returned unchanged when there is no key for the domain.
+func (s *Signer) Sign(from string, raw []byte) ([]byte, error) {
+	if s == nil {
+		return raw, nil
+	}
+	domain := domainOf(from)
+	key, ok := s.keys[domain]
+	if !ok {
+		return raw, nil
+	}
+
+	var signed bytes.Buffer
+	err := dkim.Sign(&signed, bytes.NewReader(raw), &dkim.SignOptions{
+		Domain:                 domain,
+		Selector:               key.Selector,
+		Signer:                 key.Key,
+		HeaderCanonicalization: dkim.CanonicalizationRelaxed,
+		BodyCanonicalization:   dkim.CanonicalizationRelaxed,
+		HeaderKeys:             signedHeaders,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return signed.Bytes(), nil
+}
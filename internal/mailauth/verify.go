@@ -0,0 +1,188 @@
+package mailauth
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"net/mail"
+	"strings"
+
+	"blitiri.com.ar/go/spf"
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/emersion/go-msgauth/dmarc"
+	"golang.org/x/net/publicsuffix"
+)
+
+// maxDKIMSignatures bounds the signatures verified per message.
+const maxDKIMSignatures = 5
+
+// Verifier checks SPF, DKIM and DMARC on inbound mail.
+type Verifier struct {
+	// Resolver is used for all DNS lookups; net.DefaultResolver when nil.
+	Resolver Resolver
+}
+
+func (v *Verifier) resolver() Resolver {
+	if v.Resolver != nil {
+		return v.Resolver
+	}
+	return net.DefaultResolver
+}
+
+// Verify authenticates raw, received from ip which introduced itself as helo
+// and gave mailFrom as reverse-path. Lookup failures are reported as
+// temperror results rather than returned.
+func (v *Verifier) Verify(ctx context.Context, ip net.IP, helo, mailFrom string, raw []byte) *Results {
+	results := &Results{MailFrom: mailFrom, Helo: helo}
+	v.checkSPF(ctx, results, ip)
+	v.checkDKIM(ctx, results, raw)
+	v.checkDMARC(ctx, results, raw)
+	return results
+}
+
+func (v *Verifier) checkSPF(ctx context.Context, results *Results, ip net.IP) {
+	sender := results.MailFrom
+	results.SPFDomain = domainOf(sender)
+	if results.SPFDomain == "" {
+		// Null reverse-path: check the HELO identity (RFC 7208 section 2.4)
+		sender = "postmaster@" + results.Helo
+		results.SPFDomain = strings.ToLower(results.Helo)
+	}
+	result, _ := spf.CheckHostWithSender(ip, results.Helo, sender, spf.WithContext(ctx), spf.WithResolver(v.resolver()))
+	results.SPF = Result(result)
+}
+
+func (v *Verifier) checkDKIM(ctx context.Context, results *Results, raw []byte) {
+	verifications, err := dkim.VerifyWithOptions(bytes.NewReader(raw), &dkim.VerifyOptions{
+		LookupTXT:        v.lookupTXT(ctx),
+		MaxVerifications: maxDKIMSignatures,
+	})
+	if err != nil && !errors.Is(err, dkim.ErrTooManySignatures) {
+		results.DKIM = PermError
+		return
+	}
+
+	results.DKIM = None
+	for _, verification := range verifications {
+		sig := DKIMSignature{Domain: strings.ToLower(verification.Domain), Result: Pass}
+		switch {
+		case verification.Err == nil:
+		case dkim.IsTempFail(verification.Err):
+			sig.Result, sig.Reason = TempError, verification.Err.Error()
+		case dkim.IsPermFail(verification.Err):
+			sig.Result, sig.Reason = PermError, verification.Err.Error()
+		default:
+			sig.Result, sig.Reason = Fail, verification.Err.Error()
+		}
+		results.DKIMSignatures = append(results.DKIMSignatures, sig)
+		results.DKIM = worseDKIM(results.DKIM, sig.Result)
+	}
+}
+
+// worseDKIM combines signature results: one valid signature passes the
+// message, otherwise transient errors win over failures.
+func worseDKIM(current, next Result) Result {
+	rank := map[Result]int{None: 0, PermError: 1, Fail: 2, TempError: 3, Pass: 4}
+	if rank[next] > rank[current] {
+		return next
+	}
+	return current
+}
+
+func (v *Verifier) checkDMARC(ctx context.Context, results *Results, raw []byte) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		results.DMARC = PermError
+		return
+	}
+	from, err := mail.ParseAddressList(msg.Header.Get("From"))
+	if err != nil || len(from) != 1 || domainOf(from[0].Address) == "" {
+		// RFC 7489 section 6.6.1: the From domain must be unambiguous
+		results.DMARC = PermError
+		return
+	}
+	results.FromDomain = domainOf(from[0].Address)
+
+	record, policyDomain, err := v.lookupDMARC(ctx, results.FromDomain)
+	switch {
+	case errors.Is(err, dmarc.ErrNoPolicy):
+		results.DMARC = None
+		return
+	case dmarc.IsTempFail(err):
+		results.DMARC = TempError
+		return
+	case err != nil:
+		results.DMARC = PermError
+		return
+	}
+
+	results.DMARCPolicy = string(record.Policy)
+	if policyDomain != results.FromDomain && record.SubdomainPolicy != "" {
+		results.DMARCPolicy = string(record.SubdomainPolicy)
+	}
+
+	results.DMARC = Fail
+	if results.SPF == Pass && aligned(results.SPFDomain, results.FromDomain, record.SPFAlignment) {
+		results.DMARC = Pass
+	}
+	for _, sig := range results.DKIMSignatures {
+		if sig.Result == Pass && aligned(sig.Domain, results.FromDomain, record.DKIMAlignment) {
+			results.DMARC = Pass
+		}
+	}
+}
+
+// lookupDMARC returns the DMARC record for domain, falling back to its
+// organizational domain, and the domain the record was found at.
+func (v *Verifier) lookupDMARC(ctx context.Context, domain string) (*dmarc.Record, string, error) {
+	options := &dmarc.LookupOptions{LookupTXT: v.lookupTXT(ctx)}
+	record, err := dmarc.LookupWithOptions(domain, options)
+	if !errors.Is(err, dmarc.ErrNoPolicy) {
+		return record, domain, err
+	}
+	org := organizationalDomain(domain)
+	if org == domain {
+		return nil, domain, err
+	}
+	record, err = dmarc.LookupWithOptions(org, options)
+	return record, org, err
+}
+
+func (v *Verifier) lookupTXT(ctx context.Context) func(string) ([]string, error) {
+	return func(name string) ([]string, error) {
+		return v.resolver().LookupTXT(ctx, name)
+	}
+}
+
+// aligned reports whether an authenticated domain is aligned with the From
+// domain (RFC 7489 section 3.1).
+func aligned(domain, fromDomain string, mode dmarc.AlignmentMode) bool {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if domain == "" {
+		return false
+	}
+	if mode == dmarc.AlignmentStrict {
+		return domain == fromDomain
+	}
+	return organizationalDomain(domain) == organizationalDomain(fromDomain)
+}
+
+// organizationalDomain returns the registered domain of domain according to
+// the public suffix list.
+func organizationalDomain(domain string) string {
+	org, err := publicsuffix.EffectiveTLDPlusOne(domain)
+	if err != nil {
+		return domain
+	}
+	return org
+}
+
+// domainOf returns the lowercased domain of an address.
+func domainOf(address string) string {
+	at := strings.LastIndex(address, "@")
+	if at < 0 {
+		return ""
+	}
+	return strings.ToLower(strings.TrimSuffix(address[at+1:], "."))
+}
@@ -0,0 +1,17 @@
+package models
+
+import "time"
+
+// Contact is an address book entry. Its name, addresses, notes and pinned
+// key fingerprint are stored as JSON encrypted to version KeyVersion of the
+// owner's key, the same way as a retired UserKey, so the server cannot read
+// them.
+type Contact struct {
+	ID                  uint   `gorm:"primaryKey"`
+	UserID              uint   `gorm:"index;not null"`
+	KeyVersion          int    `gorm:"not null"`
+	EncryptedData       []byte `gorm:"not null"`
+	EncryptedPassphrase []byte `gorm:"not null"`
+	CreatedAt           time.Time
+	UpdatedAt           time.Time
+}
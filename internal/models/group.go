@@ -0,0 +1,41 @@
+package models
+
+import "time"
+
+// Group is a persistent set of users that messages can be addressed to as a
+// whole. Each membership change starts a new epoch with a new group secret,
+// so messages are encrypted once to the group rather than once per member.
+type Group struct {
+	ID    uint   `gorm:"primaryKey"`
+	Name  string `gorm:"not null"`
+	Epoch uint64 `gorm:"not null"`
+	// PendingCommit is set when a member left or lost their keys; the next
+	// member to send starts a new epoch first.
+	PendingCommit bool `gorm:"not null;default:false"`
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+}
+
+// GroupMember is a user's membership of a group. Admins add and remove
+// members.
+type GroupMember struct {
+	ID        uint   `gorm:"primaryKey"`
+	GroupID   uint   `gorm:"uniqueIndex:idx_group_member;not null"`
+	UserID    uint   `gorm:"uniqueIndex:idx_group_member;index;not null"`
+	Admin     bool   `gorm:"not null;default:false"`
+	JoinedAt  uint64 `gorm:"not null"` // First epoch of the membership
+	CreatedAt time.Time
+}
+
+// GroupEpochKey is a group's epoch secret encrypted to one member's secmail
+// key (of KeyVersion). Members keep the secrets of every epoch they were in,
+// so they can read the messages sent while they were members.
+type GroupEpochKey struct {
+	ID                   uint   `gorm:"primaryKey"`
+	GroupID              uint   `gorm:"uniqueIndex:idx_group_epoch_key;not null"`
+	Epoch                uint64 `gorm:"uniqueIndex:idx_group_epoch_key;not null"`
+	UserID               uint   `gorm:"uniqueIndex:idx_group_epoch_key;index;not null"`
+	KeyVersion           int    `gorm:"not null"`
+	EncryptedEpochSecret []byte `gorm:"not null"`
+	CreatedAt            time.Time
+}
@@ -0,0 +1,17 @@
+package models
+
+import "time"
+
+// KeyLogEntry is one leaf of the append-only key transparency log, recording
+// the publication of a version of a user's public key. Entries are never
+// updated or deleted; LeafIndex is the leaf's position in the Merkle tree.
+type KeyLogEntry struct {
+	ID          uint   `gorm:"primaryKey"`
+	LeafIndex   int64  `gorm:"uniqueIndex;not null"`
+	UserID      uint   `gorm:"index;not null"`
+	AddressHash string `gorm:"index;not null"`
+	KeyVersion  int    `gorm:"not null"`
+	Leaf        []byte `gorm:"not null"` // encoded crypto.KeyLogLeaf
+	LeafHash    []byte `gorm:"not null"`
+	CreatedAt   time.Time
+}
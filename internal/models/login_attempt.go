@@ -0,0 +1,12 @@
+package models
+
+import "time"
+
+// LoginAttempt is an audit record of a failed or throttled login.
+type LoginAttempt struct {
+	ID        uint   `gorm:"primaryKey"`
+	Email     string `gorm:"index;not null"`
+	IPAddress string `gorm:"index;not null"`
+	Reason    string `gorm:"not null"`
+	CreatedAt time.Time
+}
@@ -0,0 +1,40 @@
+package models
+
+import "time"
+
+// MailingList is a distribution address, such as team@example.com, that
+// local users post to. Each post is encrypted to every member at send time.
+type MailingList struct {
+	ID          uint   `gorm:"primaryKey"`
+	Address     string `gorm:"uniqueIndex;not null"` // Lowercased
+	Name        string `gorm:"not null"`
+	Description string
+	// Policy is who may post: "open" (any local user), "members" or
+	// "moderated" (members; posts by non-owners wait for an owner's approval)
+	Policy    string `gorm:"not null;default:members"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// MailingListMember is a user's subscription to a mailing list. Owners
+// manage the list and moderate posts.
+type MailingListMember struct {
+	ID        uint `gorm:"primaryKey"`
+	ListID    uint `gorm:"uniqueIndex:idx_list_member;not null"`
+	UserID    uint `gorm:"uniqueIndex:idx_list_member;index;not null"`
+	Owner     bool `gorm:"not null;default:false"`
+	CreatedAt time.Time
+}
+
+// MailingListPost is a post to a moderated list awaiting an owner's
+// decision. Until it is approved the message is only encrypted to the
+// sender and the list's owners.
+type MailingListPost struct {
+	ID          uint   `gorm:"primaryKey"`
+	ListID      uint   `gorm:"index;not null"`
+	MessageID   uint   `gorm:"uniqueIndex;not null"`
+	Status      string `gorm:"not null"` // "held", "approved" or "rejected"
+	ModeratorID *uint
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
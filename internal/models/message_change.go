@@ -0,0 +1,13 @@
+package models
+
+import "time"
+
+// MessageChange records that a message visible to a user was created,
+// updated or destroyed. IDs order the changes and serve as sync states.
+type MessageChange struct {
+	ID        uint   `gorm:"primaryKey"`
+	UserID    uint   `gorm:"index;not null"`
+	MessageID uint   `gorm:"not null"`
+	Kind      string `gorm:"not null"` // created, updated or destroyed
+	CreatedAt time.Time
+}
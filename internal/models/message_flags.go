@@ -0,0 +1,14 @@
+package models
+
+import "time"
+
+// MessageFlags holds one user's IMAP flags (\Seen, \Flagged, keywords...) on
+// a message. Flags are per user because messages are shared between the
+// sender and all recipients.
+type MessageFlags struct {
+	ID        uint   `gorm:"primaryKey"`
+	UserID    uint   `gorm:"uniqueIndex:idx_message_flags;not null"`
+	MessageID uint   `gorm:"uniqueIndex:idx_message_flags;not null"`
+	Flags     string `gorm:"type:text;not null"` // Space separated
+	UpdatedAt time.Time
+}
@@ -0,0 +1,29 @@
+package models
+
+import "time"
+
+// PGPKey is a user's own OpenPGP key, used to sign outbound mail and decrypt
+// inbound PGP/MIME. The secret key is encrypted to the user's secmail public
+// key, so it can only be used while the user has a key session.
+type PGPKey struct {
+	ID                  uint   `gorm:"primaryKey"`
+	UserID              uint   `gorm:"uniqueIndex;not null"`
+	Fingerprint         string `gorm:"not null"`
+	PublicKey           []byte `gorm:"not null"` // Armored
+	EncryptedSecretKey  []byte `gorm:"not null"`
+	EncryptedPassphrase []byte `gorm:"not null"`
+	CreatedAt           time.Time
+	UpdatedAt           time.Time
+}
+
+// PGPContactKey is the OpenPGP public key of an external correspondent, as
+// imported by one user.
+type PGPContactKey struct {
+	ID          uint   `gorm:"primaryKey"`
+	UserID      uint   `gorm:"uniqueIndex:idx_pgp_contact;not null"`
+	Email       string `gorm:"uniqueIndex:idx_pgp_contact;not null"` // Lowercased
+	Fingerprint string `gorm:"not null"`
+	PublicKey   []byte `gorm:"not null"` // Armored
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
@@ -0,0 +1,35 @@
+package models
+
+import "time"
+
+// Prekey is a signed X25519 prekey that senders of forward secret messages
+// start ratchet chains to. The private key is encrypted to version
+// KeyVersion of the owner's secmail key, which also signed the public key.
+// Retired prekeys are kept so pending mail stays readable, then erased,
+// after which messages encrypted through them can no longer be read.
+type Prekey struct {
+	ID                  uint   `gorm:"primaryKey"`
+	UserID              uint   `gorm:"index;not null"`
+	KeyVersion          int    `gorm:"not null"`
+	PublicKey           []byte `gorm:"not null"`
+	Signature           []byte `gorm:"not null"`
+	EncryptedPrivateKey []byte `gorm:"not null"`
+	CreatedAt           time.Time
+	RetiredAt           *time.Time `gorm:"index"`
+}
+
+// SendingChain is the state of a sender's ratchet chain to one recipient in
+// a conversation. Only the next chain key is kept, encrypted to the sender's
+// secmail key, so earlier message keys cannot be recomputed from it.
+type SendingChain struct {
+	ID                 uint   `gorm:"primaryKey"`
+	ConversationID     uint   `gorm:"uniqueIndex:idx_sending_chain;not null"`
+	SenderID           uint   `gorm:"uniqueIndex:idx_sending_chain;not null"`
+	RecipientID        uint   `gorm:"uniqueIndex:idx_sending_chain;not null"`
+	PrekeyID           uint   `gorm:"index;not null"`
+	EphemeralPublicKey []byte `gorm:"not null"`
+	Counter            uint32 `gorm:"not null"`
+	EncryptedChainKey  []byte `gorm:"not null"`
+	CreatedAt          time.Time
+	UpdatedAt          time.Time
+}
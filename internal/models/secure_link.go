@@ -0,0 +1,23 @@
+package models
+
+import "time"
+
+// SecureLink lets an external recipient without an account read a message
+// once, and reply once, on a web page. The message's session passphrase is
+// sealed with a one-time passphrase the sender shares out-of-band; only the
+// SHA-256 hash of the link token is stored.
+type SecureLink struct {
+	ID        uint   `gorm:"primaryKey"`
+	MessageID uint   `gorm:"index;not null"`
+	SenderID  uint   `gorm:"index;not null"`
+	Recipient string `gorm:"not null"`
+	TokenHash string `gorm:"uniqueIndex;not null"`
+	// SealedPassphrase is erased once the link has been replied through or
+	// too many wrong passphrases were tried.
+	SealedPassphrase []byte
+	Attempts         int       `gorm:"not null;default:0"`
+	ExpiresAt        time.Time `gorm:"index"`
+	OpenedAt         *time.Time
+	RepliedAt        *time.Time
+	CreatedAt        time.Time
+}
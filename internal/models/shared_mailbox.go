@@ -0,0 +1,31 @@
+package models
+
+import "time"
+
+// MailboxDelegate grants a user access to a shared mailbox. The mailbox's
+// private key is encrypted to version KeyVersion of the delegate's key, the
+// same way as a retired UserKey.
+type MailboxDelegate struct {
+	ID                  uint   `gorm:"primaryKey"`
+	MailboxID           uint   `gorm:"uniqueIndex:idx_mailbox_delegate;not null"` // User ID of the shared mailbox
+	UserID              uint   `gorm:"uniqueIndex:idx_mailbox_delegate;index;not null"`
+	CanRead             bool   `gorm:"not null;default:false"`
+	CanSendAs           bool   `gorm:"not null;default:false"`
+	CanManage           bool   `gorm:"not null;default:false"`
+	KeyVersion          int    `gorm:"not null"`
+	EncryptedPrivateKey []byte `gorm:"not null"`
+	EncryptedPassphrase []byte `gorm:"not null"`
+	CreatedAt           time.Time
+	UpdatedAt           time.Time
+}
+
+// MailboxAuditEvent records what a delegate did in a shared mailbox.
+type MailboxAuditEvent struct {
+	ID        uint   `gorm:"primaryKey"`
+	MailboxID uint   `gorm:"index;not null"`
+	ActorID   uint   `gorm:"not null"`
+	Action    string `gorm:"not null"` // "read", "send", "grant" or "revoke"
+	MessageID uint   // For read and send
+	Detail    string // For grant and revoke: the delegate's address and roles
+	CreatedAt time.Time
+}
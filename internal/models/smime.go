@@ -0,0 +1,16 @@
+package models
+
+import "time"
+
+// SMIMEContactCert is the X.509 certificate of an external correspondent, as
+// imported by one user.
+type SMIMEContactCert struct {
+	ID          uint   `gorm:"primaryKey"`
+	UserID      uint   `gorm:"uniqueIndex:idx_smime_contact;not null"`
+	Email       string `gorm:"uniqueIndex:idx_smime_contact;not null"` // Lowercased
+	Fingerprint string `gorm:"not null"`
+	Certificate []byte `gorm:"not null"` // PEM
+	NotAfter    time.Time
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
@@ -11,8 +11,23 @@ type User struct {
 	Email        string `gorm:"uniqueIndex;not null"`
 	PasswordHash string `gorm:"not null"`
 	PublicKey    []byte `gorm:"not null"`
-	PrivateKey   []byte `gorm:"not null"` // In production, never store private key; demo only
-	CreatedAt    time.Time
-	UpdatedAt    time.Time
-	DeletedAt    gorm.DeletedAt `gorm:"index"`
+	PrivateKey   []byte `gorm:"not null"` // Wrapped with the user's password
+	RecoveryKey  []byte // Private key wrapped with the recovery phrase shown at registration
+	Certificate  []byte // Optional PEM X.509 certificate for PublicKey, used for S/MIME
+	// KeyVersion numbers PublicKey/PrivateKey; retired versions are kept as
+	// UserKeys
+	KeyVersion int `gorm:"not null;default:1"`
+	// EmailVerifiedAt is nil while the account is pending verification
+	EmailVerifiedAt *time.Time
+	// Shared is set for shared mailboxes, which have no password; their
+	// private key is wrapped to each MailboxDelegate instead
+	Shared    bool `gorm:"not null;default:false"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	DeletedAt gorm.DeletedAt `gorm:"index"`
+}
+
+// IsVerified reports whether the user has confirmed their email address.
+func (u *User) IsVerified() bool {
+	return u.EmailVerifiedAt != nil
 }
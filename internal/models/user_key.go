@@ -0,0 +1,19 @@
+package models
+
+import "time"
+
+// UserKey is a retired secmail key pair of a user, kept to decrypt mail that
+// was encrypted to it. The private key is encrypted to the user's current
+// public key like PGPKey's secret key, so it stays readable through password
+// changes and recovery and is re-encrypted on every rotation.
+type UserKey struct {
+	ID                  uint   `gorm:"primaryKey"`
+	UserID              uint   `gorm:"uniqueIndex:idx_user_key_version;not null"`
+	Version             int    `gorm:"uniqueIndex:idx_user_key_version;not null"`
+	PublicKey           []byte `gorm:"not null"`
+	EncryptedPrivateKey []byte `gorm:"not null"`
+	EncryptedPassphrase []byte `gorm:"not null"`
+	Certificate         []byte // S/MIME certificate that certified this key, if any
+	CreatedAt           time.Time
+	RetiredAt           time.Time
+}
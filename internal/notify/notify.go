@@ -0,0 +1,63 @@
+package notify
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Notifier delivers out-of-band notifications such as password reset links.
+type Notifier interface {
+	Notify(to, subject, body string) error
+}
+
+// LogNotifier writes notifications to the standard logger.
+type LogNotifier struct{}
+
+// Notify logs the notification.
+func (LogNotifier) Notify(to, subject, body string) error {
+	log.Printf("notification to=%s subject=%q\n%s", to, subject, body)
+	return nil
+}
+
+// FileNotifier appends notifications to a local file, one block per message.
+type FileNotifier struct {
+	Path string
+	mu   sync.Mutex
+}
+
+// Notify appends the notification to the file.
+func (n *FileNotifier) Notify(to, subject, body string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	f, err := os.OpenFile(n.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = fmt.Fprintf(f, "Date: %s\nTo: %s\nSubject: %s\n\n%s\n.\n", time.Now().UTC().Format(time.RFC1123Z), to, subject, body)
+	return err
+}
+
+// FromEnv builds a Notifier from the NOTIFIER environment variable. Supported
+// values are "log" (the default) and "file:<path>".
+func FromEnv() (Notifier, error) {
+	spec := os.Getenv("NOTIFIER")
+	switch {
+	case spec == "" || spec == "log":
+		return LogNotifier{}, nil
+	case strings.HasPrefix(spec, "file:"):
+		path := strings.TrimPrefix(spec, "file:")
+		if path == "" {
+			return nil, fmt.Errorf("NOTIFIER file sink requires a path")
+		}
+		return &FileNotifier{Path: path}, nil
+	default:
+		return nil, fmt.Errorf("unsupported NOTIFIER %q", spec)
+	}
+}
@@ -0,0 +1,52 @@
+package notify
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileNotifier(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notifications.log")
+	n := &FileNotifier{Path: path}
+
+	if err := n.Notify("alice@example.com", "First", "hello"); err != nil {
+		t.Fatalf("Failed to notify: %v", err)
+	}
+	if err := n.Notify("bob@example.com", "Second", "world"); err != nil {
+		t.Fatalf("Failed to notify: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read notifications: %v", err)
+	}
+	content := string(data)
+	for _, want := range []string{"To: alice@example.com", "Subject: First", "hello", "To: bob@example.com", "world"} {
+		if !strings.Contains(content, want) {
+			t.Errorf("Notification file does not contain %q", want)
+		}
+	}
+}
+
+func TestFromEnv(t *testing.T) {
+	t.Setenv("NOTIFIER", "")
+	if _, err := FromEnv(); err != nil {
+		t.Errorf("Default notifier should be valid: %v", err)
+	}
+
+	t.Setenv("NOTIFIER", "file:/tmp/secmail-notify.log")
+	n, err := FromEnv()
+	if err != nil {
+		t.Fatalf("File notifier should be valid: %v", err)
+	}
+	if fn, ok := n.(*FileNotifier); !ok || fn.Path != "/tmp/secmail-notify.log" {
+		t.Error("Expected file notifier with configured path")
+	}
+
+	t.Setenv("NOTIFIER", "carrier-pigeon")
+	if _, err := FromEnv(); err == nil {
+		t.Error("Unsupported notifier should return an error")
+	}
+}
@@ -0,0 +1,184 @@
+// Package pop3d implements a POP3 server (RFC 1939) over the encrypted
+// message store.
+package pop3d
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"secmail/internal/auth"
+	"secmail/internal/email"
+	"secmail/internal/relay"
+	"sync"
+
+	"gorm.io/gorm"
+)
+
+// ErrServerClosed is returned by Serve after Close.
+var ErrServerClosed = errors.New("pop3d: server closed")
+
+// Store authenticates users and gives access to their inboxes.
+type Store interface {
+	// Authenticate checks secmail credentials and returns the user ID and
+	// the unwrapped private key.
+	Authenticate(username, password, clientIP string) (uint, []byte, error)
+	// ListMailbox returns the messages of a mailbox in ID order.
+	ListMailbox(userID uint, mailbox string) ([]email.MailboxMessage, error)
+	// Render decrypts a message as RFC 5322.
+	Render(userID, messageID uint, privateKey []byte) ([]byte, error)
+	// MarkRead records that the user has read the body of a message.
+	MarkRead(userID, messageID uint) error
+	// SetFlags replaces the user's flags on a message.
+	SetFlags(userID, messageID uint, flags []string) error
+}
+
+// DBStore is the Store backed by the secmail database. Queue names the
+// Message-ID of messages sent within secmail, matching the copies relayed
+// to external recipients.
+type DBStore struct {
+	DB    *gorm.DB
+	Queue *relay.Queue
+}
+
+// Authenticate checks secmail credentials, subject to login throttling.
+func (s DBStore) Authenticate(username, password, clientIP string) (uint, []byte, error) {
+	user, privateKey, err := auth.Authenticate(s.DB, username, password, clientIP)
+	if err != nil {
+		return 0, nil, err
+	}
+	return user.ID, privateKey, nil
+}
+
+// ListMailbox returns the messages of a mailbox in ID order.
+func (s DBStore) ListMailbox(userID uint, mailbox string) ([]email.MailboxMessage, error) {
+	return email.ListMailbox(userID, mailbox, s.DB)
+}
+
+// Render decrypts a message as RFC 5322.
+func (s DBStore) Render(userID, messageID uint, privateKey []byte) ([]byte, error) {
+	messageIDHeader := s.Queue.MessageID(&email.Message{ID: messageID})
+	return email.RenderMessage(userID, messageID, privateKey, messageIDHeader, s.DB)
+}
+
+// MarkRead records that the user has read the body of a message, erasing
+// their key to it if it is a burn-after-reading message.
+func (s DBStore) MarkRead(userID, messageID uint) error {
+	return email.MarkRead(userID, messageID, s.DB)
+}
+
+// SetFlags replaces the user's flags on a message.
+func (s DBStore) SetFlags(userID, messageID uint, flags []string) error {
+	return email.SetMessageFlags(userID, messageID, flags, s.DB)
+}
+
+// Server is a POP3 server giving clients access to the users' inboxes with
+// their secmail credentials.
+type Server struct {
+	store     Store
+	tlsConfig *tls.Config
+
+	mu        sync.Mutex
+	closed    bool
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	// locked holds the users with a session in the transaction state; RFC
+	// 1939 gives each session exclusive access to its maildrop.
+	locked map[uint]bool
+}
+
+// NewServer returns a POP3 server. Without a TLS config, STLS is not offered
+// and passwords are accepted in the clear; with one, clients must start TLS
+// before logging in.
+func NewServer(store Store, tlsConfig *tls.Config) *Server {
+	return &Server{
+		store:     store,
+		tlsConfig: tlsConfig,
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[net.Conn]struct{}),
+		locked:    make(map[uint]bool),
+	}
+}
+
+// ListenAndServe listens on addr and serves POP3 connections.
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts connections on l until the server is closed.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	s.listeners[l] = struct{}{}
+	s.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			delete(s.listeners, l)
+			s.mu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return ErrServerClosed
+		}
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+
+		go func() {
+			newSession(s, conn).serve()
+			s.mu.Lock()
+			delete(s.conns, conn)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+// Close stops the listeners and closes all connections. Pending deletions
+// of open sessions are discarded, as for any connection that ends without
+// QUIT.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	return nil
+}
+
+// lock gives a session exclusive access to a user's maildrop.
+func (s *Server) lock(userID uint) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.locked[userID] {
+		return false
+	}
+	s.locked[userID] = true
+	return true
+}
+
+func (s *Server) unlock(userID uint) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.locked, userID)
+}
@@ -0,0 +1,213 @@
+package pop3d
+
+import (
+	"net"
+	"net/textproto"
+	"secmail/internal/auth"
+	"secmail/internal/email"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeStore struct {
+	mu       sync.Mutex
+	messages []email.MailboxMessage
+	raw      map[uint]string
+	read     []uint
+}
+
+func (f *fakeStore) Authenticate(username, password, clientIP string) (uint, []byte, error) {
+	if username != "alice@secmail.test" || password != "correct horse" {
+		return 0, nil, auth.ErrInvalidCredentials
+	}
+	return 1, []byte("private key"), nil
+}
+
+func (f *fakeStore) ListMailbox(userID uint, mailbox string) ([]email.MailboxMessage, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if mailbox != email.MailboxInbox {
+		return nil, email.ErrNoSuchMailbox
+	}
+	return append([]email.MailboxMessage(nil), f.messages...), nil
+}
+
+func (f *fakeStore) Render(userID, messageID uint, privateKey []byte) ([]byte, error) {
+	raw, ok := f.raw[messageID]
+	if !ok {
+		return nil, email.ErrSessionKeyNotFound
+	}
+	return []byte(raw), nil
+}
+
+func (f *fakeStore) MarkRead(userID, messageID uint) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.read = append(f.read, messageID)
+	return nil
+}
+
+func (f *fakeStore) readIDs() []uint {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]uint(nil), f.read...)
+}
+
+func (f *fakeStore) SetFlags(userID, messageID uint, flags []string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := range f.messages {
+		if f.messages[i].ID == messageID {
+			f.messages[i].Flags = flags
+		}
+	}
+	return nil
+}
+
+func newFakeStore() *fakeStore {
+	sentAt := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	return &fakeStore{
+		messages: []email.MailboxMessage{
+			{ID: 3, SentAt: sentAt},
+			{ID: 7, SentAt: sentAt, Flags: []string{`\Seen`}},
+			{ID: 8, SentAt: sentAt},
+		},
+		raw: map[uint]string{
+			3: "Subject: Lunch\r\n\r\nSee you at noon.\r\n.dotted line\r\n",
+			7: "Subject: Invoice\n\nPlease pay by Friday.\n",
+		},
+	}
+}
+
+func dial(t *testing.T, addr string) *textproto.Conn {
+	c, err := textproto.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	expectOK(t, c)
+	return c
+}
+
+func cmd(t *testing.T, c *textproto.Conn, format string, args ...interface{}) string {
+	if err := c.PrintfLine(format, args...); err != nil {
+		t.Fatalf("Failed to send %q: %v", format, err)
+	}
+	line, err := c.ReadLine()
+	if err != nil {
+		t.Fatalf("Failed to read reply to %q: %v", format, err)
+	}
+	return line
+}
+
+func expectOK(t *testing.T, c *textproto.Conn) {
+	line, err := c.ReadLine()
+	if err != nil || !strings.HasPrefix(line, "+OK") {
+		t.Fatalf("Expected +OK, got %q (%v)", line, err)
+	}
+}
+
+func readMultiline(t *testing.T, c *textproto.Conn) []string {
+	lines, err := c.ReadDotLines()
+	if err != nil {
+		t.Fatalf("Failed to read multi-line reply: %v", err)
+	}
+	return lines
+}
+
+func startTestServer(t *testing.T, store Store) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	s := NewServer(store, nil)
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+	return l.Addr().String()
+}
+
+func TestPOP3Session(t *testing.T) {
+	store := newFakeStore()
+	addr := startTestServer(t, store)
+	c := dial(t, addr)
+
+	if reply := cmd(t, c, "STAT"); !strings.HasPrefix(reply, "-ERR") {
+		t.Errorf("STAT before login should fail, got %q", reply)
+	}
+	cmd(t, c, "USER alice@secmail.test")
+	if reply := cmd(t, c, "PASS wrong"); reply != "-ERR [AUTH] Invalid credentials" {
+		t.Errorf("Unexpected reply to wrong password: %q", reply)
+	}
+	cmd(t, c, "USER alice@secmail.test")
+	if reply := cmd(t, c, "PASS correct horse"); reply != "+OK Maildrop has 3 messages" {
+		t.Fatalf("Failed to log in: %q", reply)
+	}
+
+	// A second session cannot open the locked maildrop
+	other := dial(t, addr)
+	cmd(t, other, "USER alice@secmail.test")
+	if reply := cmd(t, other, "PASS correct horse"); !strings.HasPrefix(reply, "-ERR [IN-USE]") {
+		t.Errorf("Expected maildrop to be locked, got %q", reply)
+	}
+
+	// Sizes count CRLF line endings, even for messages stored with LF
+	lunch := len(newFakeStore().raw[3])
+	invoice := len(strings.ReplaceAll(newFakeStore().raw[7], "\n", "\r\n"))
+	unreadable := len(unreadableMessage)
+	if reply := cmd(t, c, "STAT"); reply != "+OK 3 "+strconv.Itoa(lunch+invoice+unreadable) {
+		t.Errorf("Unexpected STAT reply: %q", reply)
+	}
+
+	cmd(t, c, "UIDL")
+	if uids := readMultiline(t, c); strings.Join(uids, ",") != "1 3,2 7,3 8" {
+		t.Errorf("Unexpected UIDL listing: %v", uids)
+	}
+	if reply := cmd(t, c, "LIST 2"); reply != "+OK 2 "+strconv.Itoa(invoice) {
+		t.Errorf("Unexpected LIST reply: %q", reply)
+	}
+
+	// Logging in renders the maildrop for its sizes but reads nothing
+	if read := store.readIDs(); len(read) != 0 {
+		t.Errorf("Expected no message to be read before RETR, got %v", read)
+	}
+	cmd(t, c, "RETR 1")
+	body := readMultiline(t, c)
+	if len(body) != 4 || body[2] != "See you at noon." || body[3] != ".dotted line" {
+		t.Errorf("Unexpected message: %q", body)
+	}
+
+	cmd(t, c, "DELE 1")
+	if reply := cmd(t, c, "RETR 1"); !strings.HasPrefix(reply, "-ERR") {
+		t.Errorf("RETR of a deleted message should fail, got %q", reply)
+	}
+	cmd(t, c, "RSET")
+	cmd(t, c, "DELE 2")
+	if reply := cmd(t, c, "STAT"); !strings.HasPrefix(reply, "+OK 2 ") {
+		t.Errorf("Unexpected STAT reply after DELE: %q", reply)
+	}
+	if reply := cmd(t, c, "QUIT"); !strings.HasPrefix(reply, "+OK") {
+		t.Fatalf("Failed to quit: %q", reply)
+	}
+
+	if read := store.readIDs(); len(read) != 1 || read[0] != 3 {
+		t.Errorf("Expected RETR to read message 3, got %v", read)
+	}
+
+	// Deleted messages keep their flags and are hidden from new sessions
+	messages, _ := store.ListMailbox(1, email.MailboxInbox)
+	if flags := messages[1].Flags; len(flags) != 2 || flags[0] != `\Seen` || flags[1] != deletedFlag {
+		t.Errorf("Unexpected flags after QUIT: %v", flags)
+	}
+	if flags := messages[0].Flags; len(flags) != 0 {
+		t.Errorf("RSET message should keep its flags, got %v", flags)
+	}
+
+	c = dial(t, addr)
+	cmd(t, c, "USER alice@secmail.test")
+	if reply := cmd(t, c, "PASS correct horse"); reply != "+OK Maildrop has 2 messages" {
+		t.Errorf("Unexpected maildrop after deletion: %q", reply)
+	}
+}
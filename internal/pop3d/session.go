@@ -0,0 +1,377 @@
+package pop3d
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"secmail/internal/auth"
+	"secmail/internal/email"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// maxLineLength bounds command lines; RFC 2449 allows 255 octets.
+	maxLineLength = 512
+	// idleTimeout is the RFC 1939 autologout timer.
+	idleTimeout = 10 * time.Minute
+	// deletedFlag marks messages removed over POP3. They stay in the store
+	// and are hidden from later POP3 sessions.
+	deletedFlag = `\Deleted`
+)
+
+// unreadableMessage is served in place of a message the user holds no
+// session key for, such as a message sent before senders kept a copy.
+const unreadableMessage = "Subject: [Unreadable message]\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"\r\n" +
+	"This message could not be decrypted with your key.\r\n"
+
+// message is an entry of the maildrop, numbered from 1 in ID order.
+type message struct {
+	id      uint
+	flags   []string
+	raw     []byte
+	deleted bool
+}
+
+type session struct {
+	server *Server
+	conn   net.Conn
+	r      *bufio.Reader
+	w      *bufio.Writer
+
+	username string
+	userID   uint
+	// messages is the maildrop, loaded when the user logs in.
+	messages []*message
+}
+
+func newSession(server *Server, conn net.Conn) *session {
+	s := &session{server: server}
+	s.setConn(conn)
+	return s
+}
+
+func (s *session) setConn(conn net.Conn) {
+	s.conn = conn
+	s.r = bufio.NewReaderSize(conn, maxLineLength)
+	s.w = bufio.NewWriter(conn)
+}
+
+func (s *session) serve() {
+	defer s.conn.Close()
+	defer func() {
+		if s.messages != nil {
+			s.server.unlock(s.userID)
+		}
+	}()
+
+	s.reply("+OK secmail POP3 server ready")
+	for {
+		s.conn.SetDeadline(time.Now().Add(idleTimeout))
+		line, err := s.r.ReadSlice('\n')
+		if errors.Is(err, bufio.ErrBufferFull) {
+			s.reply("-ERR Line too long")
+			return
+		}
+		if err != nil {
+			return
+		}
+
+		cmd, arg, _ := strings.Cut(strings.TrimRight(string(line), "\r\n"), " ")
+		if quit := s.handle(strings.ToUpper(cmd), arg); quit {
+			return
+		}
+	}
+}
+
+// handle runs one command and reports whether the session is over.
+func (s *session) handle(cmd, arg string) bool {
+	if cmd == "QUIT" {
+		s.quit()
+		return true
+	}
+	if cmd == "CAPA" {
+		s.capabilities()
+		return false
+	}
+	if s.messages == nil {
+		s.authorization(cmd, arg)
+		return false
+	}
+
+	switch cmd {
+	case "STAT":
+		count, size := 0, 0
+		for _, msg := range s.messages {
+			if !msg.deleted {
+				count++
+				size += len(msg.raw)
+			}
+		}
+		s.reply(fmt.Sprintf("+OK %d %d", count, size))
+	case "LIST":
+		s.scanListing(arg, func(n int, msg *message) string {
+			return fmt.Sprintf("%d %d", n, len(msg.raw))
+		})
+	case "UIDL":
+		s.scanListing(arg, func(n int, msg *message) string {
+			return fmt.Sprintf("%d %d", n, msg.id)
+		})
+	case "RETR":
+		msg, _, ok := s.message(arg)
+		if !ok {
+			return false
+		}
+		s.reply(fmt.Sprintf("+OK %d octets", len(msg.raw)))
+		s.writeMultiline(msg.raw)
+		// Only RETR reads a message; the maildrop is rendered at login for
+		// its sizes
+		if err := s.server.store.MarkRead(s.userID, msg.id); err != nil {
+			log.Println("POP3 failed to mark message read:", err)
+		}
+	case "DELE":
+		msg, n, ok := s.message(arg)
+		if !ok {
+			return false
+		}
+		msg.deleted = true
+		s.reply(fmt.Sprintf("+OK Message %d deleted", n))
+	case "NOOP":
+		s.reply("+OK")
+	case "RSET":
+		for _, msg := range s.messages {
+			msg.deleted = false
+		}
+		s.reply(fmt.Sprintf("+OK Maildrop has %d messages", len(s.messages)))
+	default:
+		s.reply("-ERR Unknown command")
+	}
+	return false
+}
+
+func (s *session) capabilities() {
+	s.reply("+OK Capability list follows")
+	caps := []string{"USER", "UIDL", "RESP-CODES", "AUTH-RESP-CODE", "IMPLEMENTATION secmail"}
+	if s.server.tlsConfig != nil && !s.isTLS() {
+		caps = append(caps, "STLS")
+	}
+	s.writeMultiline([]byte(strings.Join(caps, "\r\n") + "\r\n"))
+}
+
+func (s *session) isTLS() bool {
+	_, ok := s.conn.(*tls.Conn)
+	return ok
+}
+
+// authorization handles the commands of the AUTHORIZATION state.
+func (s *session) authorization(cmd, arg string) {
+	switch cmd {
+	case "STLS":
+		if s.server.tlsConfig == nil || s.isTLS() {
+			s.reply("-ERR STLS not available")
+			return
+		}
+		s.reply("+OK Begin TLS negotiation")
+		tlsConn := tls.Server(s.conn, s.server.tlsConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			log.Println("POP3 TLS handshake failed:", err)
+			s.conn.Close()
+			return
+		}
+		s.setConn(tlsConn)
+		s.username = ""
+	case "USER":
+		if s.server.tlsConfig != nil && !s.isTLS() {
+			s.reply("-ERR Must issue STLS first")
+			return
+		}
+		s.username = strings.TrimSpace(arg)
+		s.reply("+OK")
+	case "PASS":
+		if s.username == "" {
+			s.reply("-ERR USER first")
+			return
+		}
+		s.login(arg)
+	default:
+		s.reply("-ERR Log in first")
+	}
+}
+
+// login authenticates the user and loads their maildrop. Every message is
+// decrypted up front, as STAT and LIST report exact sizes.
+func (s *session) login(password string) {
+	username := s.username
+	s.username = ""
+
+	clientIP := ""
+	if host, _, err := net.SplitHostPort(s.conn.RemoteAddr().String()); err == nil {
+		clientIP = host
+	}
+	userID, privateKey, err := s.server.store.Authenticate(username, strings.TrimSpace(password), clientIP)
+	var throttled *auth.ThrottledError
+	if errors.As(err, &throttled) {
+		s.reply("-ERR [AUTH] Too many failed login attempts, try again later")
+		return
+	}
+	if errors.Is(err, auth.ErrInvalidCredentials) {
+		s.reply("-ERR [AUTH] Invalid credentials")
+		return
+	}
+	if err != nil {
+		log.Println("POP3 login failed:", err)
+		s.reply("-ERR [SYS/TEMP] Internal server error")
+		return
+	}
+
+	if !s.server.lock(userID) {
+		s.reply("-ERR [IN-USE] Maildrop already locked")
+		return
+	}
+	messages, err := s.loadMaildrop(userID, privateKey)
+	if err != nil {
+		s.server.unlock(userID)
+		log.Println("POP3 failed to load maildrop:", err)
+		s.reply("-ERR [SYS/TEMP] Internal server error")
+		return
+	}
+	s.userID = userID
+	s.messages = messages
+	s.reply(fmt.Sprintf("+OK Maildrop has %d messages", len(messages)))
+}
+
+func (s *session) loadMaildrop(userID uint, privateKey []byte) ([]*message, error) {
+	inbox, err := s.server.store.ListMailbox(userID, email.MailboxInbox)
+	if err != nil {
+		return nil, err
+	}
+	messages := []*message{}
+	for _, entry := range inbox {
+		if hasFlag(entry.Flags, deletedFlag) {
+			continue
+		}
+		raw, err := s.server.store.Render(userID, entry.ID, privateKey)
+		if errors.Is(err, email.ErrSessionKeyNotFound) {
+			raw, err = []byte(unreadableMessage), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, &message{id: entry.ID, flags: entry.Flags, raw: toCRLF(raw)})
+	}
+	return messages, nil
+}
+
+// message returns the message numbered by arg, replying with an error when
+// there is none.
+func (s *session) message(arg string) (*message, int, bool) {
+	n, err := strconv.Atoi(strings.TrimSpace(arg))
+	if err != nil || n < 1 || n > len(s.messages) {
+		s.reply("-ERR No such message")
+		return nil, 0, false
+	}
+	msg := s.messages[n-1]
+	if msg.deleted {
+		s.reply("-ERR Message already deleted")
+		return nil, 0, false
+	}
+	return msg, n, true
+}
+
+// scanListing replies to LIST and UIDL: one line for the message numbered
+// by arg, or a multi-line listing of all messages not deleted.
+func (s *session) scanListing(arg string, line func(n int, msg *message) string) {
+	if strings.TrimSpace(arg) != "" {
+		msg, n, ok := s.message(arg)
+		if ok {
+			s.reply("+OK " + line(n, msg))
+		}
+		return
+	}
+	var listing bytes.Buffer
+	for i, msg := range s.messages {
+		if !msg.deleted {
+			listing.WriteString(line(i+1, msg) + "\r\n")
+		}
+	}
+	s.reply("+OK")
+	s.writeMultiline(listing.Bytes())
+}
+
+// quit ends the session. In the TRANSACTION state, messages marked with
+// DELE are flagged \Deleted.
+func (s *session) quit() {
+	if s.messages == nil {
+		s.reply("+OK Bye")
+		return
+	}
+	failed := false
+	for _, msg := range s.messages {
+		if !msg.deleted {
+			continue
+		}
+		flags := append(append([]string(nil), msg.flags...), deletedFlag)
+		if err := s.server.store.SetFlags(s.userID, msg.id, flags); err != nil {
+			log.Println("POP3 failed to delete message:", err)
+			failed = true
+		}
+	}
+	// Release the maildrop before replying, so the client can log in again
+	// right away
+	s.server.unlock(s.userID)
+	s.messages = nil
+	if failed {
+		s.reply("-ERR [SYS/TEMP] Some deleted messages not removed")
+		return
+	}
+	s.reply("+OK Bye")
+}
+
+func (s *session) reply(line string) {
+	s.w.WriteString(line + "\r\n")
+	s.w.Flush()
+}
+
+// writeMultiline sends CRLF-terminated data with dot-stuffing and the
+// terminating line.
+func (s *session) writeMultiline(data []byte) {
+	for len(data) > 0 {
+		line := data
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			line, data = data[:i+1], data[i+1:]
+		} else {
+			data = nil
+		}
+		if bytes.HasPrefix(line, []byte(".")) {
+			s.w.WriteByte('.')
+		}
+		s.w.Write(line)
+		if !bytes.HasSuffix(line, []byte("\n")) {
+			s.w.WriteString("\r\n")
+		}
+	}
+	s.w.WriteString(".\r\n")
+	s.w.Flush()
+}
+
+func hasFlag(flags []string, flag string) bool {
+	for _, f := range flags {
+		if strings.EqualFold(f, flag) {
+			return true
+		}
+	}
+	return false
+}
+
+// toCRLF normalizes line endings, so sizes match what RETR sends.
+func toCRLF(raw []byte) []byte {
+	raw = bytes.ReplaceAll(raw, []byte("\r\n"), []byte("\n"))
+	return bytes.ReplaceAll(raw, []byte("\n"), []byte("\r\n"))
+}
@@ -0,0 +1,204 @@
+package relay
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+)
+
+// MXResolver looks up mail exchangers for a domain. *net.Resolver implements it;
+// tests inject a fake so delivery runs offline.
+type MXResolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+}
+
+// DeliveryError is returned by Client.Deliver. Permanent errors must not be
+// retried and result in a bounce.
+type DeliveryError struct {
+	Permanent bool
+	Err       error
+}
+
+func (e *DeliveryError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *DeliveryError) Unwrap() error {
+	return e.Err
+}
+
+// Client delivers messages to remote SMTP servers.
+type Client struct {
+	// Smarthost receives all outbound mail when set ("host:port"); otherwise
+	// the recipient domain's MX records are used.
+	Smarthost string
+	// HeloName is the name announced in EHLO.
+	HeloName string
+	// RequireTLS refuses delivery to servers that do not offer STARTTLS.
+	RequireTLS bool
+	Resolver   MXResolver
+}
+
+// Deliver sends raw to a single recipient. envelopeID is passed as the DSN
+// ENVID so delivery status notifications can be matched to the queue entry.
+func (c *Client) Deliver(ctx context.Context, envelopeID, from, to string, raw []byte) error {
+	hosts, err := c.hosts(ctx, to)
+	if err != nil {
+		return err
+	}
+
+	var lastErr error
+	for _, host := range hosts {
+		err := c.deliverTo(host, envelopeID, from, to, raw)
+		if err == nil {
+			return nil
+		}
+		lastErr = err
+		// A permanent rejection from one MX is authoritative
+		var de *DeliveryError
+		if errors.As(err, &de) && de.Permanent {
+			return err
+		}
+	}
+	return lastErr
+}
+
+// hosts returns the addresses to try for the recipient, in preference order.
+func (c *Client) hosts(ctx context.Context, to string) ([]string, error) {
+	if c.Smarthost != "" {
+		return []string{c.Smarthost}, nil
+	}
+
+	at := strings.LastIndex(to, "@")
+	if at < 0 || at == len(to)-1 {
+		return nil, &DeliveryError{Permanent: true, Err: fmt.Errorf("invalid recipient address %q", to)}
+	}
+	domain := to[at+1:]
+
+	resolver := c.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	mxs, err := resolver.LookupMX(ctx, domain)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			// RFC 5321 section 5.1: fall back to the domain itself
+			return []string{net.JoinHostPort(domain, "25")}, nil
+		}
+		return nil, &DeliveryError{Err: fmt.Errorf("MX lookup for %s failed: %w", domain, err)}
+	}
+	if len(mxs) == 1 && mxs[0].Host == "." {
+		return nil, &DeliveryError{Permanent: true, Err: fmt.Errorf("domain %s does not accept mail", domain)}
+	}
+
+	sort.SliceStable(mxs, func(i, j int) bool { return mxs[i].Pref < mxs[j].Pref })
+	hosts := make([]string, 0, len(mxs))
+	for _, mx := range mxs {
+		hosts = append(hosts, net.JoinHostPort(strings.TrimSuffix(mx.Host, "."), "25"))
+	}
+	return hosts, nil
+}
+
+// deliverTo runs one SMTP transaction against addr.
+func (c *Client) deliverTo(addr, envelopeID, from, to string, raw []byte) error {
+	client, err := c.dial(addr)
+	if err != nil {
+		return &DeliveryError{Err: err}
+	}
+	defer client.Close()
+
+	mailOpts := &smtp.MailOptions{EnvelopeID: envelopeID, Return: smtp.DSNReturnHeaders}
+	if err := client.Mail(from, mailOpts); err != nil {
+		return classify(err)
+	}
+	rcptOpts := &smtp.RcptOptions{
+		Notify:                []smtp.DSNNotify{smtp.DSNNotifyFailure, smtp.DSNNotifyDelayed},
+		OriginalRecipientType: smtp.DSNAddressTypeRFC822,
+		OriginalRecipient:     to,
+	}
+	if err := client.Rcpt(to, rcptOpts); err != nil {
+		return classify(err)
+	}
+	w, err := client.Data()
+	if err != nil {
+		return classify(err)
+	}
+	if _, err := w.Write(raw); err != nil {
+		return classify(err)
+	}
+	if err := w.Close(); err != nil {
+		return classify(err)
+	}
+	client.Quit()
+	return nil
+}
+
+// dial connects to addr, upgrading with STARTTLS when the server offers it.
+func (c *Client) dial(addr string) (*smtp.Client, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := smtp.DialStartTLS(addr, &tls.Config{ServerName: host})
+	if err != nil {
+		if c.RequireTLS {
+			return nil, err
+		}
+		client, err = smtp.Dial(addr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := client.Hello(c.heloName()); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+func (c *Client) heloName() string {
+	if c.HeloName != "" {
+		return c.HeloName
+	}
+	return "localhost"
+}
+
+// classify turns an SMTP reply error into a DeliveryError.
+func classify(err error) error {
+	var smtpErr *smtp.SMTPError
+	if errors.As(err, &smtpErr) {
+		return &DeliveryError{Permanent: smtpErr.Code >= 500, Err: err}
+	}
+	return &DeliveryError{Err: err}
+}
+
+// diagnosticCode formats an error as a DSN Diagnostic-Code value.
+func diagnosticCode(err error) string {
+	var smtpErr *smtp.SMTPError
+	if errors.As(err, &smtpErr) {
+		return fmt.Sprintf("smtp; %d %s", smtpErr.Code, smtpErr.Message)
+	}
+	return "X-Secmail; " + strings.ReplaceAll(err.Error(), "\n", " ")
+}
+
+// statusCode returns the RFC 3463 status code for a failed delivery.
+func statusCode(err error) string {
+	var smtpErr *smtp.SMTPError
+	if errors.As(err, &smtpErr) && smtpErr.EnhancedCode != (smtp.EnhancedCode{}) && smtpErr.EnhancedCode != smtp.NoEnhancedCode {
+		e := smtpErr.EnhancedCode
+		return fmt.Sprintf("%d.%d.%d", e[0], e[1], e[2])
+	}
+	var de *DeliveryError
+	if errors.As(err, &de) && de.Permanent {
+		return "5.0.0"
+	}
+	return "4.0.0"
+}
@@ -0,0 +1,184 @@
+package relay
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/mail"
+	gmtextproto "github.com/emersion/go-message/textproto"
+)
+
+// BounceInfo describes a failed delivery reported back to the sender.
+type BounceInfo struct {
+	ReportingMTA   string
+	EnvelopeID     string
+	Sender         string
+	Recipient      string
+	Status         string
+	DiagnosticCode string
+	// OriginalHeaders are the headers of the undelivered message.
+	OriginalHeaders []byte
+}
+
+// BuildBounce renders an RFC 3464 delivery status notification for a failed
+// delivery, addressed to the original sender.
+func BuildBounce(info BounceInfo) ([]byte, error) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+
+	var h mail.Header
+	h.SetDate(time.Now())
+	h.SetAddressList("From", []*mail.Address{{Name: "Mail Delivery System", Address: "MAILER-DAEMON@" + info.ReportingMTA}})
+	h.SetAddressList("To", []*mail.Address{{Address: info.Sender}})
+	h.SetSubject("Undelivered Mail Returned to Sender")
+	h.Set("Auto-Submitted", "auto-replied")
+	h.Set("MIME-Version", "1.0")
+	h.SetContentType("multipart/report", map[string]string{
+		"report-type": "delivery-status",
+		"boundary":    mw.Boundary(),
+	})
+	if err := h.GenerateMessageID(); err != nil {
+		return nil, err
+	}
+
+	// Human readable explanation
+	textHeader := textproto.MIMEHeader{}
+	textHeader.Set("Content-Type", "text/plain; charset=utf-8")
+	part, err := mw.CreatePart(textHeader)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(part, "Your message could not be delivered to %s.\r\n\r\n%s\r\n", info.Recipient, info.DiagnosticCode)
+
+	// Machine readable delivery status
+	statusHeader := textproto.MIMEHeader{}
+	statusHeader.Set("Content-Type", "message/delivery-status")
+	part, err = mw.CreatePart(statusHeader)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(part, "Reporting-MTA: dns; %s\r\n", info.ReportingMTA)
+	if info.EnvelopeID != "" {
+		fmt.Fprintf(part, "Original-Envelope-Id: %s\r\n", info.EnvelopeID)
+	}
+	fmt.Fprintf(part, "Arrival-Date: %s\r\n\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(part, "Original-Recipient: rfc822; %s\r\n", info.Recipient)
+	fmt.Fprintf(part, "Final-Recipient: rfc822; %s\r\n", info.Recipient)
+	fmt.Fprintf(part, "Action: failed\r\n")
+	fmt.Fprintf(part, "Status: %s\r\n", info.Status)
+	fmt.Fprintf(part, "Diagnostic-Code: %s\r\n", info.DiagnosticCode)
+
+	// Headers of the original message
+	if len(info.OriginalHeaders) > 0 {
+		headersHeader := textproto.MIMEHeader{}
+		headersHeader.Set("Content-Type", "text/rfc822-headers")
+		part, err = mw.CreatePart(headersHeader)
+		if err != nil {
+			return nil, err
+		}
+		part.Write(info.OriginalHeaders)
+	}
+
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := gmtextproto.WriteHeader(&buf, h.Header.Header); err != nil {
+		return nil, err
+	}
+	buf.Write(body.Bytes())
+	return buf.Bytes(), nil
+}
+
+// RecipientStatus is one per-recipient block of a delivery status report.
+type RecipientStatus struct {
+	Recipient string
+	// OriginalRecipient is the address the message was addressed to, when
+	// the report includes it.
+	OriginalRecipient string
+	Action            string
+	Status            string
+}
+
+// DeliveryReport is the parsed content of an RFC 3464 delivery status notification.
+type DeliveryReport struct {
+	EnvelopeID string
+	Recipients []RecipientStatus
+}
+
+// ParseDeliveryReport parses raw as a delivery status notification. It
+// returns nil without error when raw is not a DSN.
+func ParseDeliveryReport(raw []byte) (*DeliveryReport, error) {
+	entity, err := message.Read(bytes.NewReader(raw))
+	if err != nil && entity == nil {
+		return nil, err
+	}
+
+	mediaType, params, err := entity.Header.ContentType()
+	if err != nil || mediaType != "multipart/report" || !strings.EqualFold(params["report-type"], "delivery-status") {
+		return nil, nil
+	}
+
+	mr := entity.MultipartReader()
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		partType, _, _ := part.Header.ContentType()
+		if partType != "message/delivery-status" && partType != "message/global-delivery-status" {
+			continue
+		}
+		return parseDeliveryStatus(part.Body)
+	}
+}
+
+// parseDeliveryStatus parses the body of a message/delivery-status part: a
+// block of per-message fields followed by one block per recipient.
+func parseDeliveryStatus(r io.Reader) (*DeliveryReport, error) {
+	tr := textproto.NewReader(bufio.NewReader(r))
+
+	perMessage, err := tr.ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	report := &DeliveryReport{EnvelopeID: strings.TrimSpace(perMessage.Get("Original-Envelope-Id"))}
+
+	for err != io.EOF {
+		var fields textproto.MIMEHeader
+		fields, err = tr.ReadMIMEHeader()
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		recipient := addressField(fields.Get("Final-Recipient"))
+		if recipient == "" {
+			continue
+		}
+		report.Recipients = append(report.Recipients, RecipientStatus{
+			Recipient:         recipient,
+			OriginalRecipient: addressField(fields.Get("Original-Recipient")),
+			Action:            strings.ToLower(strings.TrimSpace(fields.Get("Action"))),
+			Status:            strings.TrimSpace(fields.Get("Status")),
+		})
+	}
+	return report, nil
+}
+
+// addressField returns the address of a "type; address" field.
+func addressField(value string) string {
+	if i := strings.Index(value, ";"); i >= 0 {
+		value = value[i+1:]
+	}
+	return strings.TrimSpace(value)
+}
@@ -0,0 +1,434 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"secmail/internal/crypto"
+	"secmail/internal/email"
+	"secmail/internal/mailauth"
+	"secmail/internal/models"
+	"slices"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Delivery statuses of an OutboundMessage.
+const (
+	StatusQueued   = "queued"
+	StatusDeferred = "deferred"
+	StatusSent     = "sent"
+	StatusBounced  = "bounced"
+)
+
+// Aggregate statuses written to email.Message once relaying finishes.
+const (
+	MessageStatusBounced            = "bounced"
+	MessageStatusPartiallyDelivered = "partially_delivered"
+)
+
+// OutboundMessage is one queued delivery of a message to an external recipient.
+type OutboundMessage struct {
+	ID            uint   `gorm:"primaryKey"`
+	MessageID     uint   `gorm:"index;not null"` // email.Message this delivery belongs to
+	SenderID      uint   `gorm:"not null"`
+	EnvelopeFrom  string `gorm:"not null"`
+	EnvelopeToken string `gorm:"index;not null;default:''"` // Random DSN ENVID, so reports cannot be forged
+	Recipient     string `gorm:"not null"`
+	Payload       []byte // RFC 5322 message sealed with the queue key
+	Status        string `gorm:"index;not null"`
+	Attempts      int
+	NextAttemptAt time.Time `gorm:"index"`
+	LastError     string    `gorm:"type:text"`
+	DeliveredAt   *time.Time
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+}
+
+// Config controls outbound delivery.
+type Config struct {
+	Client Client
+	// QueueKey is the age X25519 secret key sealing queued payloads.
+	QueueKey string
+	// DKIM signs queued mail for the domains it has keys for; nil disables
+	// signing.
+	DKIM         *mailauth.Signer
+	MaxAttempts  int
+	BaseBackoff  time.Duration
+	MaxBackoff   time.Duration
+	PollInterval time.Duration
+}
+
+// ConfigFromEnv builds a Config from RELAY_* environment variables.
+func ConfigFromEnv() (Config, error) {
+	cfg := Config{
+		Client: Client{
+			Smarthost:  os.Getenv("RELAY_SMARTHOST"),
+			HeloName:   os.Getenv("RELAY_HELO"),
+			RequireTLS: os.Getenv("RELAY_REQUIRE_TLS") == "true",
+		},
+		QueueKey:     os.Getenv("RELAY_QUEUE_KEY"),
+		MaxAttempts:  10,
+		BaseBackoff:  time.Minute,
+		MaxBackoff:   6 * time.Hour,
+		PollInterval: 15 * time.Second,
+	}
+	if cfg.Client.HeloName == "" {
+		cfg.Client.HeloName = os.Getenv("SMTP_DOMAIN")
+	}
+	if cfg.QueueKey == "" {
+		key, err := crypto.GenerateServerKey()
+		if err != nil {
+			return Config{}, err
+		}
+		log.Println("RELAY_QUEUE_KEY not set; using an ephemeral key, queued mail will not survive a restart")
+		cfg.QueueKey = key
+	}
+	signer, err := mailauth.SignerFromEnv()
+	if err != nil {
+		return Config{}, err
+	}
+	cfg.DKIM = signer
+	return cfg, nil
+}
+
+// Queue stores outbound deliveries and retries them with exponential backoff.
+type Queue struct {
+	db  *gorm.DB
+	cfg Config
+}
+
+// NewQueue returns a Queue using db for storage.
+func NewQueue(db *gorm.DB, cfg Config) *Queue {
+	return &Queue{db: db, cfg: cfg}
+}
+
+// MessageID returns the Message-ID header value for the outbound copies of msg.
+func (q *Queue) MessageID(msg *email.Message) string {
+	return fmt.Sprintf("secmail-%d@%s", msg.ID, q.cfg.Client.heloName())
+}
+
+// Enqueue queues one delivery of the rendered message raw per external
+// recipient, DKIM-signed for the sender's domain when a key is configured.
+// db is the transaction msg was stored in, so that the message is never
+// stored without its deliveries.
+func (q *Queue) Enqueue(msg *email.Message, raw []byte, recipients []string, db *gorm.DB) error {
+	var sender models.User
+	if err := db.Where("id = ?", msg.SenderID).First(&sender).Error; err != nil {
+		return err
+	}
+
+	raw, err := q.cfg.DKIM.Sign(sender.Email, raw)
+	if err != nil {
+		return fmt.Errorf("failed to sign message: %w", err)
+	}
+	payload, err := crypto.SealWithServerKey(raw, q.cfg.QueueKey)
+	if err != nil {
+		return err
+	}
+
+	entries := make([]OutboundMessage, 0, len(recipients))
+	for _, recipient := range recipients {
+		token, err := newEnvelopeToken()
+		if err != nil {
+			return err
+		}
+		entries = append(entries, OutboundMessage{
+			MessageID:     msg.ID,
+			SenderID:      sender.ID,
+			EnvelopeFrom:  sender.Email,
+			EnvelopeToken: token,
+			Recipient:     recipient,
+			Payload:       payload,
+			Status:        StatusQueued,
+			NextAttemptAt: time.Now(),
+		})
+	}
+	return db.Create(&entries).Error
+}
+
+// Run processes due deliveries until ctx is cancelled.
+func (q *Queue) Run(ctx context.Context) {
+	ticker := time.NewTicker(q.cfg.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := q.ProcessDue(ctx); err != nil {
+			log.Println("Outbound queue processing failed:", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ProcessDue attempts every delivery whose next attempt time has passed.
+func (q *Queue) ProcessDue(ctx context.Context) error {
+	var entries []OutboundMessage
+	err := q.db.Where("status IN ? AND next_attempt_at <= ?", []string{StatusQueued, StatusDeferred}, time.Now()).
+		Order("next_attempt_at").Limit(50).Find(&entries).Error
+	if err != nil {
+		return err
+	}
+
+	for i := range entries {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		q.attempt(ctx, &entries[i])
+	}
+	return nil
+}
+
+// attempt tries one delivery and records the outcome.
+func (q *Queue) attempt(ctx context.Context, entry *OutboundMessage) {
+	var msg email.Message
+	err := q.db.Select("id", "expires_at").Where("id = ?", entry.MessageID).First(&msg).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) || (err == nil && msg.Expired()) {
+		// The message expired before it could be delivered; the sender's
+		// copy is gone, so there is nobody to notify
+		entry.Status = StatusBounced
+		entry.LastError = "message expired before delivery"
+		entry.Payload = nil
+		if err := q.db.Save(entry).Error; err != nil {
+			log.Println("Failed to update outbound message:", err)
+		}
+		return
+	}
+	if err != nil {
+		log.Println("Failed to load outbound message:", err)
+		return
+	}
+
+	raw, err := crypto.OpenWithServerKey(entry.Payload, q.cfg.QueueKey)
+	if err != nil {
+		// Sealed with a key from a previous run; it can never be delivered
+		q.fail(entry, nil, &DeliveryError{Permanent: true, Err: errors.New("queued message could not be unsealed")})
+		return
+	}
+
+	// Entries queued before envelope tokens existed get one now
+	if entry.EnvelopeToken == "" {
+		if entry.EnvelopeToken, err = newEnvelopeToken(); err != nil {
+			log.Println("Failed to generate envelope token:", err)
+			return
+		}
+		if err := q.db.Model(entry).Update("envelope_token", entry.EnvelopeToken).Error; err != nil {
+			log.Println("Failed to update outbound message:", err)
+			return
+		}
+	}
+
+	err = q.cfg.Client.Deliver(ctx, envelopeID(entry.EnvelopeToken), entry.EnvelopeFrom, entry.Recipient, raw)
+	entry.Attempts++
+	if err == nil {
+		now := time.Now()
+		entry.Status = StatusSent
+		entry.LastError = ""
+		entry.DeliveredAt = &now
+		entry.Payload = nil
+		q.save(entry)
+		return
+	}
+
+	var de *DeliveryError
+	permanent := errors.As(err, &de) && de.Permanent
+	if !permanent && entry.Attempts < q.cfg.MaxAttempts {
+		entry.Status = StatusDeferred
+		entry.LastError = err.Error()
+		entry.NextAttemptAt = time.Now().Add(Backoff(entry.Attempts, q.cfg.BaseBackoff, q.cfg.MaxBackoff))
+		q.save(entry)
+		return
+	}
+	q.fail(entry, raw, err)
+}
+
+// fail marks a delivery as bounced and notifies the sender.
+func (q *Queue) fail(entry *OutboundMessage, raw []byte, err error) {
+	entry.Status = StatusBounced
+	entry.LastError = err.Error()
+	entry.Payload = nil
+	q.save(entry)
+
+	bounce, buildErr := BuildBounce(BounceInfo{
+		ReportingMTA:    q.cfg.Client.heloName(),
+		EnvelopeID:      envelopeID(entry.EnvelopeToken),
+		Sender:          entry.EnvelopeFrom,
+		Recipient:       entry.Recipient,
+		Status:          statusCode(err),
+		DiagnosticCode:  diagnosticCode(err),
+		OriginalHeaders: headerBlock(raw),
+	})
+	if buildErr != nil {
+		log.Println("Failed to build bounce:", buildErr)
+		return
+	}
+	if err := email.StoreInbound([]uint{entry.SenderID}, bounce, nil, q.db); err != nil {
+		log.Println("Failed to store bounce:", err)
+	}
+}
+
+// save persists entry and refreshes the status of its message.
+func (q *Queue) save(entry *OutboundMessage) {
+	if err := q.db.Save(entry).Error; err != nil {
+		log.Println("Failed to update outbound message:", err)
+		return
+	}
+	if err := refreshMessageStatus(q.db, entry.MessageID); err != nil {
+		log.Println("Failed to update message status:", err)
+	}
+}
+
+// refreshMessageStatus derives email.Message.Status from its deliveries.
+func refreshMessageStatus(db *gorm.DB, messageID uint) error {
+	var entries []OutboundMessage
+	if err := db.Select("status").Where("message_id = ?", messageID).Find(&entries).Error; err != nil {
+		return err
+	}
+	var msg email.Message
+	if err := db.Where("id = ?", messageID).First(&msg).Error; err != nil {
+		return err
+	}
+
+	sent, bounced := 0, 0
+	for _, e := range entries {
+		switch e.Status {
+		case StatusSent:
+			sent++
+		case StatusBounced:
+			bounced++
+		}
+	}
+
+	var status string
+	hasLocal := msg.RecipientsJSON != "" && msg.RecipientsJSON != "[]"
+	switch {
+	case sent+bounced < len(entries):
+		status = email.StatusQueued
+	case bounced == 0:
+		status = email.StatusSent
+	case sent == 0 && !hasLocal:
+		status = MessageStatusBounced
+	default:
+		status = MessageStatusPartiallyDelivered
+	}
+	return db.Model(&email.Message{}).Where("id = ?", messageID).Update("status", status).Error
+}
+
+// DeliveryStatus lists the deliveries of a message sent by senderID.
+func DeliveryStatus(db *gorm.DB, messageID, senderID uint) ([]OutboundMessage, error) {
+	var entries []OutboundMessage
+	err := db.Omit("payload").Where("message_id = ? AND sender_id = ?", messageID, senderID).
+		Order("id").Find(&entries).Error
+	return entries, err
+}
+
+// ApplyDeliveryReport updates queued deliveries from an inbound delivery
+// status notification received for the local users recipients. Messages
+// that are not DSNs are ignored, and so are reports that were not sent to
+// the sender of the delivery they name or do not report on its recipient.
+func ApplyDeliveryReport(db *gorm.DB, recipients []uint, raw []byte) error {
+	report, err := ParseDeliveryReport(raw)
+	if err != nil || report == nil {
+		return err
+	}
+	token, ok := parseEnvelopeID(report.EnvelopeID)
+	if !ok {
+		return nil
+	}
+
+	var entry OutboundMessage
+	if err := db.Where("envelope_token = ?", token).First(&entry).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		return err
+	}
+	if !slices.Contains(recipients, entry.SenderID) {
+		return nil
+	}
+
+	for _, rcpt := range report.Recipients {
+		// Reports name the recipient the delivery was addressed to as the
+		// original recipient, when the reporting MTA keeps it
+		original := rcpt.OriginalRecipient
+		if original == "" {
+			original = rcpt.Recipient
+		}
+		if !strings.EqualFold(original, entry.Recipient) {
+			continue
+		}
+		switch rcpt.Action {
+		case "failed":
+			entry.Status = StatusBounced
+			entry.LastError = "remote DSN: " + rcpt.Status
+		case "delivered", "relayed", "expanded":
+			entry.Status = StatusSent
+		default:
+			continue
+		}
+		if err := db.Model(&entry).Updates(map[string]interface{}{"status": entry.Status, "last_error": entry.LastError}).Error; err != nil {
+			return err
+		}
+		return refreshMessageStatus(db, entry.MessageID)
+	}
+	return nil
+}
+
+// Backoff returns the delay before retry number attempts (starting at 1).
+func Backoff(attempts int, base, max time.Duration) time.Duration {
+	delay := float64(base) * math.Pow(2, float64(attempts-1))
+	if delay > float64(max) {
+		return max
+	}
+	return time.Duration(delay)
+}
+
+// envelopeTokenBytes is the entropy of an envelope token (128 bits).
+const envelopeTokenBytes = 16
+
+// newEnvelopeToken returns a random token identifying a queue entry in
+// delivery reports.
+func newEnvelopeToken() (string, error) {
+	b := make([]byte, envelopeTokenBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// envelopeID returns the DSN ENVID used for the queue entry with the given
+// envelope token.
+func envelopeID(token string) string {
+	return "secmail-" + token
+}
+
+// parseEnvelopeID is the inverse of envelopeID.
+func parseEnvelopeID(s string) (string, bool) {
+	token, ok := strings.CutPrefix(s, "secmail-")
+	if !ok || len(token) != 2*envelopeTokenBytes {
+		return "", false
+	}
+	if _, err := hex.DecodeString(token); err != nil {
+		return "", false
+	}
+	return token, true
+}
+
+// headerBlock returns the header section of a raw message.
+func headerBlock(raw []byte) []byte {
+	if i := bytes.Index(raw, []byte("\r\n\r\n")); i >= 0 {
+		return raw[:i+2]
+	}
+	return raw
+}
@@ -0,0 +1,429 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"secmail/internal/crypto"
+	"secmail/internal/email"
+	"secmail/internal/models"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// sink is a local SMTP server recording accepted messages.
+type sink struct {
+	mu       sync.Mutex
+	messages []sinkMessage
+	// reject maps recipient addresses to the error returned for RCPT TO.
+	reject map[string]*smtp.SMTPError
+}
+
+type sinkMessage struct {
+	from, to, envID string
+	data            []byte
+}
+
+type sinkSession struct {
+	sink  *sink
+	from  string
+	envID string
+	to    string
+}
+
+func (s *sink) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	return &sinkSession{sink: s}, nil
+}
+
+func (s *sinkSession) Mail(from string, opts *smtp.MailOptions) error {
+	s.from = from
+	if opts != nil {
+		s.envID = opts.EnvelopeID
+	}
+	return nil
+}
+
+func (s *sinkSession) Rcpt(to string, opts *smtp.RcptOptions) error {
+	if err, ok := s.sink.reject[to]; ok {
+		return err
+	}
+	s.to = to
+	return nil
+}
+
+func (s *sinkSession) Data(r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.sink.mu.Lock()
+	defer s.sink.mu.Unlock()
+	s.sink.messages = append(s.sink.messages, sinkMessage{from: s.from, to: s.to, envID: s.envID, data: data})
+	return nil
+}
+
+func (s *sinkSession) Reset()        {}
+func (s *sinkSession) Logout() error { return nil }
+
+func startSink(t *testing.T, reject map[string]*smtp.SMTPError) (*sink, string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	sk := &sink{reject: reject}
+	s := smtp.NewServer(sk)
+	s.Domain = "sink.test"
+	s.AllowInsecureAuth = true
+	s.EnableDSN = true
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+	return sk, l.Addr().String()
+}
+
+func TestClientDeliver(t *testing.T) {
+	sk, addr := startSink(t, map[string]*smtp.SMTPError{
+		"gone@example.org": {Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}, Message: "No such user"},
+		"busy@example.org": {Code: 451, EnhancedCode: smtp.EnhancedCode{4, 3, 0}, Message: "Try later"},
+	})
+	client := &Client{Smarthost: addr, HeloName: "secmail.test"}
+	raw := []byte("From: alice@secmail.test\r\nTo: carol@example.org\r\nSubject: Hi\r\n\r\nHello\r\n")
+
+	if err := client.Deliver(context.Background(), "secmail-7", "alice@secmail.test", "carol@example.org", raw); err != nil {
+		t.Fatalf("Delivery failed: %v", err)
+	}
+	sk.mu.Lock()
+	if len(sk.messages) != 1 {
+		t.Fatalf("Expected 1 message at sink, got %d", len(sk.messages))
+	}
+	got := sk.messages[0]
+	sk.mu.Unlock()
+	if got.from != "alice@secmail.test" || got.to != "carol@example.org" || got.envID != "secmail-7" {
+		t.Errorf("Unexpected envelope: %+v", got)
+	}
+	if !strings.Contains(string(got.data), "Subject: Hi") {
+		t.Error("Delivered data does not contain the message")
+	}
+
+	var de *DeliveryError
+	err := client.Deliver(context.Background(), "secmail-8", "alice@secmail.test", "gone@example.org", raw)
+	if !errors.As(err, &de) || !de.Permanent {
+		t.Errorf("Expected permanent failure for 550, got %v", err)
+	}
+	if statusCode(err) != "5.1.1" {
+		t.Errorf("Unexpected status code: %s", statusCode(err))
+	}
+
+	err = client.Deliver(context.Background(), "secmail-9", "alice@secmail.test", "busy@example.org", raw)
+	if !errors.As(err, &de) || de.Permanent {
+		t.Errorf("Expected temporary failure for 451, got %v", err)
+	}
+
+	// Connection failures are temporary
+	unreachable := &Client{Smarthost: "127.0.0.1:1"}
+	err = unreachable.Deliver(context.Background(), "secmail-10", "alice@secmail.test", "carol@example.org", raw)
+	if !errors.As(err, &de) || de.Permanent {
+		t.Errorf("Expected temporary failure for unreachable host, got %v", err)
+	}
+}
+
+type fakeResolver map[string][]*net.MX
+
+func (f fakeResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	mxs, ok := f[name]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return mxs, nil
+}
+
+func TestClientHosts(t *testing.T) {
+	client := &Client{Resolver: fakeResolver{
+		"example.org": {{Host: "mx2.example.org.", Pref: 20}, {Host: "mx1.example.org.", Pref: 10}},
+		"null.test":   {{Host: ".", Pref: 0}},
+	}}
+
+	hosts, err := client.hosts(context.Background(), "carol@example.org")
+	if err != nil {
+		t.Fatalf("Failed to resolve hosts: %v", err)
+	}
+	if len(hosts) != 2 || hosts[0] != "mx1.example.org:25" || hosts[1] != "mx2.example.org:25" {
+		t.Errorf("Unexpected hosts: %v", hosts)
+	}
+
+	// Domains without MX records fall back to the domain itself
+	hosts, err = client.hosts(context.Background(), "dave@nomx.test")
+	if err != nil || len(hosts) != 1 || hosts[0] != "nomx.test:25" {
+		t.Errorf("Expected implicit MX fallback, got %v (%v)", hosts, err)
+	}
+
+	// Null MX (RFC 7505) is a permanent failure
+	var de *DeliveryError
+	if _, err := client.hosts(context.Background(), "eve@null.test"); !errors.As(err, &de) || !de.Permanent {
+		t.Errorf("Expected permanent failure for null MX, got %v", err)
+	}
+}
+
+func TestBounceRoundTrip(t *testing.T) {
+	token, err := newEnvelopeToken()
+	if err != nil {
+		t.Fatalf("Failed to generate envelope token: %v", err)
+	}
+	bounce, err := BuildBounce(BounceInfo{
+		ReportingMTA:    "secmail.test",
+		EnvelopeID:      envelopeID(token),
+		Sender:          "alice@secmail.test",
+		Recipient:       "gone@example.org",
+		Status:          "5.1.1",
+		DiagnosticCode:  "smtp; 550 No such user",
+		OriginalHeaders: []byte("Subject: Hi\r\n"),
+	})
+	if err != nil {
+		t.Fatalf("Failed to build bounce: %v", err)
+	}
+
+	report, err := ParseDeliveryReport(bounce)
+	if err != nil || report == nil {
+		t.Fatalf("Failed to parse bounce: %v", err)
+	}
+	if parsed, ok := parseEnvelopeID(report.EnvelopeID); !ok || parsed != token {
+		t.Errorf("Unexpected envelope ID: %q", report.EnvelopeID)
+	}
+	if len(report.Recipients) != 1 {
+		t.Fatalf("Expected 1 recipient status, got %d", len(report.Recipients))
+	}
+	rcpt := report.Recipients[0]
+	if rcpt.Recipient != "gone@example.org" || rcpt.OriginalRecipient != "gone@example.org" || rcpt.Action != "failed" || rcpt.Status != "5.1.1" {
+		t.Errorf("Unexpected recipient status: %+v", rcpt)
+	}
+
+	// Sequential IDs are no longer accepted as envelope IDs
+	for _, guessed := range []string{"secmail-42", "secmail-" + token[:30], "secmail-" + strings.Repeat("zz", 16)} {
+		if _, ok := parseEnvelopeID(guessed); ok {
+			t.Errorf("Expected %q to be rejected", guessed)
+		}
+	}
+
+	// Ordinary messages are not reports
+	report, err = ParseDeliveryReport([]byte("Subject: Hi\r\nContent-Type: text/plain\r\n\r\nHello\r\n"))
+	if err != nil || report != nil {
+		t.Errorf("Expected no report for plain message, got %+v (%v)", report, err)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	base, max := time.Minute, 10*time.Minute
+	expected := []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 8 * time.Minute, 10 * time.Minute}
+	for i, want := range expected {
+		if got := Backoff(i+1, base, max); got != want {
+			t.Errorf("Backoff(%d) = %v, want %v", i+1, got, want)
+		}
+	}
+}
+
+// openTestDB opens an empty database with the tables message submission
+// uses.
+func openTestDB(t *testing.T) *gorm.DB {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "secmail.db")), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	err = db.AutoMigrate(&models.User{}, &email.Message{}, &OutboundMessage{}, &models.MessageChange{}, &models.MailingList{},
+		&models.PGPContactKey{}, &models.SMIMEContactCert{}, &models.SecureLink{})
+	if err != nil {
+		t.Fatalf("Failed to migrate database: %v", err)
+	}
+	return db
+}
+
+func TestApplyDeliveryReport(t *testing.T) {
+	db := openTestDB(t)
+	msg := email.Message{SenderID: 1, RecipientsJSON: "[]", Status: email.StatusQueued}
+	if err := db.Create(&msg).Error; err != nil {
+		t.Fatalf("Failed to create message: %v", err)
+	}
+	token, err := newEnvelopeToken()
+	if err != nil {
+		t.Fatalf("Failed to generate envelope token: %v", err)
+	}
+	entry := OutboundMessage{MessageID: msg.ID, SenderID: 1, EnvelopeFrom: "alice@secmail.test", EnvelopeToken: token, Recipient: "bob@example.org", Status: StatusSent}
+	if err := db.Create(&entry).Error; err != nil {
+		t.Fatalf("Failed to create outbound message: %v", err)
+	}
+
+	report := func(recipient string) []byte {
+		bounce, err := BuildBounce(BounceInfo{ReportingMTA: "mx.example.org", EnvelopeID: envelopeID(token), Sender: "alice@secmail.test", Recipient: recipient, Status: "5.1.1"})
+		if err != nil {
+			t.Fatalf("Failed to build report: %v", err)
+		}
+		return bounce
+	}
+	status := func() string {
+		var loaded OutboundMessage
+		if err := db.Where("id = ?", entry.ID).First(&loaded).Error; err != nil {
+			t.Fatalf("Failed to load outbound message: %v", err)
+		}
+		return loaded.Status
+	}
+
+	// Reports sent to another user or about another recipient are ignored
+	for _, tc := range []struct {
+		recipients []uint
+		recipient  string
+	}{
+		{[]uint{2}, "bob@example.org"},
+		{[]uint{1}, "carol@example.org"},
+	} {
+		if err := ApplyDeliveryReport(db, tc.recipients, report(tc.recipient)); err != nil {
+			t.Fatalf("Failed to apply report: %v", err)
+		}
+		if status() != StatusSent {
+			t.Errorf("Report for %s sent to %v was applied", tc.recipient, tc.recipients)
+		}
+	}
+
+	if err := ApplyDeliveryReport(db, []uint{1}, report("bob@example.org")); err != nil {
+		t.Fatalf("Failed to apply report: %v", err)
+	}
+	if status() != StatusBounced {
+		t.Errorf("Expected the delivery to be bounced, got %s", status())
+	}
+}
+
+func TestSubmitIsAtomic(t *testing.T) {
+	db := openTestDB(t)
+	publicKey, privateKey, err := crypto.GenerateRSAKeyPair()
+	if err != nil {
+		t.Fatalf("Failed to generate key pair: %v", err)
+	}
+	now := time.Now()
+	sender := models.User{Email: "alice@secmail.test", PasswordHash: "x", PublicKey: publicKey, PrivateKey: privateKey, EmailVerifiedAt: &now}
+	if err := db.Create(&sender).Error; err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+
+	// Without a queue key the external delivery cannot be sealed, which must
+	// not leave the message stored without it
+	q := NewQueue(db, Config{})
+	if _, err := q.Submit(sender.ID, nil, nil, []string{"bob@example.org"}, "Hello", "Hi Bob", email.Lifetime{}, nil); err == nil {
+		t.Fatal("Expected submission to fail without a queue key")
+	}
+	for _, model := range []any{&email.Message{}, &OutboundMessage{}, &models.MessageChange{}} {
+		var count int64
+		if err := db.Model(model).Count(&count).Error; err != nil {
+			t.Fatalf("Failed to count rows: %v", err)
+		}
+		if count != 0 {
+			t.Errorf("Expected no %T after a failed submission, got %d", model, count)
+		}
+	}
+
+	queueKey, err := crypto.GenerateServerKey()
+	if err != nil {
+		t.Fatalf("Failed to generate queue key: %v", err)
+	}
+	q = NewQueue(db, Config{QueueKey: queueKey})
+	msg, err := q.Submit(sender.ID, nil, nil, []string{"bob@example.org"}, "Hello", "Hi Bob", email.Lifetime{}, nil)
+	if err != nil {
+		t.Fatalf("Failed to submit: %v", err)
+	}
+	var entries []OutboundMessage
+	if err := db.Where("message_id = ?", msg.ID).Find(&entries).Error; err != nil {
+		t.Fatalf("Failed to load outbound messages: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Recipient != "bob@example.org" {
+		t.Errorf("Unexpected outbound messages: %+v", entries)
+	}
+}
+
+func TestSubmitSecureLinksIsAtomic(t *testing.T) {
+	db := openTestDB(t)
+	publicKey, privateKey, err := crypto.GenerateRSAKeyPair()
+	if err != nil {
+		t.Fatalf("Failed to generate key pair: %v", err)
+	}
+	now := time.Now()
+	sender := models.User{Email: "alice@secmail.test", PasswordHash: "x", PublicKey: publicKey, PrivateKey: privateKey, EmailVerifiedAt: &now}
+	if err := db.Create(&sender).Error; err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+
+	q := NewQueue(db, Config{})
+	if _, _, err := q.SubmitSecureLinks(sender.ID, nil, nil, []string{"bob@example.org"}, "Hello", "Hi Bob", email.Lifetime{}, privateKey); err == nil {
+		t.Fatal("Expected submission to fail without a queue key")
+	}
+	for _, model := range []any{&email.Message{}, &models.SecureLink{}, &OutboundMessage{}} {
+		var count int64
+		if err := db.Model(model).Count(&count).Error; err != nil {
+			t.Fatalf("Failed to count rows: %v", err)
+		}
+		if count != 0 {
+			t.Errorf("Expected no %T after a failed submission, got %d", model, count)
+		}
+	}
+
+	queueKey, err := crypto.GenerateServerKey()
+	if err != nil {
+		t.Fatalf("Failed to generate queue key: %v", err)
+	}
+	q = NewQueue(db, Config{QueueKey: queueKey})
+	_, grants, err := q.SubmitSecureLinks(sender.ID, nil, nil, []string{"bob@example.org"}, "Hello", "Hi Bob", email.Lifetime{}, privateKey)
+	if err != nil {
+		t.Fatalf("Failed to submit: %v", err)
+	}
+	if len(grants) != 1 || grants[0].Recipient != "bob@example.org" {
+		t.Errorf("Unexpected grants: %+v", grants)
+	}
+}
+
+func TestSubmitLocalAddresses(t *testing.T) {
+	db := openTestDB(t)
+	email.SetLocalDomains([]string{"secmail.test"})
+	t.Cleanup(func() { email.SetLocalDomains(nil) })
+	now := time.Now()
+	var users []models.User
+	for _, address := range []string{"alice@secmail.test", "bob@secmail.test"} {
+		publicKey, privateKey, err := crypto.GenerateRSAKeyPair()
+		if err != nil {
+			t.Fatalf("Failed to generate key pair: %v", err)
+		}
+		user := models.User{Email: address, PasswordHash: "x", PublicKey: publicKey, PrivateKey: privateKey, EmailVerifiedAt: &now}
+		if err := db.Create(&user).Error; err != nil {
+			t.Fatalf("Failed to create user: %v", err)
+		}
+		users = append(users, user)
+	}
+	sender, bob := users[0], users[1]
+	q := NewQueue(db, Config{})
+
+	// A user given both by ID and by address receives the message once
+	msg, err := q.Submit(sender.ID, []uint{bob.ID}, nil, []string{"Bob@secmail.test"}, "Hello", "Hi Bob", email.Lifetime{}, nil)
+	if err != nil {
+		t.Fatalf("Failed to submit: %v", err)
+	}
+	if msg.RecipientsJSON != fmt.Sprintf("[%d]", bob.ID) {
+		t.Errorf("Unexpected recipients: %s", msg.RecipientsJSON)
+	}
+
+	// An unknown address in a local domain is not relayed
+	_, err = q.Submit(sender.ID, nil, nil, []string{"nobody@secmail.test"}, "Hello", "Hi", email.Lifetime{}, nil)
+	if !errors.Is(err, email.ErrUnknownRecipient) {
+		t.Errorf("Expected ErrUnknownRecipient, got %v", err)
+	}
+	var queued int64
+	if err := db.Model(&OutboundMessage{}).Count(&queued).Error; err != nil {
+		t.Fatalf("Failed to count rows: %v", err)
+	}
+	if queued != 0 {
+		t.Errorf("Expected nothing queued, got %d", queued)
+	}
+}
@@ -0,0 +1,129 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"secmail/internal/email"
+	"slices"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// Submit sends a message from senderID. Addresses in to that belong to local
+// users are delivered directly along with recipients, and mailing list
+// addresses to the list's members; all others are rendered and queued for
+// outbound relay. groups are delivered to their
+// members. lifetime only applies to the copies stored by secmail, not those
+// delivered outside. privateKey is the sender's unwrapped key, used to sign
+// external copies when available and required to address groups.
+func (q *Queue) Submit(senderID uint, recipients, groups []uint, to []string, subject, body string, lifetime email.Lifetime, privateKey []byte) (*email.Message, error) {
+	recipients, lists, external, err := q.splitAddresses(recipients, to)
+	if err != nil {
+		return nil, err
+	}
+
+	// The message and its deliveries are stored in one transaction, so a
+	// failure leaves nothing behind and the sender can retry without
+	// duplicating the message for the recipients that succeeded
+	var message *email.Message
+	err = q.db.Transaction(func(tx *gorm.DB) error {
+		// SendMessage expands list addresses into the lists' members
+		var err error
+		message, err = email.SendMessage(senderID, recipients, groups, append(lists, external...), subject, body, lifetime, privateKey, tx)
+		if err != nil {
+			return err
+		}
+		if len(external) == 0 {
+			return nil
+		}
+
+		deliveries, err := email.ComposeExternal(message, subject, body, q.MessageID(message), external, privateKey, tx)
+		if err != nil {
+			return fmt.Errorf("failed to compose external delivery: %w", err)
+		}
+		for _, delivery := range deliveries {
+			if err := q.Enqueue(message, delivery.Raw, delivery.Recipients, tx); err != nil {
+				return fmt.Errorf("failed to queue external delivery: %w", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+// SubmitSecureLinks sends a message like Submit, except that external
+// recipients are not sent its content but a link to read it once, and reply
+// once, with a one-time passphrase. The passphrases are returned in the
+// grants for the sender to share out-of-band. privateKey is required.
+func (q *Queue) SubmitSecureLinks(senderID uint, recipients, groups []uint, to []string, subject, body string, lifetime email.Lifetime, privateKey []byte) (*email.Message, []email.SecureLinkGrant, error) {
+	recipients, lists, external, err := q.splitAddresses(recipients, to)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// As in Submit, the message, its links and their notices are stored
+	// together
+	var message *email.Message
+	var grants []email.SecureLinkGrant
+	err = q.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		message, err = email.SendMessage(senderID, recipients, groups, append(lists, external...), subject, body, lifetime, privateKey, tx)
+		if err != nil {
+			return err
+		}
+		if len(external) == 0 {
+			return nil
+		}
+
+		var deliveries []email.ExternalDelivery
+		grants, deliveries, err = email.CreateSecureLinks(message, external, privateKey, tx)
+		if err != nil {
+			return fmt.Errorf("failed to create secure links: %w", err)
+		}
+		for _, delivery := range deliveries {
+			if err := q.Enqueue(message, delivery.Raw, delivery.Recipients, tx); err != nil {
+				return fmt.Errorf("failed to queue secure link: %w", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return message, grants, nil
+}
+
+// splitAddresses adds the addresses in to that belong to local users to
+// recipients, and returns the mailing list and external addresses apart. An
+// address in a local domain that is neither a user nor a list is rejected
+// with email.ErrUnknownRecipient rather than relayed.
+func (q *Queue) splitAddresses(recipients []uint, to []string) ([]uint, []string, []string, error) {
+	var lists, external []string
+	for _, addr := range to {
+		addr = strings.TrimSpace(addr)
+		recipientID, err := email.LookupLocalRecipient(addr, q.db)
+		switch {
+		case err == nil:
+			if !slices.Contains(recipients, recipientID) {
+				recipients = append(recipients, recipientID)
+			}
+		case errors.Is(err, email.ErrUnknownRecipient):
+			if _, err := email.LookupList(addr, q.db); err == nil {
+				lists = append(lists, addr)
+			} else if errors.Is(err, email.ErrListNotFound) && email.IsLocalAddress(addr) {
+				return nil, nil, nil, fmt.Errorf("%w: %s", email.ErrUnknownRecipient, addr)
+			} else if errors.Is(err, email.ErrListNotFound) {
+				external = append(external, addr)
+			} else {
+				return nil, nil, nil, err
+			}
+		default:
+			return nil, nil, nil, err
+		}
+	}
+	return recipients, lists, external, nil
+}
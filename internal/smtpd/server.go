@@ -0,0 +1,235 @@
+package smtpd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"secmail/internal/email"
+	"secmail/internal/mailauth"
+	"secmail/internal/relay"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	"gorm.io/gorm"
+)
+
+const (
+	maxMessageBytes = 10 << 20
+	maxRecipients   = 50
+	// verifyTimeout bounds the DNS lookups of sender authentication.
+	verifyTimeout = 30 * time.Second
+)
+
+// Store resolves local recipients and stores accepted messages.
+type Store interface {
+	// LookupRecipient returns the user ID for a local address.
+	LookupRecipient(address string) (uint, error)
+	// Deliver encrypts and stores a raw message for the given users. auth
+	// holds the sender authentication results, if any.
+	Deliver(recipients []uint, raw []byte, auth *email.AuthResults) error
+}
+
+// DBStore is the Store backed by the secmail database.
+type DBStore struct {
+	DB *gorm.DB
+}
+
+// LookupRecipient returns the user ID for a local address.
+func (s DBStore) LookupRecipient(address string) (uint, error) {
+	return email.LookupLocalRecipient(address, s.DB)
+}
+
+// Deliver encrypts and stores a raw message for the given users. Delivery
+// status notifications sent to the sender of an outbound delivery also
+// update it.
+func (s DBStore) Deliver(recipients []uint, raw []byte, auth *email.AuthResults) error {
+	if err := relay.ApplyDeliveryReport(s.DB, recipients, raw); err != nil {
+		log.Println("Failed to apply delivery report:", err)
+	}
+	return email.StoreInbound(recipients, raw, auth, s.DB)
+}
+
+// NewServer returns an SMTP server accepting mail for local users on addr.
+// Messages are encrypted to the recipients' keys before they are stored.
+// When verifier is not nil, SPF, DKIM and DMARC are checked on every message
+// and the results are added as an Authentication-Results header naming
+// domain.
+func NewServer(addr, domain string, store Store, verifier *mailauth.Verifier) *smtp.Server {
+	s := smtp.NewServer(&backend{store: store, domain: domain, verifier: verifier})
+	s.Addr = addr
+	s.Domain = domain
+	s.MaxMessageBytes = maxMessageBytes
+	s.MaxRecipients = maxRecipients
+	s.ReadTimeout = time.Minute
+	s.WriteTimeout = time.Minute
+	return s
+}
+
+// backend creates a session per SMTP connection.
+type backend struct {
+	store    Store
+	domain   string
+	verifier *mailauth.Verifier
+}
+
+func (b *backend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	return &session{backend: b, conn: c}, nil
+}
+
+// session holds the envelope of the message currently being received.
+type session struct {
+	backend    *backend
+	conn       *smtp.Conn
+	from       string
+	recipients []uint
+}
+
+func (s *session) Mail(from string, opts *smtp.MailOptions) error {
+	s.from = from
+	s.recipients = nil
+	return nil
+}
+
+func (s *session) Rcpt(to string, opts *smtp.RcptOptions) error {
+	userID, err := s.backend.store.LookupRecipient(to)
+	if errors.Is(err, email.ErrUnknownRecipient) || errors.Is(err, email.ErrRecipientUnverified) {
+		return &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+			Message:      "No such user here",
+		}
+	}
+	if err != nil {
+		log.Println("SMTP recipient lookup failed:", err)
+		return &smtp.SMTPError{
+			Code:         451,
+			EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+			Message:      "Temporary failure, try again later",
+		}
+	}
+
+	for _, id := range s.recipients {
+		if id == userID {
+			return nil
+		}
+	}
+	s.recipients = append(s.recipients, userID)
+	return nil
+}
+
+func (s *session) Data(r io.Reader) error {
+	if len(s.recipients) == 0 {
+		return &smtp.SMTPError{
+			Code:         554,
+			EnhancedCode: smtp.EnhancedCode{5, 5, 1},
+			Message:      "No valid recipients",
+		}
+	}
+
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if _, err := email.ParseMIME(body); err != nil {
+		return &smtp.SMTPError{
+			Code:         554,
+			EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+			Message:      "Message could not be parsed",
+		}
+	}
+
+	var trace []byte
+	var auth *email.AuthResults
+	if s.backend.verifier != nil {
+		results := s.authenticate(body)
+		auth = &email.AuthResults{SPF: string(results.SPF), DKIM: string(results.DKIM), DMARC: string(results.DMARC)}
+		body = stripAuthResults(body, s.backend.domain)
+		trace = authResultsHeader(results, s.backend.domain)
+	}
+	trace = append(trace, s.receivedHeader()...)
+
+	raw := append(trace, body...)
+	if err := s.backend.store.Deliver(s.recipients, raw, auth); err != nil {
+		log.Println("SMTP delivery failed:", err)
+		return &smtp.SMTPError{
+			Code:         451,
+			EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+			Message:      "Temporary failure, try again later",
+		}
+	}
+	return nil
+}
+
+// receivedHeader returns the Received trace header (RFC 5321 section 4.4)
+// prepended to every accepted message.
+func (s *session) receivedHeader() []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Received: from %s (%s)\r\n\tby %s with ESMTP\r\n\tenvelope-from <%s>;\r\n\t%s\r\n",
+		s.conn.Hostname(), s.conn.Conn().RemoteAddr(), s.backend.domain, s.from,
+		time.Now().Format(time.RFC1123Z))
+	return buf.Bytes()
+}
+
+// authenticate checks the sender of body with the backend's verifier.
+func (s *session) authenticate(body []byte) *mailauth.Results {
+	var ip net.IP
+	if addr, ok := s.conn.Conn().RemoteAddr().(*net.TCPAddr); ok {
+		ip = addr.IP
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), verifyTimeout)
+	defer cancel()
+	return s.backend.verifier.Verify(ctx, ip, s.conn.Hostname(), s.from, body)
+}
+
+// authResultsHeader formats results as an Authentication-Results header,
+// one method per line.
+func authResultsHeader(results *mailauth.Results, domain string) []byte {
+	value := strings.ReplaceAll(results.Header(domain), "; ", ";\r\n\t")
+	return []byte("Authentication-Results: " + value + "\r\n")
+}
+
+// stripAuthResults removes Authentication-Results headers claiming to come
+// from domain, which can only be forgeries (RFC 8601 section 5).
+func stripAuthResults(body []byte, domain string) []byte {
+	br := bufio.NewReader(bytes.NewReader(body))
+	header, err := textproto.ReadHeader(br)
+	if err != nil {
+		return body
+	}
+	removed := false
+	fields := header.FieldsByKey("Authentication-Results")
+	for fields.Next() {
+		// The authserv-id comes before the first ";", possibly with a version
+		id, _, _ := strings.Cut(fields.Value(), ";")
+		if id = strings.TrimSpace(id); strings.EqualFold(id, domain) || strings.HasPrefix(strings.ToLower(id), strings.ToLower(domain)+" ") {
+			fields.Del()
+			removed = true
+		}
+	}
+	if !removed {
+		return body
+	}
+
+	var buf bytes.Buffer
+	if err := textproto.WriteHeader(&buf, header); err != nil {
+		return body
+	}
+	io.Copy(&buf, br)
+	return buf.Bytes()
+}
+
+func (s *session) Reset() {
+	s.from = ""
+	s.recipients = nil
+}
+
+func (s *session) Logout() error {
+	return nil
+}
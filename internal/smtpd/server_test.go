@@ -0,0 +1,158 @@
+package smtpd
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/smtp"
+	"secmail/internal/email"
+	"secmail/internal/mailauth"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type fakeStore struct {
+	mu        sync.Mutex
+	users     map[string]uint
+	delivered [][]byte
+	rcpts     [][]uint
+	auth      []*email.AuthResults
+}
+
+func (f *fakeStore) LookupRecipient(address string) (uint, error) {
+	id, ok := f.users[strings.ToLower(address)]
+	if !ok {
+		return 0, email.ErrUnknownRecipient
+	}
+	return id, nil
+}
+
+func (f *fakeStore) Deliver(recipients []uint, raw []byte, auth *email.AuthResults) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.delivered = append(f.delivered, raw)
+	f.rcpts = append(f.rcpts, recipients)
+	f.auth = append(f.auth, auth)
+	return nil
+}
+
+// emptyResolver finds no DNS records.
+type emptyResolver struct{}
+
+func (emptyResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (emptyResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (emptyResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func (emptyResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	return nil, &net.DNSError{Err: "no such host", Name: addr, IsNotFound: true}
+}
+
+func startTestServer(t *testing.T, store Store) string {
+	return startVerifyingServer(t, store, nil)
+}
+
+func startVerifyingServer(t *testing.T, store Store, verifier *mailauth.Verifier) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	s := NewServer(l.Addr().String(), "mx.secmail.test", store, verifier)
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+	return l.Addr().String()
+}
+
+func TestInboundDelivery(t *testing.T) {
+	store := &fakeStore{users: map[string]uint{"alice@secmail.test": 1, "bob@secmail.test": 2}}
+	addr := startTestServer(t, store)
+
+	msg := "From: Carol <carol@example.org>\r\n" +
+		"To: alice@secmail.test, bob@secmail.test\r\n" +
+		"Subject: Hello from outside\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" +
+		"Hi there!\r\n"
+	err := smtp.SendMail(addr, nil, "carol@example.org", []string{"alice@secmail.test", "Bob@secmail.test", "alice@secmail.test"}, []byte(msg))
+	if err != nil {
+		t.Fatalf("Failed to send mail: %v", err)
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if len(store.delivered) != 1 {
+		t.Fatalf("Expected 1 delivered message, got %d", len(store.delivered))
+	}
+	if got := store.rcpts[0]; len(got) != 2 || got[0] != 1 || got[1] != 2 {
+		t.Errorf("Unexpected recipients: %v", got)
+	}
+	raw := store.delivered[0]
+	if !bytes.HasPrefix(raw, []byte("Received: from ")) {
+		t.Error("Delivered message is missing the Received header")
+	}
+
+	parsed, err := email.ParseMIME(raw)
+	if err != nil {
+		t.Fatalf("Failed to parse delivered message: %v", err)
+	}
+	if parsed.From != "carol@example.org" || parsed.Subject != "Hello from outside" || parsed.Body != "Hi there!" {
+		t.Errorf("Unexpected parsed message: %+v", parsed)
+	}
+}
+
+func TestInboundRejectsUnknownRecipient(t *testing.T) {
+	store := &fakeStore{users: map[string]uint{"alice@secmail.test": 1}}
+	addr := startTestServer(t, store)
+
+	msg := "From: carol@example.org\r\nSubject: Hi\r\n\r\nHello\r\n"
+	err := smtp.SendMail(addr, nil, "carol@example.org", []string{"mallory@secmail.test"}, []byte(msg))
+	if err == nil || !strings.Contains(err.Error(), "550") {
+		t.Fatalf("Expected 550 rejection, got %v", err)
+	}
+	if len(store.delivered) != 0 {
+		t.Error("No message should have been delivered")
+	}
+}
+
+func TestInboundAuthentication(t *testing.T) {
+	store := &fakeStore{users: map[string]uint{"alice@secmail.test": 1}}
+	addr := startVerifyingServer(t, store, &mailauth.Verifier{Resolver: emptyResolver{}})
+
+	msg := "Authentication-Results: mx.secmail.test; dmarc=pass header.from=bank.test\r\n" +
+		"Authentication-Results: mx.elsewhere.test; spf=pass\r\n" +
+		"From: carol@example.org\r\n" +
+		"Subject: Hi\r\n" +
+		"\r\n" +
+		"Hello\r\n"
+	if err := smtp.SendMail(addr, nil, "carol@example.org", []string{"alice@secmail.test"}, []byte(msg)); err != nil {
+		t.Fatalf("Failed to send mail: %v", err)
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if len(store.delivered) != 1 {
+		t.Fatalf("Expected 1 delivered message, got %d", len(store.delivered))
+	}
+	auth := store.auth[0]
+	if auth == nil || auth.SPF != "none" || auth.DKIM != "none" || auth.DMARC != "none" {
+		t.Errorf("Unexpected authentication results: %+v", auth)
+	}
+	raw := string(store.delivered[0])
+	if !strings.HasPrefix(raw, "Authentication-Results: mx.secmail.test;\r\n\tspf=none") {
+		t.Errorf("Delivered message is missing our Authentication-Results header:\n%s", raw)
+	}
+	if strings.Contains(raw, "bank.test") {
+		t.Error("Forged Authentication-Results header was not removed")
+	}
+	if !strings.Contains(raw, "mx.elsewhere.test; spf=pass") {
+		t.Error("Authentication-Results of other servers should be kept")
+	}
+}
@@ -0,0 +1,255 @@
+package transparency
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"log"
+	"os"
+	"secmail/internal/crypto"
+	"secmail/internal/models"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// MaxEntries is the most entries returned by one Entries call.
+const MaxEntries = 1000
+
+var (
+	// ErrEntryNotFound is returned when the log has no entry for a key.
+	ErrEntryNotFound = errors.New("key not found in the log")
+	// ErrInvalidTreeSize is returned for tree sizes the log has not reached.
+	ErrInvalidTreeSize = errors.New("invalid tree size")
+)
+
+// Log serves signed tree heads and proofs for the key transparency log.
+// Entries are appended with Append by whoever publishes a key. As the log is
+// append-only, the Merkle tree is kept in memory and only extended with the
+// entries appended since the last request.
+type Log struct {
+	db  *gorm.DB
+	key ed25519.PrivateKey
+
+	mu   sync.Mutex
+	tree crypto.MerkleTree
+	head *crypto.TreeHead // last signed head, reused until the log grows
+}
+
+// InclusionProof proves that Leaf is entry Index of the tree of TreeSize
+// entries.
+type InclusionProof struct {
+	Index     int64    `json:"index"`
+	TreeSize  int64    `json:"tree_size"`
+	Leaf      []byte   `json:"leaf"`
+	AuditPath [][]byte `json:"audit_path"`
+}
+
+// NewLog returns a Log stored in db whose tree heads are signed with key.
+func NewLog(db *gorm.DB, key ed25519.PrivateKey) *Log {
+	return &Log{db: db, key: key}
+}
+
+// KeyFromEnv returns the tree head signing key from KEYLOG_SIGNING_KEY, a
+// base64-encoded Ed25519 seed.
+func KeyFromEnv() (ed25519.PrivateKey, error) {
+	encoded := os.Getenv("KEYLOG_SIGNING_KEY")
+	if encoded == "" {
+		generated, err := crypto.GenerateLogKey()
+		if err != nil {
+			return nil, err
+		}
+		log.Println("KEYLOG_SIGNING_KEY not set; using an ephemeral key, clients will reject tree heads after a restart")
+		encoded = generated
+	}
+	return crypto.ParseLogKey(encoded)
+}
+
+// Append adds the publication of a version of a user's public key to the log.
+// It must run in the transaction that stores the key, so no key is used
+// without being logged, and be its last statement: appends are serialized
+// until that transaction commits.
+func Append(tx *gorm.DB, userID uint, address string, keyVersion int, publicKey []byte) error {
+	leaf, err := crypto.NewKeyLogLeaf(address, keyVersion, publicKey, time.Now())
+	if err != nil {
+		return err
+	}
+
+	// Appends are serialized so leaf indexes have no gaps. SQLite, used in
+	// tests, has no table locks but only lets one transaction write anyway
+	if tx.Dialector.Name() != "sqlite" {
+		if err := tx.Exec("LOCK TABLE key_log_entries IN EXCLUSIVE MODE").Error; err != nil {
+			return err
+		}
+	}
+	size, err := logSize(tx)
+	if err != nil {
+		return err
+	}
+	return tx.Create(&models.KeyLogEntry{
+		LeafIndex:   size,
+		UserID:      userID,
+		AddressHash: crypto.KeyLogAddressHash(address),
+		KeyVersion:  keyVersion,
+		Leaf:        leaf,
+		LeafHash:    crypto.LeafHash(leaf),
+	}).Error
+}
+
+// logSize returns the number of entries in the log, read from the leaf
+// index rather than by counting them.
+func logSize(db *gorm.DB) (int64, error) {
+	var size int64
+	err := db.Model(&models.KeyLogEntry{}).Select("COALESCE(MAX(leaf_index) + 1, 0)").Scan(&size).Error
+	return size, err
+}
+
+// Backfill appends the current key of every user that is not in the log yet,
+// such as accounts created before the log existed.
+func (l *Log) Backfill() error {
+	var users []models.User
+	err := l.db.Select("id", "email", "public_key", "key_version").
+		Where("NOT EXISTS (SELECT 1 FROM key_log_entries WHERE key_log_entries.user_id = users.id AND key_log_entries.key_version = users.key_version)").
+		Order("id").Find(&users).Error
+	if err != nil {
+		return err
+	}
+	for _, user := range users {
+		err := l.db.Transaction(func(tx *gorm.DB) error {
+			return Append(tx, user.ID, user.Email, user.KeyVersion, user.PublicKey)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PublicKey returns the key that verifies tree head signatures.
+func (l *Log) PublicKey() ed25519.PublicKey {
+	return l.key.Public().(ed25519.PublicKey)
+}
+
+// treeLocked returns the tree extended to the given size, loading the leaf
+// hashes appended since it was last extended. The caller must hold l.mu.
+func (l *Log) treeLocked(size int64) (*crypto.MerkleTree, error) {
+	have := int64(l.tree.Size())
+	if size > have {
+		var entries []models.KeyLogEntry
+		err := l.db.Select("leaf_hash").Where("leaf_index >= ? AND leaf_index < ?", have, size).Order("leaf_index").Find(&entries).Error
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(entries)) != size-have {
+			return nil, ErrInvalidTreeSize
+		}
+		for _, entry := range entries {
+			l.tree.Append(entry.LeafHash)
+		}
+	}
+	return &l.tree, nil
+}
+
+// TreeHead returns a signed tree head for the current log. The same head is
+// returned until an entry is appended.
+func (l *Log) TreeHead() (*crypto.TreeHead, error) {
+	size, err := logSize(l.db)
+	if err != nil {
+		return nil, err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.head != nil && l.head.TreeSize == uint64(size) {
+		head := *l.head
+		return &head, nil
+	}
+	tree, err := l.treeLocked(size)
+	if err != nil {
+		return nil, err
+	}
+	head := &crypto.TreeHead{
+		TreeSize:  uint64(size),
+		Timestamp: time.Now().UnixMilli(),
+		RootHash:  tree.Root(int(size)),
+	}
+	crypto.SignTreeHead(head, l.key)
+	l.head = head
+	cached := *head
+	return &cached, nil
+}
+
+// Entries returns the entries with indexes from start up to but excluding
+// end, at most MaxEntries of them.
+func (l *Log) Entries(start, end int64) ([]models.KeyLogEntry, error) {
+	if start < 0 || end < start {
+		return nil, ErrInvalidTreeSize
+	}
+	if end-start > MaxEntries {
+		end = start + MaxEntries
+	}
+	var entries []models.KeyLogEntry
+	err := l.db.Select("leaf_index", "leaf").Where("leaf_index >= ? AND leaf_index < ?", start, end).
+		Order("leaf_index").Find(&entries).Error
+	return entries, err
+}
+
+// Inclusion returns the proof that version keyVersion of the key of address
+// is in the tree of treeSize entries. A keyVersion of 0 selects the latest
+// version logged within that tree and a treeSize of 0 the current tree.
+func (l *Log) Inclusion(address string, keyVersion int, treeSize int64) (*InclusionProof, error) {
+	size, err := logSize(l.db)
+	if err != nil {
+		return nil, err
+	}
+	if treeSize == 0 {
+		treeSize = size
+	}
+	if treeSize < 0 || treeSize > size {
+		return nil, ErrInvalidTreeSize
+	}
+
+	query := l.db.Where("address_hash = ? AND leaf_index < ?", crypto.KeyLogAddressHash(address), treeSize)
+	if keyVersion > 0 {
+		query = query.Where("key_version = ?", keyVersion)
+	}
+	var entry models.KeyLogEntry
+	if err := query.Order("leaf_index DESC").First(&entry).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrEntryNotFound
+		}
+		return nil, err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	tree, err := l.treeLocked(treeSize)
+	if err != nil {
+		return nil, err
+	}
+	return &InclusionProof{
+		Index:     entry.LeafIndex,
+		TreeSize:  treeSize,
+		Leaf:      entry.Leaf,
+		AuditPath: tree.InclusionProof(int(entry.LeafIndex), int(treeSize)),
+	}, nil
+}
+
+// Consistency returns the proof that the tree of first entries is a prefix
+// of the tree of second entries.
+func (l *Log) Consistency(first, second int64) ([][]byte, error) {
+	size, err := logSize(l.db)
+	if err != nil {
+		return nil, err
+	}
+	if first < 0 || second < first || second > size {
+		return nil, ErrInvalidTreeSize
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	tree, err := l.treeLocked(second)
+	if err != nil {
+		return nil, err
+	}
+	return tree.ConsistencyProof(int(first), int(second)), nil
+}
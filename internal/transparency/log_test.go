@@ -0,0 +1,167 @@
+package transparency
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"secmail/internal/crypto"
+	"secmail/internal/models"
+	"testing"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// openTestLog opens a log in an empty database.
+func openTestLog(t *testing.T) (*Log, *gorm.DB) {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "secmail.db")), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	if err := db.AutoMigrate(&models.KeyLogEntry{}); err != nil {
+		t.Fatalf("Failed to migrate database: %v", err)
+	}
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate log key: %v", err)
+	}
+	return NewLog(db, key), db
+}
+
+// appendKey logs a key in its own transaction, as the code storing keys does.
+func appendKey(t *testing.T, db *gorm.DB, userID uint, address string, keyVersion int) {
+	err := db.Transaction(func(tx *gorm.DB) error {
+		return Append(tx, userID, address, keyVersion, []byte(fmt.Sprintf("%s key %d", address, keyVersion)))
+	})
+	if err != nil {
+		t.Fatalf("Failed to append to the log: %v", err)
+	}
+}
+
+func TestAppendOrder(t *testing.T) {
+	l, db := openTestLog(t)
+	appendKey(t, db, 1, "alice@secmail.test", 1)
+	appendKey(t, db, 2, "bob@secmail.test", 1)
+	appendKey(t, db, 1, "Alice@secmail.test", 2)
+
+	entries, err := l.Entries(0, 10)
+	if err != nil {
+		t.Fatalf("Failed to list entries: %v", err)
+	}
+	want := []struct {
+		address string
+		version int
+	}{{"alice@secmail.test", 1}, {"bob@secmail.test", 1}, {"alice@secmail.test", 2}}
+	if len(entries) != len(want) {
+		t.Fatalf("Expected %d entries, got %d", len(want), len(entries))
+	}
+	for i, entry := range entries {
+		leaf, err := crypto.ParseKeyLogLeaf(entry.Leaf)
+		if err != nil {
+			t.Fatalf("Failed to parse entry %d: %v", i, err)
+		}
+		if entry.LeafIndex != int64(i) || leaf.AddressHash != crypto.KeyLogAddressHash(want[i].address) || leaf.KeyVersion != want[i].version {
+			t.Errorf("Entry %d: expected %s version %d, got index %d and %+v", i, want[i].address, want[i].version, entry.LeafIndex, leaf)
+		}
+	}
+}
+
+func TestTreeHeadCache(t *testing.T) {
+	l, db := openTestLog(t)
+	appendKey(t, db, 1, "alice@secmail.test", 1)
+
+	first, err := l.TreeHead()
+	if err != nil {
+		t.Fatalf("Failed to get tree head: %v", err)
+	}
+	if err := crypto.VerifyTreeHead(first, l.PublicKey()); err != nil || first.TreeSize != 1 {
+		t.Fatalf("Unexpected tree head %+v: %v", first, err)
+	}
+
+	// The head is reused, timestamp included, until the log grows
+	again, err := l.TreeHead()
+	if err != nil {
+		t.Fatalf("Failed to get tree head: %v", err)
+	}
+	if again.Timestamp != first.Timestamp || string(again.Signature) != string(first.Signature) {
+		t.Errorf("Expected the cached head, got %+v", again)
+	}
+
+	appendKey(t, db, 2, "bob@secmail.test", 1)
+	grown, err := l.TreeHead()
+	if err != nil {
+		t.Fatalf("Failed to get tree head: %v", err)
+	}
+	if grown.TreeSize != 2 || string(grown.RootHash) == string(first.RootHash) {
+		t.Errorf("Expected a new head for the grown log, got %+v", grown)
+	}
+	if err := crypto.VerifyTreeHead(grown, l.PublicKey()); err != nil {
+		t.Errorf("Failed to verify tree head: %v", err)
+	}
+}
+
+func TestProofsAtEarlierTreeSizes(t *testing.T) {
+	l, db := openTestLog(t)
+	appendKey(t, db, 1, "alice@secmail.test", 1)
+	appendKey(t, db, 2, "bob@secmail.test", 1)
+	appendKey(t, db, 3, "carol@secmail.test", 1)
+	earlier, err := l.TreeHead()
+	if err != nil {
+		t.Fatalf("Failed to get tree head: %v", err)
+	}
+	appendKey(t, db, 1, "alice@secmail.test", 2)
+	appendKey(t, db, 4, "dave@secmail.test", 1)
+	current, err := l.TreeHead()
+	if err != nil {
+		t.Fatalf("Failed to get tree head: %v", err)
+	}
+
+	// Proofs for the earlier head are computed from the tree, which has
+	// already grown past it
+	tests := []struct {
+		name     string
+		head     int64
+		version  int
+		index    int64
+		treeSize uint64
+		root     []byte
+	}{
+		{"latest version at the earlier head", 3, 0, 0, earlier.TreeSize, earlier.RootHash},
+		{"latest version at the current head", 0, 0, 3, current.TreeSize, current.RootHash},
+		{"first version at the current head", 0, 1, 0, current.TreeSize, current.RootHash},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proof, err := l.Inclusion("alice@secmail.test", tt.version, tt.head)
+			if err != nil {
+				t.Fatalf("Failed to get inclusion proof: %v", err)
+			}
+			if proof.Index != tt.index || uint64(proof.TreeSize) != tt.treeSize {
+				t.Fatalf("Expected entry %d of %d, got %d of %d", tt.index, tt.treeSize, proof.Index, proof.TreeSize)
+			}
+			if err := crypto.VerifyInclusion(crypto.LeafHash(proof.Leaf), uint64(proof.Index), tt.treeSize, proof.AuditPath, tt.root); err != nil {
+				t.Errorf("Failed to verify inclusion proof: %v", err)
+			}
+		})
+	}
+
+	if _, err := l.Inclusion("dave@secmail.test", 0, int64(earlier.TreeSize)); !errors.Is(err, ErrEntryNotFound) {
+		t.Errorf("Expected a key logged later to be missing from the earlier tree, got %v", err)
+	}
+	if _, err := l.Inclusion("alice@secmail.test", 0, int64(current.TreeSize)+1); !errors.Is(err, ErrInvalidTreeSize) {
+		t.Errorf("Expected ErrInvalidTreeSize, got %v", err)
+	}
+
+	proof, err := l.Consistency(int64(earlier.TreeSize), int64(current.TreeSize))
+	if err != nil {
+		t.Fatalf("Failed to get consistency proof: %v", err)
+	}
+	if err := crypto.VerifyConsistency(earlier.TreeSize, current.TreeSize, earlier.RootHash, current.RootHash, proof); err != nil {
+		t.Errorf("Failed to verify consistency proof: %v", err)
+	}
+	if _, err := l.Consistency(int64(current.TreeSize), int64(current.TreeSize)+1); !errors.Is(err, ErrInvalidTreeSize) {
+		t.Errorf("Expected ErrInvalidTreeSize, got %v", err)
+	}
+}
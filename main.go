@@ -1,11 +1,25 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"log"
+	"net/http"
 	"os"
 	"secmail/internal/auth"
+	"secmail/internal/crypto"
 	"secmail/internal/database"
+	"secmail/internal/email"
 	"secmail/internal/handlers"
+	"secmail/internal/imapd"
+	"secmail/internal/mailauth"
+	"secmail/internal/notify"
+	"secmail/internal/pop3d"
+	"secmail/internal/relay"
+	"secmail/internal/smtpd"
+	"secmail/internal/transparency"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
@@ -17,34 +31,482 @@ func main() {
 		log.Fatal("DATABASE_URL environment variable not set")
 	}
 
+	if err := auth.LoadConfig(); err != nil {
+		log.Fatal(err)
+	}
+
 	db, err := database.InitDB(dsn)
 	if err != nil {
 		log.Fatal("Failed to connect to database:", err)
 	}
 
+	verificationPolicy, err := email.ParseVerificationPolicy(os.Getenv("EMAIL_VERIFICATION_POLICY"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	email.SetVerificationPolicy(verificationPolicy)
+
+	// Shared mailboxes and lists can only be created by administrators, in
+	// the domains secmail receives mail for
+	localDomainList := os.Getenv("LOCAL_DOMAINS")
+	if localDomainList == "" {
+		localDomainList = os.Getenv("SMTP_DOMAIN")
+	}
+	localDomains, err := email.ParseLocalDomains(localDomainList)
+	if err != nil {
+		log.Fatal(err)
+	}
+	email.SetLocalDomains(localDomains)
+	admins, err := email.ParseAdmins(os.Getenv("ADMIN_EMAILS"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	email.SetAdmins(admins)
+
+	forwardSecrecyPolicy, err := email.ParseForwardSecrecyPolicy(os.Getenv("FS_PREKEY_ROTATION"), os.Getenv("FS_PREKEY_RETENTION"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	email.SetForwardSecrecyPolicy(forwardSecrecyPolicy)
+	email.SetPublicBaseURL(auth.PublicBaseURL())
+	go email.RunPrekeyPurge(context.Background(), db, time.Hour)
+	go email.RunMessageReaper(context.Background(), db, time.Minute)
+
+	smimeTrustStore, err := loadSMIMETrustStore(os.Getenv("SMIME_TRUST_STORE"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	email.SetSMIMETrustStore(smimeTrustStore)
+
+	notifier, err := notify.FromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	relayConfig, err := relay.ConfigFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	queue := relay.NewQueue(db, relayConfig)
+	go queue.Run(context.Background())
+
+	logKey, err := transparency.KeyFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	keyLog := transparency.NewLog(db, logKey)
+	if err := keyLog.Backfill(); err != nil {
+		log.Fatal("Failed to publish keys in the transparency log:", err)
+	}
+
 	r := gin.Default()
 
 	// Auth routes
 	// Public routes
 	r.POST("/register", func(c *gin.Context) {
-		auth.Register(c, db)
+		auth.Register(c, db, notifier)
 	})
 	r.POST("/login", func(c *gin.Context) {
 		auth.Login(c, db)
 	})
+	r.GET("/auth/verify", func(c *gin.Context) {
+		auth.VerifyEmail(c, db)
+	})
+	r.POST("/auth/verify/resend", func(c *gin.Context) {
+		auth.ResendVerification(c, db, notifier)
+	})
+	r.POST("/auth/password/forgot", func(c *gin.Context) {
+		auth.RequestPasswordReset(c, db, notifier)
+	})
+	r.POST("/auth/password/reset", func(c *gin.Context) {
+		auth.ResetPassword(c, db)
+	})
+
+	// Key directory
+	r.GET("/keys/:email", func(c *gin.Context) {
+		handlers.GetPublicKeys(c, db)
+	})
+
+	r.GET("/prekeys/:email", func(c *gin.Context) {
+		handlers.GetPrekey(c, db)
+	})
+
+	// Secure message links, opened by external recipients without an account
+	secureLinkRoutes := r.Group("/secure")
+	{
+		secureLinkRoutes.GET("/:token", func(c *gin.Context) {
+			handlers.SecureLinkPage(c)
+		})
+		secureLinkRoutes.POST("/:token/open", func(c *gin.Context) {
+			handlers.OpenSecureLink(c, db)
+		})
+		secureLinkRoutes.POST("/:token/reply", func(c *gin.Context) {
+			handlers.ReplySecureLink(c, db)
+		})
+	}
+
+	// Key transparency log
+	keyLogRoutes := r.Group("/transparency")
+	{
+		keyLogRoutes.GET("/public-key", func(c *gin.Context) {
+			handlers.GetLogPublicKey(c, keyLog)
+		})
+		keyLogRoutes.GET("/tree-head", func(c *gin.Context) {
+			handlers.GetTreeHead(c, keyLog)
+		})
+		keyLogRoutes.GET("/entries", func(c *gin.Context) {
+			handlers.GetLogEntries(c, keyLog)
+		})
+		keyLogRoutes.GET("/proof/inclusion", func(c *gin.Context) {
+			handlers.GetInclusionProof(c, keyLog)
+		})
+		keyLogRoutes.GET("/proof/consistency", func(c *gin.Context) {
+			handlers.GetConsistencyProof(c, keyLog)
+		})
+	}
+	wkd := r.Group("/.well-known/openpgpkey")
+	{
+		wkd.GET("/policy", handlers.GetWKDPolicy)
+		wkd.GET("/hu/:hash", func(c *gin.Context) {
+			handlers.GetWKDKey(c, db)
+		})
+		wkd.GET("/:domain/policy", handlers.GetWKDPolicy)
+		wkd.GET("/:domain/hu/:hash", func(c *gin.Context) {
+			handlers.GetWKDKey(c, db)
+		})
+	}
+
+	// Protected account routes
+	account := r.Group("/auth")
+	account.Use(auth.JWTMiddleware())
+	{
+		account.POST("/password", func(c *gin.Context) {
+			auth.ChangePassword(c, db)
+		})
+		account.POST("/recovery-key", func(c *gin.Context) {
+			auth.RegenerateRecoveryKey(c, db)
+		})
+		account.GET("/keys", func(c *gin.Context) {
+			auth.ListKeys(c, db)
+		})
+		account.POST("/keys/rotate", func(c *gin.Context) {
+			auth.RotateKey(c, db)
+		})
+	}
 
 	// Protected routes
 	emails := r.Group("/emails")
 	emails.Use(auth.JWTMiddleware())
 	{
 		emails.POST("/send", func(c *gin.Context) {
-			handlers.SendEmail(c, db)
+			handlers.SendEmail(c, db, queue)
 		})
 		emails.GET("/inbox", func(c *gin.Context) {
 			handlers.GetInbox(c, db)
 		})
+		emails.GET("/:id/delivery", func(c *gin.Context) {
+			handlers.GetDeliveryStatus(c, db)
+		})
+		emails.GET("/:id/raw", func(c *gin.Context) {
+			handlers.ExportEmail(c, db, queue)
+		})
+		emails.POST("/import", func(c *gin.Context) {
+			handlers.ImportEmails(c, db)
+		})
+	}
+
+	// Account backups
+	backups := r.Group("/backup")
+	backups.Use(auth.JWTMiddleware())
+	{
+		backups.POST("/export", func(c *gin.Context) {
+			handlers.ExportBackup(c, db, queue)
+		})
+		backups.POST("/restore", func(c *gin.Context) {
+			handlers.RestoreBackup(c, db)
+		})
+	}
+
+	// Forward secrecy
+	forwardSecrecy := r.Group("/forward-secrecy")
+	forwardSecrecy.Use(auth.JWTMiddleware())
+	{
+		forwardSecrecy.POST("/prekey", func(c *gin.Context) {
+			handlers.RotatePrekey(c, db)
+		})
+		forwardSecrecy.DELETE("/prekey", func(c *gin.Context) {
+			handlers.DisableForwardSecrecy(c, db)
+		})
+	}
+
+	// Groups
+	groups := r.Group("/groups")
+	groups.Use(auth.JWTMiddleware())
+	{
+		groups.POST("", func(c *gin.Context) {
+			handlers.CreateGroup(c, db)
+		})
+		groups.GET("", func(c *gin.Context) {
+			handlers.ListGroups(c, db)
+		})
+		groups.GET("/:id", func(c *gin.Context) {
+			handlers.GetGroup(c, db)
+		})
+		groups.POST("/:id/members", func(c *gin.Context) {
+			handlers.AddGroupMember(c, db)
+		})
+		groups.DELETE("/:id/members/:userId", func(c *gin.Context) {
+			handlers.RemoveGroupMember(c, db)
+		})
+		groups.POST("/:id/leave", func(c *gin.Context) {
+			handlers.LeaveGroup(c, db)
+		})
+		groups.POST("/:id/update", func(c *gin.Context) {
+			handlers.UpdateGroupKey(c, db)
+		})
+	}
+
+	// Mailing lists
+	lists := r.Group("/lists")
+	lists.Use(auth.JWTMiddleware())
+	{
+		lists.POST("", func(c *gin.Context) {
+			handlers.CreateList(c, db)
+		})
+		lists.GET("", func(c *gin.Context) {
+			handlers.ListMailingLists(c, db)
+		})
+		lists.GET("/:id", func(c *gin.Context) {
+			handlers.GetList(c, db)
+		})
+		lists.PATCH("/:id", func(c *gin.Context) {
+			handlers.UpdateList(c, db)
+		})
+		lists.DELETE("/:id", func(c *gin.Context) {
+			handlers.DeleteList(c, db)
+		})
+		lists.POST("/:id/members", func(c *gin.Context) {
+			handlers.AddListMember(c, db)
+		})
+		lists.DELETE("/:id/members/:userId", func(c *gin.Context) {
+			handlers.RemoveListMember(c, db)
+		})
+		lists.POST("/:id/unsubscribe", func(c *gin.Context) {
+			handlers.Unsubscribe(c, db)
+		})
+		lists.GET("/:id/held", func(c *gin.Context) {
+			handlers.GetHeldPosts(c, db)
+		})
+		lists.POST("/:id/held/:postId/approve", func(c *gin.Context) {
+			handlers.ModeratePost(c, db, true)
+		})
+		lists.POST("/:id/held/:postId/reject", func(c *gin.Context) {
+			handlers.ModeratePost(c, db, false)
+		})
+	}
+
+	// Shared mailboxes
+	shared := r.Group("/shared")
+	shared.Use(auth.JWTMiddleware())
+	{
+		shared.POST("", func(c *gin.Context) {
+			handlers.CreateSharedMailbox(c, db, notifier)
+		})
+		shared.GET("", func(c *gin.Context) {
+			handlers.ListSharedMailboxes(c, db)
+		})
+		shared.GET("/:id", func(c *gin.Context) {
+			handlers.GetSharedMailbox(c, db)
+		})
+		shared.GET("/:id/inbox", func(c *gin.Context) {
+			handlers.GetSharedInbox(c, db)
+		})
+		shared.POST("/:id/send", func(c *gin.Context) {
+			handlers.SendAsSharedMailbox(c, db, queue)
+		})
+		shared.PUT("/:id/delegates/:userId", func(c *gin.Context) {
+			handlers.SetDelegate(c, db)
+		})
+		shared.DELETE("/:id/delegates/:userId", func(c *gin.Context) {
+			handlers.RemoveDelegate(c, db)
+		})
+		shared.GET("/:id/audit", func(c *gin.Context) {
+			handlers.GetMailboxAudit(c, db)
+		})
+	}
+
+	// Address book
+	contacts := r.Group("/contacts")
+	contacts.Use(auth.JWTMiddleware())
+	{
+		contacts.POST("", func(c *gin.Context) {
+			handlers.CreateContact(c, db)
+		})
+		contacts.GET("", func(c *gin.Context) {
+			handlers.ListContacts(c, db)
+		})
+		contacts.GET("/autocomplete", func(c *gin.Context) {
+			handlers.AutocompleteContacts(c, db)
+		})
+		contacts.POST("/import", func(c *gin.Context) {
+			handlers.ImportContacts(c, db)
+		})
+		contacts.GET("/export", func(c *gin.Context) {
+			handlers.ExportContacts(c, db)
+		})
+		contacts.GET("/:id", func(c *gin.Context) {
+			handlers.GetContact(c, db)
+		})
+		contacts.PUT("/:id", func(c *gin.Context) {
+			handlers.UpdateContact(c, db)
+		})
+		contacts.DELETE("/:id", func(c *gin.Context) {
+			handlers.DeleteContact(c, db)
+		})
+		contacts.POST("/:id/pin", func(c *gin.Context) {
+			handlers.PinContactKey(c, db)
+		})
+	}
+
+	// OpenPGP keys
+	pgp := r.Group("/pgp")
+	pgp.Use(auth.JWTMiddleware())
+	{
+		pgp.POST("/key", func(c *gin.Context) {
+			handlers.ImportPGPKey(c, db)
+		})
+		pgp.GET("/key", func(c *gin.Context) {
+			handlers.GetPGPKey(c, db)
+		})
+		pgp.DELETE("/key", func(c *gin.Context) {
+			handlers.DeletePGPKey(c, db)
+		})
+		pgp.POST("/contacts", func(c *gin.Context) {
+			handlers.ImportPGPContact(c, db)
+		})
+		pgp.GET("/contacts", func(c *gin.Context) {
+			handlers.ListPGPContacts(c, db)
+		})
+		pgp.DELETE("/contacts/:id", func(c *gin.Context) {
+			handlers.DeletePGPContact(c, db)
+		})
+	}
+
+	// S/MIME certificates
+	smime := r.Group("/smime")
+	smime.Use(auth.JWTMiddleware())
+	{
+		smime.POST("/certificate", func(c *gin.Context) {
+			handlers.SetCertificate(c, db)
+		})
+		smime.GET("/certificate", func(c *gin.Context) {
+			handlers.GetCertificate(c, db)
+		})
+		smime.DELETE("/certificate", func(c *gin.Context) {
+			handlers.DeleteCertificate(c, db)
+		})
+		smime.POST("/contacts", func(c *gin.Context) {
+			handlers.ImportSMIMEContact(c, db)
+		})
+		smime.GET("/contacts", func(c *gin.Context) {
+			handlers.ListSMIMEContacts(c, db)
+		})
+		smime.DELETE("/contacts/:id", func(c *gin.Context) {
+			handlers.DeleteSMIMEContact(c, db)
+		})
+	}
+
+	// JMAP
+	r.GET("/.well-known/jmap", func(c *gin.Context) {
+		c.Redirect(http.StatusPermanentRedirect, "/jmap/session")
+	})
+	jmapAPI := r.Group("/jmap")
+	jmapAPI.Use(auth.JWTMiddleware())
+	{
+		jmapAPI.GET("/session", func(c *gin.Context) {
+			handlers.GetJMAPSession(c, db, queue)
+		})
+		jmapAPI.POST("", func(c *gin.Context) {
+			handlers.JMAPAPI(c, db, queue)
+		})
+		jmapAPI.GET("/download/:accountId/:blobId/:name", func(c *gin.Context) {
+			handlers.DownloadJMAPBlob(c, db, queue)
+		})
+	}
+
+	// Inbound SMTP listener (disabled unless SMTP_LISTEN_ADDR is set)
+	if smtpAddr := os.Getenv("SMTP_LISTEN_ADDR"); smtpAddr != "" {
+		smtpDomain := os.Getenv("SMTP_DOMAIN")
+		if smtpDomain == "" {
+			smtpDomain = "localhost"
+		}
+		smtpServer := smtpd.NewServer(smtpAddr, smtpDomain, smtpd.DBStore{DB: db}, &mailauth.Verifier{})
+		go func() {
+			log.Println("SMTP server starting on", smtpAddr)
+			if err := smtpServer.ListenAndServe(); err != nil {
+				log.Fatal("SMTP server failed:", err)
+			}
+		}()
+	}
+
+	// IMAP server (disabled unless IMAP_LISTEN_ADDR is set)
+	if imapAddr := os.Getenv("IMAP_LISTEN_ADDR"); imapAddr != "" {
+		tlsConfig, err := loadTLSConfig(os.Getenv("IMAP_TLS_CERT"), os.Getenv("IMAP_TLS_KEY"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		if tlsConfig == nil {
+			log.Println("IMAP_TLS_CERT not set, IMAP passwords are accepted without TLS")
+		}
+		imapServer := imapd.NewServer(imapd.DBStore{DB: db, Queue: queue}, tlsConfig)
+		go func() {
+			log.Println("IMAP server starting on", imapAddr)
+			if err := imapServer.ListenAndServe(imapAddr); err != nil {
+				log.Fatal("IMAP server failed:", err)
+			}
+		}()
+	}
+
+	// POP3 server (disabled unless POP3_LISTEN_ADDR is set)
+	if pop3Addr := os.Getenv("POP3_LISTEN_ADDR"); pop3Addr != "" {
+		tlsConfig, err := loadTLSConfig(os.Getenv("POP3_TLS_CERT"), os.Getenv("POP3_TLS_KEY"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		if tlsConfig == nil {
+			log.Println("POP3_TLS_CERT not set, POP3 passwords are accepted without TLS")
+		}
+		pop3Server := pop3d.NewServer(pop3d.DBStore{DB: db, Queue: queue}, tlsConfig)
+		go func() {
+			log.Println("POP3 server starting on", pop3Addr)
+			if err := pop3Server.ListenAndServe(pop3Addr); err != nil {
+				log.Fatal("POP3 server failed:", err)
+			}
+		}()
 	}
 
 	log.Println("Server starting on :8080")
 	r.Run(":8080")
 }
+
+// loadSMIMETrustStore returns the CA pool for S/MIME signature verification:
+// the PEM bundle at path, or the system roots when path is empty.
+func loadSMIMETrustStore(path string) (*x509.CertPool, error) {
+	if path == "" {
+		return x509.SystemCertPool()
+	}
+	return crypto.LoadTrustStore(path)
+}
+
+// loadTLSConfig returns the STARTTLS configuration for a mail access server,
+// or nil when no certificate is configured.
+func loadTLSConfig(certFile, keyFile string) (*tls.Config, error) {
+	if certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+}